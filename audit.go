@@ -0,0 +1,194 @@
+package leafdb
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// auditBucket is the reserved top-level bucket holding the audit log. Its
+// keys are, as in the changefeed, the committing transaction's ID and the
+// record's position in that transaction, both big-endian.
+const auditBucket = reservedPrefix + "audit"
+
+// AuditRecord is one entry of the audit log: a change a transaction made, as
+// seen when it committed.
+type AuditRecord struct {
+	// TxID is the ID of the transaction that committed the change.
+	TxID uint64
+	// Time is when the transaction committed.
+	Time time.Time
+	Op   ChangeOp
+	// Bucket is the path of bucket names from the top level down to the
+	// bucket the change applies to.
+	Bucket [][]byte
+	Key    []byte
+	// ValueHash is the SHA-256 of the value of a ChangePut, and nil for
+	// other ops. The value itself is not kept.
+	ValueHash []byte
+	// Sequence is the new sequence of a ChangeSequence.
+	Sequence uint64
+}
+
+var errInvalidAudit = errors.New("leafdb: invalid audit record")
+
+// writeAudit appends a record of every change of the transaction, as
+// Pending reports them, to the audit log, all under the commit's time.
+func (tx *Tx) writeAudit() error {
+	now := time.Now()
+	var records [][]byte
+	err := tx.diff(func(c Change) bool {
+		r := AuditRecord{Time: now, Op: c.Op, Bucket: c.Bucket, Key: c.Key, Sequence: c.Sequence}
+		if c.Op == ChangePut {
+			sum := sha256.Sum256(c.Value)
+			r.ValueHash = sum[:]
+		}
+		records = append(records, encodeAuditRecord(r))
+		return true
+	})
+	if err != nil || len(records) == 0 {
+		return err
+	}
+	b := tx.bucket([]byte(auditBucket))
+	if b == nil {
+		if b, err = tx.createTopLevel([]byte(auditBucket)); err != nil {
+			return err
+		}
+	}
+	var key [12]byte
+	binary.BigEndian.PutUint64(key[:], tx.mgr.txid+1)
+	for i, r := range records {
+		binary.BigEndian.PutUint32(key[8:], uint32(i))
+		if err := b.Put(key[:], r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeAuditRecord(r AuditRecord) []byte {
+	buf := binary.AppendVarint(nil, r.Time.UnixNano())
+	buf = append(buf, byte(r.Op))
+	buf = appendChangePath(buf, r.Bucket)
+	buf = appendChangeBytes(buf, r.Key)
+	buf = appendChangeBytes(buf, r.ValueHash)
+	return binary.AppendUvarint(buf, r.Sequence)
+}
+
+func decodeAuditRecord(key, buf []byte) (AuditRecord, error) {
+	if len(key) != 12 {
+		return AuditRecord{}, errInvalidAudit
+	}
+	r := AuditRecord{TxID: binary.BigEndian.Uint64(key)}
+	ns, n := binary.Varint(buf)
+	if n <= 0 || n >= len(buf) {
+		return AuditRecord{}, errInvalidAudit
+	}
+	r.Time = time.Unix(0, ns)
+	r.Op = ChangeOp(buf[n])
+	buf = buf[n+1:]
+	var err error
+	if r.Bucket, err = readChangePath(&buf); err != nil {
+		return AuditRecord{}, errInvalidAudit
+	}
+	if r.Key, err = readChangeBytes(&buf); err != nil {
+		return AuditRecord{}, errInvalidAudit
+	}
+	if r.ValueHash, err = readChangeBytes(&buf); err != nil {
+		return AuditRecord{}, errInvalidAudit
+	}
+	if len(r.ValueHash) == 0 {
+		r.ValueHash = nil
+	}
+	if r.Sequence, err = readChangeUvarint(&buf); err != nil {
+		return AuditRecord{}, errInvalidAudit
+	}
+	return r, nil
+}
+
+// Audit returns an iterator over the audit log records of transactions with
+// IDs greater than since, in commit order. Like Changes, it reads from a
+// snapshot taken now and holds a read transaction until it is closed.
+//
+// Records are only written while the database is opened with Options.Audit.
+func (db *DB) Audit(since uint64) (*AuditIterator, error) {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditIterator{tx: tx, since: since}, nil
+}
+
+// TruncateAudit deletes the audit log records of transactions with IDs
+// below before.
+func (db *DB) TruncateAudit(before uint64) error {
+	return db.Write(func(tx *Tx) error {
+		b := tx.bucket([]byte(auditBucket))
+		if b == nil {
+			return nil
+		}
+		var keys [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && len(k) == 12 && binary.BigEndian.Uint64(k) < before; k, _ = c.Next() {
+			keys = append(keys, k)
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// AuditIterator walks the audit log. Call Next to advance, Record to read
+// the current entry and Close when done.
+type AuditIterator struct {
+	tx     *Tx
+	cursor *Cursor
+	since  uint64
+	record AuditRecord
+	err    error
+}
+
+// Next advances to the next record and reports whether there is one.
+func (it *AuditIterator) Next() bool {
+	if it.err != nil || it.tx.closed {
+		return false
+	}
+	var k, v []byte
+	if it.cursor == nil {
+		b := it.tx.bucket([]byte(auditBucket))
+		if b == nil {
+			return false
+		}
+		it.cursor = b.Cursor()
+		var seek [8]byte
+		binary.BigEndian.PutUint64(seek[:], it.since+1)
+		k, v = it.cursor.Seek(seek[:])
+	} else {
+		k, v = it.cursor.Next()
+	}
+	if k == nil {
+		return false
+	}
+	it.record, it.err = decodeAuditRecord(k, v)
+	return it.err == nil
+}
+
+// Record returns the current record.
+func (it *AuditIterator) Record() AuditRecord {
+	return it.record
+}
+
+// Err returns the error that stopped iteration, if any.
+func (it *AuditIterator) Err() error {
+	return it.err
+}
+
+// Close ends the iterator's read transaction.
+func (it *AuditIterator) Close() error {
+	it.tx.Rollback()
+	return nil
+}
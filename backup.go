@@ -0,0 +1,205 @@
+package leafdb
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// WriteTo writes a copy of the database as seen by tx to w, in the format
+// of a database file. Pages reachable from the transaction's snapshot are
+// copied as-is; every other page is written zeroed and recorded as free. A
+// read transaction does not block writers, so this can back up a live
+// database. The copy of an encrypted database is encrypted with the same
+// key.
+func (tx *Tx) WriteTo(w io.Writer) (int64, error) {
+	if tx == nil || tx.closed {
+		return 0, ErrTxClosed
+	}
+	store := tx.mgr
+	reachable := make(map[uint64]bool)
+	if err := markTree(store, reachable, tx.mgr.root, true); err != nil {
+		return 0, err
+	}
+
+	pageCount := tx.mgr.nextPage
+	var free []uint64
+	for id := uint64(metaPage1 + 1); id < pageCount; id++ {
+		if !reachable[id] {
+			free = append(free, id)
+		}
+	}
+	m := meta{txid: tx.mgr.txid, root: tx.mgr.root, nextPage: pageCount}
+	freelistPages := make(map[uint64][]byte)
+	m.freelist, m.freelistPage = backupFreelist(free, store.PageSize(), freelistPages)
+
+	var written int64
+	pageSize := store.PageSize()
+	c := tx.db.cipher
+	buf := getPageBuffer(tx.db.diskPageSize)
+	defer putPageBuffer(buf)
+	var sealed []byte
+	if c != nil {
+		sealed = getPageBuffer(tx.db.diskPageSize)
+		defer putPageBuffer(sealed)
+	}
+	for id := uint64(0); id < pageCount; id++ {
+		var page []byte
+		switch {
+		case id == metaPage0 || id == metaPage1:
+			clear(buf)
+			if err := writeMetaPage(buf, m, pageSize, c); err != nil {
+				return written, err
+			}
+			page = buf
+		case reachable[id]:
+			p, err := store.ReadPage(id)
+			if err != nil {
+				return written, err
+			}
+			page = p
+		case freelistPages[id] != nil:
+			page = freelistPages[id]
+		default:
+			clear(buf)
+			page = buf
+		}
+		// Meta and zeroed pages are already in their stored form.
+		if c != nil && len(page) == pageSize {
+			c.seal(sealed, id, page)
+			page = sealed
+		}
+		n, err := w.Write(page)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Size returns the size in bytes of the database as seen by tx, which is
+// what WriteTo writes.
+func (tx *Tx) Size() int64 {
+	if tx == nil || tx.mgr == nil {
+		return 0
+	}
+	return int64(tx.mgr.nextPage) * int64(tx.db.diskPageSize)
+}
+
+// backupFreelist lays out free, in ascending order, for a backup's meta
+// page. Runs that do not fit inline go to a chain of freelist pages taken
+// from the end of free; the encoded chain pages are stored in pages.
+func backupFreelist(free []uint64, pageSize int, pages map[uint64][]byte) ([]uint64, uint64) {
+	var chain []uint64
+	runs := toRuns(free)
+	inline, chunks := packFreeRuns(runs, pageSize)
+	for len(chain) < len(chunks) {
+		// Taking the last page never adds a run.
+		for len(chain) < len(chunks) {
+			chain = append(chain, free[len(free)-1])
+			free = free[:len(free)-1]
+		}
+		runs = toRuns(free)
+		inline, chunks = packFreeRuns(runs, pageSize)
+	}
+	if len(chain) == 0 {
+		return free, 0
+	}
+	for i, id := range chain {
+		next := uint64(0)
+		if i+1 < len(chain) {
+			next = chain[i+1]
+		}
+		var chunk []pageRun
+		if i < len(chunks) {
+			chunk = chunks[i]
+		}
+		page := make([]byte, pageSize)
+		// The page is sized for pageSize and chunk fits, so this cannot fail.
+		_ = writeFreelistPage(page, chunk, next, pageSize)
+		pages[id] = page
+	}
+	return runIDs(runs[:inline]), chain[0]
+}
+
+// markTree records every page of the tree rooted at pageID, including
+// overflow pages. When buckets is set the tree is a bucket index and the
+// buckets its leaves point to are marked as well.
+func markTree(store pageStore, reachable map[uint64]bool, pageID uint64, buckets bool) error {
+	if pageID == 0 {
+		return nil
+	}
+	n, err := readNode(store, pageID)
+	if err != nil {
+		return err
+	}
+	reachable[pageID] = true
+	if !n.isLeaf {
+		for _, child := range n.children {
+			if err := markTree(store, reachable, child, buckets); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, id := range n.overflow {
+		if err := markOverflow(store, reachable, id); err != nil {
+			return err
+		}
+	}
+	if !buckets {
+		return nil
+	}
+	for _, val := range n.values {
+		if err := markBucket(store, reachable, decodePageID(val)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func markBucket(store pageStore, reachable map[uint64]bool, headerID uint64) error {
+	h, err := readBucketHeader(store, headerID)
+	if err != nil {
+		return err
+	}
+	reachable[headerID] = true
+	if err := markTree(store, reachable, h.kvRoot, false); err != nil {
+		return err
+	}
+	if err := markFilter(store, reachable, h.filter); err != nil {
+		return err
+	}
+	return markTree(store, reachable, h.bucketRoot, true)
+}
+
+// markFilter records the pages of the Bloom filter with directory pageID.
+func markFilter(store pageStore, reachable map[uint64]bool, pageID uint64) error {
+	if pageID == 0 {
+		return nil
+	}
+	dir, err := readFilterPage(store, pageID, pageFilter)
+	if err != nil {
+		return err
+	}
+	reachable[pageID] = true
+	for _, id := range filterBlocks(dir) {
+		reachable[id] = true
+	}
+	return nil
+}
+
+func markOverflow(store pageStore, reachable map[uint64]bool, pageID uint64) error {
+	for pageID != 0 {
+		buf, err := store.ReadPage(pageID)
+		if err != nil {
+			return err
+		}
+		if len(buf) < store.PageSize() || !isChainPage(buf[0]) {
+			return atPage(corrupted(0, "invalid overflow page"), pageID)
+		}
+		reachable[pageID] = true
+		pageID = binary.LittleEndian.Uint64(buf[1:])
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package leafdb
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxBatchSize is the batch size used when Options.MaxBatchSize
+	// is zero.
+	DefaultMaxBatchSize = 1000
+	// DefaultMaxBatchDelay is the batch delay used when
+	// Options.MaxBatchDelay is zero.
+	DefaultMaxBatchDelay = 10 * time.Millisecond
+)
+
+// errRunAlone is returned to a batch call whose function failed, so that it
+// reruns on its own and its error is not charged to the rest of the batch.
+var errRunAlone = errors.New("leafdb: batch function must run alone")
+
+// Batch calls fn as part of a write transaction shared with other concurrent
+// Batch calls. Calls are collected until MaxBatchSize functions are queued or
+// MaxBatchDelay has passed since the first, then run together in one
+// transaction, so a single commit and fsync covers all of them.
+//
+// If fn returns an error the shared transaction is rolled back and fn is
+// retried on its own, while the other functions are retried as a batch. fn
+// may therefore run more than once and must be idempotent; its side effects
+// should only take effect once Batch returns nil.
+func (db *DB) Batch(fn func(*Tx) error) error {
+	if fn == nil {
+		return nil
+	}
+	errCh := make(chan error, 1)
+
+	db.batchMu.Lock()
+	if db.batch == nil || len(db.batch.calls) >= db.maxBatchSize {
+		db.batch = &batch{db: db}
+		db.batch.timer = time.AfterFunc(db.maxBatchDelay, db.batch.trigger)
+	}
+	db.batch.calls = append(db.batch.calls, batchCall{fn: fn, err: errCh})
+	if len(db.batch.calls) >= db.maxBatchSize {
+		go db.batch.trigger()
+	}
+	db.batchMu.Unlock()
+
+	err := <-errCh
+	if err == errRunAlone {
+		err = db.Write(fn)
+	}
+	return err
+}
+
+type batchCall struct {
+	fn  func(*Tx) error
+	err chan<- error
+}
+
+type batch struct {
+	db    *DB
+	timer *time.Timer
+	start sync.Once
+	calls []batchCall
+}
+
+// trigger runs the batch once, whichever of the timer or the size limit
+// fires first.
+func (b *batch) trigger() {
+	b.start.Do(b.run)
+}
+
+func (b *batch) run() {
+	b.db.batchMu.Lock()
+	b.timer.Stop()
+	// Later Batch calls start a new batch rather than join this one.
+	if b.db.batch == b {
+		b.db.batch = nil
+	}
+	b.db.batchMu.Unlock()
+
+	for len(b.calls) > 0 {
+		failed := -1
+		err := b.db.Write(func(tx *Tx) error {
+			for i, c := range b.calls {
+				if err := safeBatchCall(c.fn, tx); err != nil {
+					failed = i
+					return err
+				}
+			}
+			return nil
+		})
+		if failed < 0 {
+			for _, c := range b.calls {
+				c.err <- err
+			}
+			return
+		}
+		b.calls[failed].err <- errRunAlone
+		b.calls = append(b.calls[:failed], b.calls[failed+1:]...)
+	}
+}
+
+// safeBatchCall converts a panic in fn into an error so that one call cannot
+// take down the transaction shared with the others; the panic resurfaces
+// when fn reruns alone in its caller's goroutine.
+func safeBatchCall(fn func(*Tx) error, tx *Tx) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("leafdb: batch function panicked: %v", p)
+		}
+	}()
+	return fn(tx)
+}
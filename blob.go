@@ -0,0 +1,113 @@
+package leafdb
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DefaultBlobCollectInterval is the interval of the blob collector used when
+// Options.BlobCollectInterval is zero.
+const DefaultBlobCollectInterval = time.Minute
+
+// CollectBlobs frees the pages of the blob chains that writes have dropped,
+// see BucketOptions.BlobThreshold, and returns how many it freed. Such
+// pages are referenced by no leaf, so it finds them by walking every tree
+// in a read transaction, which does not hold up writers, and then frees
+// them in a short write transaction. Pages that read transactions may still
+// see are reused once they end, as with any freed page. Chains dropped
+// while it runs are left for the next call.
+//
+// A background goroutine calls it every Options.BlobCollectInterval once a
+// commit has dropped a chain. Chains dropped before the database was last
+// closed wait for the next call, from the collector or explicit.
+func (db *DB) CollectBlobs() (int, error) {
+	if db == nil {
+		return 0, ErrDatabaseClosed
+	}
+	db.collectMu.Lock()
+	defer db.collectMu.Unlock()
+	garbage, err := db.droppedBlobPages()
+	if err != nil || len(garbage) == 0 {
+		return 0, err
+	}
+	err = db.Write(func(tx *Tx) error {
+		for _, id := range garbage {
+			tx.mgr.FreePage(id)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(garbage), nil
+}
+
+// droppedBlobPages returns the pages of blob chains that no leaf of the
+// latest commit references. Such a page is neither reachable nor free, so
+// no later write can make it either, and it stays safe to free after the
+// walk.
+func (db *DB) droppedBlobPages() ([]uint64, error) {
+	db.lockWriter()
+	if db.mapping == nil {
+		db.mu.Unlock()
+		return nil, ErrDatabaseClosed
+	}
+	// The read transaction pins the pages of the snapshot, and the lists of
+	// free pages are taken with it under the writer lock, so that they
+	// match.
+	tx, err := db.begin(context.Background(), false)
+	if err != nil {
+		db.mu.Unlock()
+		return nil, err
+	}
+	defer tx.Rollback()
+	meta := db.snapshotMeta()
+	pending := db.pendingIDs()
+	chain, err := db.freelistPageIDs()
+	db.blobsDropped.Store(0)
+	db.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &checker{
+		store:    tx.mgr,
+		nextPage: meta.nextPage,
+		owner:    make(map[uint64]string),
+	}
+	c.claimPages(meta, chain, pending)
+	if len(c.errs) > 0 {
+		// Pages missed by a walk that failed would be freed while in use.
+		return nil, fmt.Errorf("leafdb: blob collection stopped: %w", c.errs[0])
+	}
+	var garbage []uint64
+	for id := uint64(metaPage1 + 1); id < c.nextPage; id++ {
+		if _, ok := c.owner[id]; !ok && c.isBlob(id) {
+			garbage = append(garbage, id)
+		}
+	}
+	return garbage, nil
+}
+
+// dropBlob leaves the blob chain at first to the blob collector, unless the
+// transaction wrote it: no reader can see such a chain, so it is freed at
+// once.
+func (m *txPageManager) dropBlob(first uint64) {
+	if m.allocated[first] {
+		freeOverflowPages(m, first)
+		return
+	}
+	m.blobsDropped++
+}
+
+// collectDroppedBlobs is run by the blob collector. A failed collection is
+// retried on the next tick, as the dropped chains are found again.
+func (db *DB) collectDroppedBlobs() {
+	if db.blobsDropped.Load() == 0 {
+		return
+	}
+	if _, err := db.CollectBlobs(); err != nil {
+		db.blobsDropped.Add(1)
+	}
+}
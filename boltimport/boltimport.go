@@ -0,0 +1,139 @@
+// Package boltimport copies bbolt databases into leafdb, for projects moving
+// over from bbolt. Both use byte-ordered keys in nested buckets with a
+// sequence each, so the data carries over unchanged:
+//
+//	stats, err := boltimport.ImportFile(db, "old.bolt")
+package boltimport
+
+import (
+	"iter"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"leafdb"
+)
+
+// Stats counts what an import copied.
+type Stats struct {
+	Buckets int
+	Keys    int
+}
+
+// ImportFile opens the bbolt file at path read-only and imports it into dst
+// with Import. It waits up to a second for a process that has the file open
+// for writing.
+func ImportFile(dst *leafdb.DB, path string) (Stats, error) {
+	src, err := bolt.Open(path, 0, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return Stats{}, err
+	}
+	defer src.Close()
+	return Import(dst, src)
+}
+
+// Import copies every bucket, nested bucket and key of src into dst in a
+// single write transaction, along with the bucket sequences. Buckets that
+// already exist in dst are merged into, keys already there are overwritten
+// and sequences are set to those of src. Buckets new to dst are filled with
+// Bucket.FillFromSorted, which writes each page once.
+func Import(dst *leafdb.DB, src *bolt.DB) (Stats, error) {
+	var stats Stats
+	err := src.View(func(btx *bolt.Tx) error {
+		return dst.Write(func(tx *leafdb.Tx) error {
+			im := &importer{tx: tx, stats: &stats}
+			err := btx.ForEach(func(name []byte, bb *bolt.Bucket) error {
+				b, created := tx.Bucket(name), false
+				if b == nil {
+					var err error
+					if b, err = tx.CreateBucket(name); err != nil {
+						return err
+					}
+					created = true
+				}
+				return im.copyBucket(b, bb, created, [][]byte{name})
+			})
+			if err != nil {
+				return err
+			}
+			return im.setSequences()
+		})
+	})
+	if err != nil {
+		return Stats{}, err
+	}
+	return stats, nil
+}
+
+type importer struct {
+	tx    *leafdb.Tx
+	stats *Stats
+	// sequences holds the sequences to set once all buckets are written.
+	// Setting one goes through a Bucket of its own, which would leave the
+	// Bucket values still being written to stale.
+	sequences []leafdb.Change
+}
+
+// copyBucket copies the keys and nested buckets of bb at path into b, which
+// is empty if created is set.
+func (im *importer) copyBucket(b *leafdb.Bucket, bb *bolt.Bucket, created bool, path [][]byte) error {
+	im.stats.Buckets++
+	if seq := bb.Sequence(); seq != 0 {
+		im.sequences = append(im.sequences, leafdb.Change{Op: leafdb.ChangeSequence, Bucket: path, Sequence: seq})
+	}
+	if created {
+		if err := b.FillFromSorted(im.keys(bb), 0); err != nil {
+			return err
+		}
+	} else {
+		for k, v := range im.keys(bb) {
+			if err := b.Put(k, v); err != nil {
+				return err
+			}
+		}
+	}
+	c := bb.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if v != nil {
+			continue
+		}
+		child, childCreated := b.Bucket(k), false
+		if child == nil {
+			var err error
+			if child, err = b.CreateBucket(k); err != nil {
+				return err
+			}
+			childCreated = true
+		}
+		if err := im.copyBucket(child, bb.Bucket(k), childCreated, append(path[:len(path):len(path)], k)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keys returns the pairs of bb in key order, skipping nested buckets, and
+// counts them as they are read.
+func (im *importer) keys(bb *bolt.Bucket) iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		c := bb.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if v == nil {
+				continue
+			}
+			im.stats.Keys++
+			if !yield(k, v) {
+				return
+			}
+		}
+	}
+}
+
+func (im *importer) setSequences() error {
+	for _, c := range im.sequences {
+		if err := im.tx.ApplyChange(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,10 +1,24 @@
 package leafdb
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"iter"
+	"math"
+	"slices"
+	"time"
 )
 
+// reservedPrefix starts the names of internal buckets, such as index and
+// changefeed buckets. They are hidden from bucket listings and cannot be
+// opened, created or deleted through the public API.
+const reservedPrefix = "\x00"
+
+func isReservedName(name []byte) bool {
+	return bytes.HasPrefix(name, []byte(reservedPrefix))
+}
+
 // Bucket is a namespace for key/value pairs and nested buckets.
 type Bucket struct {
 	tx         *Tx
@@ -14,20 +28,160 @@ type Bucket struct {
 	kvRoot     uint64
 	bucketRoot uint64
 	sequence   uint64
+	// quota is the limit set by SetQuota, or zero, and size the logical size
+	// of the pairs of b, which is only tracked while a quota is set.
+	quota uint64
+	size  uint64
+	// options are those stored by SetOptions.
+	options BucketOptions
+	// filter is the directory page of the Bloom filter of b, or zero.
+	filter uint64
+	// fillPercent is set by SetFillPercent; zero uses options.FillPercent.
+	fillPercent float64
+}
+
+// SetFillPercent sets how full Put and Merge leave the left part of a page
+// that splits, as a fraction of the page size between 0.1 and 1; values
+// outside are clamped. The default, DefaultFillPercent, splits pages in
+// half. Raising it suits keys that are mostly inserted in ascending order,
+// such as timestamps: a split then leaves full pages behind, and the new
+// page receives the inserts that follow, which roughly halves the pages
+// written and the space used. Random inserts into full pages split them
+// again sooner. The setting is not stored in the file and only applies to
+// writes through b; to keep it for every transaction, set
+// BucketOptions.FillPercent with SetOptions.
+func (b *Bucket) SetFillPercent(fill float64) {
+	if b != nil {
+		b.fillPercent = fill
+	}
+}
+
+// BucketOptions is the configuration of a bucket that is stored in its
+// header, so that it applies whichever transaction or process opens the
+// bucket.
+type BucketOptions struct {
+	// FillPercent is the fill percent of writes to the bucket, as set by
+	// SetFillPercent, which overrides it for one Bucket; zero uses
+	// DefaultFillPercent.
+	FillPercent float64
+	// BlobThreshold moves values of at least this many bytes out of the
+	// leaves into blob chains, pages of their own that the leaf points to,
+	// so that leaves of small pairs stay dense and rewriting a leaf does
+	// not copy the large values in it. A value replaced or deleted leaves
+	// its blob chain to the blob collector, see DB.CollectBlobs, instead of
+	// reading it to free its pages. Zero only moves the values that do not
+	// fit in a leaf, which are freed as they are dropped. The threshold
+	// applies to values as they are written.
+	BlobThreshold int
+	// Validator names the function, registered with DB.RegisterValidator,
+	// that checks the pairs written to the bucket, so that writes of
+	// malformed values fail. Only the name is stored: every process that
+	// writes to the bucket must register the function after Open, or
+	// writes fail with ErrNoValidator. The validator applies to pairs as
+	// they are written.
+	Validator string
+	// BloomBitsPerKey, if set, keeps a Bloom filter of the keys of the
+	// bucket with about that many bits per key, at most 32, in pages of
+	// its own, so that a Get of an absent key usually returns without
+	// descending the tree. Ten bits per key let about one lookup of an
+	// absent key in a hundred through. The filter is built when the option
+	// is set and grows with the bucket, up to a directory page of block
+	// pages: with 4 KiB pages and ten bits per key, about 1.6 million keys.
+	// See Bucket.RebuildFilter for keys deleted since.
+	BloomBitsPerKey int
+	// Comparator, Codec and TTL are reserved for a key order other than
+	// bytewise, an encoding of values and a default time to live of pairs.
+	// The engine implements none of them yet, so SetOptions rejects them
+	// with ErrNotImplemented unless they are zero. The header keeps
+	// a place for them, so that files that hold them still open.
+	Comparator string
+	Codec      string
+	TTL        time.Duration
+}
+
+// maxOptionName bounds the length of BucketOptions.Comparator and Codec.
+const maxOptionName = 255
+
+// SetOptions stores opts in the header of b. Bucket objects opened before
+// in the same transaction keep the old options.
+func (b *Bucket) SetOptions(opts BucketOptions) error {
+	if b == nil || b.tx == nil || b.tx.closed {
+		return ErrTxClosed
+	}
+	if !b.tx.writable {
+		return ErrTxReadOnly
+	}
+	if opts.FillPercent != 0 {
+		opts.FillPercent = min(max(opts.FillPercent, minFillPercent), maxFillPercent)
+	}
+	opts.BlobThreshold = min(max(opts.BlobThreshold, 0), maxValueLength)
+	if len(opts.Validator) > maxValidatorName {
+		return errValidatorName
+	}
+	opts.BloomBitsPerKey = min(max(opts.BloomBitsPerKey, 0), maxBloomBitsPerKey)
+	if opts.Comparator != "" || opts.Codec != "" || opts.TTL != 0 {
+		return ErrNotImplemented
+	}
+	rebuild := opts.BloomBitsPerKey != b.options.BloomBitsPerKey
+	b.tx.untrackedWrite()
+	b.options = opts
+	if rebuild {
+		if err := b.buildFilter(); err != nil {
+			return err
+		}
+	}
+	return b.persistHeader()
+}
+
+// Options returns the options stored in the header of b.
+func (b *Bucket) Options() BucketOptions {
+	if b == nil {
+		return BucketOptions{}
+	}
+	return b.options
+}
+
+// fill returns the fill percent of writes through b.
+func (b *Bucket) fill() float64 {
+	if b.fillPercent != 0 {
+		return b.fillPercent
+	}
+	return b.options.FillPercent
 }
 
 func (b *Bucket) Get(key []byte) []byte {
 	if b == nil || b.tx == nil || b.tx.closed {
 		return nil
 	}
-	tree := newBPTree(&b.kvRoot, b.tx.mgr)
-	val, ok, err := tree.get(key)
+	b.trackRead(key)
+	if !b.mayContain(key) {
+		return nil
+	}
+	val, ok, err := b.readTree().get(key)
 	if err != nil || !ok {
 		return nil
 	}
 	return val
 }
 
+// writeTree returns the key/value tree of b for writes, which follow the
+// fill percent and blob threshold of b.
+func (b *Bucket) writeTree() *bptree {
+	tree := newBPTree(&b.kvRoot, b.tx.mgr)
+	tree.fillPercent = b.fill()
+	tree.blobThreshold = b.options.BlobThreshold
+	return tree
+}
+
+// readTree returns the key/value tree of b for Get, First, Last and
+// cursors, which return its keys and values in place with
+// Options.NoCopyReads.
+func (b *Bucket) readTree() *bptree {
+	tree := newBPTree(&b.kvRoot, b.tx.mgr)
+	tree.noCopy = b.tx.db.noCopyReads
+	return tree
+}
+
 func (b *Bucket) Put(key, value []byte) error {
 	if b == nil || b.tx == nil || b.tx.closed {
 		return ErrTxClosed
@@ -35,11 +189,53 @@ func (b *Bucket) Put(key, value []byte) error {
 	if !b.tx.writable {
 		return ErrTxReadOnly
 	}
-	tree := newBPTree(&b.kvRoot, b.tx.mgr)
+	if len(key) > MaxKeySize {
+		return ErrKeyTooLarge
+	}
+	if err := b.validate(key, value); err != nil {
+		return err
+	}
+	indexes, err := b.declaredIndexes()
+	if err != nil {
+		return err
+	}
+	hooks := b.hooks()
+	tree := b.writeTree()
+	old, err := indexedValue(tree, indexes, hooks, key)
+	if err != nil {
+		return err
+	}
+	oldSize, err := b.storedSize(tree, key)
+	if err != nil {
+		return err
+	}
+	newSize := pairSize(key, value)
+	if err := b.checkQuota(oldSize, newSize); err != nil {
+		return err
+	}
+	if err := checkUnique(indexes, key, value); err != nil {
+		return err
+	}
 	if err := tree.set(key, value); err != nil {
 		return err
 	}
-	return b.persistHeader()
+	if err := b.addToFilter(key); err != nil {
+		return err
+	}
+	b.account(oldSize, newSize)
+	if err := b.persistHeader(); err != nil {
+		return err
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	if err := updateIndexes(indexes, key, old, value); err != nil {
+		return err
+	}
+	if err := b.putHooks(hooks, key, old, value); err != nil {
+		return err
+	}
+	return b.recordChange(Change{Op: ChangePut, Key: key, Value: value})
 }
 
 func (b *Bucket) Delete(key []byte) error {
@@ -49,7 +245,20 @@ func (b *Bucket) Delete(key []byte) error {
 	if !b.tx.writable {
 		return ErrTxReadOnly
 	}
-	tree := newBPTree(&b.kvRoot, b.tx.mgr)
+	indexes, err := b.declaredIndexes()
+	if err != nil {
+		return err
+	}
+	hooks := b.hooks()
+	tree := b.writeTree()
+	old, err := indexedValue(tree, indexes, hooks, key)
+	if err != nil {
+		return err
+	}
+	oldSize, err := b.storedSize(tree, key)
+	if err != nil {
+		return err
+	}
 	deleted, err := tree.delete(key)
 	if err != nil {
 		return err
@@ -57,38 +266,216 @@ func (b *Bucket) Delete(key []byte) error {
 	if !deleted {
 		return nil
 	}
-	return b.persistHeader()
+	b.account(oldSize, 0)
+	if err := b.persistHeader(); err != nil {
+		return err
+	}
+	if err := updateIndexes(indexes, key, old, nil); err != nil {
+		return err
+	}
+	if err := b.deleteHooks(hooks, key, old); err != nil {
+		return err
+	}
+	return b.recordChange(Change{Op: ChangeDelete, Key: key})
+}
+
+// errMergeDelete aborts the tree update of a Merge whose function asked for
+// the key to be deleted.
+var errMergeDelete = errors.New("leafdb: merge deletes key")
+
+// Merge replaces the value of key with the result of fn applied to the
+// current value, which is nil if key is absent. The value is read and written
+// in one descent of the tree, so there is no window between a Get and a Put.
+// If fn returns a nil slice the key is deleted; if fn returns an error, b is
+// left unchanged and Merge returns the error. fn must not modify old in
+// place, but may append to it.
+func (b *Bucket) Merge(key []byte, fn func(old []byte) ([]byte, error)) error {
+	if b == nil || b.tx == nil || b.tx.closed {
+		return ErrTxClosed
+	}
+	if !b.tx.writable {
+		return ErrTxReadOnly
+	}
+	if len(key) > MaxKeySize {
+		return ErrKeyTooLarge
+	}
+	indexes, err := b.declaredIndexes()
+	if err != nil {
+		return err
+	}
+	hooks := b.hooks()
+	var old, value []byte
+	tree := b.writeTree()
+	oldSize, err := b.storedSize(tree, key)
+	if err != nil {
+		return err
+	}
+	err = tree.update(key, func(cur []byte) ([]byte, error) {
+		v, err := fn(cur)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			return nil, errMergeDelete
+		}
+		if err := b.validate(key, v); err != nil {
+			return nil, err
+		}
+		if err := b.checkQuota(oldSize, pairSize(key, v)); err != nil {
+			return nil, err
+		}
+		if err := checkUnique(indexes, key, v); err != nil {
+			return nil, err
+		}
+		old, value = cur, v
+		return v, nil
+	})
+	if err == errMergeDelete {
+		return b.Delete(key)
+	}
+	if err != nil {
+		return err
+	}
+	if err := b.addToFilter(key); err != nil {
+		return err
+	}
+	b.account(oldSize, pairSize(key, value))
+	if err := b.persistHeader(); err != nil {
+		return err
+	}
+	if err := updateIndexes(indexes, key, old, value); err != nil {
+		return err
+	}
+	if err := b.putHooks(hooks, key, old, value); err != nil {
+		return err
+	}
+	return b.recordChange(Change{Op: ChangePut, Key: key, Value: value})
+}
+
+var (
+	errNotCounter      = errors.New("leafdb: value is not a counter")
+	errCounterOverflow = errors.New("leafdb: counter overflow")
+)
+
+// Increment adds delta to the counter stored under key and returns the new
+// value. Counters are stored as signed varints; an absent key counts from
+// zero. The value is updated in place with Merge, so concurrent increments in
+// separate transactions never lose updates.
+func (b *Bucket) Increment(key []byte, delta int64) (int64, error) {
+	var n int64
+	err := b.Merge(key, func(old []byte) ([]byte, error) {
+		var cur int64
+		if old != nil {
+			v, size := binary.Varint(old)
+			if size <= 0 || size != len(old) {
+				return nil, errNotCounter
+			}
+			cur = v
+		}
+		if delta > 0 && cur > math.MaxInt64-delta || delta < 0 && cur < math.MinInt64-delta {
+			return nil, errCounterOverflow
+		}
+		n = cur + delta
+		return binary.AppendVarint(nil, n), nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Counter returns the value of the counter stored under key, or zero if key
+// is absent.
+func (b *Bucket) Counter(key []byte) (int64, error) {
+	v := b.Get(key)
+	if v == nil {
+		return 0, nil
+	}
+	n, size := binary.Varint(v)
+	if size <= 0 || size != len(v) {
+		return 0, errNotCounter
+	}
+	return n, nil
 }
 
 func (b *Bucket) Bucket(name []byte) *Bucket {
+	if isReservedName(name) {
+		return nil
+	}
+	return b.child(name)
+}
+
+// child opens the nested bucket name, including reserved ones.
+func (b *Bucket) child(name []byte) *Bucket {
 	if b == nil || b.tx == nil || b.tx.closed {
 		return nil
 	}
 	if len(name) == 0 {
 		return nil
 	}
+	b.tx.trackBucket(b, name)
 	tree := newBPTree(&b.bucketRoot, b.tx.mgr)
 	val, ok, err := tree.get(name)
 	if err != nil || !ok {
 		return nil
 	}
-	pageID := decodePageID(val)
-	kvRoot, bucketRoot, sequence, err := readBucketHeader(b.tx.mgr, pageID)
+	child, err := b.openChild(name, decodePageID(val))
 	if err != nil {
 		return nil
 	}
-	return &Bucket{
-		tx:         b.tx,
-		name:       cloneBytes(name),
-		parent:     b,
-		header:     pageID,
-		kvRoot:     kvRoot,
-		bucketRoot: bucketRoot,
-		sequence:   sequence,
+	return child
+}
+
+// ForEachBucket calls fn for every nested bucket in key order. Iteration
+// stops at the first error returned by fn.
+func (b *Bucket) ForEachBucket(fn func(name []byte, child *Bucket) error) error {
+	if b == nil || b.tx == nil || b.tx.closed {
+		return ErrTxClosed
 	}
+	b.trackScan()
+	root := b.bucketRoot
+	c := &Cursor{tree: newBPTree(&root, b.tx.mgr)}
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if isReservedName(k) {
+			continue
+		}
+		child, err := b.openChild(k, decodePageID(v))
+		if err != nil {
+			return err
+		}
+		if err := fn(k, child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Bucket) openChild(name []byte, pageID uint64) (*Bucket, error) {
+	h, err := readBucketHeader(b.tx.mgr, pageID)
+	if err != nil {
+		return nil, err
+	}
+	child := &Bucket{tx: b.tx, name: cloneBytes(name), parent: b}
+	child.setHeaderFields(pageID, h)
+	return child, nil
 }
 
 func (b *Bucket) CreateBucket(name []byte) (*Bucket, error) {
+	if err := b.validateWritable(name); err != nil {
+		return nil, err
+	}
+	if isReservedName(name) {
+		return nil, ErrReservedName
+	}
+	child, err := b.createChild(name)
+	if err != nil {
+		return nil, err
+	}
+	return child, b.recordChange(Change{Op: ChangeCreateBucket, Key: name})
+}
+
+// createChild creates the nested bucket name, including reserved ones.
+func (b *Bucket) createChild(name []byte) (*Bucket, error) {
 	if err := b.validateWritable(name); err != nil {
 		return nil, err
 	}
@@ -116,6 +503,17 @@ func (b *Bucket) CreateBucketIfNotExists(name []byte) (*Bucket, error) {
 }
 
 func (b *Bucket) DeleteBucket(name []byte) error {
+	if isReservedName(name) {
+		return ErrBucketNotFound
+	}
+	if err := b.deleteChild(name); err != nil {
+		return err
+	}
+	return b.recordChange(Change{Op: ChangeDeleteBucket, Key: name})
+}
+
+// deleteChild deletes the nested bucket name, including reserved ones.
+func (b *Bucket) deleteChild(name []byte) error {
 	if b == nil || b.tx == nil || b.tx.closed {
 		return ErrTxClosed
 	}
@@ -145,7 +543,136 @@ func (b *Bucket) Cursor() *Cursor {
 	if b == nil || b.tx == nil || b.tx.closed {
 		return nil
 	}
-	return &Cursor{tree: newBPTree(&b.kvRoot, b.tx.mgr)}
+	b.trackScan()
+	return &Cursor{tree: b.readTree()}
+}
+
+// First returns the pair with the smallest key, or nil if the bucket is empty.
+func (b *Bucket) First() ([]byte, []byte) {
+	return b.edge(false)
+}
+
+// Last returns the pair with the largest key, or nil if the bucket is empty.
+func (b *Bucket) Last() ([]byte, []byte) {
+	return b.edge(true)
+}
+
+// MinKey returns the smallest key in the bucket, or nil if it is empty.
+func (b *Bucket) MinKey() []byte {
+	key, _ := b.First()
+	return key
+}
+
+// MaxKey returns the largest key in the bucket, or nil if it is empty.
+func (b *Bucket) MaxKey() []byte {
+	key, _ := b.Last()
+	return key
+}
+
+func (b *Bucket) edge(last bool) ([]byte, []byte) {
+	if b == nil || b.tx == nil || b.tx.closed {
+		return nil, nil
+	}
+	b.trackScan()
+	key, value, ok, err := b.readTree().edge(last)
+	if err != nil || !ok {
+		return nil, nil
+	}
+	return key, value
+}
+
+// Range calls fn for each pair with start <= key < end in key order until fn
+// returns false. A nil start begins at the first key and a nil end scans to
+// the last.
+func (b *Bucket) Range(start, end []byte, fn func(key, value []byte) bool) error {
+	if b == nil || b.tx == nil || b.tx.closed {
+		return ErrTxClosed
+	}
+	for k, v := range b.Cursor().Range(start, end) {
+		if !fn(k, v) {
+			break
+		}
+	}
+	return nil
+}
+
+// All returns an iterator over the pairs of b in key order, for use with
+// range-over-func:
+//
+//	for k, v := range b.All() {
+//		...
+//	}
+//
+// Like a Cursor, it must only be used while the transaction is open.
+func (b *Bucket) All() iter.Seq2[[]byte, []byte] {
+	return func(yield func(key, value []byte) bool) {
+		b.Cursor().Range(nil, nil)(yield)
+	}
+}
+
+// KV is a key/value pair returned by bucket listing helpers.
+type KV struct {
+	Key   []byte
+	Value []byte
+}
+
+const listTokenVersion = 1
+
+// List returns up to limit pairs whose keys start with prefix, resuming after
+// the position encoded in token. The returned token is nil once the listing
+// is exhausted. Tokens are keyed on the last returned key, so they remain
+// valid across transactions.
+func (b *Bucket) List(prefix []byte, limit int, token []byte) ([]KV, []byte, error) {
+	if b == nil || b.tx == nil || b.tx.closed {
+		return nil, nil, ErrTxClosed
+	}
+	if limit <= 0 {
+		return nil, nil, errors.New("leafdb: list limit must be positive")
+	}
+	start := prefix
+	var after []byte
+	if len(token) > 0 {
+		last, err := decodeListToken(token, prefix)
+		if err != nil {
+			return nil, nil, err
+		}
+		start = last
+		after = last
+	}
+
+	c := b.Cursor()
+	out := make([]KV, 0, limit)
+	for k, v := c.Seek(start); k != nil; k, v = c.Next() {
+		if !bytes.HasPrefix(k, prefix) {
+			return out, nil, nil
+		}
+		if after != nil && bytes.Equal(k, after) {
+			continue
+		}
+		if len(out) == limit {
+			return out, encodeListToken(out[len(out)-1].Key), nil
+		}
+		out = append(out, KV{Key: k, Value: v})
+	}
+	return out, nil, nil
+}
+
+func encodeListToken(last []byte) []byte {
+	token := make([]byte, 1+len(last))
+	token[0] = listTokenVersion
+	copy(token[1:], last)
+	return token
+}
+
+func decodeListToken(token, prefix []byte) ([]byte, error) {
+	if token[0] != listTokenVersion {
+		return nil, ErrInvalidToken
+	}
+	last := token[1:]
+	if !bytes.HasPrefix(last, prefix) {
+		return nil, ErrInvalidToken
+	}
+	return last, nil
 }
 
 // Sequence returns the current sequence value for the bucket.
@@ -153,9 +680,19 @@ func (b *Bucket) Sequence() uint64 {
 	if b == nil {
 		return 0
 	}
+	b.trackSequence()
 	return b.sequence
 }
 
+// setSequence sets the sequence of b and records the change.
+func (b *Bucket) setSequence(sequence uint64) error {
+	b.sequence = sequence
+	if err := b.persistHeader(); err != nil {
+		return err
+	}
+	return b.recordChange(Change{Op: ChangeSequence, Sequence: sequence})
+}
+
 // NextSequence increments and returns the next sequence value.
 func (b *Bucket) NextSequence() (uint64, error) {
 	if b == nil || b.tx == nil || b.tx.closed {
@@ -168,13 +705,16 @@ func (b *Bucket) NextSequence() (uint64, error) {
 	if err := b.persistHeader(); err != nil {
 		return 0, err
 	}
+	if err := b.recordChange(Change{Op: ChangeSequence, Sequence: b.sequence}); err != nil {
+		return 0, err
+	}
 	return b.sequence, nil
 }
 
 func (b *Bucket) persistHeader() error {
 	oldHeader := b.header
 	headID := b.tx.mgr.AllocPage()
-	if err := writeBucketHeader(b.tx.mgr, headID, b.kvRoot, b.bucketRoot, b.sequence); err != nil {
+	if err := writeBucketHeader(b.tx.mgr, headID, b.headerFields()); err != nil {
 		return err
 	}
 	b.header = headID
@@ -207,6 +747,26 @@ func (b *Bucket) updateChild(name []byte, headerID uint64) error {
 	return b.persistHeader()
 }
 
+// path returns the names of the buckets from the top level down to b.
+func (b *Bucket) path() [][]byte {
+	var path [][]byte
+	for p := b; p != nil; p = p.parent {
+		path = append(path, p.name)
+	}
+	slices.Reverse(path)
+	return path
+}
+
+// recordChange adds c, a change to b or to one of its pairs, to the
+// changefeed. Changes to reserved buckets are internal and not recorded.
+func (b *Bucket) recordChange(c Change) error {
+	if isReservedName(b.name) {
+		return nil
+	}
+	c.Bucket = b.path()
+	return b.tx.recordChange(c)
+}
+
 func (b *Bucket) validateWritable(name []byte) error {
 	if b == nil || b.tx == nil || b.tx.closed {
 		return ErrTxClosed
@@ -217,6 +777,9 @@ func (b *Bucket) validateWritable(name []byte) error {
 	if len(name) == 0 {
 		return errors.New("leafdb: bucket name required")
 	}
+	if len(name) > MaxKeySize {
+		return ErrKeyTooLarge
+	}
 	return nil
 }
 
@@ -235,28 +798,207 @@ func (b *Bucket) linkChild(name []byte, headerID uint64) error {
 	return tree.set(name, encodePageID(headerID))
 }
 
-func readBucketHeader(store pageStore, pageID uint64) (uint64, uint64, uint64, error) {
+// bucketHeader holds the fields of a bucket header page. Headers written
+// before quotas and options existed have zeros in their place.
+type bucketHeader struct {
+	kvRoot     uint64
+	bucketRoot uint64
+	sequence   uint64
+	quota      uint64
+	size       uint64
+	options    BucketOptions
+	filter     uint64
+}
+
+// The options of a bucket, and the directory page of its Bloom filter, are
+// stored after the fixed fields of its header as a record: its length as a
+// uint16, then one entry per option that is set, a tag byte followed by a
+// uvarint length and the value. Unknown tags are skipped, so options can be
+// added without breaking older readers.
+const (
+	bucketOptionsOffset    = 41
+	bucketOptionFill       = 1
+	bucketOptionBlob       = 2
+	bucketOptionValidator  = 3
+	bucketOptionBloom      = 4
+	bucketOptionFilter     = 5
+	bucketOptionComparator = 6
+	bucketOptionCodec      = 7
+	bucketOptionTTL        = 8
+)
+
+func encodeBucketOptions(opts BucketOptions, filter uint64) []byte {
+	var rec []byte
+	if opts.FillPercent != 0 {
+		rec = append(rec, bucketOptionFill, 8)
+		rec = binary.LittleEndian.AppendUint64(rec, math.Float64bits(opts.FillPercent))
+	}
+	if opts.BlobThreshold != 0 {
+		v := binary.AppendUvarint(nil, uint64(opts.BlobThreshold))
+		rec = append(rec, bucketOptionBlob, byte(len(v)))
+		rec = append(rec, v...)
+	}
+	if opts.Validator != "" {
+		rec = append(rec, bucketOptionValidator)
+		rec = binary.AppendUvarint(rec, uint64(len(opts.Validator)))
+		rec = append(rec, opts.Validator...)
+	}
+	if opts.BloomBitsPerKey != 0 {
+		rec = append(rec, bucketOptionBloom, 1, byte(opts.BloomBitsPerKey))
+	}
+	if filter != 0 {
+		rec = append(rec, bucketOptionFilter, 8)
+		rec = binary.LittleEndian.AppendUint64(rec, filter)
+	}
+	if opts.Comparator != "" {
+		rec = append(rec, bucketOptionComparator)
+		rec = binary.AppendUvarint(rec, uint64(len(opts.Comparator)))
+		rec = append(rec, opts.Comparator...)
+	}
+	if opts.Codec != "" {
+		rec = append(rec, bucketOptionCodec)
+		rec = binary.AppendUvarint(rec, uint64(len(opts.Codec)))
+		rec = append(rec, opts.Codec...)
+	}
+	if opts.TTL != 0 {
+		v := binary.AppendUvarint(nil, uint64(opts.TTL))
+		rec = append(rec, bucketOptionTTL, byte(len(v)))
+		rec = append(rec, v...)
+	}
+	return rec
+}
+
+// decodeBucketOptions returns the options of the bucket header page and
+// the directory page of its Bloom filter, or zero.
+func decodeBucketOptions(page []byte) (BucketOptions, uint64, error) {
+	var opts BucketOptions
+	var filter uint64
+	if len(page) < bucketOptionsOffset+2 {
+		return opts, 0, corrupted(len(page), "short bucket page")
+	}
+	n := int(binary.LittleEndian.Uint16(page[bucketOptionsOffset:]))
+	pos := bucketOptionsOffset + 2
+	rec := page[pos:]
+	if n > len(rec) {
+		return opts, 0, corrupted(bucketOptionsOffset, "corrupted bucket options length")
+	}
+	rec = rec[:n]
+	for len(rec) > 0 {
+		tag := rec[0]
+		length, size := binary.Uvarint(rec[1:])
+		if size <= 0 || length > uint64(len(rec)-1-size) {
+			return opts, 0, corrupted(pos, "corrupted bucket option")
+		}
+		value := rec[1+size : 1+size+int(length)]
+		switch tag {
+		case bucketOptionFill:
+			if len(value) != 8 {
+				return opts, 0, corrupted(pos, "corrupted fill percent")
+			}
+			opts.FillPercent = math.Float64frombits(binary.LittleEndian.Uint64(value))
+		case bucketOptionBlob:
+			v, size := binary.Uvarint(value)
+			if size != len(value) || v > uint64(maxValueLength) {
+				return opts, 0, corrupted(pos, "corrupted blob threshold")
+			}
+			opts.BlobThreshold = int(v)
+		case bucketOptionValidator:
+			if len(value) > maxValidatorName {
+				return opts, 0, corrupted(pos, "corrupted validator name")
+			}
+			opts.Validator = string(value)
+		case bucketOptionBloom:
+			if len(value) != 1 || value[0] > maxBloomBitsPerKey {
+				return opts, 0, corrupted(pos, "corrupted bloom bits per key")
+			}
+			opts.BloomBitsPerKey = int(value[0])
+		case bucketOptionFilter:
+			if len(value) != 8 {
+				return opts, 0, corrupted(pos, "corrupted filter page")
+			}
+			filter = binary.LittleEndian.Uint64(value)
+		case bucketOptionComparator:
+			if len(value) > maxOptionName {
+				return opts, 0, corrupted(pos, "corrupted comparator name")
+			}
+			opts.Comparator = string(value)
+		case bucketOptionCodec:
+			if len(value) > maxOptionName {
+				return opts, 0, corrupted(pos, "corrupted codec name")
+			}
+			opts.Codec = string(value)
+		case bucketOptionTTL:
+			v, size := binary.Uvarint(value)
+			if size != len(value) || v > math.MaxInt64 {
+				return opts, 0, corrupted(pos, "corrupted TTL")
+			}
+			opts.TTL = time.Duration(v)
+		}
+		pos += 1 + size + int(length)
+		rec = rec[1+size+int(length):]
+	}
+	return opts, filter, nil
+}
+
+// headerFields returns the header fields of b.
+func (b *Bucket) headerFields() bucketHeader {
+	return bucketHeader{
+		kvRoot:     b.kvRoot,
+		bucketRoot: b.bucketRoot,
+		sequence:   b.sequence,
+		quota:      b.quota,
+		size:       b.size,
+		options:    b.options,
+		filter:     b.filter,
+	}
+}
+
+// setHeaderFields loads the fields of h, read from header page id, into b.
+func (b *Bucket) setHeaderFields(id uint64, h bucketHeader) {
+	b.header = id
+	b.kvRoot, b.bucketRoot, b.sequence = h.kvRoot, h.bucketRoot, h.sequence
+	b.quota, b.size = h.quota, h.size
+	b.options, b.filter = h.options, h.filter
+}
+
+func readBucketHeader(store pageStore, pageID uint64) (bucketHeader, error) {
 	buf, err := store.ReadPage(pageID)
 	if err != nil {
-		return 0, 0, 0, err
+		return bucketHeader{}, err
 	}
-	if len(buf) < store.PageSize() {
-		return 0, 0, 0, errors.New("leafdb: invalid bucket header")
+	if len(buf) < store.PageSize() || len(buf) < bucketOptionsOffset {
+		return bucketHeader{}, atPage(corrupted(len(buf), "short bucket page"), pageID)
 	}
 	if buf[0] != pageBucket {
-		return 0, 0, 0, errors.New("leafdb: invalid bucket page")
+		return bucketHeader{}, atPage(corrupted(0, "invalid bucket page type"), pageID)
 	}
-	kvRoot := binary.LittleEndian.Uint64(buf[1:])
-	bucketRoot := binary.LittleEndian.Uint64(buf[9:])
-	sequence := binary.LittleEndian.Uint64(buf[17:])
-	return kvRoot, bucketRoot, sequence, nil
+	options, filter, err := decodeBucketOptions(buf)
+	if err != nil {
+		return bucketHeader{}, atPage(err, pageID)
+	}
+	return bucketHeader{
+		kvRoot:     binary.LittleEndian.Uint64(buf[1:]),
+		bucketRoot: binary.LittleEndian.Uint64(buf[9:]),
+		sequence:   binary.LittleEndian.Uint64(buf[17:]),
+		quota:      binary.LittleEndian.Uint64(buf[25:]),
+		size:       binary.LittleEndian.Uint64(buf[33:]),
+		options:    options,
+		filter:     filter,
+	}, nil
 }
 
-func writeBucketHeader(store pageStore, pageID, kvRoot, bucketRoot, sequence uint64) error {
-	buf := make([]byte, store.PageSize())
+func writeBucketHeader(store pageStore, pageID uint64, h bucketHeader) error {
+	buf := getPageBuffer(store.PageSize())
 	buf[0] = pageBucket
-	binary.LittleEndian.PutUint64(buf[1:], kvRoot)
-	binary.LittleEndian.PutUint64(buf[9:], bucketRoot)
-	binary.LittleEndian.PutUint64(buf[17:], sequence)
-	return store.WritePage(pageID, buf)
+	binary.LittleEndian.PutUint64(buf[1:], h.kvRoot)
+	binary.LittleEndian.PutUint64(buf[9:], h.bucketRoot)
+	binary.LittleEndian.PutUint64(buf[17:], h.sequence)
+	binary.LittleEndian.PutUint64(buf[25:], h.quota)
+	binary.LittleEndian.PutUint64(buf[33:], h.size)
+	rec := encodeBucketOptions(h.options, h.filter)
+	binary.LittleEndian.PutUint16(buf[bucketOptionsOffset:], uint16(len(rec)))
+	copy(buf[bucketOptionsOffset+2:], rec)
+	err := store.WritePage(pageID, buf)
+	putPageBuffer(buf)
+	return err
 }
@@ -0,0 +1,246 @@
+package leafdb
+
+import (
+	"bytes"
+	"errors"
+	"iter"
+)
+
+// DefaultBulkFillPercent is the fill factor used by FillFromSorted when none
+// is given. Leaving some room lets a few later inserts land without splits.
+const DefaultBulkFillPercent = 0.9
+
+var (
+	errBucketNotEmpty = errors.New("leafdb: bulk load into a non-empty bucket")
+	errUnsortedKeys   = errors.New("leafdb: bulk load keys not in ascending order")
+)
+
+// BulkLoad creates the top-level bucket name if it does not exist and fills
+// it from pairs with FillFromSorted at DefaultBulkFillPercent, in one write
+// transaction.
+func (db *DB) BulkLoad(name []byte, pairs iter.Seq2[[]byte, []byte]) error {
+	return db.Write(func(tx *Tx) error {
+		b, err := tx.CreateBucketIfNotExists(name)
+		if err != nil {
+			return err
+		}
+		return b.FillFromSorted(pairs, 0)
+	})
+}
+
+// FillFromSorted fills the empty bucket b from pairs, whose keys must be in
+// strictly ascending order. Rather than inserting pair by pair, which copies
+// the path to each key, it builds the tree bottom-up and writes every page
+// once, filled to fillPercent of the page size. A fillPercent of zero uses
+// DefaultBulkFillPercent; other values are clamped to [0.1, 1].
+//
+// The pairs are otherwise stored as by Put: declared indexes are updated,
+// hooks are called and the changefeed records a put for each.
+func (b *Bucket) FillFromSorted(pairs iter.Seq2[[]byte, []byte], fillPercent float64) error {
+	if b == nil || b.tx == nil || b.tx.closed {
+		return ErrTxClosed
+	}
+	if !b.tx.writable {
+		return ErrTxReadOnly
+	}
+	indexes, err := b.declaredIndexes()
+	if err != nil {
+		return err
+	}
+	hooks := b.hooks()
+	tree := b.writeTree()
+	root, err := readNode(b.tx.mgr, b.kvRoot)
+	if err != nil {
+		return err
+	}
+	if !root.isLeaf || len(root.keys) > 0 {
+		return errBucketNotEmpty
+	}
+
+	if fillPercent == 0 {
+		fillPercent = DefaultBulkFillPercent
+	}
+	fillPercent = min(max(fillPercent, minFillPercent), maxFillPercent)
+	bb := &bulkBuilder{
+		t:     tree,
+		limit: int(float64(b.tx.mgr.PageSize()) * fillPercent),
+		leaf:  &node{pageID: b.tx.mgr.AllocPage(), isLeaf: true},
+	}
+	var prev []byte
+	var size uint64
+	for key, value := range pairs {
+		if prev != nil && bytes.Compare(prev, key) >= 0 {
+			return errUnsortedKeys
+		}
+		if value == nil {
+			value = []byte{}
+		}
+		if err := b.validate(key, value); err != nil {
+			return err
+		}
+		size += pairSize(key, value)
+		if err := b.checkQuota(0, size); err != nil {
+			return err
+		}
+		if err := checkUnique(indexes, key, value); err != nil {
+			return err
+		}
+		key, value = cloneBytes(key), cloneBytes(value)
+		if err := bb.add(key, value); err != nil {
+			return err
+		}
+		if err := updateIndexes(indexes, key, nil, value); err != nil {
+			return err
+		}
+		if err := b.putHooks(hooks, key, nil, value); err != nil {
+			return err
+		}
+		if err := b.recordChange(Change{Op: ChangePut, Key: key, Value: value}); err != nil {
+			return err
+		}
+		prev = key
+	}
+	newRoot, err := bb.finish()
+	if err != nil {
+		return err
+	}
+	b.tx.mgr.FreePage(root.pageID)
+	b.kvRoot = newRoot
+	b.account(0, size)
+	if b.options.BloomBitsPerKey != 0 {
+		if err := b.buildFilter(); err != nil {
+			return err
+		}
+	}
+	return b.persistHeader()
+}
+
+// bulkBuilder writes a tree bottom-up from pairs added in key order. Leaves
+// are written as they fill; branch levels are built once all leaves exist.
+type bulkBuilder struct {
+	t *bptree
+	// limit is the number of bytes of a page to fill.
+	limit int
+	// leaf is the leaf being filled; entries is the sum of the sizes of its
+	// entries without prefix compression.
+	leaf    *node
+	entries int
+	// level holds the leaves written so far.
+	level []childRef
+}
+
+func (bb *bulkBuilder) add(key, value []byte) error {
+	entry, _, err := leafEntrySize(key, value, bb.t.store.PageSize(), bb.t.blobThreshold)
+	if err != nil {
+		return err
+	}
+	if len(bb.leaf.keys) > 0 && bb.sizeWith(key, entry) > bb.limit {
+		next := bb.t.store.AllocPage()
+		bb.leaf.next = next
+		if err := bb.writeLeaf(); err != nil {
+			return err
+		}
+		bb.leaf = &node{pageID: next, isLeaf: true}
+		bb.entries = 0
+	}
+	bb.leaf.keys = append(bb.leaf.keys, key)
+	bb.leaf.values = append(bb.leaf.values, value)
+	bb.entries += entry
+	return nil
+}
+
+// sizeWith returns the encoded size of the current leaf with one more entry
+// of entry bytes for key, matching leafSize.
+func (bb *bulkBuilder) sizeWith(key []byte, entry int) int {
+	n := len(bb.leaf.keys) + 1
+	prefix := commonPrefixLen(bb.leaf.keys[0], key)
+	size := nodeHeaderSize + bb.entries + entry
+	if (n-1)*prefix > 2 {
+		size += 2 + prefix - n*prefix
+	}
+	return size
+}
+
+func (bb *bulkBuilder) writeLeaf() error {
+	if err := bb.t.writeNode(bb.leaf); err != nil {
+		return err
+	}
+	var first []byte
+	if len(bb.leaf.keys) > 0 {
+		first = bb.leaf.keys[0]
+	}
+	bb.level = append(bb.level, childRef{pageID: bb.leaf.pageID, first: first, count: uint64(len(bb.leaf.keys))})
+	return nil
+}
+
+// finish writes the last leaf and the branch levels above the leaves, and
+// returns the ID of the root page.
+func (bb *bulkBuilder) finish() (uint64, error) {
+	if err := bb.writeLeaf(); err != nil {
+		return 0, err
+	}
+	level := bb.level
+	for len(level) > 1 {
+		var err error
+		if level, err = bb.writeBranches(level); err != nil {
+			return 0, err
+		}
+	}
+	return level[0].pageID, nil
+}
+
+// writeBranches writes the branch pages over children and returns them as
+// the next level up.
+func (bb *bulkBuilder) writeBranches(children []childRef) ([]childRef, error) {
+	var (
+		branches []*node
+		firsts   [][]byte
+		size     int
+	)
+	for _, c := range children {
+		if len(branches) > 0 {
+			cur := branches[len(branches)-1]
+			if len(cur.children) < 2 || size+16+2+len(c.first) <= bb.limit {
+				cur.keys = append(cur.keys, c.first)
+				cur.children = append(cur.children, c.pageID)
+				cur.counts = append(cur.counts, c.count)
+				size += 16 + 2 + len(c.first)
+				continue
+			}
+		}
+		branches = append(branches, &node{children: []uint64{c.pageID}, counts: []uint64{c.count}})
+		firsts = append(firsts, c.first)
+		size = nodeHeaderSize + 16
+	}
+	// A branch needs two children. A lone last child takes a sibling from
+	// the previous branch, or joins it if that has only two; MaxKeySize
+	// leaves room for three.
+	if last := len(branches) - 1; last > 0 && len(branches[last].children) == 1 {
+		prev, lone := branches[last-1], branches[last]
+		if len(prev.children) == 2 {
+			prev.keys = append(prev.keys, firsts[last])
+			prev.children = append(prev.children, lone.children[0])
+			prev.counts = append(prev.counts, lone.counts[0])
+			branches, firsts = branches[:last], firsts[:last]
+		} else {
+			k := len(prev.keys) - 1
+			lone.keys = [][]byte{firsts[last]}
+			lone.children = []uint64{prev.children[k+1], lone.children[0]}
+			lone.counts = []uint64{prev.counts[k+1], lone.counts[0]}
+			firsts[last] = prev.keys[k]
+			prev.keys = prev.keys[:k]
+			prev.children = prev.children[:k+1]
+			prev.counts = prev.counts[:k+1]
+		}
+	}
+
+	out := make([]childRef, len(branches))
+	for i, n := range branches {
+		n.pageID = bb.t.store.AllocPage()
+		if err := bb.t.writeNode(n); err != nil {
+			return nil, err
+		}
+		out[i] = childRef{pageID: n.pageID, first: firsts[i], count: n.count()}
+	}
+	return out, nil
+}
@@ -0,0 +1,130 @@
+package leafdb
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// nodeLRU caches the decoded nodes of committed pages for all transactions,
+// evicting the least recently used once their estimated size exceeds the
+// budget.
+//
+// Entries are keyed by page ID alone. A committed page does not change until
+// it is freed and reused, and it is only reused once no open transaction can
+// reach it, so an entry stays valid until a commit rewrites its page; commits
+// drop the entries of every page they write before their meta page is
+// published. A nil *nodeLRU caches nothing.
+type nodeLRU struct {
+	mu      sync.Mutex
+	budget  int
+	size    int
+	entries map[uint64]*list.Element
+	// order holds *lruEntry values, most recently used first.
+	order list.List
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type lruEntry struct {
+	n    *node
+	size int
+}
+
+func newNodeLRU(budget int) *nodeLRU {
+	if budget <= 0 {
+		return nil
+	}
+	return &nodeLRU{budget: budget, entries: make(map[uint64]*list.Element)}
+}
+
+func (c *nodeLRU) get(id uint64) *node {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	var n *node
+	if e, ok := c.entries[id]; ok {
+		c.order.MoveToFront(e)
+		n = e.Value.(*lruEntry).n
+	}
+	c.mu.Unlock()
+	if n == nil {
+		c.misses.Add(1)
+		return nil
+	}
+	c.hits.Add(1)
+	return n
+}
+
+func (c *nodeLRU) add(n *node) {
+	if c == nil {
+		return
+	}
+	size := nodeMemSize(n)
+	if size > c.budget {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[n.pageID]; ok {
+		c.size -= e.Value.(*lruEntry).size
+		e.Value = &lruEntry{n: n, size: size}
+		c.order.MoveToFront(e)
+	} else {
+		c.entries[n.pageID] = c.order.PushFront(&lruEntry{n: n, size: size})
+	}
+	c.size += size
+	for c.size > c.budget {
+		e := c.order.Back()
+		c.remove(e.Value.(*lruEntry).n.pageID, e)
+	}
+}
+
+// invalidate drops the entries of pages about to be rewritten.
+func (c *nodeLRU) invalidate(ids map[uint64][]byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id := range ids {
+		if e, ok := c.entries[id]; ok {
+			c.remove(id, e)
+		}
+	}
+}
+
+func (c *nodeLRU) remove(id uint64, e *list.Element) {
+	c.size -= e.Value.(*lruEntry).size
+	c.order.Remove(e)
+	delete(c.entries, id)
+}
+
+func (c *nodeLRU) stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mu.Lock()
+	size, n := c.size, len(c.entries)
+	c.mu.Unlock()
+	return CacheStats{
+		Hits:   c.hits.Load(),
+		Misses: c.misses.Load(),
+		Nodes:  n,
+		Size:   size,
+	}
+}
+
+// nodeMemSize estimates the memory held by a decoded node.
+func nodeMemSize(n *node) int {
+	size := 96 + 8*(len(n.children)+len(n.counts)+len(n.overflow))
+	for _, k := range n.keys {
+		size += 24 + len(k)
+	}
+	for _, v := range n.values {
+		size += 24 + len(v)
+	}
+	return size
+}
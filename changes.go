@@ -0,0 +1,411 @@
+package leafdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// changesBucket is the reserved top-level bucket holding the changefeed.
+// Its keys are the committing transaction's ID and the change's position in
+// that transaction, both big-endian, so they sort in commit order. The key
+// truncatedKey, which sorts before them, holds the before of the last
+// TruncateChanges as a big-endian uint64.
+const changesBucket = reservedPrefix + "changes"
+
+var truncatedKey = []byte{0}
+
+// ChangeOp is the kind of mutation a Change records.
+type ChangeOp uint8
+
+const (
+	// ChangePut sets Key to Value in Bucket.
+	ChangePut ChangeOp = iota + 1
+	// ChangeDelete deletes Key from Bucket.
+	ChangeDelete
+	// ChangeCreateBucket creates the bucket named Key inside Bucket, or at
+	// the top level if Bucket is empty.
+	ChangeCreateBucket
+	// ChangeDeleteBucket deletes the bucket named Key inside Bucket, or at
+	// the top level if Bucket is empty.
+	ChangeDeleteBucket
+	// ChangeSequence sets the sequence of Bucket to Sequence.
+	ChangeSequence
+	// ChangeMoveBucket moves the bucket named Key inside Bucket, or at the
+	// top level if Bucket is empty, to the path To.
+	ChangeMoveBucket
+)
+
+func (op ChangeOp) String() string {
+	switch op {
+	case ChangePut:
+		return "put"
+	case ChangeDelete:
+		return "delete"
+	case ChangeCreateBucket:
+		return "create-bucket"
+	case ChangeDeleteBucket:
+		return "delete-bucket"
+	case ChangeSequence:
+		return "sequence"
+	case ChangeMoveBucket:
+		return "move-bucket"
+	}
+	return fmt.Sprintf("ChangeOp(%d)", uint8(op))
+}
+
+// Change is one committed mutation recorded in the changefeed. Index
+// maintenance is not recorded; it follows from the Puts and Deletes.
+type Change struct {
+	// TxID is the ID of the transaction that committed the change.
+	TxID uint64
+	Op   ChangeOp
+	// Bucket is the path of bucket names from the top level down to the
+	// bucket the change applies to.
+	Bucket   [][]byte
+	Key      []byte
+	Value    []byte
+	Sequence uint64
+	// To is the new path of the bucket moved by a ChangeMoveBucket.
+	To [][]byte
+}
+
+var errInvalidChange = errors.New("leafdb: invalid changefeed entry")
+
+// recordChange appends c to the changefeed if it is enabled, and tracks it
+// for the conflict checks of optimistic transactions if they are.
+func (tx *Tx) recordChange(c Change) error {
+	tx.trackChange(c)
+	if !tx.db.changefeed {
+		return nil
+	}
+	if tx.changeLog == nil {
+		b := tx.bucket([]byte(changesBucket))
+		if b == nil {
+			var err error
+			if b, err = tx.createTopLevel([]byte(changesBucket)); err != nil {
+				return err
+			}
+		}
+		tx.changeLog = b
+	}
+	var key [12]byte
+	binary.BigEndian.PutUint64(key[:], tx.mgr.txid+1)
+	binary.BigEndian.PutUint32(key[8:], tx.changeSeq)
+	tx.changeSeq++
+	return tx.changeLog.Put(key[:], encodeChange(c))
+}
+
+func encodeChange(c Change) []byte {
+	buf := []byte{byte(c.Op)}
+	buf = appendChangePath(buf, c.Bucket)
+	buf = appendChangeBytes(buf, c.Key)
+	buf = appendChangeBytes(buf, c.Value)
+	buf = binary.AppendUvarint(buf, c.Sequence)
+	if c.Op == ChangeMoveBucket {
+		buf = appendChangePath(buf, c.To)
+	}
+	return buf
+}
+
+func appendChangePath(buf []byte, path [][]byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(path)))
+	for _, name := range path {
+		buf = appendChangeBytes(buf, name)
+	}
+	return buf
+}
+
+func appendChangeBytes(buf, b []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+func decodeChange(key, buf []byte) (Change, error) {
+	if len(key) != 12 || len(buf) == 0 {
+		return Change{}, errInvalidChange
+	}
+	c := Change{TxID: binary.BigEndian.Uint64(key), Op: ChangeOp(buf[0])}
+	buf = buf[1:]
+	var err error
+	if c.Bucket, err = readChangePath(&buf); err != nil {
+		return Change{}, err
+	}
+	if c.Key, err = readChangeBytes(&buf); err != nil {
+		return Change{}, err
+	}
+	if c.Value, err = readChangeBytes(&buf); err != nil {
+		return Change{}, err
+	}
+	if c.Sequence, err = readChangeUvarint(&buf); err != nil {
+		return Change{}, err
+	}
+	if c.Op == ChangeMoveBucket {
+		if c.To, err = readChangePath(&buf); err != nil {
+			return Change{}, err
+		}
+	}
+	return c, nil
+}
+
+func readChangePath(buf *[]byte) ([][]byte, error) {
+	n, err := readChangeUvarint(buf)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(*buf)) {
+		return nil, errInvalidChange
+	}
+	path := make([][]byte, n)
+	for i := range path {
+		if path[i], err = readChangeBytes(buf); err != nil {
+			return nil, err
+		}
+	}
+	return path, nil
+}
+
+func readChangeUvarint(buf *[]byte) (uint64, error) {
+	v, n := binary.Uvarint(*buf)
+	if n <= 0 {
+		return 0, errInvalidChange
+	}
+	*buf = (*buf)[n:]
+	return v, nil
+}
+
+func readChangeBytes(buf *[]byte) ([]byte, error) {
+	n, err := readChangeUvarint(buf)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(*buf)) {
+		return nil, errInvalidChange
+	}
+	b := (*buf)[:n:n]
+	*buf = (*buf)[n:]
+	return b, nil
+}
+
+// Changes returns an iterator over the changefeed entries of transactions
+// with IDs greater than since, in commit order. Pass the TxID of the last
+// change processed to resume where it left off. The iterator reads from a
+// snapshot taken now and holds a read transaction until it is closed. It
+// fails with ErrChangesTruncated if TruncateChanges has deleted entries
+// after since, which a consumer can only make up for by starting over from
+// a copy of the database.
+//
+// Changes are only recorded while the database is opened with
+// Options.Changefeed.
+func (db *DB) Changes(since uint64) (*ChangeIterator, error) {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	if before := changesTruncated(tx); since < before-1 {
+		tx.Rollback()
+		return nil, fmt.Errorf("%w before transaction %d, after %d", ErrChangesTruncated, before, since)
+	}
+	return &ChangeIterator{tx: tx, since: since}, nil
+}
+
+// changesTruncated returns the before of the last TruncateChanges as seen by
+// tx, or 1 if there was none.
+func changesTruncated(tx *Tx) uint64 {
+	if b := tx.bucket([]byte(changesBucket)); b != nil {
+		if v := b.Get(truncatedKey); len(v) == 8 {
+			return max(binary.BigEndian.Uint64(v), 1)
+		}
+	}
+	return 1
+}
+
+// TruncateChanges deletes the changefeed entries of transactions with IDs
+// below before. It records before, so that Changes refuses to resume from
+// a transaction whose successors it deleted instead of skipping them.
+func (db *DB) TruncateChanges(before uint64) error {
+	return db.Write(func(tx *Tx) error {
+		b := tx.bucket([]byte(changesBucket))
+		if b == nil {
+			return nil
+		}
+		if before <= changesTruncated(tx) {
+			return nil
+		}
+		var keys [][]byte
+		c := b.Cursor()
+		var start [12]byte
+		for k, _ := c.Seek(start[:]); k != nil && len(k) == 12 && binary.BigEndian.Uint64(k) < before; k, _ = c.Next() {
+			keys = append(keys, k)
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return b.Put(truncatedKey, binary.BigEndian.AppendUint64(nil, before))
+	})
+}
+
+// ChangeIterator walks the changefeed. Call Next to advance, Change to read
+// the current entry and Close when done.
+type ChangeIterator struct {
+	tx     *Tx
+	cursor *Cursor
+	since  uint64
+	change Change
+	err    error
+}
+
+// Next advances to the next change and reports whether there is one.
+func (it *ChangeIterator) Next() bool {
+	if it.err != nil || it.tx.closed {
+		return false
+	}
+	var k, v []byte
+	if it.cursor == nil {
+		b := it.tx.bucket([]byte(changesBucket))
+		if b == nil {
+			return false
+		}
+		it.cursor = b.Cursor()
+		var seek [8]byte
+		binary.BigEndian.PutUint64(seek[:], it.since+1)
+		k, v = it.cursor.Seek(seek[:])
+	} else {
+		k, v = it.cursor.Next()
+	}
+	if k == nil {
+		return false
+	}
+	it.change, it.err = decodeChange(k, v)
+	return it.err == nil
+}
+
+// Change returns the current change.
+func (it *ChangeIterator) Change() Change {
+	return it.change
+}
+
+// Err returns the error that stopped iteration, if any.
+func (it *ChangeIterator) Err() error {
+	return it.err
+}
+
+// Close ends the iterator's read transaction.
+func (it *ChangeIterator) Close() error {
+	it.tx.Rollback()
+	return nil
+}
+
+// replicaBucket is the reserved top-level bucket where a follower records
+// how far it has applied another database's changefeed.
+const replicaBucket = reservedPrefix + "replica"
+
+var appliedKey = []byte("applied")
+
+// ApplyChange applies c, read from another database's changefeed, as if the
+// mutation had been made through the Bucket and Tx methods. Declared indexes
+// are maintained and, if enabled, the change is recorded in this database's
+// changefeed under this transaction's ID.
+func (tx *Tx) ApplyChange(c Change) error {
+	if tx == nil || tx.closed {
+		return ErrTxClosed
+	}
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	if c.Op == ChangeMoveBucket {
+		return tx.applyMove(c)
+	}
+	if len(c.Bucket) == 0 {
+		switch c.Op {
+		case ChangeCreateBucket:
+			_, err := tx.CreateBucket(c.Key)
+			return err
+		case ChangeDeleteBucket:
+			return tx.DeleteBucket(c.Key)
+		}
+		return fmt.Errorf("%w: %s without a bucket", errInvalidChange, c.Op)
+	}
+	b := tx.bucketAt(c.Bucket)
+	if b == nil {
+		return ErrBucketNotFound
+	}
+	switch c.Op {
+	case ChangePut:
+		return b.Put(c.Key, c.Value)
+	case ChangeDelete:
+		return b.Delete(c.Key)
+	case ChangeCreateBucket:
+		_, err := b.CreateBucket(c.Key)
+		return err
+	case ChangeDeleteBucket:
+		return b.DeleteBucket(c.Key)
+	case ChangeSequence:
+		return b.setSequence(c.Sequence)
+	}
+	return fmt.Errorf("%w: unknown op %d", errInvalidChange, c.Op)
+}
+
+// applyMove applies a ChangeMoveBucket.
+func (tx *Tx) applyMove(c Change) error {
+	if len(c.To) == 0 {
+		return fmt.Errorf("%w: %s without a destination", errInvalidChange, c.Op)
+	}
+	var src, dst *Bucket
+	if len(c.Bucket) > 0 {
+		if src = tx.bucketAt(c.Bucket); src == nil {
+			return ErrBucketNotFound
+		}
+	}
+	if parent := c.To[:len(c.To)-1]; len(parent) > 0 {
+		if dst = tx.bucketAt(parent); dst == nil {
+			return ErrBucketNotFound
+		}
+	}
+	return tx.moveBucket(src, c.Key, dst, c.To[len(c.To)-1])
+}
+
+// bucketAt opens the bucket at path, or returns nil if there is none.
+func (tx *Tx) bucketAt(path [][]byte) *Bucket {
+	b := tx.Bucket(path[0])
+	for _, name := range path[1:] {
+		b = b.Bucket(name)
+	}
+	return b
+}
+
+// AppliedTxID returns the transaction ID last stored with SetAppliedTxID, or
+// zero if none has been.
+func (tx *Tx) AppliedTxID() uint64 {
+	v := tx.bucket([]byte(replicaBucket)).Get(appliedKey)
+	if len(v) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+// SetAppliedTxID records that the changes of another database up to and
+// including transaction id have been applied. Storing it in the transaction
+// that applies them keeps the position and the data consistent across
+// crashes.
+func (tx *Tx) SetAppliedTxID(id uint64) error {
+	if tx == nil || tx.closed {
+		return ErrTxClosed
+	}
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	b := tx.bucket([]byte(replicaBucket))
+	if b == nil {
+		var err error
+		if b, err = tx.createTopLevel([]byte(replicaBucket)); err != nil {
+			return err
+		}
+	}
+	tx.untrackedWrite()
+	var v [8]byte
+	binary.BigEndian.PutUint64(v[:], id)
+	return b.Put(appliedKey, v[:])
+}
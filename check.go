@@ -0,0 +1,277 @@
+package leafdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Check verifies the integrity of the latest committed state and returns
+// every problem found, or nil if the database is consistent. It walks all
+// reachable pages, verifying page types, checksums and key order, and
+// accounts for every page in the file as either reachable or free, reporting
+// pages that are referenced twice, out of range, or leaked. Pages of blob
+// chains that writes dropped are not leaked; they wait for the blob
+// collector, see DB.CollectBlobs.
+//
+// Check holds the writer lock while it runs, so writers wait for it; readers
+// are not blocked.
+func (db *DB) Check() []error {
+	if db == nil {
+		return []error{ErrDatabaseClosed}
+	}
+	db.lockWriter()
+	defer db.mu.Unlock()
+	if db.mapping == nil {
+		return []error{ErrDatabaseClosed}
+	}
+	return db.check()
+}
+
+// check runs the checks of Check. Callers must hold the writer lock.
+func (db *DB) check() []error {
+	meta := db.snapshotMeta()
+	mgr := newTxPageManager(db, true, meta)
+	c := &checker{
+		store:    checksumStore{mgr},
+		nextPage: meta.nextPage,
+		owner:    make(map[uint64]string),
+	}
+	chain, err := db.freelistPageIDs()
+	if err != nil {
+		c.errorf("freelist chain: %w", err)
+	}
+	c.claimPages(meta, chain, db.pendingIDs())
+	for id := uint64(metaPage1 + 1); id < c.nextPage; id++ {
+		if _, ok := c.owner[id]; !ok && !c.isBlob(id) {
+			c.errorf("page %d: neither reachable nor free", id)
+		}
+	}
+	return c.errs
+}
+
+// RebuildFreelist replaces the list of free pages with every page that the
+// latest commit does not reach, found by walking its trees as Check does.
+// It repairs pages that are neither reachable nor free, such as those
+// leaked by a bug or lost with a damaged freelist, and drops free pages
+// that are still in use, and returns the number of free pages. A walk that
+// finds the trees damaged could miss pages in use, so RebuildFreelist then
+// changes nothing and returns an error wrapping ErrInconsistent with the
+// problems found. Pages of older snapshots would be freed too, so it fails
+// with ErrTxOpen while read transactions are open.
+func (db *DB) RebuildFreelist() (int, error) {
+	tx, err := db.begin(context.Background(), true)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if _, ok := db.minReadTxID(); ok {
+		return 0, ErrTxOpen
+	}
+	// The rebuilt freelist holds every page the tree leaves out, so the
+	// meta page a crash falls back to must hold the same tree.
+	if db.unwritten != nil {
+		if err := db.sync(); err != nil {
+			return 0, err
+		}
+	}
+	m := tx.mgr
+	c := &checker{
+		store:    checksumStore{m},
+		nextPage: m.nextPage,
+		owner:    make(map[uint64]string),
+	}
+	c.checkTree(m.root, "root bucket index", nil, nil, true)
+	if len(c.errs) > 0 {
+		return 0, fmt.Errorf("%w: %w", ErrInconsistent, errors.Join(c.errs...))
+	}
+	m.freelist = m.freelist[:0]
+	for id := uint64(metaPage1 + 1); id < m.nextPage; id++ {
+		if _, ok := c.owner[id]; !ok {
+			m.freelist = append(m.freelist, id)
+		}
+	}
+	m.rebuiltFreelist = true
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(db.snapshotMeta().freelist), nil
+}
+
+// claimPages checks the tree of m and claims its free pages: those of the
+// freelist, of the freelist chain and the pending ones.
+func (c *checker) claimPages(m meta, chain, pending []uint64) {
+	c.checkTree(m.root, "root bucket index", nil, nil, true)
+	for _, id := range chain {
+		c.claim(id, "freelist chain")
+	}
+	for _, id := range m.freelist {
+		c.claim(id, "freelist")
+	}
+	for _, id := range pending {
+		c.claim(id, "pending free")
+	}
+}
+
+// pendingIDs returns the pages freed by commits that readers may still see.
+// Callers must hold the writer lock.
+func (db *DB) pendingIDs() []uint64 {
+	pending := make([]uint64, 0, len(db.pending))
+	for _, p := range db.pending {
+		pending = append(pending, p.id)
+	}
+	return pending
+}
+
+// checksumStore verifies node checksums regardless of the DB options.
+type checksumStore struct {
+	pageStore
+}
+
+func (checksumStore) VerifyChecksums() bool {
+	return true
+}
+
+type checker struct {
+	store    pageStore
+	nextPage uint64
+	// owner records what first referenced each page.
+	owner map[uint64]string
+	errs  []error
+}
+
+func (c *checker) errorf(format string, args ...any) {
+	c.errs = append(c.errs, fmt.Errorf(format, args...))
+}
+
+// claim records that what references page id and reports whether the page
+// is valid to read: in range and not already claimed.
+func (c *checker) claim(id uint64, what string) bool {
+	if id <= metaPage1 || id >= c.nextPage {
+		c.errorf("page %d: referenced by %s but out of range", id, what)
+		return false
+	}
+	if prev, ok := c.owner[id]; ok {
+		c.errorf("page %d: referenced by %s and by %s", id, what, prev)
+		return false
+	}
+	c.owner[id] = what
+	return true
+}
+
+// isBlob reports whether page id belongs to a blob chain.
+func (c *checker) isBlob(id uint64) bool {
+	buf, err := c.store.ReadPage(id)
+	return err == nil && len(buf) >= c.store.PageSize() && buf[0] == pageBlob
+}
+
+// checkTree checks the subtree at pageID, whose keys must fall within
+// [lo, hi) where a nil bound is open. For bucket index trees, the buckets
+// the leaves point to are checked as well.
+func (c *checker) checkTree(pageID uint64, what string, lo, hi []byte, buckets bool) uint64 {
+	if pageID == 0 {
+		return 0
+	}
+	if !c.claim(pageID, what) {
+		return unknownCount
+	}
+	n, err := readNode(c.store, pageID)
+	if err != nil {
+		c.errorf("page %d (%s): %w", pageID, what, err)
+		return unknownCount
+	}
+	for i, key := range n.keys {
+		if i > 0 && bytes.Compare(n.keys[i-1], key) >= 0 {
+			c.errorf("page %d (%s): keys out of order at index %d", pageID, what, i)
+		}
+		if (lo != nil && bytes.Compare(key, lo) < 0) || (hi != nil && bytes.Compare(key, hi) >= 0) {
+			c.errorf("page %d (%s): key %q outside the range of its parent", pageID, what, key)
+		}
+	}
+	if !n.isLeaf {
+		if len(n.children) != len(n.keys)+1 {
+			c.errorf("page %d (%s): %d children for %d keys", pageID, what, len(n.children), len(n.keys))
+			return unknownCount
+		}
+		for i, child := range n.children {
+			childLo, childHi := lo, hi
+			if i > 0 {
+				childLo = n.keys[i-1]
+			}
+			if i < len(n.keys) {
+				childHi = n.keys[i]
+			}
+			count := c.checkTree(child, what, childLo, childHi, buckets)
+			if want := n.counts[i]; want != unknownCount && count != unknownCount && count != want {
+				c.errorf("page %d (%s): count %d for child %d, which holds %d pairs", pageID, what, want, child, count)
+			}
+		}
+		return n.count()
+	}
+	for i, id := range n.overflow {
+		if id != 0 {
+			c.checkOverflow(id, fmt.Sprintf("%s value %q", what, n.keys[i]))
+		}
+	}
+	if buckets {
+		for i, val := range n.values {
+			c.checkBucket(decodePageID(val), fmt.Sprintf("bucket %q", n.keys[i]))
+		}
+	}
+	return n.count()
+}
+
+func (c *checker) checkBucket(headerID uint64, what string) {
+	if !c.claim(headerID, what+" header") {
+		return
+	}
+	h, err := readBucketHeader(c.store, headerID)
+	if err != nil {
+		c.errorf("page %d (%s header): %w", headerID, what, err)
+		return
+	}
+	c.checkTree(h.kvRoot, what, nil, nil, false)
+	c.checkTree(h.bucketRoot, what+" bucket index", nil, nil, true)
+	c.checkFilter(h.filter, what+" filter")
+}
+
+// checkFilter claims the directory and block pages of a Bloom filter.
+func (c *checker) checkFilter(pageID uint64, what string) {
+	if pageID == 0 || !c.claim(pageID, what) {
+		return
+	}
+	dir, err := readFilterPage(c.store, pageID, pageFilter)
+	if err != nil {
+		c.errorf("page %d (%s): %w", pageID, what, err)
+		return
+	}
+	for _, id := range filterBlocks(dir) {
+		if !c.claim(id, what+" block") {
+			continue
+		}
+		if _, err := readFilterPage(c.store, id, pageFilterBlock); err != nil {
+			c.errorf("page %d (%s block): %w", id, what, err)
+		}
+	}
+}
+
+// checkOverflow claims the pages of an overflow chain.
+func (c *checker) checkOverflow(pageID uint64, what string) {
+	for pageID != 0 {
+		if !c.claim(pageID, what) {
+			return
+		}
+		buf, err := c.store.ReadPage(pageID)
+		if err != nil {
+			c.errorf("page %d (%s): %w", pageID, what, err)
+			return
+		}
+		if len(buf) < c.store.PageSize() || !isChainPage(buf[0]) {
+			c.errorf("page %d (%s): not an overflow page", pageID, what)
+			return
+		}
+		pageID = binary.LittleEndian.Uint64(buf[1:])
+	}
+}
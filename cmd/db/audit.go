@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"leafdb"
+)
+
+// runAudit prints the audit log, one tab-separated line per record: the
+// transaction ID, the commit time, the op, the bucket path, the key and the
+// value hash, or the new sequence for a sequence change.
+func runAudit(args []string) error {
+	flags := newFlags("audit", "[-since txid] [-bucket path] <file>")
+	since := flags.Uint64("since", 0, "only print the records of transactions after `txid`")
+	bucket := flags.String("bucket", "", "only print the records of the bucket at `path` and those inside it")
+	parseFlags(flags, args, 1, 1)
+	var prefix [][]byte
+	if *bucket != "" {
+		var err error
+		if prefix, err = parseBucketPath(*bucket); err != nil {
+			return err
+		}
+	}
+
+	db, err := openDB(flags.Arg(0), false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	it, err := db.Audit(*since)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	for it.Next() {
+		r := it.Record()
+		if !hasPathPrefix(r.Bucket, prefix) {
+			continue
+		}
+		last := hex.EncodeToString(r.ValueHash)
+		if r.Op == leafdb.ChangeSequence {
+			last = fmt.Sprint(r.Sequence)
+		}
+		if _, err := fmt.Fprintf(out, "%d\t%s\t%s\t%s\t%s\t%s\n", r.TxID, r.Time.UTC().Format(time.RFC3339Nano),
+			r.Op, formatBucketPath(r.Bucket), encodeName(r.Key), last); err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
+
+// formatBucketPath reverses parseBucketPath.
+func formatBucketPath(path [][]byte) string {
+	names := make([]string, len(path))
+	for i, name := range path {
+		names[i] = encodeName(name)
+	}
+	return strings.Join(names, "/")
+}
+
+// hasPathPrefix reports whether path is prefix or a path inside it.
+func hasPathPrefix(path, prefix [][]byte) bool {
+	if len(path) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		if !bytes.Equal(path[i], prefix[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"leafdb"
+)
+
+// runBackup writes a copy of a database with Tx.WriteTo, signed with the
+// key in -key-file if given, for restore to verify.
+func runBackup(args []string) error {
+	flags := newFlags("backup", "[-key-file f] <file> <backup>")
+	keyFile := flags.String("key-file", "", "sign the backup with the key read from `f`")
+	parseFlags(flags, args, 2, 2)
+	key, err := readKeyFile(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB(flags.Arg(0), false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	out, err := os.OpenFile(flags.Arg(1), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	err = db.Read(func(tx *leafdb.Tx) error {
+		var w io.Writer = out
+		var s *leafdb.SignedWriter
+		if key != nil {
+			if s, err = leafdb.NewSignedWriter(out, key); err != nil {
+				return err
+			}
+			w = s
+		}
+		if _, err := tx.WriteTo(w); err != nil {
+			return err
+		}
+		if s != nil {
+			return s.Close()
+		}
+		return nil
+	})
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(flags.Arg(1))
+	}
+	return err
+}
+
+// readKeyFile returns the contents of the key file at path, used as they are,
+// or nil if path is empty.
+func readKeyFile(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("key file: %w", err)
+	}
+	return key, nil
+}
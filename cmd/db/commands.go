@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"leafdb"
+	"leafdb/recover"
+)
+
+func runGet(args []string) error {
+	flags := newFlags("get", "[-n] <file> <bucket> <key>")
+	noNewline := flags.Bool("n", false, "do not print a trailing newline")
+	parseFlags(flags, args, 3, 3)
+	path, err := parseBucketPath(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	key := []byte(flags.Arg(2))
+
+	db, err := openDB(flags.Arg(0), false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var value []byte
+	err = db.Read(func(tx *leafdb.Tx) error {
+		b := bucketAt(tx, path)
+		if b == nil {
+			return fmt.Errorf("bucket %s: %w", flags.Arg(1), errNotFound)
+		}
+		value = b.Get(key)
+		if value == nil {
+			return fmt.Errorf("key %q: %w", key, errNotFound)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	os.Stdout.Write(value)
+	if !*noNewline {
+		fmt.Println()
+	}
+	return nil
+}
+
+func runSet(args []string) error {
+	flags := newFlags("set", "<file> <bucket> <key> [value]")
+	parseFlags(flags, args, 3, 4)
+	path, err := parseBucketPath(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	key := []byte(flags.Arg(2))
+	value := []byte(flags.Arg(3))
+	if flags.NArg() == 3 {
+		if value, err = io.ReadAll(os.Stdin); err != nil {
+			return err
+		}
+	}
+
+	db, err := openDB(flags.Arg(0), true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Write(func(tx *leafdb.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(path[0])
+		for _, name := range path[1:] {
+			if err != nil {
+				return err
+			}
+			b, err = b.CreateBucketIfNotExists(name)
+		}
+		if err != nil {
+			return err
+		}
+		return b.Put(key, value)
+	})
+}
+
+func runDel(args []string) error {
+	flags := newFlags("del", "<file> <bucket> <key>")
+	parseFlags(flags, args, 3, 3)
+	path, err := parseBucketPath(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	key := []byte(flags.Arg(2))
+
+	db, err := openDB(flags.Arg(0), false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Write(func(tx *leafdb.Tx) error {
+		b := bucketAt(tx, path)
+		if b == nil {
+			return fmt.Errorf("bucket %s: %w", flags.Arg(1), errNotFound)
+		}
+		if b.Get(key) == nil {
+			return fmt.Errorf("key %q: %w", key, errNotFound)
+		}
+		return b.Delete(key)
+	})
+}
+
+func runBuckets(args []string) error {
+	flags := newFlags("buckets", "<file> [bucket]")
+	parseFlags(flags, args, 1, 2)
+	var path [][]byte
+	if flags.NArg() == 2 {
+		var err error
+		if path, err = parseBucketPath(flags.Arg(1)); err != nil {
+			return err
+		}
+	}
+
+	db, err := openDB(flags.Arg(0), false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	return db.Read(func(tx *leafdb.Tx) error {
+		list := func(name []byte, _ *leafdb.Bucket) error {
+			_, err := fmt.Fprintln(out, encodeName(name))
+			return err
+		}
+		if path == nil {
+			return tx.ForEachBucket(list)
+		}
+		b := bucketAt(tx, path)
+		if b == nil {
+			return fmt.Errorf("bucket %s: %w", flags.Arg(1), errNotFound)
+		}
+		return b.ForEachBucket(list)
+	})
+}
+
+func runKeys(args []string) error {
+	flags := newFlags("keys", "[-prefix p] [-values] <file> <bucket>")
+	prefix := flags.String("prefix", "", "only list keys starting with `p`")
+	values := flags.Bool("values", false, "print each value after its key, separated by a tab")
+	parseFlags(flags, args, 2, 2)
+	path, err := parseBucketPath(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB(flags.Arg(0), false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	return db.Read(func(tx *leafdb.Tx) error {
+		b := bucketAt(tx, path)
+		if b == nil {
+			return fmt.Errorf("bucket %s: %w", flags.Arg(1), errNotFound)
+		}
+		c := b.Cursor()
+		p := []byte(*prefix)
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			out.Write(k)
+			if *values {
+				out.WriteByte('\t')
+				out.Write(v)
+			}
+			if err := out.WriteByte('\n'); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func runCheck(args []string) error {
+	flags := newFlags("check", "<file>")
+	parseFlags(flags, args, 1, 1)
+
+	db, err := openDB(flags.Arg(0), false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	errs := db.Check()
+	for _, err := range errs {
+		fmt.Println(err)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d problems found", len(errs))
+	}
+	fmt.Println("ok")
+	return nil
+}
+
+func runSalvage(args []string) error {
+	flags := newFlags("salvage", "<file> <new file>")
+	parseFlags(flags, args, 2, 2)
+
+	report, err := recover.Salvage(flags.Arg(0), flags.Arg(1), nil)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("scanned %d pages, %d unreadable\n", report.Pages, report.Unreadable)
+	fmt.Printf("wrote %d buckets and %d pairs from %d leaves\n", report.Buckets, report.Pairs, report.Leaves)
+	if report.LostPairs > 0 {
+		fmt.Printf("%d pairs from %d leaves of unknown buckets are in %s\n", report.LostPairs, report.Orphans, recover.LostAndFound)
+	}
+	return nil
+}
+
+func runStats(args []string) error {
+	flags := newFlags("stats", "[-histogram] <file> [bucket]")
+	histogram := flags.Bool("histogram", false, "print key size, value size and leaf fill histograms")
+	parseFlags(flags, args, 1, 2)
+	var path [][]byte
+	if flags.NArg() == 2 {
+		var err error
+		if path, err = parseBucketPath(flags.Arg(1)); err != nil {
+			return err
+		}
+	}
+
+	db, err := openDB(flags.Arg(0), false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Read(func(tx *leafdb.Tx) error {
+		var s leafdb.BucketStats
+		var sizes leafdb.SizeStats
+		if path == nil {
+			st := db.Stats()
+			fmt.Printf("pages        %d (%d free, %d pending)\n", st.PageCount, st.FreePages, st.PendingPages)
+			err := tx.ForEachBucket(func(_ []byte, b *leafdb.Bucket) error {
+				bs, err := b.Stats()
+				addBucketStats(&s, bs)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			if *histogram {
+				if sizes, err = tx.SizeStats(); err != nil {
+					return err
+				}
+			}
+		} else {
+			b := bucketAt(tx, path)
+			if b == nil {
+				return fmt.Errorf("bucket %s: %w", flags.Arg(1), errNotFound)
+			}
+			var err error
+			if s, err = b.Stats(); err != nil {
+				return err
+			}
+			if *histogram {
+				if sizes, err = b.SizeStats(); err != nil {
+					return err
+				}
+			}
+		}
+		fmt.Printf("buckets      %d\n", s.BucketN)
+		fmt.Printf("keys         %d\n", s.KeyN)
+		fmt.Printf("depth        %d\n", s.Depth)
+		fmt.Printf("branch       %d pages (%s full)\n", s.BranchPages, percent(s.BranchInuse, s.BranchAlloc))
+		fmt.Printf("leaf         %d pages (%s full)\n", s.LeafPages, percent(s.LeafInuse, s.LeafAlloc))
+		fmt.Printf("overflow     %d pages\n", s.OverflowPages)
+		if s.FilterPages != 0 {
+			fmt.Printf("filter       %d pages\n", s.FilterPages)
+		}
+		if *histogram {
+			printHistogram("key size", "bytes", sizes.KeySize)
+			printHistogram("value size", "bytes", sizes.ValueSize)
+			printHistogram("leaf fill", "%", sizes.LeafFill)
+		}
+		return nil
+	})
+}
+
+func addBucketStats(s *leafdb.BucketStats, o leafdb.BucketStats) {
+	s.BucketN += o.BucketN
+	s.KeyN += o.KeyN
+	s.Depth = max(s.Depth, o.Depth)
+	s.BranchPages += o.BranchPages
+	s.LeafPages += o.LeafPages
+	s.OverflowPages += o.OverflowPages
+	s.FilterPages += o.FilterPages
+	s.BranchInuse += o.BranchInuse
+	s.BranchAlloc += o.BranchAlloc
+	s.LeafInuse += o.LeafInuse
+	s.LeafAlloc += o.LeafAlloc
+}
+
+func percent(n, total int) string {
+	if total == 0 {
+		return "0%"
+	}
+	return fmt.Sprintf("%.1f%%", float64(n)*100/float64(total))
+}
+
+// printHistogram prints the buckets of h from the first to the last that is
+// not empty, with a bar scaled to the largest.
+func printHistogram(name, unit string, h leafdb.SizeHistogram) {
+	fmt.Printf("\n%s: %d, mean %.1f %s\n", name, h.Count, h.Mean(), unit)
+	first, last := -1, -1
+	var most uint64
+	for i, n := range h.Counts {
+		if n == 0 {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		last = i
+		most = max(most, n)
+	}
+	for i := first; i >= 0 && i <= last; i++ {
+		bound := "> " + strconv.Itoa(h.Bounds[len(h.Bounds)-1])
+		if i < len(h.Bounds) {
+			bound = "<= " + strconv.Itoa(h.Bounds[i])
+		}
+		line := fmt.Sprintf("  %-10s %10d %s", bound, h.Counts[i], strings.Repeat("#", int((h.Counts[i]*40+most-1)/most)))
+		fmt.Println(strings.TrimRight(line, " "))
+	}
+}
+
+func runPage(args []string) error {
+	flags := newFlags("page", "<file> <page id>")
+	parseFlags(flags, args, 2, 2)
+	id, err := strconv.ParseUint(flags.Arg(1), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid page id %q", flags.Arg(1))
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	info, err := leafdb.InspectPage(f, st.Size(), id, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("page %d: %s\n", info.ID, info.Type)
+	switch info.Type {
+	case "meta":
+		fmt.Printf("magic %q, txid %d, root %d, next page %d, freelist page %d, encrypted %t\n",
+			info.Magic, info.TxID, info.Root, info.NextPage, info.FreelistPage, info.Encrypted)
+		fmt.Printf("%d free pages inline: %v\n", len(info.Free), info.Free)
+	case "leaf", "branch":
+		checksum := "none"
+		if info.Checksum {
+			checksum = "ok"
+			if !info.ChecksumOK {
+				checksum = "MISMATCH"
+			}
+		}
+		slots := ""
+		if info.Slots {
+			slots = ", slot directory"
+		}
+		fmt.Printf("%d keys, next %d, checksum %s%s\n", info.Count, info.Next, checksum, slots)
+		for i, e := range info.Entries {
+			if e.Overflow != 0 {
+				fmt.Printf("  %d: %q = %d bytes at overflow page %d\n", i, e.Key, e.Length, e.Overflow)
+				continue
+			}
+			fmt.Printf("  %d: %q = %s\n", i, e.Key, abbrev(e.Value))
+		}
+		for i, child := range info.Children {
+			var count string
+			if i < len(info.Counts) {
+				count = fmt.Sprintf(", %d pairs", info.Counts[i])
+			}
+			if i == 0 {
+				fmt.Printf("  child %d%s\n", child, count)
+				continue
+			}
+			fmt.Printf("  %q child %d%s\n", info.Keys[i-1], child, count)
+		}
+	case "bucket":
+		fmt.Printf("key/value root %d, bucket index root %d, sequence %d\n", info.KVRoot, info.BucketRoot, info.Sequence)
+		if info.Quota != 0 {
+			fmt.Printf("quota %d bytes, %d used\n", info.Quota, info.QuotaUsed)
+		}
+		if fill := info.BucketOptions.FillPercent; fill != 0 {
+			fmt.Printf("fill percent %g\n", fill)
+		}
+		if blob := info.BucketOptions.BlobThreshold; blob != 0 {
+			fmt.Printf("blob threshold %d bytes\n", blob)
+		}
+		if name := info.BucketOptions.Validator; name != "" {
+			fmt.Printf("validator %q\n", name)
+		}
+		if bits := info.BucketOptions.BloomBitsPerKey; bits != 0 {
+			fmt.Printf("bloom filter %d bits per key, directory %d\n", bits, info.Filter)
+		}
+		if name := info.BucketOptions.Comparator; name != "" {
+			fmt.Printf("comparator %q\n", name)
+		}
+		if name := info.BucketOptions.Codec; name != "" {
+			fmt.Printf("codec %q\n", name)
+		}
+		if ttl := info.BucketOptions.TTL; ttl != 0 {
+			fmt.Printf("TTL %v\n", ttl)
+		}
+	case "filter":
+		fmt.Printf("%d blocks: %v\n", info.Count, info.Children)
+	case "freelist":
+		fmt.Printf("%d ids, next %d: %v\n", len(info.Free), info.Next, info.Free)
+	case "overflow", "blob":
+		fmt.Printf("next %d\n", info.Next)
+	}
+	if info.Err != nil {
+		fmt.Printf("error: %v\n", info.Err)
+	}
+	fmt.Println()
+	// Pages are mostly padding, so the zeros at the end are left out.
+	end := len(info.Data)
+	for end > 0 && info.Data[end-1] == 0 {
+		end--
+	}
+	end = min((end+15)/16*16, len(info.Data))
+	fmt.Print(hex.Dump(info.Data[:end]))
+	if end < len(info.Data) {
+		fmt.Printf("%08x  %d zero bytes\n", end, len(info.Data)-end)
+	}
+	return nil
+}
+
+// abbrev quotes v, cutting it short after 64 bytes.
+func abbrev(v []byte) string {
+	if len(v) <= 64 {
+		return strconv.Quote(string(v))
+	}
+	return fmt.Sprintf("%q... (%d bytes)", v[:64], len(v))
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"unicode/utf8"
+
+	"leafdb"
+	"leafdb/boltimport"
+)
+
+// dumpFile is the JSON form of a whole database.
+type dumpFile struct {
+	Buckets []dumpBucket `json:"buckets"`
+}
+
+type dumpBucket struct {
+	Name    dumpBytes    `json:"name"`
+	Keys    []dumpPair   `json:"keys,omitempty"`
+	Buckets []dumpBucket `json:"buckets,omitempty"`
+}
+
+type dumpPair struct {
+	Key   dumpBytes `json:"key"`
+	Value dumpBytes `json:"value"`
+}
+
+// dumpBytes marshals as a JSON string when it holds valid UTF-8 and as
+// {"base64": "..."} otherwise, so dumps stay readable without losing
+// binary data.
+type dumpBytes []byte
+
+func (b dumpBytes) MarshalJSON() ([]byte, error) {
+	if utf8.Valid(b) {
+		return json.Marshal(string(b))
+	}
+	return json.Marshal(struct {
+		Base64 string `json:"base64"`
+	}{base64.StdEncoding.EncodeToString(b)})
+}
+
+func (b *dumpBytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*b = dumpBytes(s)
+		return nil
+	}
+	var enc struct {
+		Base64 *string `json:"base64"`
+	}
+	if err := json.Unmarshal(data, &enc); err != nil {
+		return err
+	}
+	if enc.Base64 == nil {
+		return errors.New(`expected a string or {"base64": ...}`)
+	}
+	raw, err := base64.StdEncoding.DecodeString(*enc.Base64)
+	if err != nil {
+		return err
+	}
+	*b = raw
+	return nil
+}
+
+func runDump(args []string) error {
+	flags := newFlags("dump", "<file>")
+	parseFlags(flags, args, 1, 1)
+
+	db, err := openDB(flags.Arg(0), false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var dump dumpFile
+	err = db.Read(func(tx *leafdb.Tx) error {
+		return tx.ForEachBucket(func(name []byte, b *leafdb.Bucket) error {
+			d, err := dumpBucketTree(name, b)
+			dump.Buckets = append(dump.Buckets, d)
+			return err
+		})
+	})
+	if err != nil {
+		return err
+	}
+	out := bufio.NewWriter(os.Stdout)
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(dump); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+func dumpBucketTree(name []byte, b *leafdb.Bucket) (dumpBucket, error) {
+	d := dumpBucket{Name: name}
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		d.Keys = append(d.Keys, dumpPair{Key: k, Value: v})
+	}
+	err := b.ForEachBucket(func(name []byte, child *leafdb.Bucket) error {
+		cd, err := dumpBucketTree(name, child)
+		d.Buckets = append(d.Buckets, cd)
+		return err
+	})
+	return d, err
+}
+
+func runLoad(args []string) error {
+	flags := newFlags("load", "<file>")
+	parseFlags(flags, args, 1, 1)
+
+	var dump dumpFile
+	dec := json.NewDecoder(bufio.NewReader(os.Stdin))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&dump); err != nil {
+		return err
+	}
+
+	db, err := openDB(flags.Arg(0), true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Write(func(tx *leafdb.Tx) error {
+		for _, d := range dump.Buckets {
+			b, err := tx.CreateBucketIfNotExists(d.Name)
+			if err != nil {
+				return err
+			}
+			if err := loadBucketTree(b, d); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// loadBucketTree writes the keys and nested buckets of d into b, merging
+// with anything already there.
+func loadBucketTree(b *leafdb.Bucket, d dumpBucket) error {
+	for _, kv := range d.Keys {
+		if err := b.Put(kv.Key, kv.Value); err != nil {
+			return err
+		}
+	}
+	for _, cd := range d.Buckets {
+		child, err := b.CreateBucketIfNotExists(cd.Name)
+		if err != nil {
+			return err
+		}
+		if err := loadBucketTree(child, cd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runExport(args []string) error {
+	flags := newFlags("export", "[-key-file f] <file>")
+	keyFile := flags.String("key-file", "", "sign the stream with the key read from `f`")
+	parseFlags(flags, args, 1, 1)
+	key, err := readKeyFile(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB(flags.Arg(0), false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if key != nil {
+		return db.ExportSigned(os.Stdout, key)
+	}
+	return db.Export(os.Stdout)
+}
+
+func runImport(args []string) error {
+	flags := newFlags("import", "[-key-file f] <file>")
+	keyFile := flags.String("key-file", "", "verify the stream with the key read from `f` and import nothing unless it matches")
+	parseFlags(flags, args, 1, 1)
+	key, err := readKeyFile(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB(flags.Arg(0), true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if key != nil {
+		return db.ImportSigned(os.Stdin, key)
+	}
+	return db.Import(os.Stdin)
+}
+
+func runBolt(args []string) error {
+	flags := newFlags("bolt", "<bolt file> <file>")
+	parseFlags(flags, args, 2, 2)
+
+	db, err := openDB(flags.Arg(1), true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	stats, err := boltimport.ImportFile(db, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %d buckets and %d keys\n", stats.Buckets, stats.Keys)
+	return nil
+}
@@ -1,53 +1,138 @@
+// Command db inspects and edits leafdb database files.
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"os"
+	"strings"
 
 	"leafdb"
 )
 
-func main() {
-	db, err := leafdb.Open("example.db")
-	if err != nil {
-		log.Fatalf("open failed: %v", err)
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []command{
+	{"get", "print the value of a key", runGet},
+	{"set", "set a key, read from stdin if no value is given", runSet},
+	{"del", "delete a key", runDel},
+	{"buckets", "list buckets at the top level or inside a bucket", runBuckets},
+	{"keys", "list the keys of a bucket", runKeys},
+	{"dump", "write every bucket and key as JSON to stdout", runDump},
+	{"load", "read buckets and keys as JSON from stdin", runLoad},
+	{"export", "write every bucket and key as a binary stream to stdout", runExport},
+	{"import", "read a stream written by export from stdin", runImport},
+	{"bolt", "copy the buckets and keys of a bbolt file into a database", runBolt},
+	{"check", "verify the integrity of a database file", runCheck},
+	{"stats", "print page usage and, with -histogram, size distributions", runStats},
+	{"page", "print the decoded contents and a hex dump of a page", runPage},
+	{"backup", "write a copy of a database, signed with -key-file", runBackup},
+	{"restore", "replay a changefeed onto a backup up to a transaction", runRestore},
+	{"audit", "print the audit log of committed changes", runAudit},
+	{"salvage", "copy what is readable of a damaged file to a new one", runSalvage},
+	{"mount", "serve the database as a FUSE file system", runMount},
+	{"serve", "serve the database over gRPC", runServe},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: db <command> [arguments]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", c.name, c.summary)
 	}
-	defer db.Close()
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, `Bucket paths separate nested buckets with "/"; use %2F for a "/" in a name.`)
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Exit status is 0 on success, 1 on errors, 2 on usage errors and 3 if a")
+	fmt.Fprintln(os.Stderr, "key or bucket is not found.")
+}
 
-	if err := db.Write(func(tx *leafdb.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists([]byte("config"))
-		if err != nil {
-			return err
-		}
-		if err := bucket.Put([]byte("name"), []byte("leaf")); err != nil {
-			return err
+// Exit statuses other than 0 for success.
+const (
+	exitError    = 1
+	exitUsage    = 2
+	exitNotFound = 3
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(exitUsage)
+	}
+	name := os.Args[1]
+	if name == "help" || name == "-h" || name == "-help" || name == "--help" {
+		usage()
+		return
+	}
+	for _, c := range commands {
+		if c.name != name {
+			continue
 		}
-		if err := bucket.Put([]byte("version"), []byte("1")); err != nil {
-			return err
+		if err := c.run(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "db %s: %v\n", name, err)
+			if errors.Is(err, errNotFound) {
+				os.Exit(exitNotFound)
+			}
+			os.Exit(exitError)
 		}
-		child, err := bucket.CreateBucketIfNotExists([]byte("nested"))
-		if err != nil {
-			return err
-		}
-		return child.Put([]byte("feature"), []byte("bptree"))
-	}); err != nil {
-		log.Fatalf("update failed: %v", err)
+		return
 	}
+	fmt.Fprintf(os.Stderr, "db: unknown command %q\n", name)
+	usage()
+	os.Exit(exitUsage)
+}
 
-	if err := db.Read(func(tx *leafdb.Tx) error {
-		bucket := tx.Bucket([]byte("config"))
-		if bucket == nil {
-			return fmt.Errorf("missing bucket")
+// parseFlags parses args and exits with status 2 unless between min and max
+// positional arguments remain.
+func parseFlags(flags *flag.FlagSet, args []string, min, max int) {
+	flags.Parse(args)
+	if flags.NArg() < min || flags.NArg() > max {
+		flags.Usage()
+		os.Exit(exitUsage)
+	}
+}
+
+func newFlags(name, args string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: db %s %s\n", name, args)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// openDB opens an existing database file. Unlike leafdb.Open it does not
+// create a missing file unless create is set.
+func openDB(path string, create bool) (*leafdb.DB, error) {
+	if !create {
+		if _, err := os.Stat(path); err != nil {
+			return nil, err
 		}
-		val := bucket.Get([]byte("name"))
-		fmt.Printf("name=%s\n", val)
+	}
+	return leafdb.Open(path)
+}
 
-		cursor := bucket.Cursor()
-		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
-			fmt.Printf("%s=%s\n", k, v)
+var errNotFound = errors.New("not found")
+
+// parseBucketPath splits a "/"-separated bucket path into percent-decoded
+// names.
+func parseBucketPath(s string) ([][]byte, error) {
+	var path [][]byte
+	for _, part := range strings.Split(s, "/") {
+		name, err := decodeName(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket path %q: %v", s, err)
+		}
+		if len(name) == 0 {
+			return nil, fmt.Errorf("invalid bucket path %q: empty bucket name", s)
 		}
-		return nil
-	}); err != nil {
-		log.Fatalf("view failed: %v", err)
+		path = append(path, name)
 	}
+	return path, nil
 }
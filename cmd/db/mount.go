@@ -0,0 +1,465 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"leafdb"
+)
+
+// runMount serves the database as a FUSE file system until it is unmounted
+// or the process is interrupted. Buckets appear as directories and keys as
+// files.
+func runMount(args []string) error {
+	flags := newFlags("mount", "[-rw] <file> <dir>")
+	writable := flags.Bool("rw", false, "allow writes through the mount")
+	parseFlags(flags, args, 2, 2)
+	path, dir := flags.Arg(0), flags.Arg(1)
+
+	db, err := leafdb.Open(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	mountOpts := fuse.MountOptions{FsName: path, Name: "leafdb", DirectMount: true}
+	if !*writable {
+		mountOpts.Options = append(mountOpts.Options, "ro")
+	}
+	root := &bucketDir{db: db, writable: *writable}
+	server, err := fusefs.Mount(dir, root, &fusefs.Options{MountOptions: mountOpts})
+	if err != nil {
+		return err
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		_ = server.Unmount()
+	}()
+	server.Wait()
+	return nil
+}
+
+// bucketDir is a directory node for the root bucket directory (empty path)
+// or a bucket reached through path.
+type bucketDir struct {
+	fusefs.Inode
+	db       *leafdb.DB
+	path     [][]byte
+	writable bool
+}
+
+// keyFile is a file node for a single key in a bucket.
+type keyFile struct {
+	fusefs.Inode
+	dir *bucketDir
+	key []byte
+}
+
+// keyHandle is a keyFile opened for writing. Writes and truncations through
+// it change a copy of the value, which is committed in one write
+// transaction when the handle is flushed, synced or released, so that a
+// file written in many chunks is not rewritten and synced for each.
+type keyHandle struct {
+	file *keyFile
+
+	mu sync.Mutex
+	// value is the value as changed through the handle, or nil until the
+	// handle changes it; dirty is set while the change is not committed.
+	value []byte
+	dirty bool
+}
+
+var (
+	_ fusefs.NodeReaddirer = (*bucketDir)(nil)
+	_ fusefs.NodeLookuper  = (*bucketDir)(nil)
+	_ fusefs.NodeMkdirer   = (*bucketDir)(nil)
+	_ fusefs.NodeRmdirer   = (*bucketDir)(nil)
+	_ fusefs.NodeCreater   = (*bucketDir)(nil)
+	_ fusefs.NodeUnlinker  = (*bucketDir)(nil)
+	_ fusefs.NodeGetattrer = (*keyFile)(nil)
+	_ fusefs.NodeOpener    = (*keyFile)(nil)
+	_ fusefs.NodeReader    = (*keyFile)(nil)
+	_ fusefs.NodeWriter    = (*keyFile)(nil)
+	_ fusefs.NodeSetattrer = (*keyFile)(nil)
+	_ fusefs.FileFlusher   = (*keyHandle)(nil)
+	_ fusefs.FileFsyncer   = (*keyHandle)(nil)
+	_ fusefs.FileReleaser  = (*keyHandle)(nil)
+)
+
+func (d *bucketDir) Readdir(ctx context.Context) (fusefs.DirStream, syscall.Errno) {
+	var entries []fuse.DirEntry
+	err := d.db.Read(func(tx *leafdb.Tx) error {
+		addDir := func(name []byte, _ *leafdb.Bucket) error {
+			if fileName := encodeName(name); fileName != "" {
+				entries = append(entries, fuse.DirEntry{Name: fileName, Mode: fuse.S_IFDIR})
+			}
+			return nil
+		}
+		if len(d.path) == 0 {
+			return tx.ForEachBucket(addDir)
+		}
+		b := bucketAt(tx, d.path)
+		if b == nil {
+			return leafdb.ErrBucketNotFound
+		}
+		if err := b.ForEachBucket(addDir); err != nil {
+			return err
+		}
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if fileName := encodeName(k); fileName != "" {
+				entries = append(entries, fuse.DirEntry{Name: fileName, Mode: fuse.S_IFREG})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	return fusefs.NewListDirStream(entries), 0
+}
+
+func (d *bucketDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	key, err := decodeName(name)
+	if err != nil {
+		return nil, syscall.ENOENT
+	}
+	var (
+		isDir bool
+		size  int
+		found bool
+	)
+	err = d.db.Read(func(tx *leafdb.Tx) error {
+		if len(d.path) == 0 {
+			isDir = tx.Bucket(key) != nil
+			found = isDir
+			return nil
+		}
+		b := bucketAt(tx, d.path)
+		if b == nil {
+			return nil
+		}
+		if b.Bucket(key) != nil {
+			isDir, found = true, true
+			return nil
+		}
+		if val := b.Get(key); val != nil {
+			size, found = len(val), true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	if !found {
+		return nil, syscall.ENOENT
+	}
+	if isDir {
+		d.fillDirAttr(&out.Attr)
+		return d.NewInode(ctx, d.child(key), fusefs.StableAttr{Mode: fuse.S_IFDIR}), 0
+	}
+	d.fillFileAttr(&out.Attr, size)
+	return d.NewInode(ctx, &keyFile{dir: d, key: key}, fusefs.StableAttr{Mode: fuse.S_IFREG}), 0
+}
+
+func (d *bucketDir) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	if !d.writable {
+		return nil, syscall.EROFS
+	}
+	key, err := decodeName(name)
+	if err != nil {
+		return nil, syscall.EINVAL
+	}
+	err = d.db.Write(func(tx *leafdb.Tx) error {
+		if len(d.path) == 0 {
+			_, err := tx.CreateBucket(key)
+			return err
+		}
+		b := bucketAt(tx, d.path)
+		if b == nil {
+			return leafdb.ErrBucketNotFound
+		}
+		_, err := b.CreateBucket(key)
+		return err
+	})
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	d.fillDirAttr(&out.Attr)
+	return d.NewInode(ctx, d.child(key), fusefs.StableAttr{Mode: fuse.S_IFDIR}), 0
+}
+
+func (d *bucketDir) Rmdir(ctx context.Context, name string) syscall.Errno {
+	if !d.writable {
+		return syscall.EROFS
+	}
+	key, err := decodeName(name)
+	if err != nil {
+		return syscall.ENOENT
+	}
+	return toErrno(d.db.Write(func(tx *leafdb.Tx) error {
+		if len(d.path) == 0 {
+			return tx.DeleteBucket(key)
+		}
+		b := bucketAt(tx, d.path)
+		if b == nil {
+			return leafdb.ErrBucketNotFound
+		}
+		return b.DeleteBucket(key)
+	}))
+}
+
+func (d *bucketDir) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fusefs.Inode, fusefs.FileHandle, uint32, syscall.Errno) {
+	if !d.writable {
+		return nil, nil, 0, syscall.EROFS
+	}
+	if len(d.path) == 0 {
+		// The root directory only holds buckets.
+		return nil, nil, 0, syscall.EPERM
+	}
+	key, err := decodeName(name)
+	if err != nil {
+		return nil, nil, 0, syscall.EINVAL
+	}
+	err = d.db.Write(func(tx *leafdb.Tx) error {
+		b := bucketAt(tx, d.path)
+		if b == nil {
+			return leafdb.ErrBucketNotFound
+		}
+		if b.Get(key) != nil {
+			return nil
+		}
+		return b.Put(key, []byte{})
+	})
+	if err != nil {
+		return nil, nil, 0, toErrno(err)
+	}
+	d.fillFileAttr(&out.Attr, 0)
+	file := &keyFile{dir: d, key: key}
+	node := d.NewInode(ctx, file, fusefs.StableAttr{Mode: fuse.S_IFREG})
+	return node, &keyHandle{file: file}, fuse.FOPEN_DIRECT_IO, 0
+}
+
+func (d *bucketDir) Unlink(ctx context.Context, name string) syscall.Errno {
+	if !d.writable {
+		return syscall.EROFS
+	}
+	key, err := decodeName(name)
+	if err != nil {
+		return syscall.ENOENT
+	}
+	return toErrno(d.db.Write(func(tx *leafdb.Tx) error {
+		b := bucketAt(tx, d.path)
+		if b == nil {
+			return leafdb.ErrBucketNotFound
+		}
+		return b.Delete(key)
+	}))
+}
+
+func (d *bucketDir) child(name []byte) *bucketDir {
+	path := make([][]byte, 0, len(d.path)+1)
+	path = append(path, d.path...)
+	path = append(path, name)
+	return &bucketDir{db: d.db, path: path, writable: d.writable}
+}
+
+func (d *bucketDir) fillDirAttr(attr *fuse.Attr) {
+	attr.Mode = fuse.S_IFDIR | 0o555
+	if d.writable {
+		attr.Mode |= 0o200
+	}
+}
+
+func (d *bucketDir) fillFileAttr(attr *fuse.Attr, size int) {
+	attr.Mode = fuse.S_IFREG | 0o444
+	if d.writable {
+		attr.Mode |= 0o200
+	}
+	attr.Size = uint64(size)
+}
+
+func (f *keyFile) Getattr(ctx context.Context, fh fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	val, errno := f.current(fh)
+	if errno != 0 {
+		return errno
+	}
+	f.dir.fillFileAttr(&out.Attr, len(val))
+	return 0
+}
+
+func (f *keyFile) Open(ctx context.Context, flags uint32) (fusefs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC) == 0 {
+		return nil, fuse.FOPEN_DIRECT_IO, 0
+	}
+	if !f.dir.writable {
+		return nil, 0, syscall.EROFS
+	}
+	return &keyHandle{file: f}, fuse.FOPEN_DIRECT_IO, 0
+}
+
+func (f *keyFile) Read(ctx context.Context, fh fusefs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	val, errno := f.current(fh)
+	if errno != 0 {
+		return nil, errno
+	}
+	if off >= int64(len(val)) {
+		return fuse.ReadResultData(nil), 0
+	}
+	end := off + int64(len(dest))
+	if end > int64(len(val)) {
+		end = int64(len(val))
+	}
+	return fuse.ReadResultData(val[off:end]), 0
+}
+
+func (f *keyFile) Write(ctx context.Context, fh fusefs.FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
+	h, ok := fh.(*keyHandle)
+	if !f.dir.writable || !ok {
+		return 0, syscall.EROFS
+	}
+	errno := h.change(func(val []byte) []byte {
+		if end := off + int64(len(data)); end > int64(len(val)) {
+			val = append(val, make([]byte, end-int64(len(val)))...)
+		}
+		copy(val[off:], data)
+		return val
+	})
+	if errno != 0 {
+		return 0, errno
+	}
+	return uint32(len(data)), 0
+}
+
+func (f *keyFile) Setattr(ctx context.Context, fh fusefs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if size, ok := in.GetSize(); ok {
+		if !f.dir.writable {
+			return syscall.EROFS
+		}
+		resize := func(val []byte) []byte {
+			if int(size) <= len(val) {
+				return val[:size]
+			}
+			return append(val, make([]byte, int(size)-len(val))...)
+		}
+		if h, ok := fh.(*keyHandle); ok {
+			if errno := h.change(resize); errno != 0 {
+				return errno
+			}
+		} else if err := f.update(resize); err != nil {
+			return toErrno(err)
+		}
+	}
+	return f.Getattr(ctx, fh, out)
+}
+
+// current returns the value of the key as read through fh: as changed
+// through it if it is a keyHandle that changed it, and as committed
+// otherwise.
+func (f *keyFile) current(fh fusefs.FileHandle) ([]byte, syscall.Errno) {
+	if h, ok := fh.(*keyHandle); ok {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if h.value != nil {
+			return h.value, 0
+		}
+	}
+	return f.value()
+}
+
+func (f *keyFile) value() ([]byte, syscall.Errno) {
+	var val []byte
+	err := f.dir.db.Read(func(tx *leafdb.Tx) error {
+		if b := bucketAt(tx, f.dir.path); b != nil {
+			val = b.Get(f.key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	if val == nil {
+		return nil, syscall.ENOENT
+	}
+	return val, 0
+}
+
+func (f *keyFile) update(fn func(val []byte) []byte) error {
+	return f.dir.db.Write(func(tx *leafdb.Tx) error {
+		b := bucketAt(tx, f.dir.path)
+		if b == nil {
+			return leafdb.ErrBucketNotFound
+		}
+		return b.Put(f.key, fn(b.Get(f.key)))
+	})
+}
+
+// change applies fn to the value of h, loading the committed one first.
+func (h *keyHandle) change(fn func(val []byte) []byte) syscall.Errno {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.value == nil {
+		val, errno := h.file.value()
+		if errno != 0 && errno != syscall.ENOENT {
+			return errno
+		}
+		h.value = append([]byte{}, val...)
+	}
+	h.value = fn(h.value)
+	h.dirty = true
+	return 0
+}
+
+// commit writes the value as changed through h, if it was since the last
+// commit.
+func (h *keyHandle) commit() syscall.Errno {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.dirty {
+		return 0
+	}
+	if err := h.file.update(func([]byte) []byte { return h.value }); err != nil {
+		return toErrno(err)
+	}
+	h.dirty = false
+	return 0
+}
+
+func (h *keyHandle) Flush(ctx context.Context) syscall.Errno {
+	return h.commit()
+}
+
+func (h *keyHandle) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	return h.commit()
+}
+
+func (h *keyHandle) Release(ctx context.Context) syscall.Errno {
+	return h.commit()
+}
+
+func toErrno(err error) syscall.Errno {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, leafdb.ErrBucketNotFound):
+		return syscall.ENOENT
+	case errors.Is(err, leafdb.ErrBucketExists):
+		return syscall.EEXIST
+	case errors.Is(err, leafdb.ErrTxReadOnly):
+		return syscall.EROFS
+	default:
+		return syscall.EIO
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+func runMount(args []string) error {
+	return errors.New("mount is not supported on this platform")
+}
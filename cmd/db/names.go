@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"leafdb"
+)
+
+// bucketAt resolves a nested bucket path starting at the top level.
+func bucketAt(tx *leafdb.Tx, path [][]byte) *leafdb.Bucket {
+	if len(path) == 0 {
+		return nil
+	}
+	b := tx.Bucket(path[0])
+	for _, name := range path[1:] {
+		if b == nil {
+			return nil
+		}
+		b = b.Bucket(name)
+	}
+	return b
+}
+
+// encodeName turns a bucket name or key into a file name by percent-encoding
+// '%', '/', control bytes and, for names that are not valid UTF-8, every
+// byte outside ASCII. The names "." and ".." are encoded as well. Empty names
+// have no file name and encode to "".
+func encodeName(name []byte) string {
+	const hex = "0123456789ABCDEF"
+	switch string(name) {
+	case ".":
+		return "%2E"
+	case "..":
+		return "%2E%2E"
+	}
+	valid := utf8.Valid(name)
+	var sb strings.Builder
+	for _, c := range name {
+		if c == '%' || c == '/' || c < 0x20 || c == 0x7f || (c >= 0x80 && !valid) {
+			sb.WriteByte('%')
+			sb.WriteByte(hex[c>>4])
+			sb.WriteByte(hex[c&0xf])
+			continue
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String()
+}
+
+// decodeName reverses encodeName.
+func decodeName(name string) ([]byte, error) {
+	s, err := url.PathUnescape(name)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(s), nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"leafdb"
+)
+
+// runRestore recovers a database as of a past transaction: it copies a
+// backup and replays onto it the changefeed of the database the backup was
+// taken from, which serves as the archived log, up to -until-txid. With
+// -key-file the backup must be one signed by backup, and is verified as it
+// is copied.
+func runRestore(args []string) error {
+	flags := newFlags("restore", "[-until-txid N] [-key-file f] <backup> <log file> <new file>")
+	until := flags.Uint64("until-txid", math.MaxUint64, "replay the transactions up to and including `N`")
+	keyFile := flags.String("key-file", "", "verify the signed backup with the key read from `f`")
+	parseFlags(flags, args, 3, 3)
+	key, err := readKeyFile(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	if err := copyFile(flags.Arg(0), flags.Arg(2), key); err != nil {
+		return err
+	}
+	db, err := leafdb.Open(flags.Arg(2))
+	if err != nil {
+		os.Remove(flags.Arg(2))
+		return err
+	}
+	// A backup of a database that was itself restored or replicated records
+	// how far it got; a plain backup is as of its own transaction.
+	var base uint64
+	db.Read(func(tx *leafdb.Tx) error {
+		if base = tx.AppliedTxID(); base == 0 {
+			base = tx.ID()
+		}
+		return nil
+	})
+	if *until < base {
+		db.Close()
+		os.Remove(flags.Arg(2))
+		return fmt.Errorf("the backup is already at transaction %d", base)
+	}
+	defer db.Close()
+	log, err := openDB(flags.Arg(1), false)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+
+	it, err := log.Changes(base)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	var changes []leafdb.Change
+	applied, last := 0, base
+	apply := func() error {
+		if len(changes) == 0 {
+			return nil
+		}
+		txid := changes[0].TxID
+		err := db.Write(func(tx *leafdb.Tx) error {
+			for _, c := range changes {
+				if err := tx.ApplyChange(c); err != nil {
+					return err
+				}
+			}
+			return tx.SetAppliedTxID(txid)
+		})
+		if err != nil {
+			return fmt.Errorf("transaction %d: %v", txid, err)
+		}
+		changes = changes[:0]
+		applied, last = applied+1, txid
+		return nil
+	}
+	for it.Next() {
+		c := it.Change()
+		if c.TxID > *until {
+			break
+		}
+		if len(changes) > 0 && c.TxID != changes[0].TxID {
+			if err := apply(); err != nil {
+				return err
+			}
+		}
+		changes = append(changes, c)
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	if err := apply(); err != nil {
+		return err
+	}
+	fmt.Printf("replayed %d transactions onto the backup at %d, up to %d\n", applied, base, last)
+	return nil
+}
+
+// copyFile copies src to dst, which must not exist. If key is not nil, src
+// is a signed stream whose data is copied once verified; dst is removed if
+// it does not verify.
+func copyFile(src, dst string, key []byte) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	var r io.Reader = in
+	if key != nil {
+		if r, err = leafdb.NewVerifiedReader(in, key); err != nil {
+			return err
+		}
+	}
+	out, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, r)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"google.golang.org/grpc"
+
+	"leafdb"
+	"leafdb/rpc"
+)
+
+// runServe serves the database over gRPC until the process is interrupted,
+// then stops accepting calls and waits for those in flight.
+func runServe(args []string) error {
+	flags := newFlags("serve", "[-addr host:port] [-debug host:port] [-tx-timeout d] <file>")
+	addr := flags.String("addr", "localhost:7070", "listen on `host:port`")
+	txTimeout := flags.Duration("tx-timeout", rpc.DefaultTxTimeout, "roll back interactive transactions after `d`; 0 for no limit")
+	debug := flags.String("debug", "", "serve live statistics at /debug/leafdb and /debug/vars on `host:port`")
+	parseFlags(flags, args, 1, 1)
+
+	db, err := openDB(flags.Arg(0), true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	lis, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	server := grpc.NewServer()
+	srv := rpc.NewServer(db)
+	srv.TxTimeout = *txTimeout
+	rpc.RegisterLeafDBServer(server, srv)
+
+	if *debug != "" {
+		debugLis, err := net.Listen("tcp", *debug)
+		if err != nil {
+			lis.Close()
+			return err
+		}
+		defer debugLis.Close()
+		go http.Serve(debugLis, debugHandler(db))
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		server.GracefulStop()
+	}()
+	return server.Serve(lis)
+}
+
+// debugHandler serves the statistics of db as JSON at /debug/leafdb, and
+// the process's expvars, db's included, at /debug/vars.
+func debugHandler(db *leafdb.DB) http.Handler {
+	expvar.Publish("leafdb", db.StatsVar())
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/leafdb", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(db.Stats())
+	})
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
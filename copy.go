@@ -0,0 +1,82 @@
+package leafdb
+
+// CopyBucket copies the top-level bucket name as seen by src, with its
+// pairs, nested buckets, sequences, options and quotas, into dst under the
+// same name. src and dst may belong to different databases, encrypted or
+// not, so that a bucket can be moved between shards or archived; delete it
+// from src afterwards to move it. The pairs are streamed in key order from
+// src into FillFromSorted, bucket by bucket, so they are never all held in
+// memory.
+//
+// It fails with ErrBucketExists if dst already has a bucket name. The
+// reserved nested buckets of indexes and sorted sets are copied too, so an
+// index is whole in dst once declared there again; declared indexes and
+// hooks of dst are updated and called, and the changefeed of dst records
+// the writes, as for FillFromSorted. A validator named in the options of a
+// copied bucket must be registered in dst.
+func CopyBucket(src, dst *Tx, name []byte) error {
+	if src == nil || src.closed || dst == nil || dst.closed {
+		return ErrTxClosed
+	}
+	if !dst.writable {
+		return ErrTxReadOnly
+	}
+	from := src.Bucket(name)
+	if from == nil {
+		return ErrBucketNotFound
+	}
+	to, err := dst.CreateBucket(name)
+	if err != nil {
+		return err
+	}
+	return copyBucket(from, to)
+}
+
+// copyBucket copies the pairs, nested buckets, sequence, options and quota
+// of from into the empty bucket to.
+func copyBucket(from, to *Bucket) error {
+	if from.options != (BucketOptions{}) {
+		if err := to.SetOptions(from.options); err != nil {
+			return err
+		}
+	}
+	if err := to.FillFromSorted(from.All(), 0); err != nil {
+		return err
+	}
+	if from.sequence != 0 {
+		if err := to.setSequence(from.sequence); err != nil {
+			return err
+		}
+	}
+	if from.quota != 0 {
+		to.tx.notReplayable()
+		// from has a quota, so it keeps its size: the size of to.
+		to.quota, to.size = from.quota, from.size
+		if err := to.persistHeader(); err != nil {
+			return err
+		}
+	}
+
+	root := from.bucketRoot
+	c := &Cursor{tree: newBPTree(&root, from.tx.mgr)}
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		child, err := from.openChild(k, decodePageID(v))
+		if err != nil {
+			return err
+		}
+		var copied *Bucket
+		if isReservedName(k) {
+			to.tx.notReplayable()
+			copied, err = to.createChild(k)
+		} else {
+			copied, err = to.CreateBucket(k)
+		}
+		if err != nil {
+			return err
+		}
+		if err := copyBucket(child, copied); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package leafdb
+
+import (
+	"errors"
+	"fmt"
+)
+
+// errPageBeyondEnd is returned for reads of pages past the end of the file,
+// or of the pages in use, which only a corrupted page points to.
+var errPageBeyondEnd = errors.New("leafdb: page beyond end of file")
+
+// CorruptionError reports a page whose contents cannot be decoded. Page
+// decoders check every length, count and offset they read against the page
+// and return a CorruptionError rather than read past it, whatever the page
+// holds. It matches ErrCorrupted with errors.Is, as well as Err if set.
+type CorruptionError struct {
+	// PageID is the page that failed to decode.
+	PageID uint64
+	// Offset is the position in the page of the field found to be wrong.
+	Offset int
+	// Reason says what is wrong, such as "corrupted key length".
+	Reason string
+	// Err is a more specific error the problem also matches, such as
+	// ErrChecksumMismatch, or nil.
+	Err error
+
+	// located is set once PageID is known.
+	located bool
+}
+
+func (e *CorruptionError) Error() string {
+	if !e.located {
+		return fmt.Sprintf("leafdb: %s at offset %d", e.Reason, e.Offset)
+	}
+	return fmt.Sprintf("leafdb: page %d: %s at offset %d", e.PageID, e.Reason, e.Offset)
+}
+
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrCorrupted
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return e.Err
+}
+
+// corrupted returns a CorruptionError for the field at off of the page being
+// decoded. Decoders that are given a page rather than its ID leave it to
+// their caller to set the ID with atPage.
+func corrupted(off int, reason string) *CorruptionError {
+	return &CorruptionError{Offset: off, Reason: reason}
+}
+
+// atPage sets id as the page of the CorruptionError in err, unless it has
+// one already, as when it comes from another page the decoder read, and
+// returns err.
+func atPage(err error, id uint64) error {
+	var ce *CorruptionError
+	if errors.As(err, &ce) && !ce.located {
+		ce.PageID, ce.located = id, true
+	}
+	return err
+}
+
+// checksumMismatch returns the CorruptionError of a node page whose
+// checksum does not match.
+func checksumMismatch() *CorruptionError {
+	return &CorruptionError{Offset: 13, Reason: "checksum mismatch", Err: ErrChecksumMismatch}
+}
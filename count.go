@@ -0,0 +1,210 @@
+package leafdb
+
+import (
+	"encoding/binary"
+	"math/rand/v2"
+)
+
+// countSamples is the number of descents EstimatedCount averages.
+const countSamples = 32
+
+// Count returns the number of pairs of b, not counting nested buckets. It
+// adds up the counts the root page keeps of the pairs below its children.
+// Below branches that keep none, see Rank, it reads the key count in the
+// header of each leaf instead of decoding the leaf, so it takes time linear
+// in the number of leaves rather than in the number and size of the pairs.
+func (b *Bucket) Count() (int, error) {
+	if b == nil || b.tx == nil || b.tx.closed {
+		return 0, ErrTxClosed
+	}
+	b.trackScan()
+	return countTree(b.tx.mgr, b.kvRoot)
+}
+
+// EstimatedCount returns an estimate of the number of pairs of b, not
+// counting nested buckets, from a few random descents of its tree. Each
+// descent multiplies the number of children of the branches it passes by
+// the number of keys of the leaf it ends in, which estimates the count
+// without bias; the estimate is their mean. It reads a few pages per
+// descent whatever the size of b, and is exact if the tree is a single
+// leaf or its pages are evenly filled. If the root page keeps the counts of
+// its children, see Rank, their sum is returned instead.
+func (b *Bucket) EstimatedCount() (int, error) {
+	if b == nil || b.tx == nil || b.tx.closed {
+		return 0, ErrTxClosed
+	}
+	b.trackScan()
+	if b.kvRoot == 0 {
+		return 0, nil
+	}
+	store := b.tx.mgr
+	var total float64
+	for range countSamples {
+		estimate := 1.0
+		id := b.kvRoot
+		for {
+			n, keys, err := readCountPage(store, id)
+			if err != nil {
+				return 0, err
+			}
+			if n == nil {
+				if id == b.kvRoot {
+					return keys, nil
+				}
+				estimate *= float64(keys)
+				break
+			}
+			if count := n.count(); id == b.kvRoot && count != unknownCount {
+				return int(count), nil
+			}
+			estimate *= float64(len(n.children))
+			id = n.children[rand.IntN(len(n.children))]
+		}
+		total += estimate
+	}
+	return int(total/countSamples + 0.5), nil
+}
+
+// Rank returns the number of keys of b before key, whether or not key is in
+// b, not counting nested buckets. It descends the tree once, adding up the
+// counts branch pages keep of the pairs below their children, so it reads a
+// page per level. Below branches written by versions that did not keep
+// counts, and not rewritten since, it counts the keys of the leaves.
+func (b *Bucket) Rank(key []byte) (int, error) {
+	if b == nil || b.tx == nil || b.tx.closed {
+		return 0, ErrTxClosed
+	}
+	b.trackScan()
+	if b.kvRoot == 0 {
+		return 0, nil
+	}
+	store := b.tx.mgr
+	rank := 0
+	id := b.kvRoot
+	for {
+		n, err := readNodeKeys(store, id)
+		if err != nil {
+			return 0, err
+		}
+		if n.isLeaf {
+			idx, _ := findKeyIndex(n.keys, key)
+			return rank + idx, nil
+		}
+		idx := findChildIndex(n.keys, key)
+		for i := range idx {
+			count, err := childCount(store, n, i)
+			if err != nil {
+				return 0, err
+			}
+			rank += count
+		}
+		id = n.children[idx]
+	}
+}
+
+// Nth returns the pair of b at position i in key order, counting from zero,
+// not counting nested buckets, or nil if i is not in [0, Count). Like Rank,
+// it descends the tree once. With Options.NoCopyReads the value is valid
+// only for the life of the transaction, as with Get.
+func (b *Bucket) Nth(i int) (key, value []byte, err error) {
+	if b == nil || b.tx == nil || b.tx.closed {
+		return nil, nil, ErrTxClosed
+	}
+	b.trackScan()
+	if b.kvRoot == 0 || i < 0 {
+		return nil, nil, nil
+	}
+	store := b.tx.mgr
+	id := b.kvRoot
+	for {
+		n, err := readNodeKeys(store, id)
+		if err != nil {
+			return nil, nil, err
+		}
+		if n.isLeaf {
+			if i >= len(n.keys) {
+				return nil, nil, nil
+			}
+			key = n.keys[i]
+			break
+		}
+		child := 0
+		for ; child < len(n.children)-1; child++ {
+			count, err := childCount(store, n, child)
+			if err != nil {
+				return nil, nil, err
+			}
+			if i < count {
+				break
+			}
+			i -= count
+		}
+		id = n.children[child]
+	}
+	value, ok, err := b.readTree().get(key)
+	if err != nil || !ok {
+		return nil, nil, err
+	}
+	return key, value, nil
+}
+
+// childCount returns the number of pairs below the ith child of branch n,
+// counting them if n does not know it.
+func childCount(store pageStore, n *node, i int) (int, error) {
+	if count := n.counts[i]; count != unknownCount {
+		return int(count), nil
+	}
+	return countTree(store, n.children[i])
+}
+
+// countTree returns the number of pairs of the tree at id.
+func countTree(store pageStore, id uint64) (int, error) {
+	if id == 0 {
+		return 0, nil
+	}
+	n, keys, err := readCountPage(store, id)
+	if err != nil || n == nil {
+		return keys, err
+	}
+	count := 0
+	for i := range n.children {
+		keys, err := childCount(store, n, i)
+		if err != nil {
+			return 0, err
+		}
+		count += keys
+	}
+	return count, nil
+}
+
+// readCountPage returns the key count of leaf page id, read from its
+// header, or the node of branch page id.
+func readCountPage(store pageStore, id uint64) (*node, int, error) {
+	if cache, ok := store.(nodeCache); ok {
+		if n := cache.cachedNode(id); n != nil {
+			if n.isLeaf {
+				return nil, len(n.keys), nil
+			}
+			return n, 0, nil
+		}
+	}
+	buf, err := store.ReadPage(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(buf) < store.PageSize() || len(buf) < nodeHeaderSize {
+		return nil, 0, atPage(corrupted(len(buf), "short page"), id)
+	}
+	if buf[0] != pageLeaf {
+		n, err := readNode(store, id)
+		return n, 0, err
+	}
+	flags := binary.LittleEndian.Uint16(buf[11:])
+	if flags&^nodeFlagsLeaf != 0 {
+		return nil, 0, atPage(corrupted(11, "unsupported node page flags"), id)
+	}
+	if flags&nodeFlagChecksum != 0 && store.VerifyChecksums() && binary.LittleEndian.Uint32(buf[13:]) != nodeChecksum(buf) {
+		return nil, 0, atPage(checksumMismatch(), id)
+	}
+	return nil, int(binary.LittleEndian.Uint16(buf[1:])), nil
+}
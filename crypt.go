@@ -0,0 +1,110 @@
+package leafdb
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	// saltSize is the size of the KDF salt stored in the meta pages of an
+	// encrypted file.
+	saltSize = 16
+	// minKeySize is the shortest Options.EncryptionKey accepted.
+	minKeySize = 16
+	// pageOverhead is how much larger than pageSize a page is on disk when
+	// the file is encrypted: the GCM tag followed by the nonce.
+	pageOverhead = 16 + 12
+	// kdfInfo binds derived keys to their use.
+	kdfInfo = "leafdb page encryption"
+)
+
+var errKeyTooShort = errors.New("leafdb: encryption key too short")
+
+// pageCipher encrypts and authenticates pages with AES-256-GCM under a key
+// derived from Options.EncryptionKey and the file's salt. Every page is
+// sealed with a fresh random nonce and its page ID as additional data, so a
+// page copied to another position fails to open.
+type pageCipher struct {
+	aead cipher.AEAD
+	salt []byte
+}
+
+// newPageCipher derives the page key from key and salt.
+func newPageCipher(key, salt []byte) (*pageCipher, error) {
+	if len(key) < minKeySize {
+		return nil, errKeyTooShort
+	}
+	derived, err := hkdf.Key(sha256.New, key, salt, kdfInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(derived)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &pageCipher{aead: aead, salt: append([]byte(nil), salt...)}, nil
+}
+
+// newSalt returns a random salt for a new encrypted file.
+func newSalt() []byte {
+	salt := make([]byte, saltSize)
+	rand.Read(salt)
+	return salt
+}
+
+// seal encrypts page into dst, which must be pageOverhead bytes longer.
+func (c *pageCipher) seal(dst []byte, id uint64, page []byte) {
+	n := len(page)
+	nonce := dst[n+c.aead.Overhead():]
+	rand.Read(nonce)
+	var ad [8]byte
+	binary.LittleEndian.PutUint64(ad[:], id)
+	c.aead.Seal(dst[:0], nonce, page, ad[:])
+}
+
+// open decrypts the page sealed under id into a new buffer.
+func (c *pageCipher) open(id uint64, sealed []byte) ([]byte, error) {
+	if len(sealed) < pageOverhead {
+		return nil, ErrAuthFailed
+	}
+	n := len(sealed) - pageOverhead
+	nonce := sealed[n+c.aead.Overhead():]
+	var ad [8]byte
+	binary.LittleEndian.PutUint64(ad[:], id)
+	page, err := c.aead.Open(make([]byte, 0, n), nonce, sealed[:n+c.aead.Overhead()], ad[:])
+	if err != nil {
+		return nil, ErrAuthFailed
+	}
+	return page, nil
+}
+
+// signMeta authenticates the first size bytes of a meta page, which stay in
+// the clear so the salt can be read before the key is derived, and stores
+// the tag and nonce after them.
+func (c *pageCipher) signMeta(page []byte, size int) {
+	tag := page[size : size+c.aead.Overhead()]
+	nonce := page[size+c.aead.Overhead() : size+pageOverhead]
+	rand.Read(nonce)
+	c.aead.Seal(tag[:0], nonce, nil, page[:size])
+}
+
+// verifyMeta reports whether a meta page signed by signMeta is intact and
+// was signed with this cipher's key.
+func (c *pageCipher) verifyMeta(page []byte, size int) bool {
+	if len(page) < size+pageOverhead {
+		return false
+	}
+	tag := page[size : size+c.aead.Overhead()]
+	nonce := page[size+c.aead.Overhead() : size+pageOverhead]
+	_, err := c.aead.Open(nil, nonce, tag, page[:size])
+	return err == nil
+}
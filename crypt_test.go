@@ -0,0 +1,117 @@
+package leafdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// cryptKey is the EncryptionKey of the tests.
+var cryptKey = bytes.Repeat([]byte{0x5a}, 32)
+
+// createEncrypted creates an encrypted database at path holding 200 pairs
+// in bucket b and returns the size of its pages in the file.
+func createEncrypted(t *testing.T, path string) int {
+	t.Helper()
+	db, err := OpenWithOptions(path, &Options{EncryptionKey: cryptKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Write(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("b"))
+		if err != nil {
+			return err
+		}
+		for i := range 200 {
+			if err := b.Put(fmt.Appendf(nil, "k%03d", i), fmt.Appendf(nil, "v%03d", i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := db.diskPageSize
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return size
+}
+
+func TestEncryptionWrongKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	createEncrypted(t, path)
+	if _, err := OpenWithOptions(path, &Options{EncryptionKey: bytes.Repeat([]byte{0xa5}, 32)}); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("open with the wrong key: %v, want ErrAuthFailed", err)
+	}
+	if _, err := Open(path); !errors.Is(err, ErrEncrypted) {
+		t.Fatalf("open without a key: %v, want ErrEncrypted", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("v123")) {
+		t.Fatal("value stored in the clear")
+	}
+}
+
+// TestEncryptionTamperedPage flips a byte of each page after the meta pages
+// in turn. Pages in use must then fail authentication, on Open or in Check,
+// and no read may return a value other than the one written.
+func TestEncryptionTamperedPage(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	pageSize := createEncrypted(t, path)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := 0
+	for id := 2; id < len(data)/pageSize; id++ {
+		tampered := bytes.Clone(data)
+		tampered[id*pageSize+pageSize/2] ^= 0x01
+		tpath := filepath.Join(dir, fmt.Sprintf("tampered%d.db", id))
+		if err := os.WriteFile(tpath, tampered, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		db, err := OpenWithOptions(tpath, &Options{EncryptionKey: cryptKey})
+		if err != nil {
+			if !errors.Is(err, ErrAuthFailed) {
+				t.Fatalf("page %d: open: %v, want ErrAuthFailed", id, err)
+			}
+			failed++
+			continue
+		}
+		// Pages under one that fails authentication are reported too, as
+		// neither reachable nor free.
+		if errs := db.Check(); len(errs) > 0 {
+			if !slices.ContainsFunc(errs, func(err error) bool { return errors.Is(err, ErrAuthFailed) }) {
+				t.Fatalf("page %d: check: %v, want ErrAuthFailed", id, errs)
+			}
+			failed++
+		}
+		err = db.Read(func(tx *Tx) error {
+			b := tx.Bucket([]byte("b"))
+			for i := range 200 {
+				want := fmt.Appendf(nil, "v%03d", i)
+				if v := b.Get(fmt.Appendf(nil, "k%03d", i)); v != nil && !bytes.Equal(v, want) {
+					return fmt.Errorf("read %q, want %q", v, want)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("page %d: %v", id, err)
+		}
+		db.Close()
+	}
+	if failed == 0 {
+		t.Fatal("no tampered page failed authentication")
+	}
+}
@@ -1,76 +1,234 @@
 package leafdb
 
+import (
+	"bytes"
+	"iter"
+)
+
 // Cursor iterates over keys in a bucket.
+//
+// The Key methods move like their counterparts but return only the key:
+// leaves they read are decoded without their values, so scans that only
+// need keys, such as existence checks and counts, neither copy values nor
+// read the chains of large ones. The two kinds of methods can be mixed; a
+// pair method on a leaf read by a Key method reads the leaf again.
 type Cursor struct {
 	tree  *bptree
 	stack []cursorFrame
 	leaf  *node
 	index int
+	// keysOnly makes the cursor read leaves without their values.
+	keysOnly bool
 }
 
 // First moves to the first key/value pair.
 func (c *Cursor) First() ([]byte, []byte) {
+	return c.pair(false, c.first)
+}
+
+// FirstKey moves to the first key and returns it.
+func (c *Cursor) FirstKey() []byte {
+	return c.key(c.first)
+}
+
+// Next moves to the next key/value pair.
+func (c *Cursor) Next() ([]byte, []byte) {
+	return c.pair(false, c.next)
+}
+
+// NextKey moves to the next key and returns it.
+func (c *Cursor) NextKey() []byte {
+	return c.key(c.next)
+}
+
+// Last moves to the last key/value pair.
+func (c *Cursor) Last() ([]byte, []byte) {
+	return c.pair(false, c.last)
+}
+
+// LastKey moves to the last key and returns it.
+func (c *Cursor) LastKey() []byte {
+	return c.key(c.last)
+}
+
+// Prev moves to the previous key/value pair.
+func (c *Cursor) Prev() ([]byte, []byte) {
+	return c.pair(false, c.prev)
+}
+
+// PrevKey moves to the previous key and returns it.
+func (c *Cursor) PrevKey() []byte {
+	return c.key(c.prev)
+}
+
+// Seek moves to the first key >= seek.
+func (c *Cursor) Seek(seek []byte) ([]byte, []byte) {
+	return c.pair(false, func() bool { return c.seek(seek) })
+}
+
+// SeekKey moves to the first key >= seek and returns it.
+func (c *Cursor) SeekKey(seek []byte) []byte {
+	return c.key(func() bool { return c.seek(seek) })
+}
+
+// Range returns an iterator over the pairs with start <= key < end in key
+// order, for use with range-over-func. A nil start begins at the first key
+// and a nil end scans to the last. Ranging moves c, starting over from start
+// each time.
+func (c *Cursor) Range(start, end []byte) iter.Seq2[[]byte, []byte] {
+	return func(yield func(key, value []byte) bool) {
+		k, v := c.First()
+		if start != nil {
+			k, v = c.Seek(start)
+		}
+		for ; k != nil; k, v = c.Next() {
+			if end != nil && bytes.Compare(k, end) >= 0 {
+				return
+			}
+			if !yield(k, v) {
+				return
+			}
+		}
+	}
+}
+
+// Keys is Range for the keys alone, moving c with the Key methods.
+func (c *Cursor) Keys(start, end []byte) iter.Seq[[]byte] {
+	return func(yield func(key []byte) bool) {
+		k := c.FirstKey()
+		if start != nil {
+			k = c.SeekKey(start)
+		}
+		for ; k != nil; k = c.NextKey() {
+			if end != nil && bytes.Compare(k, end) >= 0 {
+				return
+			}
+			if !yield(k) {
+				return
+			}
+		}
+	}
+}
+
+// pair runs move, which reports whether it found a key, with leaves read as
+// keysOnly says, and returns the pair it moved to.
+func (c *Cursor) pair(keysOnly bool, move func() bool) ([]byte, []byte) {
 	if c == nil || c.tree == nil {
 		return nil, nil
 	}
+	c.keysOnly = keysOnly
+	if !move() {
+		return nil, nil
+	}
+	if c.leaf.values == nil {
+		// The leaf was read by a Key method.
+		leaf, err := readNode(c.tree.store, c.leaf.pageID)
+		if err != nil {
+			c.leaf = nil
+			return nil, nil
+		}
+		c.leaf = leaf
+	}
+	return c.tree.result(c.leaf.keys[c.index]), c.tree.result(c.leaf.values[c.index])
+}
+
+// key runs move with leaves read without their values and returns the key
+// it moved to.
+func (c *Cursor) key(move func() bool) []byte {
+	if c == nil || c.tree == nil {
+		return nil
+	}
+	c.keysOnly = true
+	if !move() {
+		return nil
+	}
+	return c.tree.result(c.leaf.keys[c.index])
+}
+
+func (c *Cursor) first() bool {
 	c.stack = c.stack[:0]
 	leaf, err := c.descendLeft(*c.tree.root)
-	if err != nil || leaf == nil || len(leaf.keys) == 0 {
-		return nil, nil
+	if err != nil || leaf == nil {
+		return false
 	}
 	c.leaf = leaf
-	c.index = 0
-	return cloneBytes(leaf.keys[0]), cloneBytes(leaf.values[0])
+	c.index = -1
+	return c.next()
 }
 
-// Next moves to the next key/value pair.
-func (c *Cursor) Next() ([]byte, []byte) {
-	if c == nil || c.tree == nil || c.leaf == nil {
-		return nil, nil
+func (c *Cursor) next() bool {
+	if c.leaf == nil {
+		return false
 	}
 	c.index++
-	if c.index < len(c.leaf.keys) {
-		return cloneBytes(c.leaf.keys[c.index]), cloneBytes(c.leaf.values[c.index])
-	}
-
-	for c.leaf.next != 0 {
-		leaf, err := readNode(c.tree.store, c.leaf.next)
-		if err != nil || leaf == nil || !leaf.isLeaf {
-			return nil, nil
+	for c.index >= len(c.leaf.keys) {
+		leaf, err := c.nextLeaf()
+		if err != nil || leaf == nil {
+			c.leaf = nil
+			return false
 		}
 		c.leaf = leaf
 		c.index = 0
-		if len(leaf.keys) > 0 {
-			return cloneBytes(leaf.keys[0]), cloneBytes(leaf.values[0])
-		}
 	}
-	return nil, nil
+	return true
 }
 
-// Seek moves to the first key >= seek.
-func (c *Cursor) Seek(seek []byte) ([]byte, []byte) {
-	if c == nil || c.tree == nil {
-		return nil, nil
+func (c *Cursor) last() bool {
+	c.stack = c.stack[:0]
+	leaf, err := c.descendRight(*c.tree.root)
+	if err != nil || leaf == nil {
+		return false
 	}
+	c.leaf = leaf
+	c.index = len(leaf.keys)
+	return c.prev()
+}
+
+func (c *Cursor) prev() bool {
+	if c.leaf == nil {
+		return false
+	}
+	c.index--
+	for c.index < 0 {
+		leaf, err := c.prevLeaf()
+		if err != nil || leaf == nil {
+			c.leaf = nil
+			return false
+		}
+		c.leaf = leaf
+		c.index = len(leaf.keys) - 1
+	}
+	return true
+}
+
+func (c *Cursor) seek(seek []byte) bool {
 	c.stack = c.stack[:0]
 	leaf, idx, err := c.seekLeaf(*c.tree.root, seek)
 	if err != nil || leaf == nil {
-		return nil, nil
+		return false
 	}
+	c.leaf = leaf
 	if idx >= len(leaf.keys) {
-		c.leaf = leaf
 		c.index = len(leaf.keys) - 1
-		return c.Next()
+		return c.next()
 	}
-	c.leaf = leaf
 	c.index = idx
-	return cloneBytes(leaf.keys[idx]), cloneBytes(leaf.values[idx])
+	return true
+}
+
+// readNode reads page id for the cursor, without the values of a leaf in
+// keysOnly mode.
+func (c *Cursor) readNode(id uint64) (*node, error) {
+	if c.keysOnly {
+		return readNodeKeys(c.tree.store, id)
+	}
+	return readNode(c.tree.store, id)
 }
 
 func (c *Cursor) descendLeft(pageID uint64) (*node, error) {
 	current := pageID
 	for {
-		n, err := readNode(c.tree.store, current)
+		n, err := c.readNode(current)
 		if err != nil {
 			return nil, err
 		}
@@ -82,10 +240,55 @@ func (c *Cursor) descendLeft(pageID uint64) (*node, error) {
 	}
 }
 
+// nextLeaf climbs the branch stack to the nearest ancestor with an unvisited
+// child and descends to that child's leftmost leaf. Leaf next pointers are
+// not followed because copy-on-write leaves them pointing at stale pages.
+func (c *Cursor) nextLeaf() (*node, error) {
+	for len(c.stack) > 0 {
+		top := &c.stack[len(c.stack)-1]
+		if top.index+1 < len(top.node.children) {
+			top.index++
+			return c.descendLeft(top.node.children[top.index])
+		}
+		c.stack = c.stack[:len(c.stack)-1]
+	}
+	return nil, nil
+}
+
+func (c *Cursor) descendRight(pageID uint64) (*node, error) {
+	current := pageID
+	for {
+		n, err := c.readNode(current)
+		if err != nil {
+			return nil, err
+		}
+		if n.isLeaf {
+			return n, nil
+		}
+		last := len(n.children) - 1
+		c.stack = append(c.stack, cursorFrame{node: n, index: last})
+		current = n.children[last]
+	}
+}
+
+// prevLeaf is the mirror of nextLeaf: it climbs to the nearest ancestor with
+// an unvisited child on the left and descends to its rightmost leaf.
+func (c *Cursor) prevLeaf() (*node, error) {
+	for len(c.stack) > 0 {
+		top := &c.stack[len(c.stack)-1]
+		if top.index > 0 {
+			top.index--
+			return c.descendRight(top.node.children[top.index])
+		}
+		c.stack = c.stack[:len(c.stack)-1]
+	}
+	return nil, nil
+}
+
 func (c *Cursor) seekLeaf(pageID uint64, seek []byte) (*node, int, error) {
 	current := pageID
 	for {
-		n, err := readNode(c.tree.store, current)
+		n, err := c.readNode(current)
 		if err != nil {
 			return nil, 0, err
 		}
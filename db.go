@@ -1,33 +1,326 @@
 package leafdb
 
 import (
+	"context"
 	"errors"
 	"os"
+	"slices"
 	"sync"
-
-	"golang.org/x/sys/unix"
+	"sync/atomic"
+	"time"
 )
 
 var (
-	ErrTxClosed       = errors.New("leafdb: transaction closed")
-	ErrTxReadOnly     = errors.New("leafdb: read-only transaction")
-	ErrBucketExists   = errors.New("leafdb: bucket exists")
-	ErrBucketNotFound = errors.New("leafdb: bucket not found")
+	ErrTxClosed         = errors.New("leafdb: transaction closed")
+	ErrTxReadOnly       = errors.New("leafdb: read-only transaction")
+	ErrBucketExists     = errors.New("leafdb: bucket exists")
+	ErrBucketNotFound   = errors.New("leafdb: bucket not found")
+	ErrKeyNotFound      = errors.New("leafdb: key not found")
+	ErrInvalidToken     = errors.New("leafdb: invalid continuation token")
+	ErrTxConflict       = errors.New("leafdb: transaction conflict")
+	ErrKeyTooLarge      = errors.New("leafdb: key too large")
+	ErrChecksumMismatch = errors.New("leafdb: page checksum mismatch")
+	ErrDatabaseClosed   = errors.New("leafdb: database closed")
+	ErrIndexNotFound    = errors.New("leafdb: index not found")
+	ErrIndexNotDeclared = errors.New("leafdb: index not declared")
+	ErrUniqueViolation  = errors.New("leafdb: unique index violation")
+	ErrNoValidator      = errors.New("leafdb: validator not registered")
+	ErrReservedName     = errors.New("leafdb: reserved bucket name")
+	ErrEncrypted        = errors.New("leafdb: database is encrypted")
+	ErrNotEncrypted     = errors.New("leafdb: database is not encrypted")
+	ErrAuthFailed       = errors.New("leafdb: page authentication failed")
+	ErrTxOpen           = errors.New("leafdb: transactions still open")
+	ErrDatabaseReadOnly = errors.New("leafdb: database is read-only")
+	ErrInconsistent     = errors.New("leafdb: database is inconsistent")
+	ErrQuotaExceeded    = errors.New("leafdb: bucket quota exceeded")
+	ErrTxPrepared       = errors.New("leafdb: transaction prepared")
+	ErrCorrupted        = errors.New("leafdb: page corrupted")
+	ErrBadSignature     = errors.New("leafdb: backup signature invalid")
+	ErrChangesTruncated = errors.New("leafdb: changefeed truncated")
+	ErrNotImplemented   = errors.New("leafdb: bucket option not implemented")
 )
 
 // DB is a memory-mapped key/value store with B+ tree pages on disk.
 type DB struct {
-	file     *os.File
-	data     []byte
-	pageSize int
+	// file is an *os.File unless the database was opened with OpenFile,
+	// which uses no mapping.
+	file    File
+	mapping *mapping
+	// fileSize is the length of the file, which the mapping may exceed.
+	fileSize int64
+	// mmapFlags and mmapAdvice are passed to every mmap of the file.
+	mmapFlags  int
+	mmapAdvice int
+	// pageSize is the size of page contents; diskPageSize is the size of a
+	// page in the file, larger by pageOverhead when the file is encrypted.
+	pageSize     int
+	diskPageSize int
+	// cipher encrypts pages on their way to the file, or is nil.
+	cipher   *pageCipher
 	meta     meta
 	metaPage uint64
-	mu       sync.Mutex
-	metaMu   sync.RWMutex
-	mapMu    sync.RWMutex
-	readMu   sync.Mutex
-	readTxs  map[uint64]int
-	pending  []pendingFree
+	// mu is the writer lock.
+	mu      writerLock
+	metaMu  sync.RWMutex
+	mapMu   sync.Mutex
+	readMu  sync.Mutex
+	readTxs map[uint64]int
+	pending []pendingFree
+	stats   dbStats
+	// txs holds the open transactions. Once closing is set no more are
+	// begun, and txsIdle, if set, is closed when the last one ends.
+	txMu         sync.Mutex
+	txs          map[*Tx]struct{}
+	closing      bool
+	txsIdle      chan struct{}
+	closeTimeout time.Duration
+	// remapping is set while remap swaps mappings so begin can tell
+	// remap-induced stalls apart from ordinary contention.
+	remapping atomic.Bool
+	// verifyChecksums enables CRC32 verification of node pages on read.
+	verifyChecksums bool
+	// nodeCache holds decoded nodes of committed pages, or is nil.
+	nodeCache *nodeLRU
+	// remote is set for databases opened with OpenRemote or with
+	// Options.NoMmap, whose pages are read through it instead of a mapping.
+	remote *remoteStore
+	// readOnly refuses write transactions, for databases opened with
+	// OpenRemote.
+	readOnly bool
+
+	batchMu       sync.Mutex
+	batch         *batch
+	maxBatchSize  int
+	maxBatchDelay time.Duration
+
+	syncMode  SyncMode
+	syncEvery int
+	// unsynced counts commits since the file was last synced. It is only
+	// touched by the writer.
+	unsynced int
+	// syncedTxID is the ID of the last commit whose meta page was synced.
+	// With SyncEveryN, the commits after it write no meta page: unwritten
+	// holds the one of the last of them, which the next sync writes, and
+	// the pages they free are not reused before then, so that a crash
+	// finds the synced meta page and every page it refers to intact.
+	syncedTxID uint64
+	unwritten  *meta
+	// unpunched holds the pages made free since the file was last synced,
+	// whose space is punched once it is, see Options.PunchHoleSize.
+	unpunched []uint64
+	// syncInterval is the interval of the syncer, which syncs unsynced
+	// commits while it runs.
+	syncInterval time.Duration
+	// fullFsync syncs with fsync rather than fdatasync.
+	fullFsync bool
+
+	// changefeed enables recording mutations for DB.Changes.
+	changefeed bool
+	// audit enables the audit log read by DB.Audit.
+	audit bool
+	// optimisticWrites makes Begin start optimistic write transactions.
+	// optimisticTxs counts the open ones by the txid of their snapshot, and
+	// committed holds what commits since the oldest of them wrote.
+	optimisticWrites bool
+	optimisticMu     sync.Mutex
+	optimisticTxs    map[uint64]int
+	committed        []committedWrites
+	// strict runs Check after every commit.
+	strict bool
+	// punchPages is the shortest run of free pages whose space is punched
+	// out of the file, or zero.
+	punchPages int
+	// noCopyReads hands out keys and values without copying them.
+	noCopyReads bool
+	// releaseFree releases the memory of pages as they become free.
+	releaseFree bool
+
+	// collectInterval is the interval of the blob collector. blobsDropped
+	// counts the blob chains commits dropped since the last collection, and
+	// collectMu serializes collections.
+	collectInterval time.Duration
+	collectMu       sync.Mutex
+	blobsDropped    atomic.Uint64
+
+	// collector and syncer are the background goroutines, while they run.
+	workerMu  sync.Mutex
+	collector *worker
+	syncer    *worker
+
+	// indexes holds the declared indexes, keyed by indexKey.
+	indexMu sync.RWMutex
+	indexes map[string]declaredIndex
+
+	// hooks holds the hooks set with SetHook, by encodeBucketPath of their
+	// bucket and then by name.
+	hookMu sync.RWMutex
+	hooks  map[string]map[string]Hook
+
+	// validators holds the functions registered with RegisterValidator.
+	validatorMu sync.RWMutex
+	validators  map[string]ValidatorFunc
+}
+
+// SyncMode selects when commits are flushed to stable storage.
+type SyncMode int
+
+const (
+	// FullSync flushes the file on every commit. A commit that returns nil
+	// survives a crash.
+	FullSync SyncMode = iota
+	// SyncEveryN flushes the file on every Options.SyncEvery-th commit. The
+	// commits in between write their meta page only at the next flush, so
+	// a crash, of the process or of the system, loses the commits since the
+	// last flush but never corrupts the file.
+	SyncEveryN
+	// NoSync never flushes the file on commit and leaves write-back to the
+	// operating system. Commits survive a process crash but an operating
+	// system crash or power loss can lose or corrupt recent commits. Call
+	// DB.Sync to flush explicitly.
+	NoSync
+)
+
+// Options configures how a database is opened.
+type Options struct {
+	// VerifyChecksums checks the CRC32 of every node page as it is read and
+	// fails the read with ErrChecksumMismatch if the page is corrupt.
+	VerifyChecksums bool
+	// MaxBatchSize is the number of Batch calls that triggers a batch to
+	// run. Zero uses DefaultMaxBatchSize.
+	MaxBatchSize int
+	// MaxBatchDelay is how long a batch waits for more calls before it runs.
+	// Zero uses DefaultMaxBatchDelay.
+	MaxBatchDelay time.Duration
+	// Sync selects the durability policy for commits. The zero value is
+	// FullSync.
+	Sync SyncMode
+	// SyncEvery is the commit interval for SyncEveryN. Values below one are
+	// treated as one.
+	SyncEvery int
+	// SyncInterval bounds how long commits that Sync leaves unflushed stay
+	// so: a background goroutine flushes the file at this interval if
+	// commits were made since the last flush, and Close flushes the rest.
+	// Zero disables it. It has no effect with FullSync, whose commits are
+	// already flushed, or on databases held in memory. It bounds what a
+	// crash can lose, not how: with SyncEveryN a crash only loses the
+	// unflushed commits, while with NoSync it can still corrupt them, see
+	// NoSync.
+	SyncInterval time.Duration
+	// FullFsync makes syncs flush the file with fsync, which also writes
+	// metadata such as its modification time, instead of fdatasync, which
+	// only writes the metadata needed to read the data back. It only makes
+	// a difference on Linux; other systems always use fsync.
+	FullFsync bool
+	// Changefeed records every committed mutation in an internal log that
+	// DB.Changes reads. Transactions committed while it is off leave no
+	// record.
+	Changefeed bool
+	// Audit records, per commit, the commit time and the bucket, key and
+	// SHA-256 of the value of every change in an internal log that DB.Audit
+	// reads. Changes are the net ones of the transaction, as Tx.Pending
+	// reports them. Transactions committed while it is off leave no record.
+	Audit bool
+	// EncryptionKey encrypts and authenticates every page of the file with
+	// AES-256-GCM under a key derived from it and a random salt stored in
+	// the meta pages. It must be a random secret of at least 16 bytes, not a
+	// passphrase. A file created with a key can only be opened with it, and
+	// only files created with a key can be opened with one. Pages that fail
+	// authentication read as ErrAuthFailed.
+	EncryptionKey []byte
+	// InitialMmapSize is the minimum size of the memory map, in bytes. The
+	// map is only replaced once the file outgrows it, so reserving address
+	// space up front avoids remaps while the database grows; read
+	// transactions pin the old map during a remap and can hold up its
+	// release. On Windows the file is extended to the size of the map.
+	InitialMmapSize int
+	// MmapFlags are added to the flags of every mmap of the file, for
+	// example syscall.MAP_POPULATE to prefault the mapping. MmapAdvice, if
+	// nonzero, is passed to madvise for every mapping, for example
+	// syscall.MADV_RANDOM to disable readahead for random reads. Both are
+	// ignored on Windows.
+	MmapFlags  int
+	MmapAdvice int
+	// NodeCacheSize is the memory budget, in bytes, of a cache of decoded
+	// B+ tree nodes shared by all transactions, so that hot pages such as
+	// the upper branch levels are not decoded again on every lookup. Zero
+	// disables the cache.
+	NodeCacheSize int
+	// CloseTimeout is how long Close waits for open transactions to end
+	// before it fails with ErrTxOpen. Zero fails at once.
+	CloseTimeout time.Duration
+	// RemoteFetchSize is the size of the ranges OpenRemote and NoMmap fetch
+	// at once, rounded up to whole pages. Zero uses DefaultRemoteFetchSize.
+	// RemoteCacheSize is the memory budget for fetched ranges. Zero uses
+	// DefaultRemoteCacheSize.
+	RemoteFetchSize int
+	RemoteCacheSize int
+	// StrictMode runs the checks of DB.Check on the committed state after
+	// every write transaction, so that a commit that leaves the tree
+	// inconsistent fails with ErrInconsistent instead of going unnoticed
+	// until the damage is read. The check walks the whole file while the
+	// writer lock is held, so it is meant for tests.
+	StrictMode bool
+	// NoMmap opens the file without mapping it: pages are read with pread
+	// in ranges of RemoteFetchSize bytes, cached up to RemoteCacheSize as
+	// for OpenRemote, and commits write them with pwrite. It is slower than
+	// the mapping, but needs no address space, so it opens files larger
+	// than a 32-bit process can map and avoids remaps as the file grows.
+	NoMmap bool
+	// PunchHoleSize returns the space of free pages to the file system: when
+	// a commit frees pages that complete a run of contiguous free pages of
+	// at least this many bytes, the run is punched out of the file with
+	// fallocate(FALLOC_FL_PUNCH_HOLE), so the file takes less disk space
+	// while its size stays the same. It only takes effect as
+	// the file is flushed: runs are punched once the commit that freed them
+	// is, which with SyncEveryN is at the next flush, as a crash before then
+	// falls back to a meta page that may still use them. NoSync, which makes
+	// no such promise, punches them at once. The pages are reused as usual.
+	// Zero
+	// disables it, and it has no effect on filesystems that cannot punch
+	// holes or outside Linux.
+	PunchHoleSize int
+	// ReleaseFreeMemory advises the kernel with madvise(MADV_DONTNEED)
+	// that the memory of pages is not needed once they become free, so
+	// that the resident memory of a long-running process tracks the pages
+	// in use rather than every page it ever read. A reused page is read
+	// back from the file. It has no effect with NoMmap, on databases held
+	// in memory, or on Windows.
+	ReleaseFreeMemory bool
+	// NoCopyReads makes Bucket.Get, First, Last and cursors return keys and
+	// values that point into the pages of the transaction instead of
+	// copies, which saves an allocation and a copy per read. The slices must
+	// not be modified, and are only valid until the transaction closes; in a
+	// write transaction, only until its next write. Values stored in
+	// overflow pages are still copied.
+	NoCopyReads bool
+	// BlobCollectInterval is how often a background goroutine runs
+	// DB.CollectBlobs once commits have dropped blob chains, see
+	// BucketOptions.BlobThreshold. Zero uses DefaultBlobCollectInterval; a
+	// negative value disables the goroutine.
+	BlobCollectInterval time.Duration
+	// OptimisticWrites makes write transactions begun with Begin and
+	// BeginCtx optimistic: they do not take the writer lock until Commit,
+	// so several can run at once, each on a snapshot as a read transaction
+	// is. Commit fails with ErrTxConflict if a transaction committed since
+	// wrote a key the transaction read or wrote, wrote to a bucket it read
+	// with a cursor or a count, or created, deleted or moved a bucket it
+	// used; otherwise the transaction's changes are applied again on the
+	// latest state, and hooks and indexes run again. Retry on
+	// ErrTxConflict. Changes to bucket options, quotas, indexes and sorted
+	// sets cannot be applied again, so a transaction that makes them fails
+	// if any other committed since it began, and they conflict with every
+	// optimistic transaction open when they commit. Write, UpdateCtx and Batch
+	// still take the writer lock.
+	OptimisticWrites bool
+}
+
+// mapping is one memory map of the database file. Read transactions pin the
+// mapping that was current when they began, so a remap only retires the old
+// region; it is unmapped once the last reader pinned to it closes.
+type mapping struct {
+	data    []byte
+	refs    int
+	retired bool
 }
 
 type pendingFree struct {
@@ -35,126 +328,887 @@ type pendingFree struct {
 	id   uint64
 }
 
-// Open opens or creates a database file.
+// Open opens or creates a database file with default options.
 func Open(path string) (*DB, error) {
-	file, info, err := openFile(path)
+	return OpenWithOptions(path, nil)
+}
+
+// OpenWithOptions opens or creates a database file. A nil opts uses the
+// defaults.
+func OpenWithOptions(path string, opts *Options) (*DB, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	diskPageSize, err := diskPageSizeFor(opts)
+	if err != nil {
+		return nil, err
+	}
+	file, info, err := openFile(path, diskPageSize)
 	if err != nil {
 		return nil, err
 	}
 
-	db, err := mapFile(file)
+	var db *DB
+	if opts.NoMmap {
+		// openFile sized a new file for its first pages.
+		size := max(info.Size(), int64(diskPageSize*3))
+		db, err = readFile(file, size, diskPageSize, opts)
+	} else {
+		db, err = mapFile(file, diskPageSize, opts)
+	}
 	if err != nil {
 		file.Close()
 		return nil, err
 	}
+	return db.open(info.Size() == 0, opts)
+}
 
-	if info.Size() == 0 {
+// OpenMem creates an empty database held in memory with default options.
+func OpenMem() (*DB, error) {
+	return OpenMemWithOptions(nil)
+}
+
+// OpenMemWithOptions creates an empty database held in memory instead of a
+// file. It supports the whole Tx and Bucket API, including nested buckets,
+// cursors and WriteTo, which saves it in the format of a database file.
+// Its pages live on the Go heap: the store grows like a file, and is
+// copied when it does. The contents are lost on Close. Options that tune
+// the file, its mapping or syncing have no effect.
+func OpenMemWithOptions(opts *Options) (*DB, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	diskPageSize, err := diskPageSizeFor(opts)
+	if err != nil {
+		return nil, err
+	}
+	db := newDB(nil, int64(diskPageSize*3), diskPageSize, opts)
+	data, err := db.mmap(max(int(db.fileSize), opts.InitialMmapSize))
+	if err != nil {
+		return nil, err
+	}
+	db.mapping = &mapping{data: data}
+	return db.open(true, opts)
+}
+
+// diskPageSizeFor returns the size of a page in the file for opts.
+func diskPageSizeFor(opts *Options) (int, error) {
+	if opts.EncryptionKey == nil {
+		return defaultPageSize, nil
+	}
+	if len(opts.EncryptionKey) < minKeySize {
+		return 0, errKeyTooShort
+	}
+	return defaultPageSize + pageOverhead, nil
+}
+
+// open applies opts to the newly mapped db and initializes an empty store or
+// loads an existing one. It closes db if that fails.
+func (db *DB) open(empty bool, opts *Options) (*DB, error) {
+	db.verifyChecksums = opts.VerifyChecksums
+	db.nodeCache = newNodeLRU(opts.NodeCacheSize)
+	db.maxBatchSize = opts.MaxBatchSize
+	if db.maxBatchSize <= 0 {
+		db.maxBatchSize = DefaultMaxBatchSize
+	}
+	db.maxBatchDelay = opts.MaxBatchDelay
+	if db.maxBatchDelay <= 0 {
+		db.maxBatchDelay = DefaultMaxBatchDelay
+	}
+	db.syncMode = opts.Sync
+	db.syncEvery = max(opts.SyncEvery, 1)
+	db.syncInterval = max(opts.SyncInterval, 0)
+	db.fullFsync = opts.FullFsync
+	db.changefeed = opts.Changefeed
+	db.audit = opts.Audit
+	db.optimisticWrites = opts.OptimisticWrites
+	db.optimisticTxs = make(map[uint64]int)
+	db.strict = opts.StrictMode
+	if opts.PunchHoleSize > 0 {
+		db.punchPages = max((opts.PunchHoleSize+db.diskPageSize-1)/db.diskPageSize, 1)
+	}
+	db.closeTimeout = opts.CloseTimeout
+	db.noCopyReads = opts.NoCopyReads
+	db.releaseFree = opts.ReleaseFreeMemory
+	db.collectInterval = opts.BlobCollectInterval
+	if db.collectInterval == 0 {
+		db.collectInterval = DefaultBlobCollectInterval
+	}
+
+	if empty {
+		var err error
+		if opts.EncryptionKey != nil {
+			if db.cipher, err = newPageCipher(opts.EncryptionKey, newSalt()); err != nil {
+				db.Close()
+				return nil, err
+			}
+		}
 		if err := db.initEmpty(); err != nil {
 			db.Close()
 			return nil, err
 		}
+		db.startWorkers()
 		return db, nil
 	}
 
-	if err := db.loadExisting(); err != nil {
+	if err := db.loadExisting(opts.EncryptionKey); err != nil {
 		db.Close()
 		return nil, err
 	}
+	db.startWorkers()
 	return db, nil
 }
 
-// Close flushes and closes the database.
+// Close flushes and closes the database. New transactions are refused with
+// ErrDatabaseClosed from the time Close is called. If transactions are still
+// open after Options.CloseTimeout, Close fails with ErrTxOpen and the
+// database stays open. With SyncEveryN or Options.SyncInterval, Close syncs
+// the commits left unsynced and reports if that fails; the database is
+// closed either way.
 func (db *DB) Close() error {
 	if db == nil {
 		return nil
 	}
+	db.stopWorkers()
+	if err := db.waitTxs(); err != nil {
+		db.startWorkers()
+		return err
+	}
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	if db.data != nil {
+	var syncErr error
+	if db.mapping != nil {
 		db.mapMu.Lock()
-		if len(db.data) > 0 {
-			_ = unix.Msync(db.data, unix.MS_SYNC)
+		if db.unwritten != nil || db.syncInterval > 0 && db.unsynced > 0 {
+			if syncErr = db.sync(); syncErr == nil {
+				db.punchFreed()
+			}
+		} else {
+			_ = db.msync()
 		}
-		_ = unix.Munmap(db.data)
+		db.retireMapping(db.mapping)
+		db.mapping = nil
 		db.mapMu.Unlock()
-		db.data = nil
 	}
 	if db.file != nil {
-		return db.file.Close()
+		if err := db.file.Close(); err != nil {
+			return err
+		}
 	}
-	return nil
+	return syncErr
 }
 
-// Read runs a read-only transaction.
+// Read runs a read-only transaction. If fn upgrades the transaction with
+// Tx.Upgrade, its changes are committed when fn returns nil.
 func (db *DB) Read(fn func(*Tx) error) error {
+	return db.ViewCtx(context.Background(), fn)
+}
+
+// ViewCtx is Read with a context. fn can watch it through Tx.Context. If
+// ctx ends before fn returns, ViewCtx returns the context's error, rolling
+// back the transaction if fn upgraded it.
+func (db *DB) ViewCtx(ctx context.Context, fn func(*Tx) error) error {
 	if fn == nil {
 		return nil
 	}
-	tx := db.begin(false)
+	tx, err := db.begin(ctx, false)
+	if err != nil {
+		return err
+	}
+	// Rolling back a closed transaction is a no-op, so this only matters if
+	// fn panics.
 	defer tx.Rollback()
-	return fn(tx)
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if tx.writable {
+		return tx.Commit()
+	}
+	return ctx.Err()
 }
 
 // Write runs a read-write transaction.
 func (db *DB) Write(fn func(*Tx) error) error {
+	return db.UpdateCtx(context.Background(), fn)
+}
+
+// UpdateCtx is Write with a context. It gives up waiting for the writer
+// lock when ctx ends, and if ctx ends before fn returns the transaction is
+// rolled back and UpdateCtx returns the context's error. fn can watch ctx
+// through Tx.Context to stop early.
+func (db *DB) UpdateCtx(ctx context.Context, fn func(*Tx) error) error {
 	if fn == nil {
 		return nil
 	}
-	tx := db.begin(true)
+	tx, err := db.begin(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 	if err := fn(tx); err != nil {
-		tx.Rollback()
 		return err
 	}
 	return tx.Commit()
 }
 
-// begin starts a new transaction. Writable transactions are exclusive.
-func (db *DB) begin(writable bool) *Tx {
+// Begin starts a transaction that the caller must end with Commit or
+// Rollback. Prefer Read and Write; Begin is for callers whose transactions
+// span several calls, such as database/sql drivers. A writable transaction
+// holds the writer lock until it ends, unless Options.OptimisticWrites is
+// set.
+func (db *DB) Begin(writable bool) (*Tx, error) {
+	return db.BeginCtx(context.Background(), writable)
+}
+
+// BeginCtx is Begin with a context. A writable transaction gives up waiting
+// for the writer lock with the context's error when ctx ends. Once begun,
+// the transaction is bound to ctx: if ctx ends before Commit, Commit rolls
+// it back and returns the context's error.
+func (db *DB) BeginCtx(ctx context.Context, writable bool) (*Tx, error) {
+	if writable && db != nil && db.optimisticWrites {
+		return db.beginOptimistic(ctx)
+	}
+	return db.begin(ctx, writable)
+}
+
+// begin starts a new transaction and registers it as open. Writable
+// transactions are exclusive.
+func (db *DB) begin(ctx context.Context, writable bool) (*Tx, error) {
 	if db == nil {
-		return &Tx{closed: true}
+		return nil, ErrDatabaseClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	tx := &Tx{db: db, writable: writable, start: time.Now(), ctx: ctx}
+	if !db.addTx(tx) {
+		return nil, ErrDatabaseClosed
+	}
+	if writable && db.readOnly {
+		db.removeTx(tx)
+		return nil, ErrDatabaseReadOnly
 	}
 	if writable {
-		db.mu.Lock()
-		meta := db.snapshotMeta()
-		mgr := newTxPageManager(db, true, meta)
-		return &Tx{db: db, writable: true, mgr: mgr}
+		if err := db.lockWriterCtx(ctx); err != nil {
+			db.removeTx(tx)
+			return nil, err
+		}
+		if db.mapping == nil {
+			db.mu.Unlock()
+			db.removeTx(tx)
+			return nil, ErrDatabaseClosed
+		}
+		mgr := newTxPageManager(db, true, db.snapshotMeta())
+		db.setTxManager(tx, mgr)
+		return tx, nil
 	}
-	db.mapMu.RLock()
-	meta := db.snapshotMeta()
+	// The mapping is pinned and the meta snapshotted under mapMu so the
+	// snapshot never references pages beyond the pinned region.
+	db.lockMapForRead()
+	if db.mapping == nil {
+		db.mapMu.Unlock()
+		db.removeTx(tx)
+		return nil, ErrDatabaseClosed
+	}
+	mapping := db.mapping
+	mapping.refs++
+	meta := db.snapshotReadMeta()
+	db.mapMu.Unlock()
+	db.stats.readTxs.Add(1)
 	mgr := newTxPageManager(db, false, meta)
-	db.addReadTx(meta.txid)
-	return &Tx{db: db, mgr: mgr, mapLock: true, readTxID: meta.txid}
+	mgr.mapping = mapping
+	tx.readTxID = meta.txid
+	db.setTxManager(tx, mgr)
+	return tx, nil
+}
+
+// TxInfo describes an open transaction.
+type TxInfo struct {
+	// ID is the Tx.ID of the transaction.
+	ID       uint64
+	Writable bool
+	// Start is when the transaction began, including any wait for the
+	// writer lock.
+	Start time.Time
+}
+
+// ActiveTx returns the transactions that are open, oldest first.
+func (db *DB) ActiveTx() []TxInfo {
+	if db == nil {
+		return nil
+	}
+	db.txMu.Lock()
+	defer db.txMu.Unlock()
+	infos := make([]TxInfo, 0, len(db.txs))
+	for tx := range db.txs {
+		info := TxInfo{Writable: tx.writable, Start: tx.start}
+		// A transaction still waiting for the writer lock has no snapshot.
+		if tx.mgr != nil {
+			info.ID = tx.mgr.txid
+		}
+		infos = append(infos, info)
+	}
+	slices.SortFunc(infos, func(a, b TxInfo) int {
+		return a.Start.Compare(b.Start)
+	})
+	return infos
+}
+
+// addTx registers tx as open, unless the database is closing.
+func (db *DB) addTx(tx *Tx) bool {
+	db.txMu.Lock()
+	defer db.txMu.Unlock()
+	if db.closing {
+		return false
+	}
+	if db.txs == nil {
+		db.txs = make(map[*Tx]struct{})
+	}
+	db.txs[tx] = struct{}{}
+	return true
+}
+
+// setTxManager sets the page manager of a beginning transaction under txMu,
+// where ActiveTx reads it.
+func (db *DB) setTxManager(tx *Tx, mgr *txPageManager) {
+	db.txMu.Lock()
+	tx.mgr = mgr
+	db.txMu.Unlock()
+}
+
+// removeTx unregisters tx and wakes a waiting Close once none are open.
+func (db *DB) removeTx(tx *Tx) {
+	db.txMu.Lock()
+	defer db.txMu.Unlock()
+	delete(db.txs, tx)
+	if len(db.txs) == 0 && db.txsIdle != nil {
+		close(db.txsIdle)
+		db.txsIdle = nil
+	}
+}
+
+// waitTxs stops new transactions from beginning and waits up to
+// closeTimeout for the open ones to end. If some are still open it lets
+// transactions begin again and returns ErrTxOpen.
+func (db *DB) waitTxs() error {
+	db.txMu.Lock()
+	db.closing = true
+	if len(db.txs) == 0 {
+		db.txMu.Unlock()
+		return nil
+	}
+	if db.txsIdle == nil {
+		db.txsIdle = make(chan struct{})
+	}
+	idle := db.txsIdle
+	db.txMu.Unlock()
+
+	timer := time.NewTimer(db.closeTimeout)
+	defer timer.Stop()
+	select {
+	case <-idle:
+		return nil
+	case <-timer.C:
+	}
+	db.txMu.Lock()
+	defer db.txMu.Unlock()
+	if len(db.txs) == 0 {
+		return nil
+	}
+	db.closing = false
+	return ErrTxOpen
+}
+
+// lockWriter takes the writer lock, recording how long it had to wait.
+func (db *DB) lockWriter() {
+	_ = db.lockWriterCtx(context.Background())
+}
+
+// lockWriterCtx is lockWriter, but gives up with the context's error if ctx
+// ends first. Contexts marked with WithSmallWrite wait in the priority lane.
+func (db *DB) lockWriterCtx(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if db.mu.TryLock() {
+		return nil
+	}
+	start := time.Now()
+	err := db.mu.LockCtx(ctx, isSmallWrite(ctx))
+	db.stats.writerLockWaits.Add(1)
+	db.stats.writerLockWait.Add(int64(time.Since(start)))
+	return err
+}
+
+type smallWriteKey struct{}
+
+// WithSmallWrite returns a copy of ctx that marks the write transactions
+// begun with it, by BeginCtx or UpdateCtx, as small. While writers queue for
+// the writer lock, small ones are let in ahead of the others, but never more
+// than maxSmallRun in a row while others wait, so that neither starves.
+// Mark only transactions that write a few keys: a long one let in early
+// holds up everyone queued behind it.
+func WithSmallWrite(ctx context.Context) context.Context {
+	return context.WithValue(ctx, smallWriteKey{}, true)
 }
 
+func isSmallWrite(ctx context.Context) bool {
+	small, _ := ctx.Value(smallWriteKey{}).(bool)
+	return small
+}
+
+// maxSmallRun is how many small writers in a row the writer lock lets in
+// ahead of others that wait.
+const maxSmallRun = 8
+
+// writerLock is a mutex that queues its waiters and hands itself to them in
+// the order they came, so that a writer cannot starve while others keep
+// taking the lock, and whose waiters can give up when a context ends;
+// sync.Mutex does neither. Small writers have a queue of their own, served
+// first. The zero value is unlocked.
+type writerLock struct {
+	mu     sync.Mutex
+	locked bool
+	// queue and small hold the channels of the waiting writers, which are
+	// closed as the lock is handed to them. smallRun counts the small
+	// writers let in ahead of others since one of those was.
+	queue    []chan struct{}
+	small    []chan struct{}
+	smallRun int
+	// maxQueue is the most writers that waited at once.
+	maxQueue int
+}
+
+func (l *writerLock) Lock() {
+	_ = l.LockCtx(context.Background(), false)
+}
+
+// TryLock takes the lock if it is free and nobody waits for it.
+func (l *writerLock) TryLock() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.locked || len(l.queue)+len(l.small) > 0 {
+		return false
+	}
+	l.locked = true
+	return true
+}
+
+// LockCtx takes the lock, waiting at the end of the queue for small writers
+// if small is set and of the other queue if not, or gives up with the
+// context's error when ctx ends.
+func (l *writerLock) LockCtx(ctx context.Context, small bool) error {
+	l.mu.Lock()
+	if !l.locked && len(l.queue)+len(l.small) == 0 {
+		l.locked = true
+		l.mu.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	if small {
+		l.small = append(l.small, ready)
+	} else {
+		l.queue = append(l.queue, ready)
+	}
+	l.maxQueue = max(l.maxQueue, len(l.queue)+len(l.small))
+	l.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+	}
+	l.mu.Lock()
+	if i := slices.Index(l.queue, ready); i >= 0 {
+		l.queue = slices.Delete(l.queue, i, i+1)
+	} else if i := slices.Index(l.small, ready); i >= 0 {
+		l.small = slices.Delete(l.small, i, i+1)
+	} else {
+		// The lock was handed over as ctx ended: pass it on.
+		l.mu.Unlock()
+		l.Unlock()
+		return ctx.Err()
+	}
+	l.mu.Unlock()
+	return ctx.Err()
+}
+
+// Unlock hands the lock to the next writer, if any waits, without letting
+// go of it in between.
+func (l *writerLock) Unlock() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.locked {
+		panic("leafdb: unlock of unlocked writer lock")
+	}
+	var next chan struct{}
+	switch {
+	case len(l.small) > 0 && (len(l.queue) == 0 || l.smallRun < maxSmallRun):
+		next, l.small = l.small[0], l.small[1:]
+		if len(l.queue) > 0 {
+			l.smallRun++
+		} else {
+			l.smallRun = 0
+		}
+	case len(l.queue) > 0:
+		next, l.queue = l.queue[0], l.queue[1:]
+		l.smallRun = 0
+	default:
+		l.locked = false
+		return
+	}
+	close(next)
+}
+
+// waiting returns the number of writers waiting for the lock and the most
+// that ever waited at once.
+func (l *writerLock) waiting() (n, most int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.queue) + len(l.small), l.maxQueue
+}
+
+// lockMapForRead takes mapMu for a beginning reader, recording waits caused
+// by a remap in progress.
+func (db *DB) lockMapForRead() {
+	if db.mapMu.TryLock() {
+		return
+	}
+	start := time.Now()
+	db.mapMu.Lock()
+	if db.remapping.Load() {
+		db.stats.remapStalls.Add(1)
+		db.stats.remapStallTime.Add(int64(time.Since(start)))
+	}
+}
+
+// page returns page id as stored in the file, encrypted if the file is.
 func (db *DB) page(id uint64) []byte {
-	start := int(id) * db.pageSize
-	end := start + db.pageSize
-	return db.data[start:end]
+	return mappedPage(db.mapping.data, id, db.diskPageSize)
+}
+
+// storedPage returns page id as stored, reading it from the file of a
+// database that is not mapped.
+func (db *DB) storedPage(id uint64) ([]byte, error) {
+	if db.remote != nil {
+		return db.remote.page(id, db.diskPageSize)
+	}
+	return db.page(id), nil
 }
 
+// readPage returns the contents of page id. Unless the file is encrypted
+// the result aliases the mapping.
+func (db *DB) readPage(id uint64) ([]byte, error) {
+	stored, err := db.storedPage(id)
+	if err != nil {
+		return nil, err
+	}
+	return db.decodePage(id, stored)
+}
+
+// decodePage returns the contents of page id given the page as stored.
+func (db *DB) decodePage(id uint64, stored []byte) ([]byte, error) {
+	if db.cipher == nil {
+		return stored, nil
+	}
+	return db.cipher.open(id, stored)
+}
+
+// writePage stores buf, a page's contents, as page id.
+func (db *DB) writePage(id uint64, buf []byte) error {
+	if db.remote != nil {
+		if db.cipher == nil {
+			return db.writeStored(id, buf)
+		}
+		stored := getPageBuffer(db.diskPageSize)
+		defer putPageBuffer(stored)
+		db.cipher.seal(stored, id, buf)
+		return db.writeStored(id, stored)
+	}
+	if db.cipher == nil {
+		copy(db.page(id), buf)
+		return nil
+	}
+	db.cipher.seal(db.page(id), id, buf)
+	return nil
+}
+
+// writeMeta encodes m into meta page id.
+func (db *DB) writeMeta(id uint64, m meta) error {
+	if db.remote == nil {
+		return writeMetaPage(db.page(id), m, db.pageSize, db.cipher)
+	}
+	stored := getPageBuffer(db.diskPageSize)
+	defer putPageBuffer(stored)
+	clear(stored)
+	if err := writeMetaPage(stored, m, db.pageSize, db.cipher); err != nil {
+		return err
+	}
+	return db.writeStored(id, stored)
+}
+
+// writeStored writes page id, as stored, to the file of a database opened
+// with Options.NoMmap, and updates the cached copy of its range.
+func (db *DB) writeStored(id uint64, stored []byte) error {
+	if _, err := db.file.WriteAt(stored, int64(id)*int64(db.diskPageSize)); err != nil {
+		return err
+	}
+	db.remote.update(id, stored)
+	return nil
+}
+
+func mappedPage(data []byte, id uint64, pageSize int) []byte {
+	start := int(id) * pageSize
+	end := start + pageSize
+	return data[start:end]
+}
+
+// remap replaces the current mapping with one of the given size. The old
+// mapping stays valid for any read transaction still pinned to it.
 func (db *DB) remap(size int) error {
+	data, err := db.mmap(size)
+	if err != nil {
+		return err
+	}
+	db.stats.remaps.Add(1)
+	db.remapping.Store(true)
+	defer db.remapping.Store(false)
+	db.mapMu.Lock()
+	defer db.mapMu.Unlock()
+	if db.mapping != nil {
+		db.retireMapping(db.mapping)
+	}
+	db.mapping = &mapping{data: data}
+	return nil
+}
+
+// releaseMapping drops a read transaction's pin on a mapping.
+func (db *DB) releaseMapping(m *mapping) {
 	db.mapMu.Lock()
 	defer db.mapMu.Unlock()
-	if db.data != nil {
-		if err := unix.Munmap(db.data); err != nil {
+	m.refs--
+	if m.refs == 0 && m.retired {
+		db.munmap(m)
+	}
+}
+
+// retireMapping marks a mapping as replaced and unmaps it if no reader is
+// pinned to it. Callers must hold mapMu.
+func (db *DB) retireMapping(m *mapping) {
+	m.retired = true
+	if m.refs == 0 {
+		db.munmap(m)
+	}
+}
+
+// munmap releases the memory of a retired mapping.
+func (db *DB) munmap(m *mapping) {
+	if db.file != nil && m.data != nil {
+		_ = munmapData(m.data)
+	}
+	m.data = nil
+}
+
+// msync flushes the current mapping. Only the writer replaces the mapping,
+// so callers holding the writer lock can sync without blocking readers on
+// mapMu.
+func (db *DB) msync() error {
+	m := db.mapping
+	if m == nil || len(m.data) == 0 || db.file == nil {
+		return nil
+	}
+	return msyncData(m.data)
+}
+
+// flushPages makes the pages written so far durable before a meta page that
+// points to them is written: with msync if they were written through the
+// mapping, and by syncing the file if they were written to it directly, as
+// without a mapping writes can reach the disk in any order. Callers must
+// hold the writer lock.
+func (db *DB) flushPages() error {
+	if db.remote != nil && db.file != nil {
+		return syncFile(db.file, db.fullFsync)
+	}
+	return db.msync()
+}
+
+// sync flushes the mapping and the file, writing the meta page of the
+// commits since the last sync first if they left it unwritten. Callers must
+// hold the writer lock.
+func (db *DB) sync() error {
+	if db.unwritten != nil {
+		if err := db.flushPages(); err != nil {
+			return err
+		}
+		if err := db.writeUnwritten(); err != nil {
 			return err
 		}
 	}
-	data, err := unix.Mmap(int(db.file.Fd()), 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
-	if err != nil {
+	if err := db.msync(); err != nil {
 		return err
 	}
-	db.data = data
+	if db.file != nil {
+		if err := syncFile(db.file, db.fullFsync); err != nil {
+			return err
+		}
+	}
+	db.unsynced = 0
+	db.syncedTxID = db.meta.txid
 	return nil
 }
 
-func (db *DB) msync() error {
-	db.mapMu.RLock()
-	defer db.mapMu.RUnlock()
-	if db.data == nil || len(db.data) == 0 {
+// writeUnwritten writes the meta page left unwritten by the last commit to
+// the slot the last synced one is not in.
+func (db *DB) writeUnwritten() error {
+	next := db.nextMetaPage()
+	db.metaMu.Lock()
+	defer db.metaMu.Unlock()
+	if err := db.writeMeta(next, *db.unwritten); err != nil {
+		return err
+	}
+	db.metaPage = next
+	db.unwritten = nil
+	return nil
+}
+
+// nextMetaPage returns the meta page slot the next meta page is written to,
+// the one not holding the current meta page.
+func (db *DB) nextMetaPage() uint64 {
+	if db.metaPage == metaPage0 {
+		return metaPage1
+	}
+	return metaPage0
+}
+
+// addUnpunched records ids, pages a commit made free, to be punched by
+// punchFreed. Pages reused before then are dropped once there are more of
+// them than free pages, so that the list stays bounded however rarely the
+// file is synced. Callers must hold the writer lock.
+func (db *DB) addUnpunched(ids []uint64) {
+	db.unpunched = append(db.unpunched, ids...)
+	if len(db.unpunched) <= 2*len(db.meta.freelist)+1024 {
+		return
+	}
+	free := make(map[uint64]bool, len(db.meta.freelist))
+	for _, id := range db.meta.freelist {
+		free[id] = true
+	}
+	db.unpunched = slices.DeleteFunc(db.unpunched, func(id uint64) bool {
+		keep := free[id]
+		delete(free, id)
+		return !keep
+	})
+}
+
+// punchFreed punches the runs of free pages holding the pages freed since
+// the last punch, once a sync has made the commits that freed them durable.
+// Callers must hold the writer lock.
+func (db *DB) punchFreed() {
+	if len(db.unpunched) == 0 {
+		return
+	}
+	db.punchHoles(freeRuns(db.meta.freelist, db.unpunched, nil, db.punchPages))
+	db.unpunched = nil
+}
+
+// punchHoles returns the space of runs of free pages to the file system. A
+// failure stops it but is not reported: the pages stay free and usable
+// either way.
+func (db *DB) punchHoles(runs []pageRun) {
+	f, ok := db.file.(*os.File)
+	if !ok {
+		return
+	}
+	for _, r := range runs {
+		off := int64(r.first) * int64(db.diskPageSize)
+		if err := punchHole(f, off, int64(r.count)*int64(db.diskPageSize)); err != nil {
+			return
+		}
+		db.stats.pagesPunched.Add(r.count)
+	}
+}
+
+// releaseMemory releases the memory of runs of free pages in the current
+// mapping, rounded inward to whole pages of memory. Like punchHoles, it
+// reports no failure. Callers must hold the writer lock.
+func (db *DB) releaseMemory(runs []pageRun) {
+	if db.file == nil || db.remote != nil || db.mapping == nil {
+		return
+	}
+	data := db.mapping.data
+	osPage := uint64(os.Getpagesize())
+	for _, r := range runs {
+		start := (r.first*uint64(db.diskPageSize) + osPage - 1) / osPage * osPage
+		end := min((r.first+r.count)*uint64(db.diskPageSize), uint64(len(data))) / osPage * osPage
+		if start >= end {
+			continue
+		}
+		if err := releaseData(data[start:end]); err != nil {
+			return
+		}
+		db.stats.pagesReleased.Add(r.count)
+	}
+}
+
+// truncate cuts the file after the last page in use, once a commit of
+// Tx.Shrink has made sure no reader can see the pages past it. Callers must
+// hold the writer lock.
+func (db *DB) truncate() error {
+	size := int64(db.meta.nextPage) * int64(db.diskPageSize)
+	if db.file == nil || size >= db.fileSize || (db.remote == nil && !truncateMapped) {
+		return nil
+	}
+	if err := db.file.Truncate(size); err != nil {
+		return err
+	}
+	if db.remote != nil {
+		db.remote.resize(size)
+	}
+	db.fileSize = size
+	return syncFile(db.file, true)
+}
+
+// syncDue reports whether the commit in progress should be flushed under the
+// configured sync policy. Callers must hold the writer lock.
+func (db *DB) syncDue() bool {
+	switch db.syncMode {
+	case NoSync:
+		db.unsynced++
+		return false
+	case SyncEveryN:
+		db.unsynced++
+		return db.unsynced >= db.syncEvery
+	default:
+		return true
+	}
+}
+
+// Sync flushes all committed transactions to stable storage. It is only
+// needed when commits are not synced individually, see SyncMode.
+func (db *DB) Sync() error {
+	if db == nil {
 		return nil
 	}
-	return unix.Msync(db.data, unix.MS_SYNC)
+	db.lockWriter()
+	defer db.mu.Unlock()
+	if db.mapping == nil {
+		return ErrDatabaseClosed
+	}
+	if err := db.sync(); err != nil {
+		return err
+	}
+	db.punchFreed()
+	return nil
+}
+
+// syncUnsynced is run by the syncer. It syncs the file if commits were made
+// since it was last synced; a failed sync is retried on the next tick.
+func (db *DB) syncUnsynced() {
+	db.lockWriter()
+	defer db.mu.Unlock()
+	if db.mapping != nil && db.unsynced > 0 && db.sync() == nil {
+		db.punchFreed()
+	}
 }
 
 func (db *DB) snapshotMeta() meta {
@@ -169,6 +1223,18 @@ func (db *DB) snapshotMeta() meta {
 	}
 }
 
+// snapshotReadMeta returns the meta a read transaction sees and registers
+// the reader under the same lock, so no commit can publish a freelist that
+// releases pages of the snapshot between the two. Readers never allocate, so
+// the freelist is not copied.
+func (db *DB) snapshotReadMeta() meta {
+	db.metaMu.RLock()
+	defer db.metaMu.RUnlock()
+	m := meta{txid: db.meta.txid, root: db.meta.root, nextPage: db.meta.nextPage}
+	db.addReadTx(m.txid)
+	return m
+}
+
 func (db *DB) addReadTx(txid uint64) {
 	db.readMu.Lock()
 	defer db.readMu.Unlock()
@@ -202,15 +1268,31 @@ func (db *DB) minReadTxID() (uint64, bool) {
 	return min, true
 }
 
+// filePages returns the number of pages of the file.
+func (db *DB) filePages() uint64 {
+	return uint64(db.fileSize) / uint64(db.diskPageSize)
+}
+
+// readMetaPair returns the meta page to open the file at and its ID: the
+// valid one of the latest transaction. A meta page that cannot be decoded,
+// as after a torn write, is skipped if the other one can be.
 func (db *DB) readMetaPair() (meta, uint64, error) {
-	meta0, ok0, err := readMetaPage(db.page(metaPage0), db.pageSize)
+	page0, err := db.storedPage(metaPage0)
 	if err != nil {
 		return meta{}, 0, err
 	}
-	meta1, ok1, err := readMetaPage(db.page(metaPage1), db.pageSize)
+	meta0, ok0, err0 := readMetaPage(page0, db.pageSize, db.filePages())
+	page1, err := db.storedPage(metaPage1)
 	if err != nil {
 		return meta{}, 0, err
 	}
+	meta1, ok1, err1 := readMetaPage(page1, db.pageSize, db.filePages())
+	switch {
+	case err0 != nil && (err1 != nil || !ok1):
+		return meta{}, 0, atPage(err0, metaPage0)
+	case err1 != nil && !ok0:
+		return meta{}, 0, atPage(err1, metaPage1)
+	}
 	if ok0 && ok1 {
 		if meta1.txid > meta0.txid {
 			return meta1, metaPage1, nil
@@ -226,7 +1308,32 @@ func (db *DB) readMetaPair() (meta, uint64, error) {
 	return meta{}, 0, errors.New("leafdb: no valid meta page")
 }
 
-func openFile(path string) (*os.File, os.FileInfo, error) {
+// verifiedMeta checks the signature of the chosen meta page of an encrypted
+// file, falling back to the other meta page if it does not verify, as after
+// a torn write. If neither does, the key is wrong.
+func (db *DB) verifiedMeta(m meta, metaPage uint64) (meta, uint64, error) {
+	page, err := db.storedPage(metaPage)
+	if err != nil {
+		return meta{}, 0, err
+	}
+	if db.cipher.verifyMeta(page, db.pageSize) {
+		return m, metaPage, nil
+	}
+	other := uint64(metaPage1)
+	if metaPage == metaPage1 {
+		other = metaPage0
+	}
+	if page, err = db.storedPage(other); err != nil {
+		return meta{}, 0, err
+	}
+	om, ok, err := readMetaPage(page, db.pageSize, db.filePages())
+	if err != nil || !ok || !db.cipher.verifyMeta(page, db.pageSize) {
+		return meta{}, 0, ErrAuthFailed
+	}
+	return om, other, nil
+}
+
+func openFile(path string, diskPageSize int) (*os.File, os.FileInfo, error) {
 	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
 	if err != nil {
 		return nil, nil, err
@@ -237,7 +1344,7 @@ func openFile(path string) (*os.File, os.FileInfo, error) {
 		return nil, nil, err
 	}
 	if info.Size() == 0 {
-		if err := file.Truncate(int64(defaultPageSize * 3)); err != nil {
+		if err := file.Truncate(int64(diskPageSize * 3)); err != nil {
 			file.Close()
 			return nil, nil, err
 		}
@@ -245,27 +1352,88 @@ func openFile(path string) (*os.File, os.FileInfo, error) {
 	return file, info, nil
 }
 
-func mapFile(file *os.File) (*DB, error) {
+// maxMmapSize is the size of the largest file that can be mapped.
+const maxMmapSize = int64(int(^uint(0) >> 1))
+
+var errMmapTooLarge = errors.New("leafdb: file too large to mmap; open it with Options.NoMmap")
+
+var errInvalidFileSize = errors.New("leafdb: invalid file size")
+
+// mapFile maps file, or the first opts.InitialMmapSize bytes if the file is
+// smaller.
+func mapFile(file *os.File, diskPageSize int, opts *Options) (*DB, error) {
 	info, err := file.Stat()
 	if err != nil {
 		return nil, err
 	}
 	size := info.Size()
 	if size <= 0 {
-		return nil, errors.New("leafdb: invalid file size")
+		return nil, errInvalidFileSize
 	}
-	if size > int64(int(^uint(0)>>1)) {
-		return nil, errors.New("leafdb: file too large to mmap")
+	if size > maxMmapSize {
+		return nil, errMmapTooLarge
 	}
-	data, err := unix.Mmap(int(file.Fd()), 0, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	db := newDB(file, size, diskPageSize, opts)
+	data, err := db.mmap(max(int(size), opts.InitialMmapSize))
 	if err != nil {
 		return nil, err
 	}
-	db := &DB{file: file, data: data, pageSize: defaultPageSize}
-	db.readTxs = make(map[uint64]int)
+	db.mapping = &mapping{data: data}
+	return db, nil
+}
+
+// readFile sets up file, of size bytes, for Options.NoMmap: its pages are
+// read through a remoteStore over the file itself.
+func readFile(file File, size int64, diskPageSize int, opts *Options) (*DB, error) {
+	if size <= 0 {
+		return nil, errInvalidFileSize
+	}
+	db := newDB(file, size, diskPageSize, opts)
+	db.remote = newRemoteStoreFor(file, size, diskPageSize, opts)
+	// As for OpenRemote, the empty mapping only marks the database as open.
+	db.mapping = &mapping{}
 	return db, nil
 }
 
+// newDB returns an unmapped DB for file, or for an in-memory store if file
+// is nil, of size bytes.
+func newDB(file File, size int64, diskPageSize int, opts *Options) *DB {
+	return &DB{
+		file:         file,
+		fileSize:     size,
+		pageSize:     defaultPageSize,
+		diskPageSize: diskPageSize,
+		mmapFlags:    opts.MmapFlags,
+		mmapAdvice:   opts.MmapAdvice,
+		readTxs:      make(map[uint64]int),
+	}
+}
+
+// mmap maps the first size bytes of the file, rounded up to whole pages,
+// with the configured flags and advice. An in-memory store is instead
+// copied into a new buffer of that size.
+func (db *DB) mmap(size int) ([]byte, error) {
+	size = (size + db.diskPageSize - 1) / db.diskPageSize * db.diskPageSize
+	if db.file == nil {
+		data := make([]byte, size)
+		if db.mapping != nil {
+			copy(data, db.mapping.data)
+		}
+		return data, nil
+	}
+	data, err := mmapFile(db.file.(*os.File), size, db.mmapFlags)
+	if err != nil {
+		return nil, err
+	}
+	if db.mmapAdvice != 0 {
+		if err := madviseData(data, db.mmapAdvice); err != nil {
+			_ = munmapData(data)
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
 func (db *DB) initEmpty() error {
 	rootID := uint64(2)
 	leaf := &node{pageID: rootID, isLeaf: true}
@@ -273,27 +1441,52 @@ func (db *DB) initEmpty() error {
 	if err != nil {
 		return err
 	}
-	copy(db.page(rootID), buf)
+	err = db.writePage(rootID, buf)
+	putPageBuffer(buf)
+	if err != nil {
+		return err
+	}
 
 	db.meta = meta{txid: 1, root: rootID, nextPage: 3}
 	db.metaPage = metaPage0
-	if err := writeMetaPage(db.page(metaPage0), db.meta, db.pageSize); err != nil {
+	if err := db.writeMeta(metaPage0, db.meta); err != nil {
 		return err
 	}
 	empty := meta{txid: 0}
-	if err := writeMetaPage(db.page(metaPage1), empty, db.pageSize); err != nil {
+	if err := db.writeMeta(metaPage1, empty); err != nil {
 		return err
 	}
+	db.syncedTxID = db.meta.txid
 	return db.msync()
 }
 
-func (db *DB) loadExisting() error {
+// loadExisting reads the current meta page and freelist of an existing
+// file, which must be encrypted if and only if key is set.
+func (db *DB) loadExisting(key []byte) error {
 	meta, metaPage, err := db.readMetaPair()
 	if err != nil {
 		return err
 	}
+	page, err := db.storedPage(metaPage)
+	if err != nil {
+		return err
+	}
+	flags, salt := metaFormat(page)
+	switch {
+	case flags&metaFlagEncrypted != 0 && key == nil:
+		return ErrEncrypted
+	case flags&metaFlagEncrypted == 0 && key != nil:
+		return ErrNotEncrypted
+	case key != nil:
+		if db.cipher, err = newPageCipher(key, salt); err != nil {
+			return err
+		}
+		if meta, metaPage, err = db.verifiedMeta(meta, metaPage); err != nil {
+			return err
+		}
+	}
 	if meta.freelistPage != 0 {
-		freeIDs, _, err := db.readFreelistChain(meta.freelistPage)
+		freeIDs, _, err := db.readFreelistChain(meta.freelistPage, meta.nextPage)
 		if err != nil {
 			return err
 		}
@@ -301,10 +1494,16 @@ func (db *DB) loadExisting() error {
 	}
 	db.meta = meta
 	db.metaPage = metaPage
+	db.syncedTxID = meta.txid
+	if flags&metaFlagReservedNames == 0 {
+		return db.checkReservedNames()
+	}
 	return nil
 }
 
-func (db *DB) readFreelistChain(pageID uint64) ([]uint64, []uint64, error) {
+// readFreelistChain returns the page IDs listed by the freelist chain at
+// pageID, which must be below limit, and the pages of the chain.
+func (db *DB) readFreelistChain(pageID, limit uint64) ([]uint64, []uint64, error) {
 	if pageID == 0 {
 		return nil, nil, nil
 	}
@@ -313,11 +1512,22 @@ func (db *DB) readFreelistChain(pageID uint64) ([]uint64, []uint64, error) {
 	current := pageID
 	for current != 0 {
 		pages = append(pages, current)
-		next, pageIDs, err := readFreelistPage(db.page(current), db.pageSize)
+		page, err := db.readPage(current)
 		if err != nil {
 			return nil, nil, err
 		}
+		next, pageIDs, err := readFreelistPage(page, db.pageSize, limit)
+		if err != nil {
+			return nil, nil, atPage(err, current)
+		}
+		if uint64(len(pages)) > min(limit, db.filePages()) {
+			// The pages of a chain are distinct and in the file.
+			return nil, nil, atPage(corrupted(3, "freelist chain loops"), current)
+		}
 		ids = append(ids, pageIDs...)
+		if next != 0 && (next <= metaPage1 || next >= limit) {
+			return nil, nil, atPage(corrupted(3, "invalid next freelist page"), current)
+		}
 		current = next
 	}
 	return ids, pages, nil
@@ -325,8 +1535,8 @@ func (db *DB) readFreelistChain(pageID uint64) ([]uint64, []uint64, error) {
 
 func (db *DB) freelistPageIDs() ([]uint64, error) {
 	db.metaMu.RLock()
-	pageID := db.meta.freelistPage
+	pageID, limit := db.meta.freelistPage, db.meta.nextPage
 	db.metaMu.RUnlock()
-	_, pages, err := db.readFreelistChain(pageID)
+	_, pages, err := db.readFreelistChain(pageID, limit)
 	return pages, err
 }
@@ -0,0 +1,296 @@
+package leafdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+)
+
+// exportMagic starts every export stream; its last byte is the version of
+// the format.
+const exportMagic = "LDBX\x01"
+
+// Export stream records. A bucket record holds the full path of a bucket
+// and its sequence; the pair records after it belong to that bucket. The end
+// record holds the number of bucket and pair records, so that a truncated
+// stream is detected.
+const (
+	exportEnd    = 0
+	exportBucket = 1
+	exportPair   = 2
+)
+
+var errInvalidExport = errors.New("leafdb: invalid export stream")
+
+// Export writes every bucket, nested bucket and pair of the database to w
+// in a read transaction, as a stream for Import. See Tx.Export.
+func (db *DB) Export(w io.Writer) error {
+	return db.Read(func(tx *Tx) error {
+		return tx.Export(w)
+	})
+}
+
+// Import reads a stream written by Export into the database in a single
+// write transaction. See Tx.Import.
+func (db *DB) Import(r io.Reader) error {
+	return db.Write(func(tx *Tx) error {
+		return tx.Import(r)
+	})
+}
+
+// Export writes every bucket, nested bucket and pair as seen by tx to w.
+// Unlike WriteTo, which copies pages, the stream holds only the data:
+// length-prefixed bucket paths with their sequences, then their pairs in
+// key order, so it is compact, independent of the page layout and can be
+// piped straight into Import on another host. Reserved buckets, such as
+// those of indexes and of the changefeed, are left out; encrypted databases
+// are exported in the clear.
+func (tx *Tx) Export(w io.Writer) error {
+	if tx == nil || tx.closed {
+		return ErrTxClosed
+	}
+	e := &exportWriter{w: bufio.NewWriter(w)}
+	e.w.WriteString(exportMagic)
+	err := tx.ForEachBucket(func(name []byte, b *Bucket) error {
+		return e.bucket(b, [][]byte{name})
+	})
+	if err != nil {
+		return err
+	}
+	e.w.WriteByte(exportEnd)
+	e.uvarint(e.buckets)
+	e.uvarint(e.pairs)
+	return e.w.Flush()
+}
+
+type exportWriter struct {
+	w       *bufio.Writer
+	buf     [binary.MaxVarintLen64]byte
+	buckets uint64
+	pairs   uint64
+}
+
+func (e *exportWriter) bucket(b *Bucket, path [][]byte) error {
+	e.w.WriteByte(exportBucket)
+	e.uvarint(uint64(len(path)))
+	for _, name := range path {
+		e.bytes(name)
+	}
+	e.uvarint(b.sequence)
+	e.buckets++
+	for k, v := range b.All() {
+		e.w.WriteByte(exportPair)
+		e.bytes(k)
+		e.bytes(v)
+		e.pairs++
+	}
+	// bufio.Writer keeps its first error, so checking once per bucket is
+	// enough to stop early.
+	if _, err := e.w.Write(nil); err != nil {
+		return err
+	}
+	return b.ForEachBucket(func(name []byte, child *Bucket) error {
+		return e.bucket(child, append(path[:len(path):len(path)], name))
+	})
+}
+
+func (e *exportWriter) uvarint(v uint64) {
+	n := binary.PutUvarint(e.buf[:], v)
+	e.w.Write(e.buf[:n])
+}
+
+func (e *exportWriter) bytes(p []byte) {
+	e.uvarint(uint64(len(p)))
+	e.w.Write(p)
+}
+
+// Import reads a stream written by Export from r and writes its buckets and
+// pairs, merging them with what tx already holds: missing buckets are
+// created, existing keys are overwritten and bucket sequences are set to
+// those of the stream. Pairs of buckets that did not exist are written with
+// FillFromSorted. Declared indexes are updated and the changefeed records
+// the writes as if they were made by Put.
+func (tx *Tx) Import(r io.Reader) error {
+	if tx == nil || tx.closed {
+		return ErrTxClosed
+	}
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	d := &exportReader{r: br}
+	magic := make([]byte, len(exportMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return d.fail(err)
+	}
+	if string(magic) == signedMagic {
+		return fmt.Errorf("%w: signed stream, read it with ImportSigned", errInvalidExport)
+	}
+	if string(magic) != exportMagic {
+		return fmt.Errorf("%w: bad magic", errInvalidExport)
+	}
+
+	var buckets, pairs uint64
+	kind := d.kind()
+	for d.err == nil && kind != exportEnd {
+		if kind != exportBucket {
+			return fmt.Errorf("%w: unexpected record %d", errInvalidExport, kind)
+		}
+		path, sequence := d.bucket()
+		if d.err != nil {
+			break
+		}
+		b, created, err := tx.importBucket(path)
+		if err != nil {
+			return err
+		}
+		if b.sequence != sequence {
+			if err := b.setSequence(sequence); err != nil {
+				return err
+			}
+		}
+		buckets++
+		if created {
+			err = b.FillFromSorted(d.pairs(&pairs), 0)
+		} else {
+			for k, v := range d.pairs(&pairs) {
+				if err = b.Put(k, v); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+		kind = d.next
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if d.uvarint() != buckets || d.uvarint() != pairs || d.err != nil {
+		return d.fail(fmt.Errorf("%w: record count mismatch", errInvalidExport))
+	}
+	return nil
+}
+
+// importBucket returns the bucket at path, creating it and its parents if
+// needed, and whether it was created.
+func (tx *Tx) importBucket(path [][]byte) (*Bucket, bool, error) {
+	b := tx.Bucket(path[0])
+	created := b == nil
+	if created {
+		var err error
+		if b, err = tx.CreateBucket(path[0]); err != nil {
+			return nil, false, err
+		}
+	}
+	for _, name := range path[1:] {
+		child := b.Bucket(name)
+		created = child == nil
+		if created {
+			var err error
+			if child, err = b.CreateBucket(name); err != nil {
+				return nil, false, err
+			}
+		}
+		b = child
+	}
+	return b, created, nil
+}
+
+// exportReader decodes the records of an export stream.
+type exportReader struct {
+	r   *bufio.Reader
+	err error
+	// next is the kind of the record that ended the last run of pairs.
+	next byte
+}
+
+// fail records err, reporting a stream that ends early as invalid.
+func (d *exportReader) fail(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		err = fmt.Errorf("%w: truncated", errInvalidExport)
+	}
+	if d.err == nil {
+		d.err = err
+	}
+	return d.err
+}
+
+func (d *exportReader) kind() byte {
+	k, err := d.r.ReadByte()
+	if err != nil {
+		d.fail(err)
+	}
+	return k
+}
+
+func (d *exportReader) uvarint() uint64 {
+	v, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		d.fail(err)
+	}
+	return v
+}
+
+func (d *exportReader) bytes() []byte {
+	n := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if n >= uint64(valueOverflowFlag) {
+		d.fail(fmt.Errorf("%w: length %d too large", errInvalidExport, n))
+		return nil
+	}
+	p := make([]byte, n)
+	if _, err := io.ReadFull(d.r, p); err != nil {
+		d.fail(err)
+		return nil
+	}
+	return p
+}
+
+// bucket reads the rest of a bucket record.
+func (d *exportReader) bucket() ([][]byte, uint64) {
+	depth := d.uvarint()
+	if d.err == nil && depth == 0 {
+		d.fail(fmt.Errorf("%w: empty bucket path", errInvalidExport))
+	}
+	var path [][]byte
+	for i := uint64(0); i < depth && d.err == nil; i++ {
+		path = append(path, d.bytes())
+	}
+	return path, d.uvarint()
+}
+
+// pairs reads pair records until the next record of another kind, whose
+// kind it leaves in d.next, and counts them in n. It stops at the first
+// error, which is left in d.err.
+func (d *exportReader) pairs(n *uint64) iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		for {
+			kind := d.kind()
+			if d.err != nil {
+				return
+			}
+			if kind != exportPair {
+				d.next = kind
+				return
+			}
+			k, v := d.bytes(), d.bytes()
+			if d.err != nil {
+				return
+			}
+			*n++
+			if !yield(k, v) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build linux
+
+package leafdb
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// fdatasyncFile flushes the data of file, and only the metadata needed to
+// read it back, such as its size.
+func fdatasyncFile(file *os.File) error {
+	return unix.Fdatasync(int(file.Fd()))
+}
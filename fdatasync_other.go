@@ -0,0 +1,10 @@
+//go:build !linux
+
+package leafdb
+
+import "os"
+
+// fdatasyncFile falls back to fsyncFile outside Linux.
+func fdatasyncFile(file *os.File) error {
+	return fsyncFile(file)
+}
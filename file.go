@@ -0,0 +1,62 @@
+package leafdb
+
+import (
+	"io"
+	"os"
+)
+
+// File is the storage of a database opened with OpenFile. *os.File
+// implements it.
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	// Truncate changes the size of the file.
+	Truncate(size int64) error
+	// Sync flushes the writes made so far to stable storage.
+	Sync() error
+	Close() error
+}
+
+// OpenFile opens or creates the database stored in f, of size bytes, as
+// OpenWithOptions does with Options.NoMmap: pages are read with ReadAt and
+// commits write them with WriteAt and call Sync as Options.Sync requires. A
+// size of zero creates an empty database. It is meant for storage that is
+// not a local file, such as the simulated files of package
+// leafdb/testutil. Close closes f.
+func OpenFile(f File, size int64, opts *Options) (*DB, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	diskPageSize, err := diskPageSizeFor(opts)
+	if err != nil {
+		return nil, err
+	}
+	empty := size == 0
+	if empty {
+		size = int64(diskPageSize * 3)
+		if err := f.Truncate(size); err != nil {
+			return nil, err
+		}
+	}
+	db, err := readFile(f, size, diskPageSize, opts)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return db.open(empty, opts)
+}
+
+// syncFile flushes file to stable storage, with fsync if full is set and
+// with fdatasync where available otherwise. Files other than *os.File are
+// flushed with their Sync method.
+func syncFile(file File, full bool) error {
+	f, ok := file.(*os.File)
+	switch {
+	case !ok:
+		return file.Sync()
+	case full:
+		return fsyncFile(f)
+	default:
+		return fdatasyncFile(f)
+	}
+}
@@ -0,0 +1,280 @@
+package leafdb
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// maxBloomBitsPerKey bounds BucketOptions.BloomBitsPerKey.
+const maxBloomBitsPerKey = 32
+
+// minFilterKeys is the fewest keys a Bloom filter is sized for.
+const minFilterKeys = 1024
+
+// A bucket with BucketOptions.BloomBitsPerKey set keeps a Bloom filter of
+// its keys in pages of its own: a directory page, pointed to by the bucket
+// header, that lists block pages of bits. A key sets and tests bits in a
+// single block, chosen by its hash, so adding it copies at most one block
+// and the directory. The directory also holds the number of hash functions,
+// the number of keys added and the number of keys the filter was sized for.
+const (
+	filterHashesOffset   = 1
+	filterBlocksOffset   = 2
+	filterKeysOffset     = 8
+	filterCapacityOffset = 16
+	filterHeaderSize     = 24
+	filterBlockHeader    = 8
+)
+
+// RebuildFilter rebuilds the Bloom filter of b, see
+// BucketOptions.BloomBitsPerKey, from the keys b holds. A filter only
+// learns keys: those deleted since it was built still pass it, and raise
+// the rate of lookups of absent keys that descend the tree anyway, until it
+// is rebuilt. A filter is rebuilt on its own only when it outgrows the
+// number of keys it was sized for.
+func (b *Bucket) RebuildFilter() error {
+	if b == nil || b.tx == nil || b.tx.closed {
+		return ErrTxClosed
+	}
+	if !b.tx.writable {
+		return ErrTxReadOnly
+	}
+	b.tx.notReplayable()
+	if err := b.buildFilter(); err != nil {
+		return err
+	}
+	return b.persistHeader()
+}
+
+// mayContain reports whether key may be in b: false only if b has a filter
+// that rules it out. A filter that cannot be read rules nothing out, so
+// that the lookup reports the problem.
+func (b *Bucket) mayContain(key []byte) bool {
+	if b.filter == 0 {
+		return true
+	}
+	store := b.tx.mgr
+	dir, err := readFilterPage(store, b.filter, pageFilter)
+	if err != nil {
+		return true
+	}
+	p := probe(dir, key, store.PageSize())
+	block, err := readFilterPage(store, binary.LittleEndian.Uint64(dir[filterHeaderSize+8*p.block:]), pageFilterBlock)
+	if err != nil {
+		return true
+	}
+	for i := range p.hashes {
+		bit := p.bit(i)
+		if block[filterBlockHeader+bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// addToFilter adds key, just stored in b, to the filter of b, building the
+// filter if b has none yet and rebuilding it if it outgrew its size. The
+// caller persists the header of b.
+func (b *Bucket) addToFilter(key []byte) error {
+	if b.options.BloomBitsPerKey == 0 {
+		return nil
+	}
+	if b.filter == 0 {
+		return b.buildFilter()
+	}
+	store := b.tx.mgr
+	pageSize := store.PageSize()
+	dir, err := readFilterPage(store, b.filter, pageFilter)
+	if err != nil {
+		return err
+	}
+	p := probe(dir, key, pageSize)
+	at := filterHeaderSize + 8*p.block
+	blockID := binary.LittleEndian.Uint64(dir[at:])
+	block, err := readFilterPage(store, blockID, pageFilterBlock)
+	if err != nil {
+		return err
+	}
+	added := false
+	for i := range p.hashes {
+		bit := p.bit(i)
+		if block[filterBlockHeader+bit/8]&(1<<(bit%8)) == 0 {
+			block[filterBlockHeader+bit/8] |= 1 << (bit % 8)
+			added = true
+		}
+	}
+	if !added {
+		// key was added before, or collides with keys that were.
+		return nil
+	}
+	keys := binary.LittleEndian.Uint64(dir[filterKeysOffset:]) + 1
+	blocks := int(binary.LittleEndian.Uint32(dir[filterBlocksOffset:]))
+	if keys > binary.LittleEndian.Uint64(dir[filterCapacityOffset:]) && blocks < maxFilterBlocks(pageSize) {
+		return b.buildFilter()
+	}
+	if blockID, err = writePrivatePage(store, blockID, block); err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint64(dir[at:], blockID)
+	binary.LittleEndian.PutUint64(dir[filterKeysOffset:], keys)
+	b.filter, err = writePrivatePage(store, b.filter, dir)
+	return err
+}
+
+// buildFilter replaces the filter of b with one of the keys b holds, sized
+// for twice as many, or drops it if b has no BloomBitsPerKey. The caller
+// persists the header of b.
+func (b *Bucket) buildFilter() error {
+	store := b.tx.mgr
+	freeFilter(store, b.filter)
+	b.filter = 0
+	bitsPerKey := b.options.BloomBitsPerKey
+	if bitsPerKey == 0 {
+		return nil
+	}
+	keys := 0
+	for range b.Cursor().Keys(nil, nil) {
+		keys++
+	}
+	pageSize := store.PageSize()
+	blockBits := (pageSize - filterBlockHeader) * 8
+	want := max(2*keys, minFilterKeys) * bitsPerKey
+	blocks := min(max((want+blockBits-1)/blockBits, 1), maxFilterBlocks(pageSize))
+
+	dir := make([]byte, pageSize)
+	dir[0] = pageFilter
+	dir[filterHashesOffset] = byte(min(max(int(math.Round(float64(bitsPerKey)*math.Ln2)), 1), 30))
+	binary.LittleEndian.PutUint32(dir[filterBlocksOffset:], uint32(blocks))
+	binary.LittleEndian.PutUint64(dir[filterKeysOffset:], uint64(keys))
+	binary.LittleEndian.PutUint64(dir[filterCapacityOffset:], uint64(blocks*blockBits/bitsPerKey))
+	content := make([][]byte, blocks)
+	for i := range content {
+		content[i] = make([]byte, pageSize)
+		content[i][0] = pageFilterBlock
+	}
+	for key := range b.Cursor().Keys(nil, nil) {
+		p := probe(dir, key, pageSize)
+		for i := range p.hashes {
+			bit := p.bit(i)
+			content[p.block][filterBlockHeader+bit/8] |= 1 << (bit % 8)
+		}
+	}
+	for i, block := range content {
+		id := store.AllocPage()
+		if err := store.WritePage(id, block); err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint64(dir[filterHeaderSize+8*i:], id)
+	}
+	id := store.AllocPage()
+	if err := store.WritePage(id, dir); err != nil {
+		return err
+	}
+	b.filter = id
+	return nil
+}
+
+// maxFilterBlocks is the number of blocks a filter directory holds.
+func maxFilterBlocks(pageSize int) int {
+	return (pageSize - filterHeaderSize) / 8
+}
+
+// filterProbe is where a key lies in a filter: its block, and the bits it
+// sets in the block, found by double hashing.
+type filterProbe struct {
+	block     int
+	hashes    int
+	h1, h2    uint64
+	blockBits uint64
+}
+
+// probe returns the probe of key in the filter of directory dir.
+func probe(dir, key []byte, pageSize int) filterProbe {
+	h := fnv64a(key)
+	blocks := uint64(binary.LittleEndian.Uint32(dir[filterBlocksOffset:]))
+	return filterProbe{
+		block:     int(mix64(h) % blocks),
+		hashes:    int(dir[filterHashesOffset]),
+		h1:        h & math.MaxUint32,
+		h2:        h>>32 | 1,
+		blockBits: uint64((pageSize - filterBlockHeader) * 8),
+	}
+}
+
+// bit returns the offset in the block of the ith bit of the key.
+func (p filterProbe) bit(i int) int {
+	return int((p.h1 + uint64(i)*p.h2) % p.blockBits)
+}
+
+// fnv64a is the 64-bit FNV-1a hash of b.
+func fnv64a(b []byte) uint64 {
+	h := uint64(14695981039346656037)
+	for _, c := range b {
+		h ^= uint64(c)
+		h *= 1099511628211
+	}
+	return h
+}
+
+// mix64 is the finalizer of SplitMix64, which spreads the bits of a hash so
+// that the block of a key does not depend on the bits that place it in the
+// block.
+func mix64(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	return h ^ h>>31
+}
+
+// readFilterPage reads page id of a filter, of type kind.
+func readFilterPage(store pageStore, id uint64, kind byte) ([]byte, error) {
+	buf, err := store.ReadPage(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < store.PageSize() || buf[0] != kind {
+		return nil, atPage(corrupted(0, "invalid filter page"), id)
+	}
+	if kind == pageFilter {
+		blocks := int(binary.LittleEndian.Uint32(buf[filterBlocksOffset:]))
+		if blocks == 0 || blocks > maxFilterBlocks(store.PageSize()) || buf[filterHashesOffset] == 0 {
+			return nil, atPage(corrupted(filterBlocksOffset, "corrupted filter directory"), id)
+		}
+	}
+	return buf, nil
+}
+
+// filterBlocks returns the block pages listed by filter directory dir.
+func filterBlocks(dir []byte) []uint64 {
+	ids := make([]uint64, binary.LittleEndian.Uint32(dir[filterBlocksOffset:]))
+	for i := range ids {
+		ids[i] = binary.LittleEndian.Uint64(dir[filterHeaderSize+8*i:])
+	}
+	return ids
+}
+
+// freeFilter frees the pages of the filter with directory id, if any.
+func freeFilter(store pageStore, id uint64) {
+	if id == 0 {
+		return
+	}
+	dir, err := readFilterPage(store, id, pageFilter)
+	if err != nil {
+		return
+	}
+	for _, block := range filterBlocks(dir) {
+		store.FreePage(block)
+	}
+	store.FreePage(id)
+}
+
+// writePrivatePage writes buf to page id if the transaction allocated it,
+// and otherwise to a new page, freeing id, and returns the page written.
+func writePrivatePage(m *txPageManager, id uint64, buf []byte) (uint64, error) {
+	if !m.private(id) {
+		m.FreePage(id)
+		id = m.AllocPage()
+	}
+	return id, m.WritePage(id, buf)
+}
@@ -0,0 +1,203 @@
+// Package fts is a full-text index for the values of a leafdb bucket. An
+// Index is a leafdb.Hook: set on a bucket, it keeps an inverted index of the
+// tokens of its values in a sibling top-level bucket, in the transaction
+// that writes them, and answers token and token prefix searches from it:
+//
+//	ix := fts.New("docs.fts")
+//	err := db.Write(func(tx *leafdb.Tx) error {
+//		docs, err := tx.CreateBucketIfNotExists([]byte("docs"))
+//		if err != nil {
+//			return err
+//		}
+//		if err := docs.SetHook("fts", ix); err != nil {
+//			return err
+//		}
+//		return docs.Put([]byte("readme"), []byte("An embedded key/value store"))
+//	})
+//
+//	err = db.Read(func(tx *leafdb.Tx) error {
+//		keys, err := ix.Search(tx, "embedded store")
+//		...
+//	})
+//
+// Like every hook, the index must be set on the bucket again after Open;
+// Rebuild indexes the pairs written while it was not.
+package fts
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"strings"
+	"unicode"
+
+	"leafdb"
+)
+
+// Index is an inverted index of the tokens of the values of a bucket, kept
+// in a bucket of its own: a set of keys made of a token, a zero byte and the
+// key of a pair whose value holds the token. Each index must have its own
+// bucket and be set on one bucket only.
+type Index struct {
+	bucket []byte
+	// Tokenize splits a value, or a query, into tokens, which must not hold
+	// zero bytes. Nil uses Tokens.
+	Tokenize func(text []byte) []string
+}
+
+// New returns an index kept in the top-level bucket named bucket.
+func New(bucket string) *Index {
+	return &Index{bucket: []byte(bucket)}
+}
+
+// Tokens splits text into its distinct runs of letters and digits, in
+// lower case, in order of first appearance.
+func Tokens(text []byte) []string {
+	fields := strings.FieldsFunc(strings.ToLower(string(text)), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	var tokens []string
+	seen := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		if !seen[f] {
+			seen[f] = true
+			tokens = append(tokens, f)
+		}
+	}
+	return tokens
+}
+
+// OnPut implements leafdb.Hook, indexing the tokens of value in place of
+// those of old.
+func (ix *Index) OnPut(b *leafdb.Bucket, key, old, value []byte) error {
+	postings, err := ix.postings(b.Tx(), true)
+	if err != nil {
+		return err
+	}
+	gone, added := ix.tokens(old), ix.tokens(value)
+	for _, t := range gone {
+		if !slices.Contains(added, t) {
+			if _, err := postings.Remove(posting(t, key)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, t := range added {
+		if !slices.Contains(gone, t) {
+			if _, err := postings.Add(posting(t, key)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// OnDelete implements leafdb.Hook, removing the tokens of old.
+func (ix *Index) OnDelete(b *leafdb.Bucket, key, old []byte) error {
+	postings, err := ix.postings(b.Tx(), true)
+	if err != nil {
+		return err
+	}
+	for _, t := range ix.tokens(old) {
+		if _, err := postings.Remove(posting(t, key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Search returns the keys, in order, of the pairs whose values hold every
+// token of query, or none if query has no tokens.
+func (ix *Index) Search(tx *leafdb.Tx, query string) ([][]byte, error) {
+	postings, err := ix.postings(tx, false)
+	if err != nil || postings == nil {
+		return nil, err
+	}
+	var keys [][]byte
+	for i, t := range ix.tokens([]byte(query)) {
+		found := matching(postings, []byte(t+"\x00"))
+		if i > 0 {
+			found = slices.DeleteFunc(found, func(k []byte) bool {
+				_, ok := slices.BinarySearchFunc(keys, k, bytes.Compare)
+				return !ok
+			})
+		}
+		keys = found
+		if len(keys) == 0 {
+			break
+		}
+	}
+	return keys, nil
+}
+
+// SearchPrefix returns the keys, in order, of the pairs whose values hold a
+// token that starts with prefix, compared in lower case as Tokens makes
+// them.
+func (ix *Index) SearchPrefix(tx *leafdb.Tx, prefix string) ([][]byte, error) {
+	postings, err := ix.postings(tx, false)
+	if err != nil || postings == nil {
+		return nil, err
+	}
+	keys := matching(postings, []byte(strings.ToLower(prefix)))
+	slices.SortFunc(keys, bytes.Compare)
+	return slices.CompactFunc(keys, bytes.Equal), nil
+}
+
+// Rebuild indexes the pairs of b, which the index is set on, from scratch,
+// dropping what the index held.
+func (ix *Index) Rebuild(b *leafdb.Bucket) error {
+	tx := b.Tx()
+	if err := tx.DeleteBucket(ix.bucket); err != nil && !errors.Is(err, leafdb.ErrBucketNotFound) {
+		return err
+	}
+	for k, v := range b.All() {
+		// With Options.NoCopyReads, k and v are only valid until the next
+		// write.
+		if err := ix.OnPut(b, bytes.Clone(k), nil, bytes.Clone(v)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ix *Index) tokens(text []byte) []string {
+	if text == nil {
+		return nil
+	}
+	if ix.Tokenize != nil {
+		return ix.Tokenize(text)
+	}
+	return Tokens(text)
+}
+
+// postings returns the bucket of ix in tx, creating it if create is set,
+// or nil if it is missing.
+func (ix *Index) postings(tx *leafdb.Tx, create bool) (*leafdb.SetBucket, error) {
+	if !create {
+		return tx.Bucket(ix.bucket).AsSet(), nil
+	}
+	b, err := tx.CreateBucketIfNotExists(ix.bucket)
+	if err != nil {
+		return nil, err
+	}
+	return b.AsSet(), nil
+}
+
+func posting(token string, key []byte) []byte {
+	return append(append([]byte(token), 0), key...)
+}
+
+// matching returns the keys of the postings that start with prefix, in the
+// order of the postings.
+func matching(postings *leafdb.SetBucket, prefix []byte) [][]byte {
+	var keys [][]byte
+	for p := range postings.Bucket().Cursor().Keys(prefix, nil) {
+		if !bytes.HasPrefix(p, prefix) {
+			break
+		}
+		if i := bytes.IndexByte(p, 0); i >= 0 {
+			keys = append(keys, bytes.Clone(p[i+1:]))
+		}
+	}
+	return keys
+}
@@ -0,0 +1,228 @@
+package leafdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+// fuzzPageSize is the page size of fuzzStore, small so that inputs holding
+// several pages stay short.
+const fuzzPageSize = 512
+
+// fuzzLimit bounds the page count decoders are given, as the size of a file
+// bounds it, so that decoded freelists stay small.
+const fuzzLimit = 1 << 16
+
+// fuzzStore is a pageStore held in memory whose pages, from page 2 on, are
+// loaded from the input of a fuzz target. Pages it does not hold read as
+// zeros.
+type fuzzStore struct {
+	pages  map[uint64][]byte
+	next   uint64
+	verify bool
+}
+
+func newFuzzStore(data []byte, verify bool) *fuzzStore {
+	s := &fuzzStore{pages: make(map[uint64][]byte), next: 2, verify: verify}
+	for ; len(data) > 0; s.next++ {
+		page := make([]byte, fuzzPageSize)
+		data = data[copy(page, data):]
+		s.pages[s.next] = page
+	}
+	return s
+}
+
+// image returns the pages of s from page 2 on, as newFuzzStore loads them.
+func (s *fuzzStore) image() []byte {
+	var data []byte
+	for id := uint64(2); id < s.next; id++ {
+		page := s.pages[id]
+		if page == nil {
+			page = make([]byte, fuzzPageSize)
+		}
+		data = append(data, page...)
+	}
+	return data
+}
+
+func (s *fuzzStore) PageSize() int {
+	return fuzzPageSize
+}
+
+func (s *fuzzStore) ReadPage(id uint64) ([]byte, error) {
+	page := make([]byte, fuzzPageSize)
+	copy(page, s.pages[id])
+	return page, nil
+}
+
+func (s *fuzzStore) WritePage(id uint64, buf []byte) error {
+	s.pages[id] = slices.Clone(buf)
+	return nil
+}
+
+func (s *fuzzStore) AllocPage() uint64 {
+	s.next++
+	return s.next - 1
+}
+
+func (s *fuzzStore) FreePage(id uint64) {}
+
+func (s *fuzzStore) VerifyChecksums() bool {
+	return s.verify
+}
+
+// checkDecodeError fails t unless err is nil or a *CorruptionError matching
+// ErrCorrupted.
+func checkDecodeError(t *testing.T, err error) {
+	t.Helper()
+	var ce *CorruptionError
+	if err != nil && (!errors.As(err, &ce) || !errors.Is(err, ErrCorrupted)) {
+		t.Fatalf("decode failed with %v, not a CorruptionError", err)
+	}
+}
+
+func FuzzReadNode(f *testing.F) {
+	s := newFuzzStore(nil, false)
+	root := s.AllocPage()
+	buf, err := encodeNodePage(fuzzPageSize, &node{pageID: root, isLeaf: true})
+	if err != nil {
+		f.Fatal(err)
+	}
+	s.WritePage(root, buf)
+	tree := newBPTree(&root, s)
+	for i := range 24 {
+		value := bytes.Repeat([]byte{byte(i)}, i%4*8)
+		if i%10 == 0 {
+			value = bytes.Repeat([]byte{byte(i)}, 2*fuzzPageSize)
+		}
+		if err := tree.set(fmt.Appendf(nil, "key%03d", i), value); err != nil {
+			f.Fatal(err)
+		}
+	}
+	for id := uint64(2); id < s.next; id++ {
+		if kind := s.pages[id][0]; kind == pageLeaf || kind == pageBranch {
+			f.Add(s.image(), id, true)
+		}
+	}
+	f.Fuzz(func(t *testing.T, data []byte, id uint64, verify bool) {
+		n, err := readNode(newFuzzStore(data, verify), id)
+		checkDecodeError(t, err)
+		if err != nil {
+			return
+		}
+		if n.isLeaf && (len(n.values) != len(n.keys) || len(n.overflow) != len(n.keys)) {
+			t.Fatalf("leaf of %d keys has %d values", len(n.keys), len(n.values))
+		}
+		if !n.isLeaf && (len(n.children) != len(n.keys)+1 || len(n.counts) != len(n.children)) {
+			t.Fatalf("branch of %d keys has %d children", len(n.keys), len(n.children))
+		}
+	})
+}
+
+func FuzzReadMetaPage(f *testing.F) {
+	for _, freelist := range [][]uint64{nil, {3, 4, 5, 9}, {7, 100, 101}} {
+		page := make([]byte, defaultPageSize)
+		m := meta{txid: 7, root: 2, nextPage: 200, freelistPage: 6, freelist: freelist}
+		if err := writeMetaPage(page, m, defaultPageSize, nil); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(page, uint64(200))
+	}
+	f.Fuzz(func(t *testing.T, data []byte, limit uint64) {
+		limit %= fuzzLimit
+		page := make([]byte, defaultPageSize)
+		copy(page, data)
+		m, ok, err := readMetaPage(page, defaultPageSize, limit)
+		checkDecodeError(t, err)
+		if err != nil || !ok {
+			return
+		}
+		if m.nextPage > limit {
+			t.Fatalf("next page %d past limit %d", m.nextPage, limit)
+		}
+		if m.freelistPage != 0 && (m.freelistPage <= metaPage1 || m.freelistPage >= m.nextPage) {
+			t.Fatalf("freelist page %d out of range", m.freelistPage)
+		}
+	})
+}
+
+func FuzzReadFreeRuns(f *testing.F) {
+	runs := []pageRun{{3, 1}, {5, 10}, {200, 2}}
+	f.Add(appendFreeRuns(nil, runs), uint16(len(runs)), uint64(300))
+	f.Fuzz(func(t *testing.T, data []byte, count uint16, limit uint64) {
+		limit %= fuzzLimit
+		ids, err := readFreeRuns(data, 0, int(count), limit)
+		checkDecodeError(t, err)
+		for i, id := range ids {
+			if id >= limit || i > 0 && id <= ids[i-1] {
+				t.Fatalf("page %d out of order or past limit %d", id, limit)
+			}
+		}
+	})
+}
+
+func FuzzReadFreelistPage(f *testing.F) {
+	page := make([]byte, defaultPageSize)
+	if err := writeFreelistPage(page, []pageRun{{3, 1}, {5, 10}, {200, 2}}, 9, defaultPageSize); err != nil {
+		f.Fatal(err)
+	}
+	f.Add(page, uint64(300))
+	f.Fuzz(func(t *testing.T, data []byte, limit uint64) {
+		limit %= fuzzLimit
+		page := make([]byte, defaultPageSize)
+		copy(page, data)
+		_, ids, err := readFreelistPage(page, defaultPageSize, limit)
+		checkDecodeError(t, err)
+		if err != nil || page[0] != pageFreeRuns {
+			return
+		}
+		for _, id := range ids {
+			if id >= limit {
+				t.Fatalf("page %d past limit %d", id, limit)
+			}
+		}
+	})
+}
+
+func FuzzReadBucketHeader(f *testing.F) {
+	for _, opts := range []BucketOptions{
+		{},
+		{FillPercent: 0.9, BlobThreshold: 1024, Validator: "json", BloomBitsPerKey: 10},
+		{Comparator: "reverse", Codec: "zstd", TTL: time.Hour},
+	} {
+		s := newFuzzStore(nil, false)
+		id := s.AllocPage()
+		h := bucketHeader{kvRoot: 3, bucketRoot: 4, sequence: 5, options: opts, filter: 6}
+		if err := writeBucketHeader(s, id, h); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(s.image())
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h, err := readBucketHeader(newFuzzStore(data, false), 2)
+		checkDecodeError(t, err)
+		if err != nil {
+			return
+		}
+		if h.options.BlobThreshold > maxValueLength || h.options.BloomBitsPerKey > maxBloomBitsPerKey || h.options.TTL < 0 {
+			t.Fatalf("invalid options %+v", h.options)
+		}
+		// What decodes encodes to a record that decodes to the same.
+		rec := encodeBucketOptions(h.options, h.filter)
+		page := make([]byte, fuzzPageSize)
+		page[bucketOptionsOffset] = byte(len(rec))
+		page[bucketOptionsOffset+1] = byte(len(rec) >> 8)
+		copy(page[bucketOptionsOffset+2:], rec)
+		opts, filter, err := decodeBucketOptions(page)
+		if err != nil {
+			t.Fatalf("options %+v do not decode once encoded: %v", h.options, err)
+		}
+		if again := encodeBucketOptions(opts, filter); !bytes.Equal(again, rec) {
+			t.Fatalf("options %+v change once encoded and decoded", h.options)
+		}
+	})
+}
@@ -0,0 +1,98 @@
+package leafdb
+
+import (
+	"maps"
+	"slices"
+)
+
+// Hook is notified of the writes to a bucket it is set on with SetHook, in
+// the transaction that makes them, after the pair and the declared indexes
+// are updated. Hooks maintain derived data, such as a full-text index in
+// another bucket, which they may write to through b.Tx. An error from a hook
+// fails the write, which has been made already, so the transaction should
+// be rolled back.
+type Hook interface {
+	// OnPut is called when value is stored under key in b by Put, Merge,
+	// PutReader or FillFromSorted. old is the value it replaces, or nil if
+	// key was absent; an empty value is not nil.
+	OnPut(b *Bucket, key, old, value []byte) error
+	// OnDelete is called when key, which held old, is deleted from b.
+	OnDelete(b *Bucket, key, old []byte) error
+}
+
+// SetHook sets h as the hook named name of b, replacing the hook of that
+// name if any, or removes it if h is nil. Hooks are kept by the DB for the
+// bucket at the path of b, not in the file, so they must be set again after
+// Open. The hooks of a bucket run in order of name.
+func (b *Bucket) SetHook(name string, h Hook) error {
+	if b == nil || b.tx == nil || b.tx.closed {
+		return ErrTxClosed
+	}
+	db := b.tx.db
+	path := encodeBucketPath(b.path())
+	db.hookMu.Lock()
+	defer db.hookMu.Unlock()
+	if h == nil {
+		delete(db.hooks[path], name)
+		return nil
+	}
+	if db.hooks == nil {
+		db.hooks = make(map[string]map[string]Hook)
+	}
+	if db.hooks[path] == nil {
+		db.hooks[path] = make(map[string]Hook)
+	}
+	db.hooks[path][name] = h
+	return nil
+}
+
+// Tx returns the transaction of b.
+func (b *Bucket) Tx() *Tx {
+	if b == nil {
+		return nil
+	}
+	return b.tx
+}
+
+// hooks returns the hooks of b in order of name.
+func (b *Bucket) hooks() []Hook {
+	db := b.tx.db
+	db.hookMu.RLock()
+	defer db.hookMu.RUnlock()
+	set := db.hooks[encodeBucketPath(b.path())]
+	if len(set) == 0 {
+		return nil
+	}
+	hooks := make([]Hook, 0, len(set))
+	for _, name := range slices.Sorted(maps.Keys(set)) {
+		hooks = append(hooks, set[name])
+	}
+	return hooks
+}
+
+// putHooks notifies hooks that value was stored under key in place of old.
+func (b *Bucket) putHooks(hooks []Hook, key, old, value []byte) error {
+	if value == nil {
+		value = []byte{}
+	}
+	b.tx.hookDepth++
+	defer func() { b.tx.hookDepth-- }()
+	for _, h := range hooks {
+		if err := h.OnPut(b, key, old, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteHooks notifies hooks that key, which held old, was deleted.
+func (b *Bucket) deleteHooks(hooks []Hook, key, old []byte) error {
+	b.tx.hookDepth++
+	defer func() { b.tx.hookDepth-- }()
+	for _, h := range hooks {
+		if err := h.OnDelete(b, key, old); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,378 @@
+package leafdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// IndexFunc derives the index values of a key/value pair. It may return
+// several values, or none to leave the pair out of the index. It must be
+// deterministic: the values it returns for a stored pair are recomputed to
+// remove the pair's entries when the pair changes.
+type IndexFunc func(key, value []byte) [][]byte
+
+// indexBucketPrefix starts the names of the nested buckets that hold a
+// bucket's indexes.
+const indexBucketPrefix = reservedPrefix + "index:"
+
+// declaredIndex is an index as declared in this process.
+type declaredIndex struct {
+	fn     IndexFunc
+	unique bool
+}
+
+// DeclareIndex declares an index named name over the pairs of b, derived by
+// fn. The first declaration creates the index and fills it from the pairs
+// already in b. Index functions are not stored in the file, so every process
+// that writes to b must declare its indexes again after Open; Put and Delete
+// on a bucket with an undeclared index fail with ErrIndexNotDeclared.
+//
+// From then on Put and Delete keep the index up to date in the same
+// transaction. Query it with ByIndex.
+func (b *Bucket) DeclareIndex(name string, fn IndexFunc) error {
+	return b.declareIndex(name, declaredIndex{fn: fn})
+}
+
+// DeclareUniqueIndex is DeclareIndex for an index in which no two keys may
+// share an index value. Writes that would make a key share one with
+// another fail with ErrUniqueViolation and leave b unchanged, and so does
+// the declaration if the pairs already in b break the constraint.
+//
+// Like the function, uniqueness is not stored in the file and must be
+// declared again after Open. Declaring an index that exists already as
+// unique scans its entries to check that they hold to the constraint.
+func (b *Bucket) DeclareUniqueIndex(name string, fn IndexFunc) error {
+	return b.declareIndex(name, declaredIndex{fn: fn, unique: true})
+}
+
+func (b *Bucket) declareIndex(name string, decl declaredIndex) error {
+	if b == nil || b.tx == nil || b.tx.closed {
+		return ErrTxClosed
+	}
+	if !b.tx.writable {
+		return ErrTxReadOnly
+	}
+	if name == "" || decl.fn == nil {
+		return fmt.Errorf("leafdb: index name and function required")
+	}
+	if err := b.buildIndex(name, decl); err != nil {
+		return err
+	}
+	db := b.tx.db
+	db.indexMu.Lock()
+	if db.indexes == nil {
+		db.indexes = make(map[string]declaredIndex)
+	}
+	db.indexes[indexKey(b, name)] = decl
+	db.indexMu.Unlock()
+	return nil
+}
+
+// buildIndex creates the index named name of b and fills it from the pairs
+// of b, or checks an existing index against the unique constraint.
+func (b *Bucket) buildIndex(name string, decl declaredIndex) error {
+	bucketName := []byte(indexBucketPrefix + name)
+	if ix := b.child(bucketName); ix != nil {
+		if decl.unique {
+			return checkUniqueEntries(ix, name)
+		}
+		return nil
+	}
+	b.tx.untrackedWrite()
+	ix, err := b.createChild(bucketName)
+	if err != nil {
+		return err
+	}
+	bound := []boundIndex{{bucket: ix, name: name, declaredIndex: decl}}
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if err := checkUnique(bound, k, v); err != nil {
+			return err
+		}
+		if err := addIndexEntries(ix, decl.fn(k, v), k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DropIndex deletes the index named name from b.
+func (b *Bucket) DropIndex(name string) error {
+	if b == nil || b.tx == nil || b.tx.closed {
+		return ErrTxClosed
+	}
+	b.tx.untrackedWrite()
+	err := b.deleteChild([]byte(indexBucketPrefix + name))
+	if err == ErrBucketNotFound {
+		return ErrIndexNotFound
+	}
+	return err
+}
+
+// Indexes returns the names of the indexes of b in order.
+func (b *Bucket) Indexes() []string {
+	if b == nil || b.tx == nil || b.tx.closed {
+		return nil
+	}
+	var names []string
+	root := b.bucketRoot
+	c := &Cursor{tree: newBPTree(&root, b.tx.mgr)}
+	for k, _ := c.Seek([]byte(indexBucketPrefix)); k != nil && isIndexBucket(k); k, _ = c.Next() {
+		names = append(names, string(k[len(indexBucketPrefix):]))
+	}
+	return names
+}
+
+// ByIndex returns a cursor over the index named name, or nil if b has no
+// such index.
+func (b *Bucket) ByIndex(name string) *IndexCursor {
+	ix := b.child([]byte(indexBucketPrefix + name))
+	if ix == nil {
+		return nil
+	}
+	return &IndexCursor{bucket: b, c: ix.Cursor()}
+}
+
+// IndexCursor iterates over an index in order of index value, and of key
+// for pairs with equal index values. Each position yields the index value
+// and the key and value of the indexed pair; a pair with several index
+// values appears once for each.
+type IndexCursor struct {
+	bucket *Bucket
+	c      *Cursor
+}
+
+// First moves to the first entry.
+func (ic *IndexCursor) First() (indexValue, key, value []byte) {
+	if ic == nil {
+		return nil, nil, nil
+	}
+	k, _ := ic.c.First()
+	return ic.entry(k)
+}
+
+// Last moves to the last entry.
+func (ic *IndexCursor) Last() (indexValue, key, value []byte) {
+	if ic == nil {
+		return nil, nil, nil
+	}
+	k, _ := ic.c.Last()
+	return ic.entry(k)
+}
+
+// Next moves to the next entry.
+func (ic *IndexCursor) Next() (indexValue, key, value []byte) {
+	if ic == nil {
+		return nil, nil, nil
+	}
+	k, _ := ic.c.Next()
+	return ic.entry(k)
+}
+
+// Prev moves to the previous entry.
+func (ic *IndexCursor) Prev() (indexValue, key, value []byte) {
+	if ic == nil {
+		return nil, nil, nil
+	}
+	k, _ := ic.c.Prev()
+	return ic.entry(k)
+}
+
+// Seek moves to the first entry whose index value is >= seek.
+func (ic *IndexCursor) Seek(seek []byte) (indexValue, key, value []byte) {
+	if ic == nil {
+		return nil, nil, nil
+	}
+	k, _ := ic.c.Seek(escapeIndexValue(nil, seek))
+	return ic.entry(k)
+}
+
+func (ic *IndexCursor) entry(k []byte) ([]byte, []byte, []byte) {
+	if k == nil {
+		return nil, nil, nil
+	}
+	indexValue, key, ok := decodeIndexEntry(k)
+	if !ok {
+		return nil, nil, nil
+	}
+	return indexValue, key, ic.bucket.Get(key)
+}
+
+// indexKey identifies the index named name of bucket b in DB.indexes by the
+// length-prefixed names on the path to b.
+func indexKey(b *Bucket, name string) string {
+	return encodeBucketPath(b.path()) + "\x00" + name
+}
+
+// encodeBucketPath length-prefixes the names of path, so the encoding of a
+// bucket's path is a prefix of those of the buckets inside it.
+func encodeBucketPath(path [][]byte) string {
+	var key []byte
+	for _, p := range path {
+		key = binary.AppendUvarint(key, uint64(len(p)))
+		key = append(key, p...)
+	}
+	return string(key)
+}
+
+func isIndexBucket(name []byte) bool {
+	return bytes.HasPrefix(name, []byte(indexBucketPrefix))
+}
+
+// boundIndex is a declared index of a bucket opened for maintenance.
+type boundIndex struct {
+	bucket *Bucket
+	name   string
+	declaredIndex
+}
+
+// declaredIndexes opens the indexes of b and looks up their functions.
+func (b *Bucket) declaredIndexes() ([]boundIndex, error) {
+	names := b.Indexes()
+	if len(names) == 0 {
+		return nil, nil
+	}
+	db := b.tx.db
+	out := make([]boundIndex, 0, len(names))
+	db.indexMu.RLock()
+	defer db.indexMu.RUnlock()
+	for _, name := range names {
+		decl, ok := db.indexes[indexKey(b, name)]
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", ErrIndexNotDeclared, name)
+		}
+		ix := b.child([]byte(indexBucketPrefix + name))
+		if ix == nil {
+			return nil, ErrIndexNotFound
+		}
+		out = append(out, boundIndex{bucket: ix, name: name, declaredIndex: decl})
+	}
+	return out, nil
+}
+
+// checkUnique returns ErrUniqueViolation if storing value under key would
+// give key an index value that another key has in one of the unique
+// indexes. It must run before anything is written, so that a violation
+// leaves the bucket unchanged.
+func checkUnique(indexes []boundIndex, key, value []byte) error {
+	if value == nil {
+		value = []byte{}
+	}
+	for _, ix := range indexes {
+		if !ix.unique {
+			continue
+		}
+		for _, v := range ix.fn(key, value) {
+			prefix := append(escapeIndexValue(nil, v), 0x00, 0x01)
+			c := ix.bucket.Cursor()
+			for k := c.SeekKey(prefix); k != nil && bytes.HasPrefix(k, prefix); k = c.NextKey() {
+				if !bytes.Equal(k[len(prefix):], key) {
+					return fmt.Errorf("%w: index %q, value %q", ErrUniqueViolation, ix.name, v)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkUniqueEntries returns ErrUniqueViolation if two keys share an index
+// value in the index ix named name. Entries are in index value order, so
+// such keys are next to each other.
+func checkUniqueEntries(ix *Bucket, name string) error {
+	var prev []byte
+	for k := range ix.Cursor().Keys(nil, nil) {
+		v, _, ok := decodeIndexEntry(k)
+		if !ok {
+			continue
+		}
+		if prev != nil && bytes.Equal(v, prev) {
+			return fmt.Errorf("%w: index %q, value %q", ErrUniqueViolation, name, v)
+		}
+		prev = v
+	}
+	return nil
+}
+
+// indexedValue returns a copy of the value stored under key if b has
+// indexes or hooks to update, or nil if it has none or key is absent.
+func indexedValue(tree *bptree, indexes []boundIndex, hooks []Hook, key []byte) ([]byte, error) {
+	if len(indexes) == 0 && len(hooks) == 0 {
+		return nil, nil
+	}
+	v, ok, err := tree.get(key)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return append([]byte{}, v...), nil
+}
+
+// updateIndexes replaces the index entries of key, derived from old, with
+// those derived from value. A nil old or value means the pair was absent or
+// is being removed.
+func updateIndexes(indexes []boundIndex, key, old, value []byte) error {
+	for _, ix := range indexes {
+		if old != nil {
+			for _, v := range ix.fn(key, old) {
+				if err := ix.bucket.Delete(encodeIndexEntry(v, key)); err != nil {
+					return err
+				}
+			}
+		}
+		if value != nil {
+			if err := addIndexEntries(ix.bucket, ix.fn(key, value), key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func addIndexEntries(ix *Bucket, values [][]byte, key []byte) error {
+	for _, v := range values {
+		if err := ix.Put(encodeIndexEntry(v, key), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Index entries are keyed by the escaped index value, a terminator and the
+// indexed key. Escaping 0x00 as 0x00 0xff and terminating with 0x00 0x01
+// keeps entries in index value order whatever bytes the values hold.
+func encodeIndexEntry(indexValue, key []byte) []byte {
+	out := escapeIndexValue(make([]byte, 0, len(indexValue)+len(key)+4), indexValue)
+	out = append(out, 0x00, 0x01)
+	return append(out, key...)
+}
+
+func escapeIndexValue(dst, v []byte) []byte {
+	for _, c := range v {
+		if c == 0x00 {
+			dst = append(dst, 0x00, 0xff)
+		} else {
+			dst = append(dst, c)
+		}
+	}
+	return dst
+}
+
+func decodeIndexEntry(entry []byte) ([]byte, []byte, bool) {
+	v := make([]byte, 0, len(entry))
+	for i := 0; i+1 < len(entry); i++ {
+		if entry[i] != 0x00 {
+			v = append(v, entry[i])
+			continue
+		}
+		switch entry[i+1] {
+		case 0xff:
+			v = append(v, 0x00)
+			i++
+		case 0x01:
+			return v, entry[i+2:], true
+		default:
+			return nil, nil, false
+		}
+	}
+	return nil, nil, false
+}
@@ -0,0 +1,92 @@
+package leafdb_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"leafdb"
+)
+
+// byEmail indexes values of the form "name,email" by email.
+func byEmail(key, value []byte) [][]byte {
+	_, email, ok := bytes.Cut(value, []byte(","))
+	if !ok {
+		return nil
+	}
+	return [][]byte{email}
+}
+
+func TestUniqueIndexViolation(t *testing.T) {
+	db, err := leafdb.OpenMem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Write(func(tx *leafdb.Tx) error {
+		b, err := tx.CreateBucket([]byte("users"))
+		if err != nil {
+			return err
+		}
+		if err := b.DeclareUniqueIndex("email", byEmail); err != nil {
+			return err
+		}
+		if err := b.Put([]byte("u1"), []byte("ann,ann@example.com")); err != nil {
+			return err
+		}
+		// A key may keep its own index value.
+		if err := b.Put([]byte("u1"), []byte("Ann,ann@example.com")); err != nil {
+			return err
+		}
+		err = b.Put([]byte("u2"), []byte("bob,ann@example.com"))
+		if !errors.Is(err, leafdb.ErrUniqueViolation) {
+			t.Fatalf("duplicate index value: %v, want ErrUniqueViolation", err)
+		}
+		if msg := err.Error(); !strings.Contains(msg, `"email"`) || !strings.Contains(msg, `"ann@example.com"`) {
+			t.Fatalf("error %q does not name the index and value", msg)
+		}
+		if v := b.Get([]byte("u2")); v != nil {
+			t.Fatalf("rejected key stored with value %q", v)
+		}
+		_, key, _ := b.ByIndex("email").Seek([]byte("ann@example.com"))
+		if string(key) != "u1" {
+			t.Fatalf("index maps the value to key %q, want u1", key)
+		}
+		// Once u1 moves to another value, its old one is free.
+		if err := b.Put([]byte("u1"), []byte("ann,ann@example.org")); err != nil {
+			return err
+		}
+		return b.Put([]byte("u2"), []byte("bob,ann@example.com"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeclareUniqueIndexOverDuplicates(t *testing.T) {
+	db, err := leafdb.OpenMem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Write(func(tx *leafdb.Tx) error {
+		b, err := tx.CreateBucket([]byte("users"))
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte("u1"), []byte("ann,same@example.com")); err != nil {
+			return err
+		}
+		if err := b.Put([]byte("u2"), []byte("bob,same@example.com")); err != nil {
+			return err
+		}
+		if err := b.DeclareUniqueIndex("email", byEmail); !errors.Is(err, leafdb.ErrUniqueViolation) {
+			t.Fatalf("declaring over duplicates: %v, want ErrUniqueViolation", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,254 @@
+package leafdb
+
+import (
+	"encoding/binary"
+	"io"
+	"slices"
+)
+
+// PageInfo is the decoded view of one page of a database file, returned by
+// InspectPage. Only the fields of the page's type are set.
+type PageInfo struct {
+	ID uint64
+	// Type is "meta", "leaf", "branch", "bucket", "freelist", "overflow",
+	// "blob", "filter" or "filter block"; "empty" for a page of zeros, which
+	// was never written or was punched out; or "unknown".
+	Type string
+	// Data is the page, decrypted if the file is encrypted and the page
+	// could be authenticated, and as stored otherwise.
+	Data []byte
+	// Err is why the page could not be decoded, or nil. The fields decoded
+	// before the problem was found are still set.
+	Err error
+
+	// Count is the number of keys of a node page, of entries of a freelist
+	// page: page IDs, or runs of them in files that store the freelist as
+	// runs, or of blocks of a filter.
+	Count int
+	// Next is the next page of a freelist, overflow or blob chain, or the
+	// right sibling a leaf had when it was split.
+	Next uint64
+	// Checksum reports whether a node page carries a checksum, and
+	// ChecksumOK whether it matches.
+	Checksum   bool
+	ChecksumOK bool
+	// Slots reports whether a leaf ends with a slot directory.
+	Slots bool
+	// Entries are the pairs of a leaf.
+	Entries []PageEntry
+	// Keys and Children are the separator keys and child pages of a branch;
+	// Children are also the block pages of a filter.
+	Keys     [][]byte
+	Children []uint64
+	// Counts are the numbers of pairs below the children of a branch, if it
+	// stores them.
+	Counts []uint64
+
+	// KVRoot, BucketRoot, Sequence, Quota, QuotaUsed, BucketOptions and
+	// Filter, the directory page of its Bloom filter, are the fields of a
+	// bucket header.
+	KVRoot        uint64
+	BucketRoot    uint64
+	Sequence      uint64
+	Quota         uint64
+	QuotaUsed     uint64
+	BucketOptions BucketOptions
+	Filter        uint64
+
+	// Magic, TxID, Root, NextPage, FreelistPage and Encrypted are the
+	// fields of a meta page.
+	Magic        string
+	TxID         uint64
+	Root         uint64
+	NextPage     uint64
+	FreelistPage uint64
+	Encrypted    bool
+	// Free lists the page IDs held by a meta or freelist page.
+	Free []uint64
+}
+
+// PageEntry is a pair of a leaf page.
+type PageEntry struct {
+	Key   []byte
+	Value []byte
+	// Overflow is the first page of a value stored out of line, or zero;
+	// such values are not read, and only their Length is set.
+	Overflow uint64
+	Length   int
+}
+
+// InspectPage decodes page id of the database file of size bytes in r,
+// without opening the database or following references to other pages, so
+// that damaged files can be examined page by page. Pages of encrypted files
+// other than the meta pages need opts.EncryptionKey and an intact meta page.
+// The error is only set if the page cannot be read at all; decoding
+// problems are reported in PageInfo.Err, as a *CorruptionError unless the
+// page could not be decrypted.
+func InspectPage(r io.ReaderAt, size int64, id uint64, opts *Options) (PageInfo, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	diskPageSize, err := diskPageSizeFor(opts)
+	if err != nil {
+		return PageInfo{}, err
+	}
+	store := &salvageStore{
+		r:            r,
+		pages:        uint64(max(size, 0)) / uint64(diskPageSize),
+		diskPageSize: diskPageSize,
+	}
+	info := PageInfo{ID: id, Type: "unknown"}
+	stored, err := store.stored(id)
+	if err != nil {
+		return info, err
+	}
+	info.Data = stored
+	if !slices.ContainsFunc(stored, func(b byte) bool { return b != 0 }) {
+		info.Type = "empty"
+		return info, nil
+	}
+	if id <= metaPage1 {
+		info.inspectMeta(stored, store.pages)
+		info.Err = atPage(info.Err, id)
+		return info, nil
+	}
+	if err := store.initCipher(opts.EncryptionKey); err != nil {
+		return info, err
+	}
+	if store.cipher != nil {
+		page, err := store.cipher.open(id, stored)
+		if err != nil {
+			info.Err = err
+			return info, nil
+		}
+		info.Data = page
+	}
+	page := info.Data
+	switch page[0] {
+	case pageLeaf, pageBranch:
+		info.inspectNode(page)
+	case pageBucket:
+		info.Type = "bucket"
+		info.KVRoot = binary.LittleEndian.Uint64(page[1:])
+		info.BucketRoot = binary.LittleEndian.Uint64(page[9:])
+		info.Sequence = binary.LittleEndian.Uint64(page[17:])
+		info.Quota = binary.LittleEndian.Uint64(page[25:])
+		info.QuotaUsed = binary.LittleEndian.Uint64(page[33:])
+		info.BucketOptions, info.Filter, info.Err = decodeBucketOptions(page)
+	case pageFreelist, pageFreeRuns:
+		info.Type = "freelist"
+		info.Count = int(binary.LittleEndian.Uint16(page[1:]))
+		info.Next, info.Free, info.Err = readFreelistPage(page, defaultPageSize, store.pages)
+	case pageOverflow:
+		info.Type = "overflow"
+		info.Next = binary.LittleEndian.Uint64(page[1:])
+	case pageBlob:
+		info.Type = "blob"
+		info.Next = binary.LittleEndian.Uint64(page[1:])
+	case pageFilter:
+		info.Type = "filter"
+		if blocks := int(binary.LittleEndian.Uint32(page[filterBlocksOffset:])); blocks > maxFilterBlocks(len(page)) {
+			info.Err = corrupted(filterBlocksOffset, "corrupted filter directory")
+		} else {
+			info.Children = filterBlocks(page)
+			info.Count = blocks
+		}
+	case pageFilterBlock:
+		info.Type = "filter block"
+	}
+	info.Err = atPage(info.Err, id)
+	return info, nil
+}
+
+func (info *PageInfo) inspectMeta(page []byte, pages uint64) {
+	info.Type = "meta"
+	info.Magic = string(page[:4])
+	m, ok, err := readMetaPage(page, defaultPageSize, pages)
+	switch {
+	case err != nil:
+		info.Err = err
+		return
+	case !ok:
+		info.Err = corrupted(0, "bad meta page magic")
+		return
+	}
+	flags, _ := metaFormat(page)
+	info.TxID = m.txid
+	info.Root = m.root
+	info.NextPage = m.nextPage
+	info.FreelistPage = m.freelistPage
+	info.Encrypted = flags&metaFlagEncrypted != 0
+	info.Free = m.freelist
+}
+
+func (info *PageInfo) inspectNode(page []byte) {
+	info.Count = int(binary.LittleEndian.Uint16(page[1:]))
+	info.Next = binary.LittleEndian.Uint64(page[3:])
+	flags := binary.LittleEndian.Uint16(page[11:])
+	pos := nodeHeaderSizeV3
+	if flags&nodeFlagChecksum != 0 {
+		pos = nodeHeaderSize
+		info.Checksum = true
+		info.ChecksumOK = binary.LittleEndian.Uint32(page[13:]) == nodeChecksum(page)
+	}
+	if page[0] == pageBranch {
+		info.Type = "branch"
+		n, err := decodeBranchNode(info.ID, info.Count, page, pos, flags)
+		if err != nil {
+			info.Err = err
+			return
+		}
+		info.Keys, info.Children = n.keys, n.children
+		if flags&nodeFlagCounts != 0 {
+			info.Counts = n.counts
+		}
+		return
+	}
+	info.Type = "leaf"
+	info.Slots = flags&nodeFlagSlots != 0
+	var prefix []byte
+	if flags&nodeFlagPrefix != 0 {
+		var err error
+		if prefix, pos, err = readKey(page, pos); err != nil {
+			info.Err = err
+			return
+		}
+	}
+	for range info.Count {
+		var e PageEntry
+		var empty bool
+		var err error
+		if e.Key, empty, pos, err = readLeafKey(page, pos, prefix, flags); err != nil {
+			info.Err = err
+			return
+		}
+		if empty {
+			e.Value = page[pos:pos]
+			info.Entries = append(info.Entries, e)
+			continue
+		}
+		if pos+4 > len(page) {
+			info.Err = corrupted(pos, "corrupted value length")
+			return
+		}
+		length := binary.LittleEndian.Uint32(page[pos:])
+		pos += 4
+		e.Length = int(length &^ valueOverflowFlag)
+		if length&valueOverflowFlag != 0 {
+			if pos+8 > len(page) {
+				info.Err = corrupted(pos, "corrupted overflow pointer")
+				return
+			}
+			e.Overflow = binary.LittleEndian.Uint64(page[pos:])
+			pos += 8
+		} else {
+			if pos+e.Length > len(page) {
+				info.Err = corrupted(pos, "corrupted value data")
+				return
+			}
+			e.Value = page[pos : pos+e.Length]
+			pos += e.Length
+		}
+		info.Entries = append(info.Entries, e)
+	}
+}
@@ -0,0 +1,169 @@
+// Package metrics exports the statistics of a leafdb database as Prometheus
+// metrics. A Collector reads DB.Stats on every scrape, so it costs nothing
+// between scrapes:
+//
+//	prometheus.MustRegister(metrics.NewCollector(db, prometheus.Labels{"db": "orders"}))
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"leafdb"
+)
+
+const namespace = "leafdb"
+
+// Collector is a prometheus.Collector for the statistics of one database.
+type Collector struct {
+	db *leafdb.DB
+
+	commits         *prometheus.Desc
+	rollbacks       *prometheus.Desc
+	readTxs         *prometheus.Desc
+	openReadTxs     *prometheus.Desc
+	commitDuration  *prometheus.Desc
+	phaseDuration   *prometheus.Desc
+	writerLockWaits *prometheus.Desc
+	writerLockWait  *prometheus.Desc
+	writerQueue     *prometheus.Desc
+	writerQueueMax  *prometheus.Desc
+	remaps          *prometheus.Desc
+	remapStalls     *prometheus.Desc
+	remapStallTime  *prometheus.Desc
+	pagesAllocated  *prometheus.Desc
+	pagesFreed      *prometheus.Desc
+	pagesWritten    *prometheus.Desc
+	bytesWritten    *prometheus.Desc
+	pagesPunched    *prometheus.Desc
+	pages           *prometheus.Desc
+	freePages       *prometheus.Desc
+	pendingPages    *prometheus.Desc
+	cacheHits       *prometheus.Desc
+	cacheMisses     *prometheus.Desc
+	cacheNodes      *prometheus.Desc
+	cacheBytes      *prometheus.Desc
+	remoteFetches   *prometheus.Desc
+	remoteFetched   *prometheus.Desc
+	remoteCached    *prometheus.Desc
+}
+
+// NewCollector returns a Collector for db. labels are added to every
+// metric, to tell several databases of one process apart.
+func NewCollector(db *leafdb.DB, labels prometheus.Labels) *Collector {
+	desc := func(name, help string, variable ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, variable, labels)
+	}
+	return &Collector{
+		db:              db,
+		commits:         desc("commits_total", "Write transactions committed."),
+		rollbacks:       desc("rollbacks_total", "Write transactions rolled back, including failed commits."),
+		readTxs:         desc("read_transactions_total", "Read transactions begun."),
+		openReadTxs:     desc("open_read_transactions", "Read transactions currently open."),
+		commitDuration:  desc("commit_duration_seconds", "Duration of commits."),
+		phaseDuration:   desc("commit_phase_duration_seconds", "Duration of the phases of commits.", "phase"),
+		writerLockWaits: desc("writer_lock_waits_total", "Writers that waited for the writer lock."),
+		writerLockWait:  desc("writer_lock_wait_seconds_total", "Time writers spent waiting for the writer lock."),
+		writerQueue:     desc("writer_queue_length", "Writers waiting for the writer lock."),
+		writerQueueMax:  desc("writer_queue_max", "Most writers that ever waited for the writer lock at once."),
+		remaps:          desc("remaps_total", "Replacements of the memory map as the file grew."),
+		remapStalls:     desc("remap_stalls_total", "Read transactions that waited for a remap to begin."),
+		remapStallTime:  desc("remap_stall_seconds_total", "Time read transactions spent waiting for remaps."),
+		pagesAllocated:  desc("pages_allocated_total", "Pages allocated by committed write transactions."),
+		pagesFreed:      desc("pages_freed_total", "Pages freed by committed write transactions."),
+		pagesWritten:    desc("pages_written_total", "Pages written to the file by commits."),
+		bytesWritten:    desc("written_bytes_total", "Bytes of pages written to the file by commits."),
+		pagesPunched:    desc("pages_punched_total", "Free pages punched out of the file."),
+		pages:           desc("pages", "Pages in use in the file, including free ones."),
+		freePages:       desc("free_pages", "Pages ready for reuse."),
+		pendingPages:    desc("pending_pages", "Freed pages held back for open readers."),
+		cacheHits:       desc("node_cache_hits_total", "Lookups of committed pages found in the node cache."),
+		cacheMisses:     desc("node_cache_misses_total", "Lookups of committed pages missing from the node cache."),
+		cacheNodes:      desc("node_cache_nodes", "Nodes held in the node cache."),
+		cacheBytes:      desc("node_cache_bytes", "Estimated size of the nodes held in the node cache."),
+		remoteFetches:   desc("remote_fetches_total", "Ranges fetched from the file of a remote database."),
+		remoteFetched:   desc("remote_fetched_bytes_total", "Bytes fetched from the file of a remote database."),
+		remoteCached:    desc("remote_cached_bytes", "Bytes of fetched ranges held in memory."),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		c.commits, c.rollbacks, c.readTxs, c.openReadTxs,
+		c.commitDuration, c.phaseDuration,
+		c.writerLockWaits, c.writerLockWait, c.writerQueue, c.writerQueueMax,
+		c.remaps, c.remapStalls, c.remapStallTime,
+		c.pagesAllocated, c.pagesFreed, c.pagesWritten, c.bytesWritten, c.pagesPunched,
+		c.pages, c.freePages, c.pendingPages,
+		c.cacheHits, c.cacheMisses, c.cacheNodes, c.cacheBytes,
+		c.remoteFetches, c.remoteFetched, c.remoteCached,
+	} {
+		ch <- d
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	s := c.db.Stats()
+	counter := func(d *prometheus.Desc, v float64) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, v)
+	}
+	gauge := func(d *prometheus.Desc, v float64) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, v)
+	}
+
+	counter(c.commits, float64(s.Tx.Commits))
+	counter(c.rollbacks, float64(s.Tx.Rollbacks))
+	counter(c.readTxs, float64(s.Tx.ReadTxs))
+	gauge(c.openReadTxs, float64(s.Tx.OpenReadTxs))
+
+	ch <- histogram(c.commitDuration, s.Commit.Total)
+	for _, p := range []struct {
+		name string
+		h    leafdb.Histogram
+	}{
+		{"page_copy", s.Commit.PageCopy},
+		{"remap", s.Commit.Remap},
+		{"meta_write", s.Commit.MetaWrite},
+		{"sync", s.Commit.Sync},
+	} {
+		ch <- histogram(c.phaseDuration, p.h, p.name)
+	}
+	counter(c.writerLockWaits, float64(s.Commit.WriterLockWaits))
+	counter(c.writerLockWait, s.Commit.WriterLockWait.Seconds())
+	gauge(c.writerQueue, float64(s.Commit.WriterQueue))
+	gauge(c.writerQueueMax, float64(s.Commit.WriterQueueMax))
+	counter(c.remaps, float64(s.Commit.Remaps))
+	counter(c.remapStalls, float64(s.Commit.RemapStalls))
+	counter(c.remapStallTime, s.Commit.RemapStallTime.Seconds())
+
+	counter(c.pagesAllocated, float64(s.Pages.Allocated))
+	counter(c.pagesFreed, float64(s.Pages.Freed))
+	counter(c.pagesWritten, float64(s.Pages.Written))
+	counter(c.bytesWritten, float64(s.Pages.WrittenBytes))
+	counter(c.pagesPunched, float64(s.Pages.Punched))
+	gauge(c.pages, float64(s.PageCount))
+	gauge(c.freePages, float64(s.FreePages))
+	gauge(c.pendingPages, float64(s.PendingPages))
+
+	counter(c.cacheHits, float64(s.Cache.Hits))
+	counter(c.cacheMisses, float64(s.Cache.Misses))
+	gauge(c.cacheNodes, float64(s.Cache.Nodes))
+	gauge(c.cacheBytes, float64(s.Cache.Size))
+
+	counter(c.remoteFetches, float64(s.Remote.Fetches))
+	counter(c.remoteFetched, float64(s.Remote.FetchedBytes))
+	gauge(c.remoteCached, float64(s.Remote.CachedBytes))
+}
+
+// histogram converts h, whose counts are per bucket, into a Prometheus
+// histogram, whose counts are cumulative.
+func histogram(d *prometheus.Desc, h leafdb.Histogram, labels ...string) prometheus.Metric {
+	buckets := make(map[float64]uint64, len(h.Bounds))
+	var cumulative uint64
+	for i, bound := range h.Bounds {
+		cumulative += h.Counts[i]
+		buckets[bound.Seconds()] = cumulative
+	}
+	return prometheus.MustNewConstHistogram(d, h.Count, h.Sum.Seconds(), buckets, labels...)
+}
@@ -0,0 +1,47 @@
+//go:build unix
+
+package leafdb
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// mmapFile maps the first size bytes of file shared and writable, with
+// flags added to MAP_SHARED. The mapping may extend past the end of the file
+// as long as nothing past it is accessed.
+func mmapFile(file *os.File, size, flags int) ([]byte, error) {
+	return unix.Mmap(int(file.Fd()), 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|flags)
+}
+
+func madviseData(data []byte, advice int) error {
+	return unix.Madvise(data, advice)
+}
+
+// releaseData tells the kernel that the memory of a range of a mapping is
+// not needed; it is read back from the file if it is accessed again.
+func releaseData(data []byte) error {
+	return unix.Madvise(data, unix.MADV_DONTNEED)
+}
+
+// growFile extends file to size bytes before it is remapped.
+func growFile(file *os.File, size int64) error {
+	return file.Truncate(size)
+}
+
+func munmapData(data []byte) error {
+	return unix.Munmap(data)
+}
+
+// msyncData synchronously writes dirty pages of a mapping back to the file.
+func msyncData(data []byte) error {
+	return unix.Msync(data, unix.MS_SYNC)
+}
+
+func fsyncFile(file *os.File) error {
+	return unix.Fsync(int(file.Fd()))
+}
+
+// truncateMapped reports whether a file can be truncated while it is mapped.
+const truncateMapped = true
@@ -0,0 +1,73 @@
+//go:build windows
+
+package leafdb
+
+import (
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// mmapFile maps the first size bytes of file shared and writable, extending
+// the file if it is shorter. The file mapping handle is closed once the view
+// exists, since the view keeps the mapping alive. flags are ignored.
+func mmapFile(file *os.File, size, flags int) ([]byte, error) {
+	hi := uint32(uint64(size) >> 32)
+	lo := uint32(uint64(size))
+	h, err := windows.CreateFileMapping(windows.Handle(file.Fd()), nil, windows.PAGE_READWRITE, hi, lo, nil)
+	if h == 0 {
+		return nil, os.NewSyscallError("CreateFileMapping", err)
+	}
+	addr, err := windows.MapViewOfFile(h, windows.FILE_MAP_WRITE, 0, 0, uintptr(size))
+	windows.CloseHandle(h)
+	if addr == 0 {
+		return nil, os.NewSyscallError("MapViewOfFile", err)
+	}
+	return unsafe.Slice((*byte)(*(*unsafe.Pointer)(unsafe.Pointer(&addr))), size), nil
+}
+
+// growFile is a no-op: mmapFile extends the file when it creates the larger
+// mapping, and SetEndOfFile would fail while older views are still mapped by
+// read transactions.
+func growFile(file *os.File, size int64) error {
+	return nil
+}
+
+// madviseData is a no-op: Windows has no equivalent of madvise for views.
+func madviseData(data []byte, advice int) error {
+	return nil
+}
+
+// releaseData is a no-op, like madviseData.
+func releaseData(data []byte) error {
+	return nil
+}
+
+func munmapData(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	addr := uintptr(unsafe.Pointer(&data[0]))
+	return os.NewSyscallError("UnmapViewOfFile", windows.UnmapViewOfFile(addr))
+}
+
+// msyncData writes dirty pages of a mapping back to the file. Unlike msync,
+// FlushViewOfFile does not wait for the writes to reach the disk; fsyncFile
+// does that.
+func msyncData(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	addr := uintptr(unsafe.Pointer(&data[0]))
+	return os.NewSyscallError("FlushViewOfFile", windows.FlushViewOfFile(addr, uintptr(len(data))))
+}
+
+func fsyncFile(file *os.File) error {
+	return os.NewSyscallError("FlushFileBuffers", windows.FlushFileBuffers(windows.Handle(file.Fd())))
+}
+
+// truncateMapped reports whether a file can be truncated while it is mapped.
+// Windows refuses to while views of it exist, so Shrink leaves the file at
+// its size and only reuses the space at its end.
+const truncateMapped = false
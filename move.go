@@ -0,0 +1,224 @@
+package leafdb
+
+import (
+	"bytes"
+	"errors"
+	"maps"
+	"slices"
+	"strings"
+)
+
+var errMoveIntoSelf = errors.New("leafdb: cannot move a bucket into itself")
+
+// RenameBucket renames the top-level bucket oldName to newName. Like
+// MoveBucket it relinks the bucket's header page under the new name instead
+// of copying its pairs.
+func (tx *Tx) RenameBucket(oldName, newName []byte) error {
+	return tx.moveBucket(nil, oldName, nil, newName)
+}
+
+// MoveBucket moves the top-level bucket name, with its pairs and nested
+// buckets, into dst under the same name. A nil dst leaves it at the top
+// level. See Bucket.MoveBucket.
+func (tx *Tx) MoveBucket(name []byte, dst *Bucket) error {
+	return tx.moveBucket(nil, name, dst, name)
+}
+
+// RenameBucket renames the nested bucket oldName of b to newName.
+func (b *Bucket) RenameBucket(oldName, newName []byte) error {
+	if b == nil || b.tx == nil {
+		return ErrTxClosed
+	}
+	return b.tx.moveBucket(b, oldName, b, newName)
+}
+
+// MoveBucket moves the nested bucket name of b, with its pairs and nested
+// buckets, into dst under the same name, or to the top level if dst is nil.
+// Only the link to the bucket's header page moves: the cost does not depend
+// on the size of the bucket. It fails with ErrBucketExists if dst already
+// has a bucket of that name, and a bucket cannot be moved into itself or
+// one of its descendants.
+//
+// Bucket values opened from the moved bucket or from buckets inside it
+// still refer to the old location and must not be used afterwards; open
+// them again from dst. b and dst themselves stay usable. Declared indexes
+// move with the bucket.
+func (b *Bucket) MoveBucket(name []byte, dst *Bucket) error {
+	if b == nil || b.tx == nil {
+		return ErrTxClosed
+	}
+	return b.tx.moveBucket(b, name, dst, name)
+}
+
+// moveBucket relinks the bucket name of src as newName in dst, where a nil
+// src or dst stands for the top level.
+func (tx *Tx) moveBucket(src *Bucket, name []byte, dst *Bucket, newName []byte) error {
+	if err := tx.validateWritable(name); err != nil {
+		return err
+	}
+	if err := tx.validateWritable(newName); err != nil {
+		return err
+	}
+	for _, b := range []*Bucket{src, dst} {
+		if b != nil && b.tx != tx {
+			return errors.New("leafdb: bucket belongs to another transaction")
+		}
+	}
+	if isReservedName(name) {
+		return ErrBucketNotFound
+	}
+	if isReservedName(newName) {
+		return ErrReservedName
+	}
+	from := append(bucketPath(src), name)
+	to := append(bucketPath(dst), newName)
+	if len(to) > len(from) && slices.EqualFunc(from, to[:len(from)], bytes.Equal) {
+		return errMoveIntoSelf
+	}
+
+	// Either bucket may be stale if the other is one of its ancestors, or
+	// if the caller wrote to it through another Bucket value.
+	for _, b := range []*Bucket{src, dst} {
+		if b != nil {
+			if err := b.reload(); err != nil {
+				return err
+			}
+		}
+	}
+	val, ok, err := tx.nestedTree(src).get(name)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrBucketNotFound
+	}
+	if slices.EqualFunc(from, to, bytes.Equal) {
+		return nil
+	}
+	if _, ok, err := tx.nestedTree(dst).get(newName); err != nil {
+		return err
+	} else if ok {
+		return ErrBucketExists
+	}
+
+	if err := tx.relink(src, func(tree *bptree) error {
+		_, err := tree.delete(name)
+		return err
+	}); err != nil {
+		return err
+	}
+	if dst != nil {
+		if err := dst.reload(); err != nil {
+			return err
+		}
+	}
+	if err := tx.relink(dst, func(tree *bptree) error {
+		return tree.set(newName, val)
+	}); err != nil {
+		return err
+	}
+	if src != nil {
+		if err := src.reload(); err != nil {
+			return err
+		}
+	}
+
+	tx.db.moveIndexes(from, to)
+	return tx.recordChange(Change{
+		Op:     ChangeMoveBucket,
+		Bucket: from[:len(from)-1],
+		Key:    name,
+		To:     to,
+	})
+}
+
+// nestedTree returns the tree of the buckets nested in b, or of the
+// top-level buckets if b is nil, for reading.
+func (tx *Tx) nestedTree(b *Bucket) *bptree {
+	if b == nil {
+		root := tx.mgr.root
+		return newBPTree(&root, tx.mgr)
+	}
+	root := b.bucketRoot
+	return newBPTree(&root, tx.mgr)
+}
+
+// relink applies fn to the tree of the buckets nested in b, or of the
+// top-level buckets if b is nil, and stores the result.
+func (tx *Tx) relink(b *Bucket, fn func(tree *bptree) error) error {
+	if b == nil {
+		root := tx.mgr.root
+		if err := fn(newBPTree(&root, tx.mgr)); err != nil {
+			return err
+		}
+		tx.mgr.root = root
+		return nil
+	}
+	if err := fn(newBPTree(&b.bucketRoot, tx.mgr)); err != nil {
+		return err
+	}
+	return b.persistHeader()
+}
+
+// reload rereads the headers of b and its parents from the current state
+// of the transaction.
+func (b *Bucket) reload() error {
+	var tree *bptree
+	if b.parent == nil {
+		tree = b.tx.nestedTree(nil)
+	} else {
+		if err := b.parent.reload(); err != nil {
+			return err
+		}
+		tree = b.tx.nestedTree(b.parent)
+	}
+	val, ok, err := tree.get(b.name)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrBucketNotFound
+	}
+	header := decodePageID(val)
+	h, err := readBucketHeader(b.tx.mgr, header)
+	if err != nil {
+		return err
+	}
+	b.setHeaderFields(header, h)
+	return nil
+}
+
+// bucketPath returns the path of b, or an empty path for the top level.
+func bucketPath(b *Bucket) [][]byte {
+	if b == nil {
+		return nil
+	}
+	return b.path()
+}
+
+// moveIndexes carries the indexes declared on the bucket at path from, and
+// on the buckets inside it, over to the same buckets at path to, and so
+// does it for their hooks. The old entries stay so that a rolled back move
+// keeps working.
+func (db *DB) moveIndexes(from, to [][]byte) {
+	oldPrefix, newPrefix := encodeBucketPath(from), encodeBucketPath(to)
+	db.indexMu.Lock()
+	moved := make(map[string]declaredIndex)
+	for key, ix := range db.indexes {
+		if rest, ok := strings.CutPrefix(key, oldPrefix); ok {
+			moved[newPrefix+rest] = ix
+		}
+	}
+	maps.Copy(db.indexes, moved)
+	db.indexMu.Unlock()
+
+	db.hookMu.Lock()
+	defer db.hookMu.Unlock()
+	movedHooks := make(map[string]map[string]Hook)
+	for key, hooks := range db.hooks {
+		if rest, ok := strings.CutPrefix(key, oldPrefix); ok {
+			movedHooks[newPrefix+rest] = maps.Clone(hooks)
+		}
+	}
+	maps.Copy(db.hooks, movedHooks)
+}
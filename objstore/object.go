@@ -0,0 +1,129 @@
+// Package objstore reads objects from S3 and other object stores with HTTP
+// range requests, so that leafdb.OpenRemote can serve a database snapshot
+// stored there without downloading it first:
+//
+//	obj, err := objstore.Open(ctx, presignedURL, nil)
+//	...
+//	db, err := objstore.OpenDB(obj, nil)
+//
+// Objects can be opened by URL, for public objects and presigned URLs, or
+// through an S3 client that signs its requests.
+package objstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"leafdb"
+)
+
+// ErrChanged is returned by ReadAt if the object was replaced after it was
+// opened. A snapshot must not change while it is being read.
+var ErrChanged = errors.New("objstore: object changed")
+
+// Object is a stored object read with HTTP range requests. It implements
+// io.ReaderAt and is safe for concurrent use.
+type Object struct {
+	url    string
+	client *http.Client
+	// sign, if set, authenticates each request.
+	sign func(*http.Request) error
+	size int64
+	etag string
+}
+
+// Open opens the object at url, such as a public object or a presigned
+// GET URL, and reads its size. A nil client uses http.DefaultClient.
+func Open(ctx context.Context, url string, client *http.Client) (*Object, error) {
+	return open(ctx, url, client, nil)
+}
+
+func open(ctx context.Context, url string, client *http.Client, sign func(*http.Request) error) (*Object, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	o := &Object{url: url, client: client, sign: sign}
+	// Presigned URLs are only valid for GET, so the size comes from the
+	// Content-Range of a one-byte read rather than from a HEAD request.
+	resp, err := o.get(ctx, 0, 1)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	_, total, ok := strings.Cut(resp.Header.Get("Content-Range"), "/")
+	if o.size, err = strconv.ParseInt(total, 10, 64); !ok || err != nil {
+		return nil, errors.New("objstore: response without an object size")
+	}
+	o.etag = resp.Header.Get("ETag")
+	return o, nil
+}
+
+// Size returns the size of the object in bytes.
+func (o *Object) Size() int64 {
+	return o.size
+}
+
+// ReadAt reads len(p) bytes from the object starting at byte offset off.
+func (o *Object) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("objstore: negative offset")
+	}
+	if off >= o.size {
+		return 0, io.EOF
+	}
+	want := min(int64(len(p)), o.size-off)
+	if want == 0 {
+		return 0, nil
+	}
+	resp, err := o.get(context.Background(), off, want)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	n, err := io.ReadFull(resp.Body, p[:want])
+	if err == nil && want < int64(len(p)) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// get requests n bytes of the object from off.
+func (o *Object) get(ctx context.Context, off, n int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, o.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+n-1))
+	if o.etag != "" {
+		req.Header.Set("If-Match", o.etag)
+	}
+	if o.sign != nil {
+		if err := o.sign(req); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return resp, nil
+	case http.StatusPreconditionFailed:
+		resp.Body.Close()
+		return nil, ErrChanged
+	}
+	resp.Body.Close()
+	return nil, fmt.Errorf("objstore: range request returned %s", resp.Status)
+}
+
+// OpenDB opens the database snapshot stored in o read-only with
+// leafdb.OpenRemote.
+func OpenDB(o *Object, opts *leafdb.Options) (*leafdb.DB, error) {
+	return leafdb.OpenRemote(o, o.Size(), opts)
+}
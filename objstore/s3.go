@@ -0,0 +1,148 @@
+package objstore
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// emptyPayloadHash is the SHA-256 of an empty request body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// Credentials are the access keys S3 requests are signed with.
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is set for temporary credentials.
+	SessionToken string
+}
+
+// S3 opens objects of an S3-compatible service, signing requests with AWS
+// Signature Version 4.
+type S3 struct {
+	// Region is the region requests are signed for, such as "us-east-1".
+	Region string
+	// Endpoint is the base URL of the service. Empty uses the AWS endpoint
+	// of Region.
+	Endpoint string
+	// PathStyle addresses buckets as the first path segment instead of as
+	// a subdomain of the endpoint, as most S3-compatible services expect.
+	PathStyle   bool
+	Credentials Credentials
+	// Client is the HTTP client used for requests. Nil uses
+	// http.DefaultClient.
+	Client *http.Client
+}
+
+// Open opens the object key in bucket and reads its size.
+func (s *S3) Open(ctx context.Context, bucket, key string) (*Object, error) {
+	if s.Region == "" || bucket == "" || key == "" {
+		return nil, errors.New("objstore: region, bucket and key required")
+	}
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + s.Region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	path := "/" + key
+	if s.PathStyle {
+		path = "/" + bucket + path
+	} else {
+		u.Host = bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawPath = uriEncode(u.Path, false)
+	return open(ctx, u.String(), s.Client, s.sign)
+}
+
+// sign adds a Signature Version 4 Authorization header to req, which must
+// have an empty body.
+func (s *S3) sign(req *http.Request) error {
+	t := time.Now().UTC()
+	amzDate := t.Format("20060102T150405Z")
+	day := t.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	if s.Credentials.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.Credentials.SessionToken)
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "range" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var canonical strings.Builder
+	canonical.WriteString(req.Method + "\n" + req.URL.EscapedPath() + "\n" + canonicalQuery(req.URL.Query()) + "\n")
+	for _, name := range names {
+		canonical.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	canonical.WriteString("\n" + signed + "\n" + emptyPayloadHash)
+
+	scope := day + "/" + s.Region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical.String()))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+	key := hmacSHA256([]byte("AWS4"+s.Credentials.SecretAccessKey), day)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.Credentials.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signed+", Signature="+signature)
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes q sorted by name and value, as signed.
+func canonicalQuery(q url.Values) string {
+	var pairs []string
+	for name, values := range q {
+		for _, v := range values {
+			pairs = append(pairs, uriEncode(name, true)+"="+uriEncode(v, true))
+		}
+	}
+	slices.Sort(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode percent-encodes every byte of s but the unreserved characters,
+// and '/' unless encodeSlash is set, as S3 expects in signed requests.
+func uriEncode(s string, encodeSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !encodeSlash {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hexDigits[c>>4])
+		b.WriteByte(hexDigits[c&15])
+	}
+	return b.String()
+}
@@ -0,0 +1,418 @@
+package leafdb
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+)
+
+// An optimistic write transaction, see Options.OptimisticWrites, writes to
+// pages of its own over a snapshot, as a read transaction pins one, without
+// the writer lock. Its commit takes the lock and, if others committed in the
+// meantime, checks what it read and wrote against what they wrote, then
+// replays its changes, as recorded for the changefeed, on the latest state.
+
+// optimisticTx is the state of an optimistic transaction until its commit
+// takes the writer lock.
+type optimisticTx struct {
+	// reads holds what the transaction read.
+	reads *accessSet
+	// changes are the changes to replay if others committed since the
+	// snapshot, without those made by hooks, which run again.
+	changes []Change
+	// opaque is set by writes that record no change, which cannot be
+	// replayed.
+	opaque bool
+}
+
+// accessSet holds the keys and buckets a transaction read or wrote. Keys
+// and bucket sequences are held by accessItem, bucket paths by
+// encodeBucketPath.
+type accessSet struct {
+	keys map[string]struct{}
+	// buckets holds the buckets opened, or those written to, whose nested
+	// buckets changed or that were created, deleted or moved.
+	buckets map[string][][]byte
+	// scans holds the buckets read in full, by a cursor or a count.
+	scans map[string]struct{}
+	// moved holds the buckets created, deleted or moved.
+	moved map[string]struct{}
+	// all is set by writes that record no change, such as a change of
+	// bucket options, which conflict with every transaction.
+	all bool
+}
+
+func newAccessSet() *accessSet {
+	return &accessSet{
+		keys:    make(map[string]struct{}),
+		buckets: make(map[string][][]byte),
+		scans:   make(map[string]struct{}),
+		moved:   make(map[string]struct{}),
+	}
+}
+
+// committedWrites is what a commit wrote, kept while optimistic
+// transactions whose snapshots it is newer than are open.
+type committedWrites struct {
+	txid   uint64
+	writes *accessSet
+}
+
+// Access items tell keys from bucket sequences after the bucket path.
+const (
+	accessKey      = 1
+	accessSequence = 2
+)
+
+func accessItem(path [][]byte, kind byte, key []byte) string {
+	return string(append(append(appendChangePath(nil, path), kind), key...))
+}
+
+func (s *accessSet) addBucket(path [][]byte) {
+	s.buckets[encodeBucketPath(path)] = path
+}
+
+func (s *accessSet) addKey(path [][]byte, kind byte, key []byte) {
+	s.keys[accessItem(path, kind, key)] = struct{}{}
+	s.addBucket(path)
+}
+
+func (s *accessSet) addScan(path [][]byte) {
+	s.scans[encodeBucketPath(path)] = struct{}{}
+	s.addBucket(path)
+}
+
+// addMoved records that the bucket at path was created, deleted or moved,
+// which changes the nested buckets of its parent.
+func (s *accessSet) addMoved(path [][]byte) {
+	s.moved[encodeBucketPath(path)] = struct{}{}
+	s.addBucket(path)
+	s.addBucket(path[:len(path)-1])
+}
+
+// addChange records the writes of c.
+func (s *accessSet) addChange(c Change) {
+	switch c.Op {
+	case ChangePut, ChangeDelete:
+		s.addKey(c.Bucket, accessKey, c.Key)
+	case ChangeSequence:
+		s.addKey(c.Bucket, accessSequence, nil)
+	case ChangeCreateBucket, ChangeDeleteBucket:
+		s.addMoved(append(clonePath(c.Bucket), cloneBytes(c.Key)))
+	case ChangeMoveBucket:
+		s.addMoved(append(clonePath(c.Bucket), cloneBytes(c.Key)))
+		s.addMoved(clonePath(c.To))
+	}
+}
+
+// movedUnder reports whether path, or a bucket path leads through, is in
+// moved.
+func movedUnder(moved map[string]struct{}, path [][]byte) bool {
+	for i := 1; i <= len(path); i++ {
+		if _, ok := moved[encodeBucketPath(path[:i])]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// conflicts reports whether a transaction that read reads and wrote writes
+// conflicts with a commit that wrote committed: whether the commit wrote a
+// key the transaction read or wrote, wrote to a bucket it read in full, or
+// created, deleted or moved a bucket it used, or the other way round.
+func conflicts(reads, writes, committed *accessSet) bool {
+	if committed.all {
+		return true
+	}
+	for item := range committed.keys {
+		if _, ok := reads.keys[item]; ok {
+			return true
+		}
+		if _, ok := writes.keys[item]; ok {
+			return true
+		}
+	}
+	for id, path := range committed.buckets {
+		if _, ok := reads.scans[id]; ok {
+			return true
+		}
+		if movedUnder(writes.moved, path) {
+			return true
+		}
+	}
+	for _, set := range []*accessSet{reads, writes} {
+		for _, path := range set.buckets {
+			if movedUnder(committed.moved, path) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// beginOptimistic starts an optimistic write transaction over a snapshot,
+// which it pins as a read transaction does.
+func (db *DB) beginOptimistic(ctx context.Context) (*Tx, error) {
+	if db == nil {
+		return nil, ErrDatabaseClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	tx := &Tx{db: db, writable: true, start: time.Now(), ctx: ctx}
+	if !db.addTx(tx) {
+		return nil, ErrDatabaseClosed
+	}
+	if db.readOnly {
+		db.removeTx(tx)
+		return nil, ErrDatabaseReadOnly
+	}
+	db.lockMapForRead()
+	if db.mapping == nil {
+		db.mapMu.Unlock()
+		db.removeTx(tx)
+		return nil, ErrDatabaseClosed
+	}
+	mapping := db.mapping
+	mapping.refs++
+	meta := db.snapshotOptimisticMeta()
+	db.mapMu.Unlock()
+	mgr := newTxPageManager(db, true, meta)
+	mgr.mapping = mapping
+	tx.readTxID = meta.txid
+	tx.optimistic = &optimisticTx{reads: newAccessSet()}
+	tx.writes = newAccessSet()
+	db.setTxManager(tx, mgr)
+	return tx, nil
+}
+
+// snapshotOptimisticMeta returns the meta an optimistic transaction starts
+// from and registers it as a reader and as an optimistic transaction under
+// the same lock, so that every commit that publishes a newer meta finds it
+// registered and keeps its writes.
+func (db *DB) snapshotOptimisticMeta() meta {
+	db.metaMu.RLock()
+	defer db.metaMu.RUnlock()
+	m := meta{
+		txid:         db.meta.txid,
+		root:         db.meta.root,
+		nextPage:     db.meta.nextPage,
+		freelistPage: db.meta.freelistPage,
+		freelist:     append([]uint64(nil), db.meta.freelist...),
+	}
+	db.addReadTx(m.txid)
+	db.optimisticMu.Lock()
+	db.optimisticTxs[m.txid]++
+	db.optimisticMu.Unlock()
+	return m
+}
+
+// endOptimistic releases the snapshot of the optimistic transaction tx.
+func (db *DB) endOptimistic(tx *Tx) {
+	db.removeReadTx(tx.readTxID)
+	if tx.mgr.mapping != nil {
+		db.releaseMapping(tx.mgr.mapping)
+		tx.mgr.mapping = nil
+	}
+	db.optimisticMu.Lock()
+	defer db.optimisticMu.Unlock()
+	if db.optimisticTxs[tx.readTxID] <= 1 {
+		delete(db.optimisticTxs, tx.readTxID)
+	} else {
+		db.optimisticTxs[tx.readTxID]--
+	}
+	db.pruneCommitted()
+	tx.readTxID = 0
+}
+
+// recordCommit keeps writes, what the commit of transaction txid wrote, for
+// the optimistic transactions that began before it. The caller holds the
+// writer lock.
+func (db *DB) recordCommit(txid uint64, writes *accessSet) {
+	db.optimisticMu.Lock()
+	defer db.optimisticMu.Unlock()
+	if writes != nil && len(db.optimisticTxs) > 0 {
+		db.committed = append(db.committed, committedWrites{txid: txid, writes: writes})
+	}
+	db.pruneCommitted()
+}
+
+// pruneCommitted drops the writes of commits that every open optimistic
+// transaction sees. The caller holds optimisticMu.
+func (db *DB) pruneCommitted() {
+	if len(db.optimisticTxs) == 0 {
+		db.committed = nil
+		return
+	}
+	oldest := uint64(math.MaxUint64)
+	for txid := range db.optimisticTxs {
+		oldest = min(oldest, txid)
+	}
+	seen := 0
+	for seen < len(db.committed) && db.committed[seen].txid <= oldest {
+		seen++
+	}
+	db.committed = db.committed[seen:]
+}
+
+// conflicting reports whether a commit since snapshot wrote something the
+// optimistic transaction o, which wrote writes, depends on. The caller
+// holds the writer lock.
+func (db *DB) conflicting(snapshot uint64, o *optimisticTx, writes *accessSet) bool {
+	db.optimisticMu.Lock()
+	defer db.optimisticMu.Unlock()
+	for _, c := range db.committed {
+		if c.txid > snapshot && conflicts(o.reads, writes, c.writes) {
+			return true
+		}
+	}
+	return false
+}
+
+// lockOptimistic takes the writer lock for the commit of the optimistic
+// transaction tx, which then continues as an ordinary write transaction.
+// If nothing committed since its snapshot, its pages are committed as they
+// are. Otherwise it fails with ErrTxConflict if a commit since wrote what
+// it read or wrote, or if it made writes that cannot be replayed, and
+// replays its changes on the latest state if not.
+func (tx *Tx) lockOptimistic() error {
+	db := tx.db
+	if err := db.lockWriterCtx(tx.ctx); err != nil {
+		return err
+	}
+	o, snapshot := tx.optimistic, tx.mgr.txid
+	current := db.snapshotMeta()
+	// The writes of the commits since the snapshot are checked before the
+	// transaction ends, which may drop them.
+	conflict := current.txid != snapshot && (o.opaque || db.conflicting(snapshot, o, tx.writes))
+	db.endOptimistic(tx)
+	tx.optimistic = nil
+	if current.txid == snapshot {
+		return nil
+	}
+	if conflict {
+		return ErrTxConflict
+	}
+	tx.mgr.rollback()
+	db.setTxManager(tx, newTxPageManager(db, true, current))
+	tx.changeLog, tx.changeSeq = nil, 0
+	tx.writes = newAccessSet()
+	for _, c := range o.changes {
+		if err := tx.ApplyChange(c); err != nil {
+			return fmt.Errorf("%w: %w", ErrTxConflict, err)
+		}
+	}
+	return nil
+}
+
+// trackChange records c, a change tx makes, in its write set, and in the
+// changes of an optimistic transaction to replay.
+func (tx *Tx) trackChange(c Change) {
+	if !tx.db.optimisticWrites {
+		return
+	}
+	if tx.writes == nil {
+		tx.writes = newAccessSet()
+	}
+	tx.writes.addChange(c)
+	if tx.optimistic != nil && tx.hookDepth == 0 {
+		c.Bucket, c.To = clonePath(c.Bucket), clonePath(c.To)
+		c.Key, c.Value = cloneBytes(c.Key), cloneBytes(c.Value)
+		tx.optimistic.changes = append(tx.optimistic.changes, c)
+	}
+}
+
+// notReplayable records that an optimistic transaction made a change that
+// cannot be replayed, such as moving pages with Shrink, so that it commits
+// only if nothing else committed since its snapshot.
+func (tx *Tx) notReplayable() {
+	if tx.optimistic != nil {
+		tx.optimistic.opaque = true
+	}
+}
+
+// untrackedWrite records that tx made a write that records no change, such
+// as a change of bucket options, which neither can be replayed nor be
+// checked against optimistic transactions, so that it conflicts with all of
+// them.
+func (tx *Tx) untrackedWrite() {
+	if !tx.db.optimisticWrites {
+		return
+	}
+	if tx.writes == nil {
+		tx.writes = newAccessSet()
+	}
+	tx.writes.all = true
+	tx.notReplayable()
+}
+
+// readsOf returns the read set of an optimistic transaction and the path
+// of b to record reads under, or nil if reads in b are not recorded. Reads
+// in reserved buckets, such as those of indexes, are recorded as reads of
+// all of the bucket they derive from; derived is set if b is one.
+func (b *Bucket) readsOf() (reads *accessSet, path [][]byte, derived bool) {
+	if b == nil || b.tx == nil || b.tx.optimistic == nil {
+		return nil, nil, false
+	}
+	for isReservedName(b.name) {
+		if b = b.parent; b == nil {
+			return nil, nil, false
+		}
+		derived = true
+	}
+	return b.tx.optimistic.reads, b.path(), derived
+}
+
+// trackRead records that key of b was read.
+func (b *Bucket) trackRead(key []byte) {
+	reads, path, derived := b.readsOf()
+	switch {
+	case reads == nil:
+	case derived:
+		reads.addScan(path)
+	default:
+		reads.addKey(path, accessKey, key)
+	}
+}
+
+// trackSequence records that the sequence of b was read.
+func (b *Bucket) trackSequence() {
+	reads, path, derived := b.readsOf()
+	switch {
+	case reads == nil:
+	case derived:
+		reads.addScan(path)
+	default:
+		reads.addKey(path, accessSequence, nil)
+	}
+}
+
+// trackScan records that b was read in full.
+func (b *Bucket) trackScan() {
+	if reads, path, _ := b.readsOf(); reads != nil {
+		reads.addScan(path)
+	}
+}
+
+// trackBucket records that the nested bucket name of b, or the top-level
+// bucket name if b is nil, was looked up.
+func (tx *Tx) trackBucket(b *Bucket, name []byte) {
+	if tx.optimistic == nil || isReservedName(name) {
+		return
+	}
+	if b == nil {
+		tx.optimistic.reads.addBucket([][]byte{cloneBytes(name)})
+		return
+	}
+	if reads, path, derived := b.readsOf(); reads != nil && !derived {
+		reads.addBucket(append(path, cloneBytes(name)))
+	}
+}
+
+// trackTopLevel records that the top-level buckets were listed.
+func (tx *Tx) trackTopLevel() {
+	if tx.optimistic != nil {
+		tx.optimistic.reads.addScan(nil)
+	}
+}
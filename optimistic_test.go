@@ -0,0 +1,104 @@
+package leafdb_test
+
+import (
+	"errors"
+	"testing"
+
+	"leafdb"
+)
+
+func openOptimistic(t *testing.T) *leafdb.DB {
+	t.Helper()
+	db, err := leafdb.OpenMemWithOptions(&leafdb.Options{OptimisticWrites: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	err = db.Write(func(tx *leafdb.Tx) error {
+		b, err := tx.CreateBucket([]byte("b"))
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte("x"), []byte("0")); err != nil {
+			return err
+		}
+		return b.Put([]byte("y"), []byte("0"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// put sets key in bucket b of tx.
+func put(t *testing.T, tx *leafdb.Tx, key, value string) {
+	t.Helper()
+	if err := tx.Bucket([]byte("b")).Put([]byte(key), []byte(value)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// get returns the value of key in bucket b of db.
+func get(t *testing.T, db *leafdb.DB, key string) string {
+	t.Helper()
+	var v string
+	err := db.Read(func(tx *leafdb.Tx) error {
+		v = string(tx.Bucket([]byte("b")).Get([]byte(key)))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestOptimisticConflict(t *testing.T) {
+	db := openOptimistic(t)
+	t1, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t2, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// t1 reads x, which t2 writes and commits first.
+	if v := t1.Bucket([]byte("b")).Get([]byte("x")); string(v) != "0" {
+		t.Fatalf("read %q, want 0", v)
+	}
+	put(t, t1, "y", "1")
+	put(t, t2, "x", "2")
+	if err := t2.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := t1.Commit(); !errors.Is(err, leafdb.ErrTxConflict) {
+		t.Fatalf("conflicting commit: %v, want ErrTxConflict", err)
+	}
+	if x, y := get(t, db, "x"), get(t, db, "y"); x != "2" || y != "0" {
+		t.Fatalf("x = %s, y = %s after the conflict, want 2 and 0", x, y)
+	}
+}
+
+func TestOptimisticDisjoint(t *testing.T) {
+	db := openOptimistic(t)
+	t1, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t2, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(t, t1, "x", "1")
+	put(t, t2, "y", "2")
+	if err := t2.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	// t1 touched nothing t2 wrote, so its write is applied again on top.
+	if err := t1.Commit(); err != nil {
+		t.Fatalf("disjoint commit: %v", err)
+	}
+	if x, y := get(t, db, "x"), get(t, db, "y"); x != "1" || y != "2" {
+		t.Fatalf("x = %s, y = %s, want 1 and 2", x, y)
+	}
+}
@@ -3,11 +3,16 @@ package leafdb
 import (
 	"encoding/binary"
 	"errors"
+	"hash/crc32"
+	"slices"
+	"sync"
 )
 
 const (
 	fileMagicV2        = "LDB2"
 	fileMagicV3        = "LDB3"
+	fileMagicV4        = "LDB4"
+	fileMagicV5        = "LDB5"
 	defaultPageSize    = 4096
 	metaPage0          = 0
 	metaPage1          = 1
@@ -16,13 +21,71 @@ const (
 	pageBucket         = 3
 	pageFreelist       = 4
 	pageOverflow       = 5
-	nodeHeaderSize     = 13
+	pageBlob           = 6
+	pageFreeRuns       = 7
+	pageFilter         = 8
+	pageFilterBlock    = 9
+	nodeHeaderSize     = 17
+	nodeHeaderSizeV3   = 13
 	freelistHeaderSize = 11
 	overflowHeaderSize = 9
 	metaHeaderSizeV2   = 36
 	metaHeaderSizeV3   = 44
+	metaHeaderSizeV5   = 64
 )
 
+// metaFlagEncrypted marks files whose pages are encrypted. The meta pages of
+// such files carry the KDF salt and are authenticated but not encrypted.
+const metaFlagEncrypted = 1 << 0
+
+// metaFlagFreeRuns marks meta pages whose freelist holds runs of consecutive
+// free pages, encoded by appendFreeRuns, instead of page IDs. Their freelist
+// chain is made of pageFreeRuns pages.
+const metaFlagFreeRuns = 1 << 1
+
+// metaFlagReservedNames marks files written since bucket names starting
+// with reservedPrefix were reserved, which need no check for user buckets
+// with such names; see checkReservedNames.
+const metaFlagReservedNames = 1 << 2
+
+// nodeFlagChecksum marks node pages whose header carries a CRC32 of the page.
+// Pages written before checksums were introduced have no flags set and a
+// shorter header.
+const nodeFlagChecksum = 1 << 0
+
+// nodeFlagPrefix marks leaf pages whose keys share a prefix that is stored
+// once after the header; each entry then holds only the rest of its key.
+const nodeFlagPrefix = 1 << 1
+
+// nodeFlagSlots marks leaf pages that end with a slot directory: the offset
+// of each entry as a uint16, in key order, so that a lookup can binary
+// search the page without decoding it. leafSlotSize is the size of a slot.
+const (
+	nodeFlagSlots = 1 << 2
+	leafSlotSize  = 2
+)
+
+// nodeFlagEmptyValues marks leaf pages holding entries with an empty value
+// stored compactly: their key length has keyEmptyValue set and is followed
+// by the key alone, without a value length. Key lengths never reach that
+// bit, as keys are at most MaxKeySize.
+const (
+	nodeFlagEmptyValues = 1 << 3
+	keyEmptyValue       = 1 << 15
+)
+
+// nodeFlagsLeaf are the flags a leaf page may carry.
+const nodeFlagsLeaf = nodeFlagChecksum | nodeFlagPrefix | nodeFlagSlots | nodeFlagEmptyValues
+
+// nodeFlagCounts marks branch pages that store, after their keys, the
+// number of pairs below each child as a uint64, in child order, so that
+// ranks and positions are found in one descent. A count of all ones is not
+// known. Branches without the flag count none of their children.
+const nodeFlagCounts = 1 << 4
+
+// nodeFlagsBranch are the flags a branch page may carry.
+const nodeFlagsBranch = nodeFlagChecksum | nodeFlagCounts
+
 type meta struct {
 	txid         uint64
 	root         uint64
@@ -31,37 +94,62 @@ type meta struct {
 	freelist     []uint64
 }
 
-func readMetaPage(page []byte, pageSize int) (meta, bool, error) {
-	if len(page) < pageSize {
-		return meta{}, false, errors.New("leafdb: invalid meta page")
+// readMetaPage decodes a meta page. It reports false if page has no meta
+// magic, as when it was never written. The next page must not be past
+// limit, the number of pages of the file, which the file always grows to
+// before a meta page refers to them.
+func readMetaPage(page []byte, pageSize int, limit uint64) (meta, bool, error) {
+	if len(page) < pageSize || pageSize < metaHeaderSizeV5 {
+		return meta{}, false, corrupted(len(page), "short meta page")
 	}
 	magic := string(page[:4])
-	if magic != fileMagicV2 && magic != fileMagicV3 {
+	if magic != fileMagicV2 && magic != fileMagicV3 && magic != fileMagicV4 && magic != fileMagicV5 {
 		return meta{}, false, nil
 	}
 	ps := int(binary.LittleEndian.Uint32(page[4:]))
 	if ps != pageSize {
-		return meta{}, false, errors.New("leafdb: page size mismatch")
+		return meta{}, false, corrupted(4, "page size mismatch")
 	}
 	m := meta{
 		txid:     binary.LittleEndian.Uint64(page[8:]),
 		root:     binary.LittleEndian.Uint64(page[16:]),
 		nextPage: binary.LittleEndian.Uint64(page[24:]),
 	}
+	if m.nextPage > limit {
+		return meta{}, false, corrupted(24, "next page beyond end of file")
+	}
+	// The free count is at countOffset, and the free pages follow at
+	// freeOffset.
+	countOffset := 40
 	var freeCount int
 	var freeOffset int
 	switch magic {
 	case fileMagicV2:
+		countOffset = 32
 		freeCount = int(binary.LittleEndian.Uint32(page[32:]))
 		freeOffset = metaHeaderSizeV2
-	case fileMagicV3:
+	case fileMagicV3, fileMagicV4:
 		m.freelistPage = binary.LittleEndian.Uint64(page[32:])
 		freeCount = int(binary.LittleEndian.Uint32(page[40:]))
 		freeOffset = metaHeaderSizeV3
+	case fileMagicV5:
+		m.freelistPage = binary.LittleEndian.Uint64(page[32:])
+		freeCount = int(binary.LittleEndian.Uint32(page[40:]))
+		freeOffset = metaHeaderSizeV5
+	}
+	if m.freelistPage != 0 && (m.freelistPage <= metaPage1 || m.freelistPage >= m.nextPage) {
+		return meta{}, false, corrupted(32, "invalid freelist page")
+	}
+	if magic == fileMagicV5 && binary.LittleEndian.Uint32(page[44:])&metaFlagFreeRuns != 0 {
+		var err error
+		if m.freelist, err = readFreeRuns(page[:pageSize], freeOffset, freeCount, m.nextPage); err != nil {
+			return meta{}, false, err
+		}
+		return m, true, nil
 	}
 	maxFree := (pageSize - freeOffset) / 8
-	if freeCount > maxFree {
-		return meta{}, false, errors.New("leafdb: freelist exceeds meta capacity")
+	if freeCount < 0 || freeCount > maxFree {
+		return meta{}, false, corrupted(countOffset, "freelist exceeds meta capacity")
 	}
 	m.freelist = make([]uint64, freeCount)
 	off := freeOffset
@@ -72,62 +160,104 @@ func readMetaPage(page []byte, pageSize int) (meta, bool, error) {
 	return m, true, nil
 }
 
-func writeMetaPage(page []byte, m meta, pageSize int) error {
-	if len(page) < pageSize {
+// pagePool recycles page-sized buffers used to encode pages and to stage
+// dirty pages in write transactions.
+var pagePool sync.Pool
+
+// getPageBuffer returns a zeroed buffer of the given page size.
+func getPageBuffer(size int) []byte {
+	if v, ok := pagePool.Get().(*[]byte); ok && cap(*v) >= size {
+		buf := (*v)[:size]
+		clear(buf)
+		return buf
+	}
+	return make([]byte, size)
+}
+
+func putPageBuffer(buf []byte) {
+	if buf == nil {
+		return
+	}
+	pagePool.Put(&buf)
+}
+
+// metaFormat returns the flags and KDF salt of a meta page. Pages older than
+// version 5 have neither.
+func metaFormat(page []byte) (uint32, []byte) {
+	if len(page) < metaHeaderSizeV5 || string(page[:4]) != fileMagicV5 {
+		return 0, nil
+	}
+	return binary.LittleEndian.Uint32(page[44:]), page[48:metaHeaderSizeV5]
+}
+
+// writeMetaPage encodes m into page, its freelist as runs. With a non-nil c
+// the file is marked encrypted, c's salt is recorded and the page is
+// signed, which needs pageOverhead bytes past pageSize.
+func writeMetaPage(page []byte, m meta, pageSize int, c *pageCipher) error {
+	if len(page) < pageSize || c != nil && len(page) < pageSize+pageOverhead {
 		return errors.New("leafdb: invalid meta page")
 	}
-	copy(page[:4], []byte(fileMagicV3))
+	runs := toRuns(m.freelist)
+	if fitFreeRuns(runs, pageSize-metaHeaderSizeV5) < len(runs) {
+		return errors.New("leafdb: freelist too large for meta page")
+	}
+	copy(page[:4], []byte(fileMagicV5))
 	binary.LittleEndian.PutUint32(page[4:], uint32(pageSize))
 	binary.LittleEndian.PutUint64(page[8:], m.txid)
 	binary.LittleEndian.PutUint64(page[16:], m.root)
 	binary.LittleEndian.PutUint64(page[24:], m.nextPage)
 	binary.LittleEndian.PutUint64(page[32:], m.freelistPage)
-	binary.LittleEndian.PutUint32(page[40:], uint32(len(m.freelist)))
-	off := metaHeaderSizeV3
-	for _, id := range m.freelist {
-		if off+8 > pageSize {
-			return errors.New("leafdb: freelist too large for meta page")
-		}
-		binary.LittleEndian.PutUint64(page[off:], id)
-		off += 8
+	binary.LittleEndian.PutUint32(page[40:], uint32(len(runs)))
+	clear(page[44:metaHeaderSizeV5])
+	appendFreeRuns(page[metaHeaderSizeV5:metaHeaderSizeV5], runs)
+	flags := uint32(metaFlagFreeRuns | metaFlagReservedNames)
+	if c == nil {
+		binary.LittleEndian.PutUint32(page[44:], flags)
+		return nil
 	}
+	binary.LittleEndian.PutUint32(page[44:], flags|metaFlagEncrypted)
+	copy(page[48:metaHeaderSizeV5], c.salt)
+	c.signMeta(page, pageSize)
 	return nil
 }
 
-func writeFreelistPage(page []byte, ids []uint64, next uint64, pageSize int) error {
+// writeFreelistPage encodes runs, which must fit, into a freelist page.
+func writeFreelistPage(page []byte, runs []pageRun, next uint64, pageSize int) error {
 	if len(page) < pageSize {
 		return errors.New("leafdb: invalid freelist page")
 	}
-	maxIDs := freelistPageCapacity(pageSize)
-	if len(ids) > maxIDs {
+	if fitFreeRuns(runs, pageSize-freelistHeaderSize) < len(runs) {
 		return errors.New("leafdb: freelist page too small")
 	}
-	page[0] = pageFreelist
-	binary.LittleEndian.PutUint16(page[1:], uint16(len(ids)))
+	page[0] = pageFreeRuns
+	binary.LittleEndian.PutUint16(page[1:], uint16(len(runs)))
 	binary.LittleEndian.PutUint64(page[3:], next)
-	off := freelistHeaderSize
-	for _, id := range ids {
-		if off+8 > pageSize {
-			return errors.New("leafdb: freelist page too small")
-		}
-		binary.LittleEndian.PutUint64(page[off:], id)
-		off += 8
-	}
+	appendFreeRuns(page[freelistHeaderSize:freelistHeaderSize], runs)
 	return nil
 }
 
-func readFreelistPage(page []byte, pageSize int) (uint64, []uint64, error) {
-	if len(page) < pageSize {
-		return 0, nil, errors.New("leafdb: invalid freelist page")
-	}
-	if page[0] != pageFreelist {
-		return 0, nil, errors.New("leafdb: invalid freelist page")
+// readFreelistPage decodes a freelist page of either type and returns the
+// next page of the chain and the free page IDs it holds, which must be
+// below limit.
+func readFreelistPage(page []byte, pageSize int, limit uint64) (uint64, []uint64, error) {
+	if len(page) < pageSize || pageSize < freelistHeaderSize {
+		return 0, nil, corrupted(len(page), "short freelist page")
 	}
 	count := int(binary.LittleEndian.Uint16(page[1:]))
 	next := binary.LittleEndian.Uint64(page[3:])
-	maxIDs := freelistPageCapacity(pageSize)
-	if count > maxIDs {
-		return 0, nil, errors.New("leafdb: freelist page too large")
+	switch page[0] {
+	case pageFreeRuns:
+		ids, err := readFreeRuns(page[:pageSize], freelistHeaderSize, count, limit)
+		if err != nil {
+			return 0, nil, err
+		}
+		return next, ids, nil
+	case pageFreelist:
+	default:
+		return 0, nil, corrupted(0, "invalid freelist page type")
+	}
+	if count > (pageSize-freelistHeaderSize)/8 {
+		return 0, nil, corrupted(1, "freelist exceeds page capacity")
 	}
 	ids := make([]uint64, count)
 	off := freelistHeaderSize
@@ -138,10 +268,121 @@ func readFreelistPage(page []byte, pageSize int) (uint64, []uint64, error) {
 	return next, ids, nil
 }
 
-func freelistPageCapacity(pageSize int) int {
-	return (pageSize - freelistHeaderSize) / 8
+// packFreeRuns splits runs into the number of them that fit inline in a
+// meta page and the chunks of the rest that each fit in a freelist page.
+func packFreeRuns(runs []pageRun, pageSize int) (int, [][]pageRun) {
+	inline := fitFreeRuns(runs, pageSize-metaHeaderSizeV5)
+	var chunks [][]pageRun
+	for rest := runs[inline:]; len(rest) > 0; {
+		n := fitFreeRuns(rest, pageSize-freelistHeaderSize)
+		chunks = append(chunks, rest[:n])
+		rest = rest[n:]
+	}
+	return inline, chunks
+}
+
+// toRuns returns the runs of consecutive pages in ids, in ascending order,
+// with duplicates merged.
+func toRuns(ids []uint64) []pageRun {
+	var runs []pageRun
+	for _, id := range slices.Sorted(slices.Values(ids)) {
+		if n := len(runs); n > 0 {
+			end := runs[n-1].first + runs[n-1].count
+			if id < end {
+				continue
+			}
+			if id == end {
+				runs[n-1].count++
+				continue
+			}
+		}
+		runs = append(runs, pageRun{first: id, count: 1})
+	}
+	return runs
+}
+
+// runIDs returns the page IDs of runs.
+func runIDs(runs []pageRun) []uint64 {
+	var ids []uint64
+	for _, r := range runs {
+		for id := r.first; id < r.first+r.count; id++ {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// appendFreeRuns appends runs, in ascending order, to buf. Each run is its
+// distance from the end of the previous run, or from zero for the first,
+// and its length, both as uvarints.
+func appendFreeRuns(buf []byte, runs []pageRun) []byte {
+	var end uint64
+	for _, r := range runs {
+		buf = binary.AppendUvarint(buf, r.first-end)
+		buf = binary.AppendUvarint(buf, r.count)
+		end = r.first + r.count
+	}
+	return buf
+}
+
+// fitFreeRuns returns how many of runs, from the first, appendFreeRuns
+// encodes in n bytes.
+func fitFreeRuns(runs []pageRun, n int) int {
+	var end uint64
+	size := 0
+	for i, r := range runs {
+		size += uvarintLen(r.first-end) + uvarintLen(r.count)
+		if size > n {
+			return i
+		}
+		end = r.first + r.count
+	}
+	return len(runs)
+}
+
+func uvarintLen(v uint64) int {
+	n := 1
+	for ; v >= 0x80; v >>= 7 {
+		n++
+	}
+	return n
+}
+
+// readFreeRuns decodes count runs encoded by appendFreeRuns at pos in page
+// and returns their page IDs, which must be below limit. Every run takes at
+// least two bytes, so a count too large for the page runs out of them.
+func readFreeRuns(page []byte, pos, count int, limit uint64) ([]uint64, error) {
+	var ids []uint64
+	var end uint64
+	for range count {
+		start := pos
+		gap, n := binary.Uvarint(page[pos:])
+		if n <= 0 {
+			return nil, corrupted(start, "corrupted freelist run")
+		}
+		pos += n
+		length, n := binary.Uvarint(page[pos:])
+		if n <= 0 || length == 0 || gap > limit || length > limit-min(limit, end+gap) {
+			return nil, corrupted(start, "corrupted freelist run")
+		}
+		pos += n
+		for id := end + gap; id < end+gap+length; id++ {
+			ids = append(ids, id)
+		}
+		end += gap + length
+	}
+	return ids, nil
+}
+
+// nodeChecksum returns the CRC32 of a node page, skipping the checksum field.
+func nodeChecksum(page []byte) uint32 {
+	sum := crc32.ChecksumIEEE(page[:nodeHeaderSizeV3])
+	return crc32.Update(sum, crc32.IEEETable, page[nodeHeaderSize:])
 }
 
-func metaInlineFreeCapacity(pageSize int) int {
-	return (pageSize - metaHeaderSizeV3) / 8
+// sealNodePage flags an encoded node page as checksummed and stores its CRC32.
+func sealNodePage(page []byte) {
+	flags := binary.LittleEndian.Uint16(page[11:])
+	binary.LittleEndian.PutUint16(page[11:], flags|nodeFlagChecksum)
+	binary.LittleEndian.PutUint32(page[13:], nodeChecksum(page))
 }
@@ -0,0 +1,15 @@
+//go:build linux
+
+package leafdb
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// punchHole deallocates size bytes of file at off without changing its size;
+// the range reads as zeros afterwards.
+func punchHole(file *os.File, off, size int64) error {
+	return unix.Fallocate(int(file.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, off, size)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package leafdb
+
+import (
+	"errors"
+	"os"
+)
+
+// punchHole is not supported outside Linux.
+func punchHole(file *os.File, off, size int64) error {
+	return errors.ErrUnsupported
+}
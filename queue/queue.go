@@ -0,0 +1,335 @@
+// Package queue implements persistent message queues in a leafdb database.
+//
+// Every operation takes the transaction it runs in, so a message can be
+// enqueued together with the data it refers to, and a consumer can apply
+// the effects of a message and acknowledge it in one commit:
+//
+//	q := queue.New("emails")
+//	err := db.Write(func(tx *leafdb.Tx) error {
+//		msg, err := q.Dequeue(tx)
+//		if err != nil {
+//			return err
+//		}
+//		if err := send(msg.Body); err != nil {
+//			return err
+//		}
+//		return q.Ack(tx, msg.ID)
+//	})
+//
+// A dequeued message stays in flight, invisible to other consumers, until
+// it is acknowledged with Ack, handed back with Nack, or its visibility
+// timeout expires, after which Dequeue delivers it again. In-flight
+// messages are stored like the others, so a consumer that crashes after
+// committing a Dequeue but before acknowledging the message loses nothing:
+// the message is delivered again once its timeout expires.
+//
+// The queues of a database are nested buckets of the top-level bucket
+// named Bucket, which should not be written to directly. A queue holds its
+// messages in order of ID, and delivers them, and those whose timeout
+// expired, in that order.
+package queue
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"leafdb"
+)
+
+// Bucket is the name of the top-level bucket that holds the queues.
+const Bucket = "queues"
+
+// DefaultVisibility is the visibility timeout used when Queue.Visibility is
+// zero.
+const DefaultVisibility = 30 * time.Second
+
+var (
+	// ErrEmpty is returned by Dequeue if the queue has no message to
+	// deliver.
+	ErrEmpty = errors.New("queue: empty")
+	// ErrNotInFlight is returned by Ack and Nack for a message that is not
+	// in flight: one that was acknowledged already, never dequeued, or made
+	// ready again by Nack or the expiry of its visibility timeout.
+	ErrNotInFlight = errors.New("queue: message not in flight")
+
+	errCorrupted = errors.New("queue: corrupted message")
+)
+
+// Names of the nested buckets of a queue: ready holds the messages to
+// deliver, inFlight those delivered and not acknowledged, and deadlines a
+// set of the deadlines of the latter followed by their IDs, in order of
+// deadline.
+var (
+	readyBucket     = []byte("ready")
+	inFlightBucket  = []byte("inflight")
+	deadlinesBucket = []byte("deadlines")
+)
+
+// Message is a message of a queue.
+type Message struct {
+	// ID identifies the message in its queue. IDs increase in the order
+	// messages are enqueued.
+	ID   uint64
+	Body []byte
+	// Deliveries is the number of times the message was dequeued, this
+	// time included.
+	Deliveries int
+	// Deadline is when the visibility timeout of the message expires.
+	Deadline time.Time
+}
+
+// Queue is a named queue. Queues with the same name share their messages,
+// whichever the database they are used on.
+type Queue struct {
+	name []byte
+	// Visibility is how long a dequeued message stays in flight before it
+	// is delivered again. Zero uses DefaultVisibility.
+	Visibility time.Duration
+	// Now returns the current time. Nil uses time.Now.
+	Now func() time.Time
+}
+
+// New returns the queue named name.
+func New(name string) *Queue {
+	return &Queue{name: []byte(name)}
+}
+
+// Name returns the name of q.
+func (q *Queue) Name() string {
+	return string(q.name)
+}
+
+// Enqueue adds a message with body to the end of q and returns its ID.
+func (q *Queue) Enqueue(tx *leafdb.Tx, body []byte) (uint64, error) {
+	b, err := q.buckets(tx, true)
+	if err != nil {
+		return 0, err
+	}
+	id, err := b.queue.NextSequence()
+	if err != nil {
+		return 0, err
+	}
+	return id, b.ready.Put(encodeID(id), appendReady(nil, 0, body))
+}
+
+// Dequeue delivers the first message of q that is ready, or whose
+// visibility timeout expired, and keeps it in flight until its new
+// timeout expires. It returns ErrEmpty if there is none.
+func (q *Queue) Dequeue(tx *leafdb.Tx) (Message, error) {
+	b, err := q.buckets(tx, true)
+	if err != nil {
+		return Message{}, err
+	}
+	now := q.now()
+	if err := b.requeue(now); err != nil {
+		return Message{}, err
+	}
+	key, value := b.ready.First()
+	if key == nil {
+		return Message{}, ErrEmpty
+	}
+	// With Options.NoCopyReads, key and value are only valid until the next
+	// write.
+	key, value = bytes.Clone(key), bytes.Clone(value)
+	deliveries, body, err := decodeReady(value)
+	if err != nil {
+		return Message{}, err
+	}
+	msg := Message{
+		ID:         binary.BigEndian.Uint64(key),
+		Body:       body,
+		Deliveries: deliveries + 1,
+		Deadline:   now.Add(q.visibility()),
+	}
+	deadline := encodeID(uint64(msg.Deadline.UnixNano()))
+	if err := b.inFlight.Put(key, appendReady(deadline, msg.Deliveries, body)); err != nil {
+		return Message{}, err
+	}
+	if _, err := b.deadlines.Add(append(deadline, key...)); err != nil {
+		return Message{}, err
+	}
+	return msg, b.ready.Delete(key)
+}
+
+// Ack removes the in-flight message id from q, which is done with it.
+func (q *Queue) Ack(tx *leafdb.Tx, id uint64) error {
+	b, err := q.buckets(tx, true)
+	if err != nil {
+		return err
+	}
+	_, _, err = b.take(encodeID(id))
+	return err
+}
+
+// Nack makes the in-flight message id ready to be delivered again at once,
+// before the messages enqueued after it.
+func (q *Queue) Nack(tx *leafdb.Tx, id uint64) error {
+	b, err := q.buckets(tx, true)
+	if err != nil {
+		return err
+	}
+	key := encodeID(id)
+	deliveries, body, err := b.take(key)
+	if err != nil {
+		return err
+	}
+	return b.ready.Put(key, appendReady(nil, deliveries, body))
+}
+
+// Len returns the number of messages of q that are ready and in flight.
+// Messages whose visibility timeout expired count as in flight until a
+// Dequeue delivers them again.
+func (q *Queue) Len(tx *leafdb.Tx) (ready, inFlight int, err error) {
+	b, err := q.buckets(tx, false)
+	if err != nil || b == nil {
+		return 0, 0, err
+	}
+	for range b.ready.Cursor().Keys(nil, nil) {
+		ready++
+	}
+	for range b.inFlight.Cursor().Keys(nil, nil) {
+		inFlight++
+	}
+	return ready, inFlight, nil
+}
+
+// Delete deletes q and its messages.
+func (q *Queue) Delete(tx *leafdb.Tx) error {
+	root := tx.Bucket([]byte(Bucket))
+	if root == nil {
+		return nil
+	}
+	err := root.DeleteBucket(q.name)
+	if errors.Is(err, leafdb.ErrBucketNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (q *Queue) visibility() time.Duration {
+	if q.Visibility > 0 {
+		return q.Visibility
+	}
+	return DefaultVisibility
+}
+
+func (q *Queue) now() time.Time {
+	if q.Now != nil {
+		return q.Now()
+	}
+	return time.Now()
+}
+
+// buckets are the buckets of a queue in a transaction.
+type buckets struct {
+	queue     *leafdb.Bucket
+	ready     *leafdb.Bucket
+	inFlight  *leafdb.Bucket
+	deadlines *leafdb.SetBucket
+}
+
+// buckets returns the buckets of q in tx, creating them if create is set,
+// or nil if they are missing.
+func (q *Queue) buckets(tx *leafdb.Tx, create bool) (*buckets, error) {
+	if len(q.name) == 0 {
+		return nil, errors.New("queue: name required")
+	}
+	if !create {
+		b := tx.Bucket([]byte(Bucket)).Bucket(q.name)
+		if b == nil {
+			return nil, nil
+		}
+		return &buckets{
+			queue:     b,
+			ready:     b.Bucket(readyBucket),
+			inFlight:  b.Bucket(inFlightBucket),
+			deadlines: b.Bucket(deadlinesBucket).AsSet(),
+		}, nil
+	}
+	root, err := tx.CreateBucketIfNotExists([]byte(Bucket))
+	if err != nil {
+		return nil, err
+	}
+	queue, err := root.CreateBucketIfNotExists(q.name)
+	if err != nil {
+		return nil, err
+	}
+	b := &buckets{queue: queue}
+	if b.ready, err = queue.CreateBucketIfNotExists(readyBucket); err != nil {
+		return nil, err
+	}
+	if b.inFlight, err = queue.CreateBucketIfNotExists(inFlightBucket); err != nil {
+		return nil, err
+	}
+	deadlines, err := queue.CreateBucketIfNotExists(deadlinesBucket)
+	if err != nil {
+		return nil, err
+	}
+	b.deadlines = deadlines.AsSet()
+	return b, nil
+}
+
+// requeue makes the in-flight messages whose deadline is not after now
+// ready again.
+func (b *buckets) requeue(now time.Time) error {
+	limit := encodeID(uint64(now.UnixNano()) + 1)
+	for {
+		key := b.deadlines.Bucket().Cursor().FirstKey()
+		if key == nil || bytes.Compare(key, limit) >= 0 {
+			return nil
+		}
+		if len(key) != 16 {
+			return errCorrupted
+		}
+		id := bytes.Clone(key[8:])
+		deliveries, body, err := b.take(id)
+		if err != nil {
+			return err
+		}
+		if err := b.ready.Put(id, appendReady(nil, deliveries, body)); err != nil {
+			return err
+		}
+	}
+}
+
+// take removes the in-flight message with key and returns its deliveries
+// and body.
+func (b *buckets) take(key []byte) (int, []byte, error) {
+	value := bytes.Clone(b.inFlight.Get(key))
+	if value == nil {
+		return 0, nil, ErrNotInFlight
+	}
+	if len(value) < 8 {
+		return 0, nil, errCorrupted
+	}
+	deliveries, body, err := decodeReady(value[8:])
+	if err != nil {
+		return 0, nil, err
+	}
+	if _, err := b.deadlines.Remove(append(value[:8:8], key...)); err != nil {
+		return 0, nil, err
+	}
+	return deliveries, body, b.inFlight.Delete(key)
+}
+
+// encodeID encodes a message ID, or a deadline, so that keys sort in its
+// order.
+func encodeID(id uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, id)
+}
+
+// appendReady appends a message as stored in the ready bucket, and after
+// its deadline in the in-flight bucket: its deliveries and its body.
+func appendReady(dst []byte, deliveries int, body []byte) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, uint32(deliveries))
+	return append(dst, body...)
+}
+
+func decodeReady(value []byte) (int, []byte, error) {
+	if len(value) < 4 {
+		return 0, nil, errCorrupted
+	}
+	return int(binary.BigEndian.Uint32(value)), value[4:], nil
+}
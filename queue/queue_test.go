@@ -0,0 +1,149 @@
+package queue_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"leafdb"
+	"leafdb/queue"
+)
+
+// clock is a time source the tests move forward by hand.
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+// dequeue runs Dequeue in a write transaction of its own and returns what
+// it returns.
+func dequeue(t *testing.T, db *leafdb.DB, q *queue.Queue) (queue.Message, error) {
+	t.Helper()
+	var msg queue.Message
+	var qerr error
+	err := db.Write(func(tx *leafdb.Tx) error {
+		msg, qerr = q.Dequeue(tx)
+		if errors.Is(qerr, queue.ErrEmpty) {
+			return nil
+		}
+		return qerr
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg, qerr
+}
+
+func TestVisibilityTimeout(t *testing.T) {
+	db, err := leafdb.OpenMem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	c := &clock{now: time.Unix(1000, 0)}
+	q := queue.New("jobs")
+	q.Visibility = time.Minute
+	q.Now = c.Now
+	err = db.Write(func(tx *leafdb.Tx) error {
+		for _, body := range []string{"a", "b"} {
+			if _, err := q.Enqueue(tx, []byte(body)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := dequeue(t, db, q)
+	if err != nil || string(a.Body) != "a" || a.Deliveries != 1 {
+		t.Fatalf("first dequeue: %+v, %v", a, err)
+	}
+	if want := c.now.Add(time.Minute); !a.Deadline.Equal(want) {
+		t.Fatalf("deadline %v, want %v", a.Deadline, want)
+	}
+	b, err := dequeue(t, db, q)
+	if err != nil || string(b.Body) != "b" {
+		t.Fatalf("second dequeue: %+v, %v", b, err)
+	}
+	// Both are in flight and hidden until their timeout expires.
+	if _, err := dequeue(t, db, q); !errors.Is(err, queue.ErrEmpty) {
+		t.Fatalf("dequeue with all in flight: %v, want ErrEmpty", err)
+	}
+	err = db.Write(func(tx *leafdb.Tx) error {
+		return q.Ack(tx, b.ID)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.now = c.now.Add(time.Minute - time.Nanosecond)
+	if _, err := dequeue(t, db, q); !errors.Is(err, queue.ErrEmpty) {
+		t.Fatalf("dequeue before the deadline: %v, want ErrEmpty", err)
+	}
+	c.now = c.now.Add(time.Nanosecond)
+	again, err := dequeue(t, db, q)
+	if err != nil || again.ID != a.ID || again.Deliveries != 2 {
+		t.Fatalf("redelivery: %+v, %v, want message %d delivered twice", again, err, a.ID)
+	}
+
+	// b was acknowledged already.
+	err = db.Write(func(tx *leafdb.Tx) error {
+		if err := q.Ack(tx, b.ID); !errors.Is(err, queue.ErrNotInFlight) {
+			t.Errorf("second ack: %v, want ErrNotInFlight", err)
+		}
+		return q.Ack(tx, again.ID)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Read(func(tx *leafdb.Tx) error {
+		ready, inFlight, err := q.Len(tx)
+		if err == nil && (ready != 0 || inFlight != 0) {
+			t.Errorf("%d ready and %d in flight after acks, want none", ready, inFlight)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNack(t *testing.T) {
+	db, err := leafdb.OpenMem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	q := queue.New("jobs")
+	err = db.Write(func(tx *leafdb.Tx) error {
+		for _, body := range []string{"a", "b"} {
+			if _, err := q.Enqueue(tx, []byte(body)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := dequeue(t, db, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Write(func(tx *leafdb.Tx) error {
+		return q.Nack(tx, a.ID)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A message handed back goes before those enqueued after it.
+	again, err := dequeue(t, db, q)
+	if err != nil || again.ID != a.ID || again.Deliveries != 2 {
+		t.Fatalf("after nack: %+v, %v, want message %d delivered twice", again, err, a.ID)
+	}
+}
@@ -0,0 +1,78 @@
+package leafdb
+
+// SetQuota limits the logical size of the pairs of b, the sum of the lengths
+// of their keys and values, to limit bytes; zero removes the limit. Put,
+// Merge, Increment and FillFromSorted return ErrQuotaExceeded rather than
+// grow b past the limit, and leave b unchanged. Writes that shrink a pair or
+// keep its size always succeed, so a bucket over a lowered limit can still
+// be trimmed. Nested buckets are not counted; they have quotas of their own.
+//
+// The size is kept in the bucket header only while a quota is set: setting
+// one on a bucket without reads all its pairs once, and every write to the
+// bucket then reads the value it replaces. The quota is stored in the file
+// but not recorded in the changefeed or in export streams, so replicas and
+// imports do not enforce it.
+func (b *Bucket) SetQuota(limit uint64) error {
+	if b == nil || b.tx == nil || b.tx.closed {
+		return ErrTxClosed
+	}
+	if !b.tx.writable {
+		return ErrTxReadOnly
+	}
+	b.tx.untrackedWrite()
+	switch {
+	case limit == 0:
+		b.size = 0
+	case b.quota == 0:
+		b.size = 0
+		for k, v := range b.All() {
+			b.size += pairSize(k, v)
+		}
+	}
+	b.quota = limit
+	return b.persistHeader()
+}
+
+// Quota returns the limit set by SetQuota, or zero if b has none, and the
+// logical size of the pairs of b, which is only tracked while a limit is set.
+func (b *Bucket) Quota() (limit, used uint64) {
+	if b == nil {
+		return 0, 0
+	}
+	return b.quota, b.size
+}
+
+// pairSize is the size of a pair counted against bucket quotas.
+func pairSize(key, value []byte) uint64 {
+	return uint64(len(key) + len(value))
+}
+
+// storedSize returns the size of the pair of key in tree if b has a quota,
+// and zero if it has none or key is absent.
+func (b *Bucket) storedSize(tree *bptree, key []byte) (uint64, error) {
+	if b.quota == 0 {
+		return 0, nil
+	}
+	n, ok, err := tree.valueSize(key)
+	if err != nil || !ok {
+		return 0, err
+	}
+	return uint64(len(key) + n), nil
+}
+
+// checkQuota returns ErrQuotaExceeded if replacing a pair of old bytes, zero
+// for none, by one of new bytes grows b past its quota.
+func (b *Bucket) checkQuota(old, new uint64) error {
+	if b.quota == 0 || new <= old || b.size+new-old <= b.quota {
+		return nil
+	}
+	return ErrQuotaExceeded
+}
+
+// account records the replacement of a pair of old bytes by one of new bytes
+// in the tracked size of b.
+func (b *Bucket) account(old, new uint64) {
+	if b.quota != 0 {
+		b.size = b.size + new - old
+	}
+}
@@ -0,0 +1,218 @@
+// Package raftfsm adapts a leafdb database to the finite state machine
+// interface of github.com/hashicorp/raft, so a raft cluster can replicate it.
+//
+// Commands are batches of leafdb.Change built with EncodeCommand and
+// submitted with raft.Apply; each log is applied in one transaction with
+// Tx.ApplyChange. The FSM also stores the index of the last log it applied
+// with Tx.SetAppliedTxID, in the same transaction, and skips logs at or
+// below it, so the logs raft replays after a restart are not applied twice.
+//
+// Snapshots are copies of the database written by Tx.WriteTo. Restore
+// replaces the contents of the database with those of a snapshot in one
+// transaction, so the *leafdb.DB stays valid across restores. Index
+// functions are not part of a snapshot: buckets replaced by a restore have
+// no indexes until DeclareIndex is called on them again.
+package raftfsm
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/hashicorp/raft"
+
+	"leafdb"
+)
+
+// FSM implements raft.FSM and raft.BatchingFSM on top of a leafdb database.
+type FSM struct {
+	db *leafdb.DB
+	// TempDir is the directory where Restore stages an incoming snapshot.
+	// Empty uses os.TempDir.
+	TempDir string
+}
+
+var (
+	_ raft.FSM         = (*FSM)(nil)
+	_ raft.BatchingFSM = (*FSM)(nil)
+)
+
+// New returns an FSM that applies raft logs to db. The database should only
+// be written to through raft, or the replicas diverge.
+func New(db *leafdb.DB) *FSM {
+	return &FSM{db: db}
+}
+
+// EncodeCommand encodes changes as the data of a raft log that the FSM
+// applies in one transaction. The TxID of each change is ignored.
+func EncodeCommand(changes ...leafdb.Change) ([]byte, error) {
+	return json.Marshal(changes)
+}
+
+// Applied returns the index of the last raft log applied to the database.
+func (f *FSM) Applied() (uint64, error) {
+	var index uint64
+	err := f.db.Read(func(tx *leafdb.Tx) error {
+		index = tx.AppliedTxID()
+		return nil
+	})
+	return index, err
+}
+
+// Apply applies a command log. It returns nil on success and the error
+// otherwise, in which case the log leaves the database unchanged.
+func (f *FSM) Apply(l *raft.Log) interface{} {
+	err := f.db.Write(func(tx *leafdb.Tx) error {
+		return applyLog(tx, tx.AppliedTxID(), l)
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ApplyBatch applies a batch of logs in one transaction. If any of them
+// fails, the batch is rolled back and the logs are applied one by one, so
+// a failing command does not affect the others.
+func (f *FSM) ApplyBatch(logs []*raft.Log) []interface{} {
+	out := make([]interface{}, len(logs))
+	err := f.db.Write(func(tx *leafdb.Tx) error {
+		applied := tx.AppliedTxID()
+		for _, l := range logs {
+			if err := applyLog(tx, applied, l); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		return out
+	}
+	for i, l := range logs {
+		out[i] = f.Apply(l)
+	}
+	return out
+}
+
+// applyLog applies l in tx unless it is not a command or its index is at or
+// below applied.
+func applyLog(tx *leafdb.Tx, applied uint64, l *raft.Log) error {
+	if l.Type != raft.LogCommand || l.Index <= applied {
+		return nil
+	}
+	var changes []leafdb.Change
+	if err := json.Unmarshal(l.Data, &changes); err != nil {
+		return err
+	}
+	for _, c := range changes {
+		if err := tx.ApplyChange(c); err != nil {
+			return err
+		}
+	}
+	return tx.SetAppliedTxID(l.Index)
+}
+
+// Snapshot captures the database as of the last applied log. The snapshot
+// holds a read transaction until it is released; it does not block Apply.
+func (f *FSM) Snapshot() (raft.FSMSnapshot, error) {
+	tx, err := f.db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshot{tx: tx}, nil
+}
+
+// Restore replaces the contents of the database with those of a snapshot
+// written by Persist.
+func (f *FSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	file, err := os.CreateTemp(f.TempDir, "leafdb-raft-*")
+	if err != nil {
+		return err
+	}
+	path := file.Name()
+	defer os.Remove(path)
+	_, err = io.Copy(file, rc)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	src, err := leafdb.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return src.Read(func(stx *leafdb.Tx) error {
+		return f.db.Write(func(tx *leafdb.Tx) error {
+			for _, name := range tx.Buckets() {
+				if err := tx.DeleteBucket(bytes.Clone(name)); err != nil {
+					return err
+				}
+			}
+			var seqs []leafdb.Change
+			err := stx.ForEachBucket(func(name []byte, b *leafdb.Bucket) error {
+				dst, err := tx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return copyBucket([][]byte{name}, dst, b, &seqs)
+			})
+			if err != nil {
+				return err
+			}
+			// Sequences are set last: ApplyChange opens the buckets afresh,
+			// which would leave the ones copyBucket holds stale.
+			for _, c := range seqs {
+				if err := tx.ApplyChange(c); err != nil {
+					return err
+				}
+			}
+			return tx.SetAppliedTxID(stx.AppliedTxID())
+		})
+	})
+}
+
+// copyBucket copies the pairs and nested buckets of src into the empty
+// bucket dst at path, and appends the changes that set their sequences to
+// seqs.
+func copyBucket(path [][]byte, dst, src *leafdb.Bucket, seqs *[]leafdb.Change) error {
+	c := src.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if err := dst.Put(k, v); err != nil {
+			return err
+		}
+	}
+	if seq := src.Sequence(); seq != 0 {
+		*seqs = append(*seqs, leafdb.Change{Op: leafdb.ChangeSequence, Bucket: path, Sequence: seq})
+	}
+	return src.ForEachBucket(func(name []byte, b *leafdb.Bucket) error {
+		child, err := dst.CreateBucket(name)
+		if err != nil {
+			return err
+		}
+		return copyBucket(append(path[:len(path):len(path)], name), child, b, seqs)
+	})
+}
+
+// snapshot is a raft.FSMSnapshot backed by a read transaction.
+type snapshot struct {
+	tx *leafdb.Tx
+}
+
+// Persist writes the database as seen by the snapshot's transaction to sink.
+func (s *snapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := s.tx.WriteTo(sink); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+// Release ends the snapshot's read transaction.
+func (s *snapshot) Release() {
+	s.tx.Rollback()
+}
@@ -0,0 +1,159 @@
+// Package recover rebuilds damaged leafdb databases from the pages that are
+// still readable. It is a last resort for files that no longer open or fail
+// DB.Check; restoring a backup is preferable when one exists.
+package recover
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+
+	"leafdb"
+)
+
+// LostAndFound is the top-level bucket that receives pairs whose bucket
+// could not be determined, in a nested bucket per leaf page named after the
+// page number.
+const LostAndFound = "lost+found"
+
+// commitEvery is the number of buckets and pairs written per transaction.
+const commitEvery = 10000
+
+// Report describes a salvage.
+type Report struct {
+	leafdb.SalvageStats
+	// Buckets and Pairs count what was written to the new database;
+	// LostPairs counts the pairs among them written to LostAndFound.
+	Buckets   int
+	Pairs     int
+	LostPairs int
+}
+
+// Salvage scans the database file at src with leafdb.Salvage and writes
+// every bucket and pair it finds to a new database at dst, which must not
+// exist. src is only read. opts, which may be nil, is used both to read src
+// and to create dst, so an encrypted file is salvaged into one encrypted
+// with the same key.
+//
+// Where several pages hold the same key, the pair read last wins. Since
+// freed pages are scanned too, the result can hold pairs and buckets that
+// had been deleted; check it before putting it in place of src.
+func Salvage(src, dst string, opts *leafdb.Options) (Report, error) {
+	var report Report
+	f, err := os.Open(src)
+	if err != nil {
+		return report, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return report, err
+	}
+	if _, err := os.Stat(dst); err == nil {
+		return report, fmt.Errorf("recover: %s already exists", dst)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return report, err
+	}
+
+	db, err := leafdb.OpenWithOptions(dst, opts)
+	if err != nil {
+		return report, err
+	}
+	w := &writer{db: db, report: &report}
+	report.SalvageStats, err = leafdb.Salvage(f, info.Size(), opts, w.add)
+	if err == nil {
+		err = w.commit()
+	} else if w.tx != nil {
+		w.tx.Rollback()
+	}
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	return report, err
+}
+
+// writer writes salvaged buckets and pairs in transactions of commitEvery
+// writes.
+type writer struct {
+	db      *leafdb.DB
+	tx      *leafdb.Tx
+	pending int
+	report  *Report
+
+	// bucket is the last bucket written to, at path.
+	bucket *leafdb.Bucket
+	path   string
+}
+
+func (w *writer) add(s leafdb.Salvaged) error {
+	if w.tx == nil {
+		tx, err := w.db.Begin(true)
+		if err != nil {
+			return err
+		}
+		w.tx = tx
+	}
+	path := s.Path
+	if !s.Bucket && path == nil {
+		path = [][]byte{[]byte(LostAndFound), strconv.AppendUint(nil, s.Page, 10)}
+	}
+	b, err := w.bucketAt(path)
+	if err != nil {
+		return err
+	}
+	switch {
+	case s.Bucket:
+		if s.Sequence != 0 {
+			if err := w.tx.ApplyChange(leafdb.Change{Op: leafdb.ChangeSequence, Bucket: path, Sequence: s.Sequence}); err != nil {
+				return err
+			}
+			// ApplyChange wrote through a Bucket of its own.
+			w.bucket = nil
+		}
+		w.report.Buckets++
+	default:
+		if err := b.Put(s.Key, s.Value); err != nil {
+			return err
+		}
+		w.report.Pairs++
+		if s.Path == nil {
+			w.report.LostPairs++
+		}
+	}
+	if w.pending++; w.pending >= commitEvery {
+		return w.commit()
+	}
+	return nil
+}
+
+// bucketAt returns the bucket at path, creating it and its parents if
+// needed.
+func (w *writer) bucketAt(path [][]byte) (*leafdb.Bucket, error) {
+	key := fmt.Sprintf("%q", path)
+	if w.bucket != nil && w.path == key {
+		return w.bucket, nil
+	}
+	b, err := w.tx.CreateBucketIfNotExists(path[0])
+	for _, name := range path[1:] {
+		if err != nil {
+			break
+		}
+		b, err = b.CreateBucketIfNotExists(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	w.bucket, w.path = b, key
+	return b, nil
+}
+
+func (w *writer) commit() error {
+	tx := w.tx
+	w.tx, w.bucket, w.pending = nil, nil, 0
+	if tx == nil {
+		return nil
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,255 @@
+package leafdb
+
+import (
+	"container/list"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// DefaultRemoteFetchSize is the size of the ranges OpenRemote fetches
+	// when Options.RemoteFetchSize is zero.
+	DefaultRemoteFetchSize = 1 << 20
+	// DefaultRemoteCacheSize is the budget of OpenRemote's cache of fetched
+	// ranges when Options.RemoteCacheSize is zero.
+	DefaultRemoteCacheSize = 64 << 20
+)
+
+// OpenRemote opens the database file of size bytes stored in r read-only,
+// without copying it. r is typically an object in object storage, such as
+// an objstore.Object, holding a snapshot written by Tx.WriteTo or a copy
+// of a closed database file; it must not change while the database is open.
+//
+// Pages are fetched on first use in aligned ranges of
+// Options.RemoteFetchSize bytes, and the most recently used ranges are kept
+// in memory up to Options.RemoteCacheSize, so a lookup in a large snapshot
+// only fetches the pages on its path. Concurrent reads of one range share a
+// single fetch. Write transactions fail with ErrDatabaseReadOnly.
+func OpenRemote(r io.ReaderAt, size int64, opts *Options) (*DB, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	diskPageSize, err := diskPageSizeFor(opts)
+	if err != nil {
+		return nil, err
+	}
+	if size < int64(diskPageSize*3) {
+		return nil, errInvalidFileSize
+	}
+	db := newDB(nil, size, diskPageSize, opts)
+	db.remote = newRemoteStoreFor(r, size, diskPageSize, opts)
+	db.readOnly = true
+	// Remote databases have no memory map; the empty mapping only marks the
+	// database as open.
+	db.mapping = &mapping{}
+	return db.open(false, opts)
+}
+
+// newRemoteStoreFor returns a remoteStore for the file of size bytes in r
+// with the fetch size and cache budget of opts.
+func newRemoteStoreFor(r io.ReaderAt, size int64, diskPageSize int, opts *Options) *remoteStore {
+	fetchSize := opts.RemoteFetchSize
+	if fetchSize <= 0 {
+		fetchSize = DefaultRemoteFetchSize
+	}
+	budget := opts.RemoteCacheSize
+	if budget <= 0 {
+		budget = DefaultRemoteCacheSize
+	}
+	return newRemoteStore(r, size, fetchSize, diskPageSize, budget)
+}
+
+// remoteStore reads the pages of a database file from an io.ReaderAt,
+// fetching the aligned range holding a page on first use and keeping the
+// most recently used ranges in memory while their size is within budget.
+// For Options.NoMmap the writer keeps it current with update and grow.
+type remoteStore struct {
+	r    io.ReaderAt
+	size atomic.Int64
+	// fetchSize is a multiple of the page size, so no page spans two
+	// ranges.
+	fetchSize int64
+	budget    int
+
+	mu     sync.Mutex
+	cached int
+	ranges map[int64]*list.Element
+	// order holds *remoteRange values, most recently used first.
+	order    list.List
+	fetching map[int64]*remoteFetch
+
+	fetches      atomic.Uint64
+	fetchedBytes atomic.Uint64
+}
+
+type remoteRange struct {
+	index int64
+	data  []byte
+}
+
+// remoteFetch is a fetch in progress; done is closed once data or err is
+// set. A stale fetch may have read pages that were written since, so its
+// data is not cached.
+type remoteFetch struct {
+	done  chan struct{}
+	data  []byte
+	err   error
+	stale bool
+}
+
+func newRemoteStore(r io.ReaderAt, size int64, fetchSize, pageSize, budget int) *remoteStore {
+	fetchSize = max(fetchSize+pageSize-1, pageSize) / pageSize * pageSize
+	s := &remoteStore{
+		r:         r,
+		fetchSize: int64(fetchSize),
+		budget:    budget,
+		ranges:    make(map[int64]*list.Element),
+		fetching:  make(map[int64]*remoteFetch),
+	}
+	s.size.Store(size)
+	return s
+}
+
+// page returns page id as stored. The result must not be modified.
+func (s *remoteStore) page(id uint64, pageSize int) ([]byte, error) {
+	off := int64(id) * int64(pageSize)
+	if off < 0 || off+int64(pageSize) > s.size.Load() {
+		return nil, errPageBeyondEnd
+	}
+	index := off / s.fetchSize
+	data, err := s.fetch(index)
+	if err != nil {
+		return nil, err
+	}
+	start := off - index*s.fetchSize
+	end := start + int64(pageSize)
+	return data[start:end:end], nil
+}
+
+// fetch returns range index from the cache, or reads it from r.
+func (s *remoteStore) fetch(index int64) ([]byte, error) {
+	s.mu.Lock()
+	if e, ok := s.ranges[index]; ok {
+		s.order.MoveToFront(e)
+		data := e.Value.(*remoteRange).data
+		s.mu.Unlock()
+		return data, nil
+	}
+	if f, ok := s.fetching[index]; ok {
+		s.mu.Unlock()
+		<-f.done
+		return f.data, f.err
+	}
+	f := &remoteFetch{done: make(chan struct{})}
+	s.fetching[index] = f
+	s.mu.Unlock()
+
+	off := index * s.fetchSize
+	buf := make([]byte, min(s.fetchSize, s.size.Load()-off))
+	n, err := s.r.ReadAt(buf, off)
+	if n == len(buf) {
+		err = nil
+	} else if err == nil {
+		err = io.ErrUnexpectedEOF
+	}
+	s.fetches.Add(1)
+	s.fetchedBytes.Add(uint64(n))
+
+	s.mu.Lock()
+	if s.fetching[index] == f {
+		delete(s.fetching, index)
+	}
+	if err == nil {
+		f.data = buf
+		if !f.stale {
+			s.add(index, buf)
+		}
+	} else {
+		f.err = err
+	}
+	s.mu.Unlock()
+	close(f.done)
+	return f.data, f.err
+}
+
+// update copies page id, as stored, into the cached range holding it, and
+// keeps a fetch of that range in progress from being cached. Readers never
+// look at a page while it is rewritten, so the copy does not race with them.
+func (s *remoteStore) update(id uint64, stored []byte) {
+	off := int64(id) * int64(len(stored))
+	index := off / s.fetchSize
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.ranges[index]; ok {
+		data := e.Value.(*remoteRange).data
+		if start := off - index*s.fetchSize; start < int64(len(data)) {
+			copy(data[start:], stored)
+		}
+	}
+	s.forget(index)
+}
+
+// resize records that the file was extended or truncated to size bytes.
+// The ranges from the one holding the nearer of the old and the new end of
+// the file on do not match the file any more, so they are dropped.
+func (s *remoteStore) resize(size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	first := (min(size, s.size.Load()) - 1) / s.fetchSize
+	for index, e := range s.ranges {
+		if index >= first {
+			s.remove(e)
+		}
+	}
+	for index := range s.fetching {
+		if index >= first {
+			s.forget(index)
+		}
+	}
+	s.size.Store(size)
+}
+
+// forget marks a fetch of range index in progress as stale, so that later
+// reads fetch the range again. Callers must hold mu.
+func (s *remoteStore) forget(index int64) {
+	if f, ok := s.fetching[index]; ok {
+		f.stale = true
+		delete(s.fetching, index)
+	}
+}
+
+// add caches a fetched range, evicting the least recently used ones over
+// budget. Callers must hold mu.
+func (s *remoteStore) add(index int64, data []byte) {
+	if len(data) > s.budget {
+		return
+	}
+	s.ranges[index] = s.order.PushFront(&remoteRange{index: index, data: data})
+	s.cached += len(data)
+	for s.cached > s.budget {
+		s.remove(s.order.Back())
+	}
+}
+
+// remove drops a cached range. Callers must hold mu.
+func (s *remoteStore) remove(e *list.Element) {
+	r := e.Value.(*remoteRange)
+	s.order.Remove(e)
+	delete(s.ranges, r.index)
+	s.cached -= len(r.data)
+}
+
+func (s *remoteStore) stats() RemoteStats {
+	if s == nil {
+		return RemoteStats{}
+	}
+	s.mu.Lock()
+	cached := s.cached
+	s.mu.Unlock()
+	return RemoteStats{
+		Fetches:      s.fetches.Load(),
+		FetchedBytes: s.fetchedBytes.Load(),
+		CachedBytes:  cached,
+	}
+}
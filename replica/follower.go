@@ -0,0 +1,276 @@
+package replica
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"leafdb"
+)
+
+// DefaultRetryInterval is the retry interval used when
+// Follower.RetryInterval is zero.
+const DefaultRetryInterval = time.Second
+
+// streamTimeout is how long a follower waits for a frame, heartbeats
+// included, before it gives up on the connection and reconnects.
+const streamTimeout = 3 * heartbeatInterval
+
+var (
+	// ErrPromoted is returned by Run once the follower has been promoted.
+	ErrPromoted = errors.New("replica: follower promoted")
+	// ErrRunning is returned by Run if the follower is already running.
+	ErrRunning = errors.New("replica: follower already running")
+	// ErrTruncated is returned by Run if the leader has truncated its
+	// changefeed past the last transaction the follower applied. The
+	// follower cannot catch up and must be seeded again with Bootstrap.
+	ErrTruncated = errors.New("replica: leader changefeed truncated past the follower")
+)
+
+// applyError reports a change that could not be applied. The follower has
+// diverged from the leader, so retrying cannot help.
+type applyError struct {
+	txid uint64
+	err  error
+}
+
+func (e *applyError) Error() string {
+	return fmt.Sprintf("replica: applying leader transaction %d: %v", e.txid, e.err)
+}
+
+func (e *applyError) Unwrap() error {
+	return e.err
+}
+
+// Follower applies a leader's committed transactions to a local database.
+type Follower struct {
+	db     *leafdb.DB
+	leader string
+	// Client is the HTTP client used to reach the leader. Nil uses
+	// http.DefaultClient.
+	Client *http.Client
+	// RetryInterval is how long Run waits before reconnecting after a
+	// connection error. Zero uses DefaultRetryInterval.
+	RetryInterval time.Duration
+
+	mu       sync.Mutex
+	stop     context.CancelFunc
+	done     chan struct{}
+	promoted bool
+}
+
+// NewFollower returns a follower that applies the changes served by the
+// Leader at leaderURL to db.
+func NewFollower(db *leafdb.DB, leaderURL string) *Follower {
+	return &Follower{db: db, leader: strings.TrimSuffix(leaderURL, "/")}
+}
+
+// Applied returns the ID of the last leader transaction applied to the
+// follower's database.
+func (f *Follower) Applied() (uint64, error) {
+	var id uint64
+	err := f.db.Read(func(tx *leafdb.Tx) error {
+		id = tx.AppliedTxID()
+		return nil
+	})
+	return id, err
+}
+
+// Run follows the leader until ctx is done or the follower is promoted,
+// reconnecting after connection errors. It returns nil after a promotion,
+// ErrTruncated if the changes it needs are gone and an error if a change
+// cannot be applied.
+func (f *Follower) Run(ctx context.Context) error {
+	f.mu.Lock()
+	if f.promoted {
+		f.mu.Unlock()
+		return ErrPromoted
+	}
+	if f.done != nil {
+		f.mu.Unlock()
+		return ErrRunning
+	}
+	ctx, f.stop = context.WithCancel(ctx)
+	done := make(chan struct{})
+	f.done = done
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		f.stop()
+		f.done = nil
+		f.mu.Unlock()
+		close(done)
+	}()
+
+	retry := f.RetryInterval
+	if retry <= 0 {
+		retry = DefaultRetryInterval
+	}
+	for {
+		err := f.follow(ctx)
+		var ae *applyError
+		if errors.As(err, &ae) || errors.Is(err, ErrTruncated) {
+			return err
+		}
+		if ctx.Err() != nil {
+			f.mu.Lock()
+			promoted := f.promoted
+			f.mu.Unlock()
+			if promoted {
+				return nil
+			}
+			return ctx.Err()
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(retry):
+		}
+	}
+}
+
+// Promote stops following the leader and waits for Run to return. The
+// database is left at the last leader transaction applied in full, ready to
+// take writes.
+func (f *Follower) Promote() {
+	f.mu.Lock()
+	f.promoted = true
+	stop, done := f.stop, f.done
+	f.mu.Unlock()
+	if done != nil {
+		stop()
+		<-done
+	}
+}
+
+// follow streams changes from the leader and applies them until the stream
+// fails or ctx is done.
+func (f *Follower) follow(ctx context.Context) error {
+	since, err := f.Applied()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.leader+"/changes?since="+strconv.FormatUint(since, 10), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := f.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return fmt.Errorf("%w: applied up to %d", ErrTruncated, since)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("replica: leader returned %s", resp.Status)
+	}
+
+	watchdog := time.AfterFunc(streamTimeout, cancel)
+	defer watchdog.Stop()
+	dec := json.NewDecoder(bufio.NewReader(resp.Body))
+	var changes []leafdb.Change
+	for {
+		var fr frame
+		if err := dec.Decode(&fr); err != nil {
+			return err
+		}
+		watchdog.Reset(streamTimeout)
+		switch {
+		case fr.Change != nil:
+			changes = append(changes, *fr.Change)
+		case fr.Commit != 0:
+			if err := f.apply(fr.Commit, changes); err != nil {
+				return err
+			}
+			changes = changes[:0]
+		}
+	}
+}
+
+// apply applies the changes of leader transaction txid in one transaction
+// that also records txid as applied.
+func (f *Follower) apply(txid uint64, changes []leafdb.Change) error {
+	err := f.db.Write(func(tx *leafdb.Tx) error {
+		for _, c := range changes {
+			if err := tx.ApplyChange(c); err != nil {
+				return err
+			}
+		}
+		return tx.SetAppliedTxID(txid)
+	})
+	if err != nil {
+		return &applyError{txid: txid, err: err}
+	}
+	return nil
+}
+
+func (f *Follower) client() *http.Client {
+	if f.Client != nil {
+		return f.Client
+	}
+	return http.DefaultClient
+}
+
+// Bootstrap creates a follower database at path from a snapshot of the
+// Leader at leaderURL. path must not exist. The new database records the
+// snapshot's transaction as applied, so a Follower picks up right after it.
+func Bootstrap(ctx context.Context, leaderURL, path string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(leaderURL, "/")+"/snapshot", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("replica: leader returned %s", resp.Status)
+	}
+	txid, err := strconv.ParseUint(resp.Header.Get("Leafdb-Txid"), 10, 64)
+	if err != nil {
+		return errors.New("replica: snapshot without a transaction ID")
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(file, resp.Body)
+	if err == nil && resp.ContentLength >= 0 && n != resp.ContentLength {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	db, err := leafdb.Open(path)
+	if err != nil {
+		return err
+	}
+	err = db.Write(func(tx *leafdb.Tx) error {
+		return tx.SetAppliedTxID(txid)
+	})
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
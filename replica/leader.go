@@ -0,0 +1,166 @@
+// Package replica replicates a leafdb database from a leader to followers
+// over HTTP.
+//
+// The leader must be opened with Options.Changefeed. A Leader serves its
+// changefeed and snapshots; a Follower streams the changefeed from where it
+// left off and applies each leader transaction in one local transaction,
+// together with the leader transaction ID it has reached, so a follower that
+// crashes resumes without gaps or repeats. Bootstrap seeds a new follower
+// file from a snapshot.
+//
+// A follower is read-only for the application until it is promoted with
+// Follower.Promote, after which it can be written to and, if opened with
+// Options.Changefeed, serve as a leader. Its transaction IDs differ from the
+// old leader's, so other followers must be bootstrapped again from it.
+package replica
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"leafdb"
+)
+
+// DefaultPollInterval is the poll interval used when Leader.PollInterval is
+// zero.
+const DefaultPollInterval = 100 * time.Millisecond
+
+// heartbeatInterval is how often an idle change stream sends an empty frame
+// so followers can tell a quiet leader from a dead connection.
+const heartbeatInterval = 5 * time.Second
+
+// frame is one line of a change stream. A stream sends the changes of each
+// transaction followed by a frame with Commit set to its ID; frames with
+// neither field set are heartbeats.
+type frame struct {
+	Change *leafdb.Change `json:"change,omitempty"`
+	Commit uint64         `json:"commit,omitempty"`
+}
+
+// Leader serves a database's changefeed and snapshots to followers. Mount it
+// on an http.ServeMux, stripping any path prefix:
+//
+//	mux.Handle("/replica/", http.StripPrefix("/replica", replica.NewLeader(db)))
+type Leader struct {
+	db *leafdb.DB
+	// PollInterval is how often a caught-up change stream checks for new
+	// commits. Zero uses DefaultPollInterval.
+	PollInterval time.Duration
+}
+
+// NewLeader returns a Leader for db.
+func NewLeader(db *leafdb.DB) *Leader {
+	return &Leader{db: db}
+}
+
+// ServeHTTP serves GET /changes?since=N, a stream of newline-delimited JSON
+// frames with the changes of transactions after N, or 410 Gone if
+// DB.TruncateChanges has deleted some of them, and GET /snapshot, a copy of
+// the database whose transaction ID is in the Leafdb-Txid header.
+func (l *Leader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch r.URL.Path {
+	case "/changes":
+		l.serveChanges(w, r)
+	case "/snapshot":
+		l.serveSnapshot(w)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (l *Leader) serveChanges(w http.ResponseWriter, r *http.Request) {
+	since, err := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid since", http.StatusBadRequest)
+		return
+	}
+	poll := l.PollInterval
+	if poll <= 0 {
+		poll = DefaultPollInterval
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	idle := time.Duration(0)
+	for first := true; ; first = false {
+		last, err := l.sendChanges(enc, since)
+		if err != nil {
+			// Nothing is written before the first error of Changes, so the
+			// status can still be set.
+			if first && errors.Is(err, leafdb.ErrChangesTruncated) {
+				http.Error(w, err.Error(), http.StatusGone)
+			}
+			return
+		}
+		if last != since {
+			since, idle = last, 0
+		} else if idle += poll; idle >= heartbeatInterval {
+			if enc.Encode(frame{}) != nil {
+				return
+			}
+			idle = 0
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(poll):
+		}
+	}
+}
+
+// sendChanges writes the changes committed after since and returns the ID of
+// the last transaction sent, or since if there were none.
+func (l *Leader) sendChanges(enc *json.Encoder, since uint64) (uint64, error) {
+	it, err := l.db.Changes(since)
+	if err != nil {
+		return since, err
+	}
+	defer it.Close()
+	last := since
+	for it.Next() {
+		c := it.Change()
+		if c.TxID != last && last != since {
+			if err := enc.Encode(frame{Commit: last}); err != nil {
+				return since, err
+			}
+		}
+		last = c.TxID
+		if err := enc.Encode(frame{Change: &c}); err != nil {
+			return since, err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return since, err
+	}
+	if last != since {
+		if err := enc.Encode(frame{Commit: last}); err != nil {
+			return since, err
+		}
+	}
+	return last, nil
+}
+
+func (l *Leader) serveSnapshot(w http.ResponseWriter) {
+	tx, err := l.db.Begin(false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer tx.Rollback()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Leafdb-Txid", strconv.FormatUint(tx.ID(), 10))
+	// Once the body has started an error can only cut it short, which
+	// Bootstrap detects by the missing bytes.
+	w.Header().Set("Content-Length", strconv.FormatInt(tx.Size(), 10))
+	_, _ = tx.WriteTo(w)
+}
@@ -0,0 +1,137 @@
+package replica_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"leafdb"
+	"leafdb/replica"
+)
+
+// startLeader opens a database with a changefeed and serves it as a leader.
+func startLeader(t *testing.T) (*leafdb.DB, *httptest.Server) {
+	t.Helper()
+	db, err := leafdb.OpenMemWithOptions(&leafdb.Options{Changefeed: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	l := replica.NewLeader(db)
+	l.PollInterval = time.Millisecond
+	srv := httptest.NewServer(l)
+	t.Cleanup(srv.Close)
+	return db, srv
+}
+
+// writeRange puts keys from to to-1 into bucket b, one transaction each,
+// and returns the ID of the last.
+func writeRange(t *testing.T, db *leafdb.DB, from, to int) uint64 {
+	t.Helper()
+	var id uint64
+	for i := from; i < to; i++ {
+		err := db.Write(func(tx *leafdb.Tx) error {
+			id = tx.ID() + 1
+			b, err := tx.CreateBucketIfNotExists([]byte("b"))
+			if err != nil {
+				return err
+			}
+			return b.Put(fmt.Appendf(nil, "k%03d", i), fmt.Appendf(nil, "v%d", i))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return id
+}
+
+// contents returns the pairs of bucket b of db.
+func contents(t *testing.T, db *leafdb.DB) map[string]string {
+	t.Helper()
+	out := make(map[string]string)
+	err := db.Read(func(tx *leafdb.Tx) error {
+		if b := tx.Bucket([]byte("b")); b != nil {
+			for k, v := range b.All() {
+				out[string(k)] = string(v)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestCatchUp(t *testing.T) {
+	leader, srv := startLeader(t)
+	writeRange(t, leader, 0, 10)
+	path := filepath.Join(t.TempDir(), "follower.db")
+	if err := replica.Bootstrap(context.Background(), srv.URL, path); err != nil {
+		t.Fatal(err)
+	}
+	// Commits after the snapshot reach the follower through the changefeed.
+	last := writeRange(t, leader, 10, 20)
+	db, err := leafdb.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	f := replica.NewFollower(db, srv.URL)
+	done := make(chan error, 1)
+	go func() { done <- f.Run(context.Background()) }()
+	last = writeRange(t, leader, 20, 30)
+
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(time.Millisecond) {
+		applied, err := f.Applied()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if applied == last {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("follower at transaction %d, leader at %d", applied, last)
+		}
+	}
+	f.Promote()
+	if err := <-done; err != nil {
+		t.Fatalf("run after promotion: %v", err)
+	}
+	if got, want := contents(t, db), contents(t, leader); !maps.Equal(got, want) {
+		t.Fatalf("follower holds %d keys, leader %d", len(got), len(want))
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	leader, srv := startLeader(t)
+	last := writeRange(t, leader, 0, 5)
+	if err := leader.TruncateChanges(last); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(srv.URL + "/changes?since=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGone {
+		t.Fatalf("changes since a truncated transaction: %s, want 410 Gone", resp.Status)
+	}
+
+	db, err := leafdb.OpenMem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := replica.NewFollower(db, srv.URL).Run(ctx); !errors.Is(err, replica.ErrTruncated) {
+		t.Fatalf("run behind the truncation: %v, want ErrTruncated", err)
+	}
+}
@@ -0,0 +1,59 @@
+package leafdb
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Files written before names starting with reservedPrefix were reserved may
+// hold user buckets with such names, which would be taken for internal
+// buckets and hidden. Open looks for them in files whose meta page lacks
+// metaFlagReservedNames, which every commit sets, and refuses the file if
+// it finds one, so that the buckets are renamed rather than lost.
+
+// checkReservedNames fails with ErrReservedName if a bucket at any level has
+// a reserved name that no internal bucket uses.
+func (db *DB) checkReservedNames() error {
+	return db.Read(func(tx *Tx) error {
+		return checkReservedNames(tx.mgr, nil, tx.mgr.root)
+	})
+}
+
+// checkReservedNames checks the buckets in the bucket index tree at root of
+// the bucket at path, and those nested in them.
+func checkReservedNames(store pageStore, path [][]byte, root uint64) error {
+	if root == 0 {
+		return nil
+	}
+	c := &Cursor{tree: newBPTree(&root, store)}
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		name := append(clonePath(path), cloneBytes(k))
+		if isReservedName(k) {
+			if !isInternalName(path, k) {
+				return fmt.Errorf("%w: bucket %q was created before names starting with a zero byte were reserved for internal buckets; rename it with an earlier version to open the file", ErrReservedName, name)
+			}
+			continue
+		}
+		h, err := readBucketHeader(store, decodePageID(v))
+		if err != nil {
+			return err
+		}
+		if err := checkReservedNames(store, name, h.bucketRoot); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isInternalName reports whether name is that of an internal bucket inside
+// the bucket at path, or at the top level if path is empty.
+func isInternalName(path [][]byte, name []byte) bool {
+	if len(path) == 0 {
+		switch string(name) {
+		case changesBucket, auditBucket, replicaBucket, batchesBucket:
+			return true
+		}
+		return false
+	}
+	return bytes.HasPrefix(name, []byte(indexBucketPrefix)) || string(name) == sortedSetScores
+}
@@ -0,0 +1,1063 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: leafdb.proto
+
+package rpc
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type GetRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Bucket        [][]byte               `protobuf:"bytes,1,rep,name=bucket,proto3" json:"bucket,omitempty"`
+	Key           []byte                 `protobuf:"bytes,2,opt,name=key,proto3" json:"key,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetRequest) Reset() {
+	*x = GetRequest{}
+	mi := &file_leafdb_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetRequest) ProtoMessage() {}
+
+func (x *GetRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_leafdb_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetRequest.ProtoReflect.Descriptor instead.
+func (*GetRequest) Descriptor() ([]byte, []int) {
+	return file_leafdb_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *GetRequest) GetBucket() [][]byte {
+	if x != nil {
+		return x.Bucket
+	}
+	return nil
+}
+
+func (x *GetRequest) GetKey() []byte {
+	if x != nil {
+		return x.Key
+	}
+	return nil
+}
+
+type GetResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Value         []byte                 `protobuf:"bytes,1,opt,name=value,proto3" json:"value,omitempty"`
+	Found         bool                   `protobuf:"varint,2,opt,name=found,proto3" json:"found,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetResponse) Reset() {
+	*x = GetResponse{}
+	mi := &file_leafdb_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetResponse) ProtoMessage() {}
+
+func (x *GetResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_leafdb_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetResponse.ProtoReflect.Descriptor instead.
+func (*GetResponse) Descriptor() ([]byte, []int) {
+	return file_leafdb_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *GetResponse) GetValue() []byte {
+	if x != nil {
+		return x.Value
+	}
+	return nil
+}
+
+func (x *GetResponse) GetFound() bool {
+	if x != nil {
+		return x.Found
+	}
+	return false
+}
+
+type PutRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Bucket        [][]byte               `protobuf:"bytes,1,rep,name=bucket,proto3" json:"bucket,omitempty"`
+	Key           []byte                 `protobuf:"bytes,2,opt,name=key,proto3" json:"key,omitempty"`
+	Value         []byte                 `protobuf:"bytes,3,opt,name=value,proto3" json:"value,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PutRequest) Reset() {
+	*x = PutRequest{}
+	mi := &file_leafdb_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PutRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PutRequest) ProtoMessage() {}
+
+func (x *PutRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_leafdb_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PutRequest.ProtoReflect.Descriptor instead.
+func (*PutRequest) Descriptor() ([]byte, []int) {
+	return file_leafdb_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *PutRequest) GetBucket() [][]byte {
+	if x != nil {
+		return x.Bucket
+	}
+	return nil
+}
+
+func (x *PutRequest) GetKey() []byte {
+	if x != nil {
+		return x.Key
+	}
+	return nil
+}
+
+func (x *PutRequest) GetValue() []byte {
+	if x != nil {
+		return x.Value
+	}
+	return nil
+}
+
+type PutResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PutResponse) Reset() {
+	*x = PutResponse{}
+	mi := &file_leafdb_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PutResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PutResponse) ProtoMessage() {}
+
+func (x *PutResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_leafdb_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PutResponse.ProtoReflect.Descriptor instead.
+func (*PutResponse) Descriptor() ([]byte, []int) {
+	return file_leafdb_proto_rawDescGZIP(), []int{3}
+}
+
+type DeleteRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Bucket        [][]byte               `protobuf:"bytes,1,rep,name=bucket,proto3" json:"bucket,omitempty"`
+	Key           []byte                 `protobuf:"bytes,2,opt,name=key,proto3" json:"key,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeleteRequest) Reset() {
+	*x = DeleteRequest{}
+	mi := &file_leafdb_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeleteRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeleteRequest) ProtoMessage() {}
+
+func (x *DeleteRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_leafdb_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeleteRequest.ProtoReflect.Descriptor instead.
+func (*DeleteRequest) Descriptor() ([]byte, []int) {
+	return file_leafdb_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *DeleteRequest) GetBucket() [][]byte {
+	if x != nil {
+		return x.Bucket
+	}
+	return nil
+}
+
+func (x *DeleteRequest) GetKey() []byte {
+	if x != nil {
+		return x.Key
+	}
+	return nil
+}
+
+type DeleteResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeleteResponse) Reset() {
+	*x = DeleteResponse{}
+	mi := &file_leafdb_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeleteResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeleteResponse) ProtoMessage() {}
+
+func (x *DeleteResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_leafdb_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeleteResponse.ProtoReflect.Descriptor instead.
+func (*DeleteResponse) Descriptor() ([]byte, []int) {
+	return file_leafdb_proto_rawDescGZIP(), []int{5}
+}
+
+type ScanRequest struct {
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Bucket [][]byte               `protobuf:"bytes,1,rep,name=bucket,proto3" json:"bucket,omitempty"`
+	// Only keys starting with prefix are returned.
+	Prefix []byte `protobuf:"bytes,2,opt,name=prefix,proto3" json:"prefix,omitempty"`
+	// The scan starts at the first key >= start.
+	Start []byte `protobuf:"bytes,3,opt,name=start,proto3" json:"start,omitempty"`
+	// At most limit pairs are returned; zero means no limit.
+	Limit         uint32 `protobuf:"varint,4,opt,name=limit,proto3" json:"limit,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ScanRequest) Reset() {
+	*x = ScanRequest{}
+	mi := &file_leafdb_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ScanRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ScanRequest) ProtoMessage() {}
+
+func (x *ScanRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_leafdb_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ScanRequest.ProtoReflect.Descriptor instead.
+func (*ScanRequest) Descriptor() ([]byte, []int) {
+	return file_leafdb_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *ScanRequest) GetBucket() [][]byte {
+	if x != nil {
+		return x.Bucket
+	}
+	return nil
+}
+
+func (x *ScanRequest) GetPrefix() []byte {
+	if x != nil {
+		return x.Prefix
+	}
+	return nil
+}
+
+func (x *ScanRequest) GetStart() []byte {
+	if x != nil {
+		return x.Start
+	}
+	return nil
+}
+
+func (x *ScanRequest) GetLimit() uint32 {
+	if x != nil {
+		return x.Limit
+	}
+	return 0
+}
+
+type KeyValue struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Key           []byte                 `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Value         []byte                 `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *KeyValue) Reset() {
+	*x = KeyValue{}
+	mi := &file_leafdb_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *KeyValue) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*KeyValue) ProtoMessage() {}
+
+func (x *KeyValue) ProtoReflect() protoreflect.Message {
+	mi := &file_leafdb_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use KeyValue.ProtoReflect.Descriptor instead.
+func (*KeyValue) Descriptor() ([]byte, []int) {
+	return file_leafdb_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *KeyValue) GetKey() []byte {
+	if x != nil {
+		return x.Key
+	}
+	return nil
+}
+
+func (x *KeyValue) GetValue() []byte {
+	if x != nil {
+		return x.Value
+	}
+	return nil
+}
+
+// Op is one write in a BatchApply request.
+type Op struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Op:
+	//
+	//	*Op_Put
+	//	*Op_Delete
+	Op            isOp_Op `protobuf_oneof:"op"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Op) Reset() {
+	*x = Op{}
+	mi := &file_leafdb_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Op) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Op) ProtoMessage() {}
+
+func (x *Op) ProtoReflect() protoreflect.Message {
+	mi := &file_leafdb_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Op.ProtoReflect.Descriptor instead.
+func (*Op) Descriptor() ([]byte, []int) {
+	return file_leafdb_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *Op) GetOp() isOp_Op {
+	if x != nil {
+		return x.Op
+	}
+	return nil
+}
+
+func (x *Op) GetPut() *PutRequest {
+	if x != nil {
+		if x, ok := x.Op.(*Op_Put); ok {
+			return x.Put
+		}
+	}
+	return nil
+}
+
+func (x *Op) GetDelete() *DeleteRequest {
+	if x != nil {
+		if x, ok := x.Op.(*Op_Delete); ok {
+			return x.Delete
+		}
+	}
+	return nil
+}
+
+type isOp_Op interface {
+	isOp_Op()
+}
+
+type Op_Put struct {
+	Put *PutRequest `protobuf:"bytes,1,opt,name=put,proto3,oneof"`
+}
+
+type Op_Delete struct {
+	Delete *DeleteRequest `protobuf:"bytes,2,opt,name=delete,proto3,oneof"`
+}
+
+func (*Op_Put) isOp_Op() {}
+
+func (*Op_Delete) isOp_Op() {}
+
+type BatchApplyRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Ops           []*Op                  `protobuf:"bytes,1,rep,name=ops,proto3" json:"ops,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BatchApplyRequest) Reset() {
+	*x = BatchApplyRequest{}
+	mi := &file_leafdb_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BatchApplyRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BatchApplyRequest) ProtoMessage() {}
+
+func (x *BatchApplyRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_leafdb_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BatchApplyRequest.ProtoReflect.Descriptor instead.
+func (*BatchApplyRequest) Descriptor() ([]byte, []int) {
+	return file_leafdb_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *BatchApplyRequest) GetOps() []*Op {
+	if x != nil {
+		return x.Ops
+	}
+	return nil
+}
+
+type BatchApplyResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BatchApplyResponse) Reset() {
+	*x = BatchApplyResponse{}
+	mi := &file_leafdb_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BatchApplyResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BatchApplyResponse) ProtoMessage() {}
+
+func (x *BatchApplyResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_leafdb_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BatchApplyResponse.ProtoReflect.Descriptor instead.
+func (*BatchApplyResponse) Descriptor() ([]byte, []int) {
+	return file_leafdb_proto_rawDescGZIP(), []int{10}
+}
+
+type BeginRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Writable      bool                   `protobuf:"varint,1,opt,name=writable,proto3" json:"writable,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BeginRequest) Reset() {
+	*x = BeginRequest{}
+	mi := &file_leafdb_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BeginRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BeginRequest) ProtoMessage() {}
+
+func (x *BeginRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_leafdb_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BeginRequest.ProtoReflect.Descriptor instead.
+func (*BeginRequest) Descriptor() ([]byte, []int) {
+	return file_leafdb_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *BeginRequest) GetWritable() bool {
+	if x != nil {
+		return x.Writable
+	}
+	return false
+}
+
+type CommitRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CommitRequest) Reset() {
+	*x = CommitRequest{}
+	mi := &file_leafdb_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CommitRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CommitRequest) ProtoMessage() {}
+
+func (x *CommitRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_leafdb_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CommitRequest.ProtoReflect.Descriptor instead.
+func (*CommitRequest) Descriptor() ([]byte, []int) {
+	return file_leafdb_proto_rawDescGZIP(), []int{12}
+}
+
+type RollbackRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RollbackRequest) Reset() {
+	*x = RollbackRequest{}
+	mi := &file_leafdb_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RollbackRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RollbackRequest) ProtoMessage() {}
+
+func (x *RollbackRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_leafdb_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RollbackRequest.ProtoReflect.Descriptor instead.
+func (*RollbackRequest) Descriptor() ([]byte, []int) {
+	return file_leafdb_proto_rawDescGZIP(), []int{13}
+}
+
+type TxRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Request:
+	//
+	//	*TxRequest_Begin
+	//	*TxRequest_Get
+	//	*TxRequest_Put
+	//	*TxRequest_Delete
+	//	*TxRequest_Commit
+	//	*TxRequest_Rollback
+	Request       isTxRequest_Request `protobuf_oneof:"request"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TxRequest) Reset() {
+	*x = TxRequest{}
+	mi := &file_leafdb_proto_msgTypes[14]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TxRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TxRequest) ProtoMessage() {}
+
+func (x *TxRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_leafdb_proto_msgTypes[14]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TxRequest.ProtoReflect.Descriptor instead.
+func (*TxRequest) Descriptor() ([]byte, []int) {
+	return file_leafdb_proto_rawDescGZIP(), []int{14}
+}
+
+func (x *TxRequest) GetRequest() isTxRequest_Request {
+	if x != nil {
+		return x.Request
+	}
+	return nil
+}
+
+func (x *TxRequest) GetBegin() *BeginRequest {
+	if x != nil {
+		if x, ok := x.Request.(*TxRequest_Begin); ok {
+			return x.Begin
+		}
+	}
+	return nil
+}
+
+func (x *TxRequest) GetGet() *GetRequest {
+	if x != nil {
+		if x, ok := x.Request.(*TxRequest_Get); ok {
+			return x.Get
+		}
+	}
+	return nil
+}
+
+func (x *TxRequest) GetPut() *PutRequest {
+	if x != nil {
+		if x, ok := x.Request.(*TxRequest_Put); ok {
+			return x.Put
+		}
+	}
+	return nil
+}
+
+func (x *TxRequest) GetDelete() *DeleteRequest {
+	if x != nil {
+		if x, ok := x.Request.(*TxRequest_Delete); ok {
+			return x.Delete
+		}
+	}
+	return nil
+}
+
+func (x *TxRequest) GetCommit() *CommitRequest {
+	if x != nil {
+		if x, ok := x.Request.(*TxRequest_Commit); ok {
+			return x.Commit
+		}
+	}
+	return nil
+}
+
+func (x *TxRequest) GetRollback() *RollbackRequest {
+	if x != nil {
+		if x, ok := x.Request.(*TxRequest_Rollback); ok {
+			return x.Rollback
+		}
+	}
+	return nil
+}
+
+type isTxRequest_Request interface {
+	isTxRequest_Request()
+}
+
+type TxRequest_Begin struct {
+	Begin *BeginRequest `protobuf:"bytes,1,opt,name=begin,proto3,oneof"`
+}
+
+type TxRequest_Get struct {
+	Get *GetRequest `protobuf:"bytes,2,opt,name=get,proto3,oneof"`
+}
+
+type TxRequest_Put struct {
+	Put *PutRequest `protobuf:"bytes,3,opt,name=put,proto3,oneof"`
+}
+
+type TxRequest_Delete struct {
+	Delete *DeleteRequest `protobuf:"bytes,4,opt,name=delete,proto3,oneof"`
+}
+
+type TxRequest_Commit struct {
+	Commit *CommitRequest `protobuf:"bytes,5,opt,name=commit,proto3,oneof"`
+}
+
+type TxRequest_Rollback struct {
+	Rollback *RollbackRequest `protobuf:"bytes,6,opt,name=rollback,proto3,oneof"`
+}
+
+func (*TxRequest_Begin) isTxRequest_Request() {}
+
+func (*TxRequest_Get) isTxRequest_Request() {}
+
+func (*TxRequest_Put) isTxRequest_Request() {}
+
+func (*TxRequest_Delete) isTxRequest_Request() {}
+
+func (*TxRequest_Commit) isTxRequest_Request() {}
+
+func (*TxRequest_Rollback) isTxRequest_Request() {}
+
+// TxResponse answers one TxRequest. get is set in reply to a get request.
+type TxResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Get           *GetResponse           `protobuf:"bytes,1,opt,name=get,proto3" json:"get,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TxResponse) Reset() {
+	*x = TxResponse{}
+	mi := &file_leafdb_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TxResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TxResponse) ProtoMessage() {}
+
+func (x *TxResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_leafdb_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TxResponse.ProtoReflect.Descriptor instead.
+func (*TxResponse) Descriptor() ([]byte, []int) {
+	return file_leafdb_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *TxResponse) GetGet() *GetResponse {
+	if x != nil {
+		return x.Get
+	}
+	return nil
+}
+
+var File_leafdb_proto protoreflect.FileDescriptor
+
+const file_leafdb_proto_rawDesc = "" +
+	"\n" +
+	"\fleafdb.proto\x12\n" +
+	"leafdb.rpc\"6\n" +
+	"\n" +
+	"GetRequest\x12\x16\n" +
+	"\x06bucket\x18\x01 \x03(\fR\x06bucket\x12\x10\n" +
+	"\x03key\x18\x02 \x01(\fR\x03key\"9\n" +
+	"\vGetResponse\x12\x14\n" +
+	"\x05value\x18\x01 \x01(\fR\x05value\x12\x14\n" +
+	"\x05found\x18\x02 \x01(\bR\x05found\"L\n" +
+	"\n" +
+	"PutRequest\x12\x16\n" +
+	"\x06bucket\x18\x01 \x03(\fR\x06bucket\x12\x10\n" +
+	"\x03key\x18\x02 \x01(\fR\x03key\x12\x14\n" +
+	"\x05value\x18\x03 \x01(\fR\x05value\"\r\n" +
+	"\vPutResponse\"9\n" +
+	"\rDeleteRequest\x12\x16\n" +
+	"\x06bucket\x18\x01 \x03(\fR\x06bucket\x12\x10\n" +
+	"\x03key\x18\x02 \x01(\fR\x03key\"\x10\n" +
+	"\x0eDeleteResponse\"i\n" +
+	"\vScanRequest\x12\x16\n" +
+	"\x06bucket\x18\x01 \x03(\fR\x06bucket\x12\x16\n" +
+	"\x06prefix\x18\x02 \x01(\fR\x06prefix\x12\x14\n" +
+	"\x05start\x18\x03 \x01(\fR\x05start\x12\x14\n" +
+	"\x05limit\x18\x04 \x01(\rR\x05limit\"2\n" +
+	"\bKeyValue\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\fR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\fR\x05value\"k\n" +
+	"\x02Op\x12*\n" +
+	"\x03put\x18\x01 \x01(\v2\x16.leafdb.rpc.PutRequestH\x00R\x03put\x123\n" +
+	"\x06delete\x18\x02 \x01(\v2\x19.leafdb.rpc.DeleteRequestH\x00R\x06deleteB\x04\n" +
+	"\x02op\"5\n" +
+	"\x11BatchApplyRequest\x12 \n" +
+	"\x03ops\x18\x01 \x03(\v2\x0e.leafdb.rpc.OpR\x03ops\"\x14\n" +
+	"\x12BatchApplyResponse\"*\n" +
+	"\fBeginRequest\x12\x1a\n" +
+	"\bwritable\x18\x01 \x01(\bR\bwritable\"\x0f\n" +
+	"\rCommitRequest\"\x11\n" +
+	"\x0fRollbackRequest\"\xc5\x02\n" +
+	"\tTxRequest\x120\n" +
+	"\x05begin\x18\x01 \x01(\v2\x18.leafdb.rpc.BeginRequestH\x00R\x05begin\x12*\n" +
+	"\x03get\x18\x02 \x01(\v2\x16.leafdb.rpc.GetRequestH\x00R\x03get\x12*\n" +
+	"\x03put\x18\x03 \x01(\v2\x16.leafdb.rpc.PutRequestH\x00R\x03put\x123\n" +
+	"\x06delete\x18\x04 \x01(\v2\x19.leafdb.rpc.DeleteRequestH\x00R\x06delete\x123\n" +
+	"\x06commit\x18\x05 \x01(\v2\x19.leafdb.rpc.CommitRequestH\x00R\x06commit\x129\n" +
+	"\brollback\x18\x06 \x01(\v2\x1b.leafdb.rpc.RollbackRequestH\x00R\brollbackB\t\n" +
+	"\arequest\"7\n" +
+	"\n" +
+	"TxResponse\x12)\n" +
+	"\x03get\x18\x01 \x01(\v2\x17.leafdb.rpc.GetResponseR\x03get2\xfd\x02\n" +
+	"\x06LeafDB\x126\n" +
+	"\x03Get\x12\x16.leafdb.rpc.GetRequest\x1a\x17.leafdb.rpc.GetResponse\x126\n" +
+	"\x03Put\x12\x16.leafdb.rpc.PutRequest\x1a\x17.leafdb.rpc.PutResponse\x12?\n" +
+	"\x06Delete\x12\x19.leafdb.rpc.DeleteRequest\x1a\x1a.leafdb.rpc.DeleteResponse\x127\n" +
+	"\x04Scan\x12\x17.leafdb.rpc.ScanRequest\x1a\x14.leafdb.rpc.KeyValue0\x01\x12K\n" +
+	"\n" +
+	"BatchApply\x12\x1d.leafdb.rpc.BatchApplyRequest\x1a\x1e.leafdb.rpc.BatchApplyResponse\x12<\n" +
+	"\aBeginTx\x12\x15.leafdb.rpc.TxRequest\x1a\x16.leafdb.rpc.TxResponse(\x010\x01B\fZ\n" +
+	"leafdb/rpcb\x06proto3"
+
+var (
+	file_leafdb_proto_rawDescOnce sync.Once
+	file_leafdb_proto_rawDescData []byte
+)
+
+func file_leafdb_proto_rawDescGZIP() []byte {
+	file_leafdb_proto_rawDescOnce.Do(func() {
+		file_leafdb_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_leafdb_proto_rawDesc), len(file_leafdb_proto_rawDesc)))
+	})
+	return file_leafdb_proto_rawDescData
+}
+
+var file_leafdb_proto_msgTypes = make([]protoimpl.MessageInfo, 16)
+var file_leafdb_proto_goTypes = []any{
+	(*GetRequest)(nil),         // 0: leafdb.rpc.GetRequest
+	(*GetResponse)(nil),        // 1: leafdb.rpc.GetResponse
+	(*PutRequest)(nil),         // 2: leafdb.rpc.PutRequest
+	(*PutResponse)(nil),        // 3: leafdb.rpc.PutResponse
+	(*DeleteRequest)(nil),      // 4: leafdb.rpc.DeleteRequest
+	(*DeleteResponse)(nil),     // 5: leafdb.rpc.DeleteResponse
+	(*ScanRequest)(nil),        // 6: leafdb.rpc.ScanRequest
+	(*KeyValue)(nil),           // 7: leafdb.rpc.KeyValue
+	(*Op)(nil),                 // 8: leafdb.rpc.Op
+	(*BatchApplyRequest)(nil),  // 9: leafdb.rpc.BatchApplyRequest
+	(*BatchApplyResponse)(nil), // 10: leafdb.rpc.BatchApplyResponse
+	(*BeginRequest)(nil),       // 11: leafdb.rpc.BeginRequest
+	(*CommitRequest)(nil),      // 12: leafdb.rpc.CommitRequest
+	(*RollbackRequest)(nil),    // 13: leafdb.rpc.RollbackRequest
+	(*TxRequest)(nil),          // 14: leafdb.rpc.TxRequest
+	(*TxResponse)(nil),         // 15: leafdb.rpc.TxResponse
+}
+var file_leafdb_proto_depIdxs = []int32{
+	2,  // 0: leafdb.rpc.Op.put:type_name -> leafdb.rpc.PutRequest
+	4,  // 1: leafdb.rpc.Op.delete:type_name -> leafdb.rpc.DeleteRequest
+	8,  // 2: leafdb.rpc.BatchApplyRequest.ops:type_name -> leafdb.rpc.Op
+	11, // 3: leafdb.rpc.TxRequest.begin:type_name -> leafdb.rpc.BeginRequest
+	0,  // 4: leafdb.rpc.TxRequest.get:type_name -> leafdb.rpc.GetRequest
+	2,  // 5: leafdb.rpc.TxRequest.put:type_name -> leafdb.rpc.PutRequest
+	4,  // 6: leafdb.rpc.TxRequest.delete:type_name -> leafdb.rpc.DeleteRequest
+	12, // 7: leafdb.rpc.TxRequest.commit:type_name -> leafdb.rpc.CommitRequest
+	13, // 8: leafdb.rpc.TxRequest.rollback:type_name -> leafdb.rpc.RollbackRequest
+	1,  // 9: leafdb.rpc.TxResponse.get:type_name -> leafdb.rpc.GetResponse
+	0,  // 10: leafdb.rpc.LeafDB.Get:input_type -> leafdb.rpc.GetRequest
+	2,  // 11: leafdb.rpc.LeafDB.Put:input_type -> leafdb.rpc.PutRequest
+	4,  // 12: leafdb.rpc.LeafDB.Delete:input_type -> leafdb.rpc.DeleteRequest
+	6,  // 13: leafdb.rpc.LeafDB.Scan:input_type -> leafdb.rpc.ScanRequest
+	9,  // 14: leafdb.rpc.LeafDB.BatchApply:input_type -> leafdb.rpc.BatchApplyRequest
+	14, // 15: leafdb.rpc.LeafDB.BeginTx:input_type -> leafdb.rpc.TxRequest
+	1,  // 16: leafdb.rpc.LeafDB.Get:output_type -> leafdb.rpc.GetResponse
+	3,  // 17: leafdb.rpc.LeafDB.Put:output_type -> leafdb.rpc.PutResponse
+	5,  // 18: leafdb.rpc.LeafDB.Delete:output_type -> leafdb.rpc.DeleteResponse
+	7,  // 19: leafdb.rpc.LeafDB.Scan:output_type -> leafdb.rpc.KeyValue
+	10, // 20: leafdb.rpc.LeafDB.BatchApply:output_type -> leafdb.rpc.BatchApplyResponse
+	15, // 21: leafdb.rpc.LeafDB.BeginTx:output_type -> leafdb.rpc.TxResponse
+	16, // [16:22] is the sub-list for method output_type
+	10, // [10:16] is the sub-list for method input_type
+	10, // [10:10] is the sub-list for extension type_name
+	10, // [10:10] is the sub-list for extension extendee
+	0,  // [0:10] is the sub-list for field type_name
+}
+
+func init() { file_leafdb_proto_init() }
+func file_leafdb_proto_init() {
+	if File_leafdb_proto != nil {
+		return
+	}
+	file_leafdb_proto_msgTypes[8].OneofWrappers = []any{
+		(*Op_Put)(nil),
+		(*Op_Delete)(nil),
+	}
+	file_leafdb_proto_msgTypes[14].OneofWrappers = []any{
+		(*TxRequest_Begin)(nil),
+		(*TxRequest_Get)(nil),
+		(*TxRequest_Put)(nil),
+		(*TxRequest_Delete)(nil),
+		(*TxRequest_Commit)(nil),
+		(*TxRequest_Rollback)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_leafdb_proto_rawDesc), len(file_leafdb_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   16,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_leafdb_proto_goTypes,
+		DependencyIndexes: file_leafdb_proto_depIdxs,
+		MessageInfos:      file_leafdb_proto_msgTypes,
+	}.Build()
+	File_leafdb_proto = out.File
+	file_leafdb_proto_goTypes = nil
+	file_leafdb_proto_depIdxs = nil
+}
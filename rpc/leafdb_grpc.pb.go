@@ -0,0 +1,343 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: leafdb.proto
+
+package rpc
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	LeafDB_Get_FullMethodName        = "/leafdb.rpc.LeafDB/Get"
+	LeafDB_Put_FullMethodName        = "/leafdb.rpc.LeafDB/Put"
+	LeafDB_Delete_FullMethodName     = "/leafdb.rpc.LeafDB/Delete"
+	LeafDB_Scan_FullMethodName       = "/leafdb.rpc.LeafDB/Scan"
+	LeafDB_BatchApply_FullMethodName = "/leafdb.rpc.LeafDB/BatchApply"
+	LeafDB_BeginTx_FullMethodName    = "/leafdb.rpc.LeafDB/BeginTx"
+)
+
+// LeafDBClient is the client API for LeafDB service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// LeafDB serves a leafdb database over gRPC.
+//
+// Keys live in buckets, addressed by a path of bucket names from the top
+// level down. A missing bucket reads as empty; writes create the path as
+// needed.
+type LeafDBClient interface {
+	// Get returns the value of a key.
+	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error)
+	// Put sets a key.
+	Put(ctx context.Context, in *PutRequest, opts ...grpc.CallOption) (*PutResponse, error)
+	// Delete removes a key. Deleting a missing key is not an error.
+	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
+	// Scan streams the pairs of a bucket in key order from a consistent
+	// snapshot.
+	Scan(ctx context.Context, in *ScanRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[KeyValue], error)
+	// BatchApply applies a list of puts and deletes atomically.
+	BatchApply(ctx context.Context, in *BatchApplyRequest, opts ...grpc.CallOption) (*BatchApplyResponse, error)
+	// BeginTx runs an interactive transaction for the lifetime of the stream.
+	// The first request must be begin; every request is answered by one
+	// response, sent once the request has taken effect. The transaction ends
+	// with commit or rollback, and is rolled back if the stream ends or a
+	// request fails first.
+	BeginTx(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[TxRequest, TxResponse], error)
+}
+
+type leafDBClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewLeafDBClient(cc grpc.ClientConnInterface) LeafDBClient {
+	return &leafDBClient{cc}
+}
+
+func (c *leafDBClient) Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetResponse)
+	err := c.cc.Invoke(ctx, LeafDB_Get_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *leafDBClient) Put(ctx context.Context, in *PutRequest, opts ...grpc.CallOption) (*PutResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(PutResponse)
+	err := c.cc.Invoke(ctx, LeafDB_Put_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *leafDBClient) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DeleteResponse)
+	err := c.cc.Invoke(ctx, LeafDB_Delete_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *leafDBClient) Scan(ctx context.Context, in *ScanRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[KeyValue], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &LeafDB_ServiceDesc.Streams[0], LeafDB_Scan_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ScanRequest, KeyValue]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type LeafDB_ScanClient = grpc.ServerStreamingClient[KeyValue]
+
+func (c *leafDBClient) BatchApply(ctx context.Context, in *BatchApplyRequest, opts ...grpc.CallOption) (*BatchApplyResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(BatchApplyResponse)
+	err := c.cc.Invoke(ctx, LeafDB_BatchApply_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *leafDBClient) BeginTx(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[TxRequest, TxResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &LeafDB_ServiceDesc.Streams[1], LeafDB_BeginTx_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[TxRequest, TxResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type LeafDB_BeginTxClient = grpc.BidiStreamingClient[TxRequest, TxResponse]
+
+// LeafDBServer is the server API for LeafDB service.
+// All implementations must embed UnimplementedLeafDBServer
+// for forward compatibility.
+//
+// LeafDB serves a leafdb database over gRPC.
+//
+// Keys live in buckets, addressed by a path of bucket names from the top
+// level down. A missing bucket reads as empty; writes create the path as
+// needed.
+type LeafDBServer interface {
+	// Get returns the value of a key.
+	Get(context.Context, *GetRequest) (*GetResponse, error)
+	// Put sets a key.
+	Put(context.Context, *PutRequest) (*PutResponse, error)
+	// Delete removes a key. Deleting a missing key is not an error.
+	Delete(context.Context, *DeleteRequest) (*DeleteResponse, error)
+	// Scan streams the pairs of a bucket in key order from a consistent
+	// snapshot.
+	Scan(*ScanRequest, grpc.ServerStreamingServer[KeyValue]) error
+	// BatchApply applies a list of puts and deletes atomically.
+	BatchApply(context.Context, *BatchApplyRequest) (*BatchApplyResponse, error)
+	// BeginTx runs an interactive transaction for the lifetime of the stream.
+	// The first request must be begin; every request is answered by one
+	// response, sent once the request has taken effect. The transaction ends
+	// with commit or rollback, and is rolled back if the stream ends or a
+	// request fails first.
+	BeginTx(grpc.BidiStreamingServer[TxRequest, TxResponse]) error
+	mustEmbedUnimplementedLeafDBServer()
+}
+
+// UnimplementedLeafDBServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedLeafDBServer struct{}
+
+func (UnimplementedLeafDBServer) Get(context.Context, *GetRequest) (*GetResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Get not implemented")
+}
+func (UnimplementedLeafDBServer) Put(context.Context, *PutRequest) (*PutResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Put not implemented")
+}
+func (UnimplementedLeafDBServer) Delete(context.Context, *DeleteRequest) (*DeleteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
+}
+func (UnimplementedLeafDBServer) Scan(*ScanRequest, grpc.ServerStreamingServer[KeyValue]) error {
+	return status.Errorf(codes.Unimplemented, "method Scan not implemented")
+}
+func (UnimplementedLeafDBServer) BatchApply(context.Context, *BatchApplyRequest) (*BatchApplyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BatchApply not implemented")
+}
+func (UnimplementedLeafDBServer) BeginTx(grpc.BidiStreamingServer[TxRequest, TxResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method BeginTx not implemented")
+}
+func (UnimplementedLeafDBServer) mustEmbedUnimplementedLeafDBServer() {}
+func (UnimplementedLeafDBServer) testEmbeddedByValue()                {}
+
+// UnsafeLeafDBServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to LeafDBServer will
+// result in compilation errors.
+type UnsafeLeafDBServer interface {
+	mustEmbedUnimplementedLeafDBServer()
+}
+
+func RegisterLeafDBServer(s grpc.ServiceRegistrar, srv LeafDBServer) {
+	// If the following call pancis, it indicates UnimplementedLeafDBServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&LeafDB_ServiceDesc, srv)
+}
+
+func _LeafDB_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LeafDBServer).Get(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LeafDB_Get_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LeafDBServer).Get(ctx, req.(*GetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LeafDB_Put_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PutRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LeafDBServer).Put(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LeafDB_Put_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LeafDBServer).Put(ctx, req.(*PutRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LeafDB_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LeafDBServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LeafDB_Delete_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LeafDBServer).Delete(ctx, req.(*DeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LeafDB_Scan_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ScanRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(LeafDBServer).Scan(m, &grpc.GenericServerStream[ScanRequest, KeyValue]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type LeafDB_ScanServer = grpc.ServerStreamingServer[KeyValue]
+
+func _LeafDB_BatchApply_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchApplyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LeafDBServer).BatchApply(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LeafDB_BatchApply_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LeafDBServer).BatchApply(ctx, req.(*BatchApplyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LeafDB_BeginTx_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(LeafDBServer).BeginTx(&grpc.GenericServerStream[TxRequest, TxResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type LeafDB_BeginTxServer = grpc.BidiStreamingServer[TxRequest, TxResponse]
+
+// LeafDB_ServiceDesc is the grpc.ServiceDesc for LeafDB service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var LeafDB_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "leafdb.rpc.LeafDB",
+	HandlerType: (*LeafDBServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Get",
+			Handler:    _LeafDB_Get_Handler,
+		},
+		{
+			MethodName: "Put",
+			Handler:    _LeafDB_Put_Handler,
+		},
+		{
+			MethodName: "Delete",
+			Handler:    _LeafDB_Delete_Handler,
+		},
+		{
+			MethodName: "BatchApply",
+			Handler:    _LeafDB_BatchApply_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Scan",
+			Handler:       _LeafDB_Scan_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "BeginTx",
+			Handler:       _LeafDB_BeginTx_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "leafdb.proto",
+}
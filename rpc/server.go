@@ -0,0 +1,352 @@
+// Package rpc serves a leafdb database over gRPC, so it can run as a small
+// networked key/value node. The service is defined in leafdb.proto; clients
+// use the generated LeafDBClient.
+package rpc
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative leafdb.proto
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"leafdb"
+)
+
+// DefaultTxTimeout is the TxTimeout of a Server returned by NewServer.
+const DefaultTxTimeout = time.Minute
+
+// Server implements LeafDBServer on top of a DB. Single writes and
+// BatchApply go through DB.Batch, so concurrent clients share commits.
+type Server struct {
+	UnimplementedLeafDBServer
+	// TxTimeout bounds how long an interactive transaction opened with
+	// BeginTx lasts, from its begin request, waiting for the writer lock
+	// included. A writable transaction holds the writer lock, so a client
+	// that stalls would block every other write; once the timeout passes,
+	// the transaction is rolled back and the stream ends with
+	// DeadlineExceeded. Zero disables the limit.
+	TxTimeout time.Duration
+	db        *leafdb.DB
+}
+
+// NewServer returns a Server for db with DefaultTxTimeout. The caller keeps
+// ownership of db and closes it after the gRPC server has stopped.
+func NewServer(db *leafdb.DB) *Server {
+	return &Server{db: db, TxTimeout: DefaultTxTimeout}
+}
+
+// Register registers a Server for db with s, as returned by NewServer.
+func Register(s *grpc.Server, db *leafdb.DB) {
+	RegisterLeafDBServer(s, NewServer(db))
+}
+
+// errRollback ends an interactive transaction without committing it.
+var errRollback = errors.New("rollback")
+
+func (s *Server) Get(ctx context.Context, req *GetRequest) (*GetResponse, error) {
+	if err := validatePath(req.Bucket); err != nil {
+		return nil, err
+	}
+	var resp *GetResponse
+	err := s.db.Read(func(tx *leafdb.Tx) error {
+		resp = get(tx, req)
+		return nil
+	})
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return resp, nil
+}
+
+func (s *Server) Put(ctx context.Context, req *PutRequest) (*PutResponse, error) {
+	if err := validatePath(req.Bucket); err != nil {
+		return nil, err
+	}
+	err := s.db.Batch(func(tx *leafdb.Tx) error {
+		return put(tx, req)
+	})
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &PutResponse{}, nil
+}
+
+func (s *Server) Delete(ctx context.Context, req *DeleteRequest) (*DeleteResponse, error) {
+	if err := validatePath(req.Bucket); err != nil {
+		return nil, err
+	}
+	err := s.db.Batch(func(tx *leafdb.Tx) error {
+		return del(tx, req)
+	})
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &DeleteResponse{}, nil
+}
+
+// Scan holds a read transaction while it streams, so a slow client keeps
+// the pages of its snapshot from being reused until it finishes.
+func (s *Server) Scan(req *ScanRequest, stream grpc.ServerStreamingServer[KeyValue]) error {
+	if err := validatePath(req.Bucket); err != nil {
+		return err
+	}
+	ctx := stream.Context()
+	err := s.db.Read(func(tx *leafdb.Tx) error {
+		b := bucketAt(tx, req.Bucket)
+		if b == nil {
+			return nil
+		}
+		start := req.Start
+		if bytes.Compare(req.Prefix, start) > 0 {
+			start = req.Prefix
+		}
+		c := b.Cursor()
+		n := uint32(0)
+		for k, v := c.Seek(start); k != nil && bytes.HasPrefix(k, req.Prefix); k, v = c.Next() {
+			if req.Limit > 0 && n == req.Limit {
+				return nil
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := stream.Send(&KeyValue{Key: k, Value: v}); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	return statusError(err)
+}
+
+func (s *Server) BatchApply(ctx context.Context, req *BatchApplyRequest) (*BatchApplyResponse, error) {
+	for _, op := range req.Ops {
+		var path [][]byte
+		switch op := op.Op.(type) {
+		case *Op_Put:
+			path = op.Put.GetBucket()
+		case *Op_Delete:
+			path = op.Delete.GetBucket()
+		default:
+			return nil, status.Error(codes.InvalidArgument, "op has neither put nor delete set")
+		}
+		if err := validatePath(path); err != nil {
+			return nil, err
+		}
+	}
+	err := s.db.Batch(func(tx *leafdb.Tx) error {
+		for _, op := range req.Ops {
+			var err error
+			switch op := op.Op.(type) {
+			case *Op_Put:
+				err = put(tx, op.Put)
+			case *Op_Delete:
+				err = del(tx, op.Delete)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &BatchApplyResponse{}, nil
+}
+
+// BeginTx runs the transaction inside DB.ViewCtx or DB.UpdateCtx, so a
+// writable transaction holds the writer lock until the client commits, rolls
+// back or goes away, or TxTimeout passes.
+func (s *Server) BeginTx(stream grpc.BidiStreamingServer[TxRequest, TxResponse]) error {
+	req, err := stream.Recv()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	begin := req.GetBegin()
+	if begin == nil {
+		return status.Error(codes.FailedPrecondition, "first request must be begin")
+	}
+	ctx, cancel := stream.Context(), context.CancelFunc(func() {})
+	if s.TxTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, s.TxTimeout)
+	}
+	defer cancel()
+	run := s.db.ViewCtx
+	if begin.Writable {
+		run = s.db.UpdateCtx
+	}
+	err = run(ctx, func(tx *leafdb.Tx) error {
+		if err := stream.Send(&TxResponse{}); err != nil {
+			return err
+		}
+		return serveTx(ctx, tx, stream)
+	})
+	if err == errRollback {
+		err = nil
+	}
+	if err != nil {
+		return statusError(err)
+	}
+	// The transaction has committed or rolled back; acknowledge the request
+	// that ended it.
+	return stream.Send(&TxResponse{})
+}
+
+// serveTx answers requests on stream until a commit, for which it returns
+// nil, or a rollback, for which it returns errRollback, or until ctx ends.
+func serveTx(ctx context.Context, tx *leafdb.Tx, stream grpc.BidiStreamingServer[TxRequest, TxResponse]) error {
+	// Recv does not watch ctx, so requests are received on a goroutine of
+	// their own, which returns once the handler does and the stream ends.
+	type received struct {
+		req *TxRequest
+		err error
+	}
+	requests := make(chan received)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			select {
+			case requests <- received{req, err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		var r received
+		select {
+		case r = <-requests:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		req, err := r.req, r.err
+		if err == io.EOF {
+			return errRollback
+		}
+		if err != nil {
+			return err
+		}
+		resp := &TxResponse{}
+		switch r := req.Request.(type) {
+		case *TxRequest_Get:
+			if err := validatePath(r.Get.Bucket); err != nil {
+				return err
+			}
+			resp.Get = get(tx, r.Get)
+		case *TxRequest_Put:
+			if err := validatePath(r.Put.Bucket); err != nil {
+				return err
+			}
+			err = put(tx, r.Put)
+		case *TxRequest_Delete:
+			if err := validatePath(r.Delete.Bucket); err != nil {
+				return err
+			}
+			err = del(tx, r.Delete)
+		case *TxRequest_Commit:
+			return nil
+		case *TxRequest_Rollback:
+			return errRollback
+		case *TxRequest_Begin:
+			return status.Error(codes.FailedPrecondition, "transaction already begun")
+		default:
+			return status.Error(codes.InvalidArgument, "empty transaction request")
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+func get(tx *leafdb.Tx, req *GetRequest) *GetResponse {
+	v := bucketAt(tx, req.Bucket).Get(req.Key)
+	if v == nil {
+		return &GetResponse{}
+	}
+	return &GetResponse{Value: bytes.Clone(v), Found: true}
+}
+
+func put(tx *leafdb.Tx, req *PutRequest) error {
+	b, err := tx.CreateBucketIfNotExists(req.Bucket[0])
+	for _, name := range req.Bucket[1:] {
+		if err != nil {
+			return err
+		}
+		b, err = b.CreateBucketIfNotExists(name)
+	}
+	if err != nil {
+		return err
+	}
+	return b.Put(req.Key, req.Value)
+}
+
+func del(tx *leafdb.Tx, req *DeleteRequest) error {
+	b := bucketAt(tx, req.Bucket)
+	if b == nil {
+		return nil
+	}
+	return b.Delete(req.Key)
+}
+
+// bucketAt returns the bucket at path, or nil if any bucket on the way is
+// missing.
+func bucketAt(tx *leafdb.Tx, path [][]byte) *leafdb.Bucket {
+	b := tx.Bucket(path[0])
+	for _, name := range path[1:] {
+		b = b.Bucket(name)
+	}
+	return b
+}
+
+func validatePath(path [][]byte) error {
+	if len(path) == 0 {
+		return status.Error(codes.InvalidArgument, "bucket path required")
+	}
+	for _, name := range path {
+		if len(name) == 0 {
+			return status.Error(codes.InvalidArgument, "empty bucket name in path")
+		}
+	}
+	return nil
+}
+
+// statusError maps leafdb errors to gRPC status codes. Errors that already
+// carry a status, such as those from the stream, pass through unchanged.
+func statusError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	case errors.Is(err, leafdb.ErrKeyTooLarge):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, leafdb.ErrTxReadOnly):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, leafdb.ErrBucketExists):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, leafdb.ErrDatabaseClosed):
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
@@ -0,0 +1,137 @@
+package rpc_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"leafdb"
+	"leafdb/rpc"
+)
+
+// serve starts a gRPC server for srv on an in-memory listener and returns a
+// client connected to it.
+func serve(t *testing.T, srv *rpc.Server) rpc.LeafDBClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	s := grpc.NewServer()
+	rpc.RegisterLeafDBServer(s, srv)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return rpc.NewLeafDBClient(conn)
+}
+
+func openMem(t *testing.T) *leafdb.DB {
+	t.Helper()
+	db, err := leafdb.OpenMem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestGetPut(t *testing.T) {
+	client := serve(t, rpc.NewServer(openMem(t)))
+	ctx := context.Background()
+	path := [][]byte{[]byte("a"), []byte("b")}
+	if _, err := client.Put(ctx, &rpc.PutRequest{Bucket: path, Key: []byte("k"), Value: []byte("v")}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(ctx, &rpc.GetRequest{Bucket: path, Key: []byte("k")})
+	if err != nil || !resp.Found || string(resp.Value) != "v" {
+		t.Fatalf("get: %v, %v, want v", resp, err)
+	}
+	resp, err = client.Get(ctx, &rpc.GetRequest{Bucket: path, Key: []byte("missing")})
+	if err != nil || resp.Found {
+		t.Fatalf("get of a missing key: %v, %v, want not found", resp, err)
+	}
+	_, err = client.Get(ctx, &rpc.GetRequest{Key: []byte("k")})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("get without a bucket: %v, want InvalidArgument", err)
+	}
+}
+
+func TestTx(t *testing.T) {
+	client := serve(t, rpc.NewServer(openMem(t)))
+	ctx := context.Background()
+	path := [][]byte{[]byte("a")}
+	stream, err := client.BeginTx(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := []*rpc.TxRequest{
+		{Request: &rpc.TxRequest_Begin{Begin: &rpc.BeginRequest{Writable: true}}},
+		{Request: &rpc.TxRequest_Put{Put: &rpc.PutRequest{Bucket: path, Key: []byte("k"), Value: []byte("v")}}},
+		{Request: &rpc.TxRequest_Get{Get: &rpc.GetRequest{Bucket: path, Key: []byte("k")}}},
+		{Request: &rpc.TxRequest_Commit{Commit: &rpc.CommitRequest{}}},
+	}
+	for i, req := range requests {
+		if err := stream.Send(req); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		if req.GetGet() != nil && string(resp.GetGet().GetValue()) != "v" {
+			t.Fatalf("get in the transaction: %v, want v", resp.GetGet())
+		}
+	}
+	resp, err := client.Get(ctx, &rpc.GetRequest{Bucket: path, Key: []byte("k")})
+	if err != nil || string(resp.Value) != "v" {
+		t.Fatalf("get after commit: %v, %v, want v", resp, err)
+	}
+}
+
+func TestTxTimeout(t *testing.T) {
+	srv := rpc.NewServer(openMem(t))
+	srv.TxTimeout = 50 * time.Millisecond
+	client := serve(t, srv)
+	ctx := context.Background()
+	path := [][]byte{[]byte("a")}
+	stream, err := client.BeginTx(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(&rpc.TxRequest{Request: &rpc.TxRequest_Begin{Begin: &rpc.BeginRequest{Writable: true}}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(&rpc.TxRequest{Request: &rpc.TxRequest_Put{Put: &rpc.PutRequest{Bucket: path, Key: []byte("k"), Value: []byte("v")}}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	// The client stalls past the timeout, so the transaction rolls back
+	// and releases the writer lock.
+	if _, err := stream.Recv(); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("stalled transaction: %v, want DeadlineExceeded", err)
+	}
+	if _, err := client.Put(ctx, &rpc.PutRequest{Bucket: path, Key: []byte("other"), Value: []byte("v")}); err != nil {
+		t.Fatalf("put after the timeout: %v", err)
+	}
+	resp, err := client.Get(ctx, &rpc.GetRequest{Bucket: path, Key: []byte("k")})
+	if err != nil || resp.Found {
+		t.Fatalf("get of the rolled back put: %v, %v, want not found", resp, err)
+	}
+}
@@ -0,0 +1,377 @@
+package leafdb
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"io"
+	"maps"
+	"slices"
+)
+
+// maxSalvageDepth bounds the bucket nesting Salvage follows, so that a loop
+// of stale pages pointing at each other cannot recurse forever.
+const maxSalvageDepth = 64
+
+// Salvaged is one find of Salvage: a bucket, or a key/value pair.
+type Salvaged struct {
+	// Bucket reports whether this is a bucket rather than a pair.
+	Bucket bool
+	// Path is the path of the bucket, or of the bucket holding the pair. It
+	// is nil for pairs on leaf pages that could not be tied to a bucket.
+	Path  [][]byte
+	Key   []byte
+	Value []byte
+	// Sequence is the sequence of a bucket.
+	Sequence uint64
+	// Page is the bucket header or leaf page the find was read from.
+	Page uint64
+}
+
+// SalvageStats counts the pages read by Salvage.
+type SalvageStats struct {
+	// Pages is the number of pages scanned, not counting the meta pages.
+	Pages int
+	// Unreadable counts the pages that failed to decode or authenticate, or
+	// whose checksum did not match.
+	Unreadable int
+	// Leaves counts the leaf pages pairs were read from; Orphans counts
+	// those of them that could not be tied to a bucket.
+	Leaves  int
+	Orphans int
+}
+
+// Salvage reads what it can from a damaged database file of size bytes in
+// r, without relying on its meta pages or on the tree above each leaf. It
+// scans every page, ties each readable leaf to its bucket through whatever
+// branch, bucket header and bucket index pages still point to it, and calls
+// fn for every bucket found, parents first, and then for every pair, in
+// page order.
+//
+// Freed pages keep their contents until they are reused, so old versions of
+// pairs and of deleted buckets are found too, with no way to tell them from
+// current ones. The internal buckets of indexes and of the changefeed are
+// skipped. Encrypted files need opts.EncryptionKey and a meta page whose
+// salt is intact. Salvage stops at the first error returned by fn.
+func Salvage(r io.ReaderAt, size int64, opts *Options, fn func(Salvaged) error) (SalvageStats, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	diskPageSize, err := diskPageSizeFor(opts)
+	if err != nil {
+		return SalvageStats{}, err
+	}
+	store := &salvageStore{
+		r:            r,
+		pages:        uint64(max(size, 0)) / uint64(diskPageSize),
+		diskPageSize: diskPageSize,
+	}
+	if err := store.initCipher(opts.EncryptionKey); err != nil {
+		return SalvageStats{}, err
+	}
+	s := &salvager{
+		store:      store,
+		parents:    make(map[uint64][]uint64),
+		kvOwner:    make(map[uint64]uint64),
+		indexOwner: make(map[uint64]uint64),
+		sequences:  make(map[uint64]uint64),
+		links:      make(map[uint64][]salvageLink),
+		paths:      make(map[uint64][][]byte),
+	}
+	s.scan()
+	if err := s.emitBuckets(fn); err != nil {
+		return s.stats, err
+	}
+	return s.stats, s.emitPairs(fn)
+}
+
+// salvageStore reads pages straight from a file for Salvage, decrypting
+// them if needed. It cannot write.
+type salvageStore struct {
+	r            io.ReaderAt
+	pages        uint64
+	diskPageSize int
+	cipher       *pageCipher
+}
+
+// initCipher sets up decryption with key, taking the salt from whichever
+// meta page still carries one. Without a key it fails with ErrEncrypted if
+// a meta page marks the file as encrypted.
+func (s *salvageStore) initCipher(key []byte) error {
+	for id := uint64(metaPage0); id <= metaPage1; id++ {
+		page, err := s.stored(id)
+		if err != nil {
+			continue
+		}
+		flags, salt := metaFormat(page)
+		if flags&metaFlagEncrypted == 0 {
+			continue
+		}
+		if key == nil {
+			return ErrEncrypted
+		}
+		s.cipher, err = newPageCipher(key, salt)
+		return err
+	}
+	if key != nil {
+		return errors.New("leafdb: no meta page holds the encryption salt")
+	}
+	return nil
+}
+
+// stored returns page id as stored in the file.
+func (s *salvageStore) stored(id uint64) ([]byte, error) {
+	if id >= s.pages {
+		return nil, errPageBeyondEnd
+	}
+	buf := make([]byte, s.diskPageSize)
+	if _, err := s.r.ReadAt(buf, int64(id)*int64(s.diskPageSize)); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (s *salvageStore) PageSize() int {
+	return defaultPageSize
+}
+
+func (s *salvageStore) ReadPage(id uint64) ([]byte, error) {
+	if id <= metaPage1 {
+		return nil, errors.New("leafdb: reference to a meta page")
+	}
+	buf, err := s.stored(id)
+	if err != nil || s.cipher == nil {
+		return buf, err
+	}
+	return s.cipher.open(id, buf)
+}
+
+func (s *salvageStore) WritePage(id uint64, buf []byte) error {
+	return ErrDatabaseReadOnly
+}
+
+func (s *salvageStore) AllocPage() uint64 {
+	return 0
+}
+
+func (s *salvageStore) FreePage(id uint64) {}
+
+func (s *salvageStore) VerifyChecksums() bool {
+	return true
+}
+
+// salvager holds what Salvage learns about the pages of a file.
+type salvager struct {
+	store *salvageStore
+	stats SalvageStats
+
+	// parents maps pages to the branch pages that point to them.
+	parents map[uint64][]uint64
+	// kvOwner and indexOwner map the roots of key/value trees and of the
+	// trees of nested buckets to the bucket header pages that point to them.
+	kvOwner    map[uint64]uint64
+	indexOwner map[uint64]uint64
+	// sequences holds the sequence of every bucket header page.
+	sequences map[uint64]uint64
+	// links maps page IDs to the leaf entries whose value is that ID, for
+	// leaves whose values all have the size of one, as bucket index leaves
+	// do.
+	links  map[uint64][]salvageLink
+	leaves []uint64
+	// paths caches the resolved paths of bucket header pages; a nil entry
+	// marks a header without one.
+	paths map[uint64][][]byte
+}
+
+type salvageLink struct {
+	leaf uint64
+	name []byte
+}
+
+// scan reads every page and records how they point to each other.
+func (s *salvager) scan() {
+	for id := uint64(metaPage1 + 1); id < s.store.pages; id++ {
+		s.stats.Pages++
+		stored, err := s.store.stored(id)
+		if err != nil {
+			s.stats.Unreadable++
+			continue
+		}
+		if !slices.ContainsFunc(stored, func(b byte) bool { return b != 0 }) {
+			// Never written.
+			continue
+		}
+		page, err := s.store.ReadPage(id)
+		if err != nil {
+			s.stats.Unreadable++
+			continue
+		}
+		switch page[0] {
+		case pageBucket:
+			h, err := readBucketHeader(s.store, id)
+			if err != nil {
+				s.stats.Unreadable++
+				continue
+			}
+			s.sequences[id] = h.sequence
+			if _, ok := s.kvOwner[h.kvRoot]; !ok {
+				s.kvOwner[h.kvRoot] = id
+			}
+			if _, ok := s.indexOwner[h.bucketRoot]; !ok {
+				s.indexOwner[h.bucketRoot] = id
+			}
+		case pageLeaf, pageBranch:
+			n, err := decodeNode(s.store, id)
+			if err != nil {
+				s.stats.Unreadable++
+				continue
+			}
+			if !n.isLeaf {
+				for _, child := range n.children {
+					s.parents[child] = append(s.parents[child], id)
+				}
+				continue
+			}
+			s.leaves = append(s.leaves, id)
+			if !slices.ContainsFunc(n.values, func(v []byte) bool { return len(v) != 8 }) {
+				for i, v := range n.values {
+					target := decodePageID(v)
+					s.links[target] = append(s.links[target], salvageLink{leaf: id, name: n.keys[i]})
+				}
+			}
+		}
+	}
+}
+
+// root returns the root of the tree holding page id and whether a bucket
+// header owns it. Of several parents, it follows the first chain that ends
+// at an owned root.
+func (s *salvager) root(id uint64, seen map[uint64]bool) (uint64, bool) {
+	if s.owned(id) {
+		return id, true
+	}
+	seen[id] = true
+	root, found := id, false
+	for _, parent := range s.parents[id] {
+		if seen[parent] {
+			continue
+		}
+		r, owned := s.root(parent, seen)
+		if owned {
+			return r, true
+		}
+		if !found {
+			root, found = r, true
+		}
+	}
+	return root, false
+}
+
+func (s *salvager) owned(id uint64) bool {
+	_, kv := s.kvOwner[id]
+	_, index := s.indexOwner[id]
+	return kv || index
+}
+
+// bucketPath returns the path of the bucket whose header is page header, or
+// nil if no chain of pages leads to it from the top level.
+func (s *salvager) bucketPath(header uint64, depth int) [][]byte {
+	if path, ok := s.paths[header]; ok {
+		return path
+	}
+	if depth > maxSalvageDepth {
+		return nil
+	}
+	var path [][]byte
+	for _, link := range s.links[header] {
+		root, owned := s.root(link.leaf, make(map[uint64]bool))
+		if !owned {
+			path = [][]byte{link.name}
+			break
+		}
+		if parent, ok := s.indexOwner[root]; ok {
+			if parentPath := s.bucketPath(parent, depth+1); parentPath != nil {
+				path = append(slices.Clip(parentPath), link.name)
+				break
+			}
+		}
+		// Otherwise the link is a pair whose value happens to be the ID.
+	}
+	s.paths[header] = path
+	return path
+}
+
+// emitBuckets calls fn for every bucket with a known path, once per path
+// with the highest sequence found, parents first.
+func (s *salvager) emitBuckets(fn func(Salvaged) error) error {
+	found := make(map[string]Salvaged)
+	for header, sequence := range s.sequences {
+		path := s.bucketPath(header, 0)
+		if path == nil || slices.ContainsFunc(path, isReservedName) {
+			continue
+		}
+		key := encodeBucketPath(path)
+		if prev, ok := found[key]; ok && prev.Sequence >= sequence {
+			continue
+		}
+		found[key] = Salvaged{Bucket: true, Path: path, Sequence: sequence, Page: header}
+	}
+	buckets := slices.Collect(maps.Values(found))
+	slices.SortFunc(buckets, func(a, b Salvaged) int {
+		return cmp.Or(
+			cmp.Compare(len(a.Path), len(b.Path)),
+			slices.CompareFunc(a.Path, b.Path, bytes.Compare),
+		)
+	})
+	for _, b := range buckets {
+		if err := fn(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// emitPairs calls fn for the pairs of every key/value leaf, skipping the
+// leaves of bucket indexes.
+func (s *salvager) emitPairs(fn func(Salvaged) error) error {
+	for _, id := range s.leaves {
+		n, err := decodeNode(s.store, id)
+		if err != nil || len(n.keys) == 0 {
+			continue
+		}
+		root, owned := s.root(id, make(map[uint64]bool))
+		var path [][]byte
+		switch header, kv := s.kvOwner[root]; {
+		case kv:
+			path = s.bucketPath(header, 0)
+			if slices.ContainsFunc(path, isReservedName) {
+				continue
+			}
+		case owned, s.isTopLevelIndex(n):
+			continue
+		}
+		s.stats.Leaves++
+		if path == nil {
+			s.stats.Orphans++
+		}
+		for i, key := range n.keys {
+			if err := fn(Salvaged{Path: path, Key: key, Value: n.values[i], Page: id}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isTopLevelIndex reports whether n, a leaf of a tree no bucket header owns,
+// belongs to the index of top-level buckets: whether every value points to
+// a bucket header.
+func (s *salvager) isTopLevelIndex(n *node) bool {
+	return len(n.values) > 0 && !slices.ContainsFunc(n.values, func(v []byte) bool {
+		if len(v) != 8 {
+			return true
+		}
+		_, ok := s.sequences[decodePageID(v)]
+		return !ok
+	})
+}
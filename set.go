@@ -0,0 +1,69 @@
+package leafdb
+
+import "iter"
+
+// SetBucket is a view of a bucket as a set of members: each member is a key
+// with an empty value, which leaf pages store without a value length, so a
+// member costs little more than its bytes. Members are kept in key order.
+// The bucket can still be used directly; Has reports any key as a member,
+// whatever its value.
+type SetBucket struct {
+	b *Bucket
+}
+
+// AsSet returns a view of b as a set, or nil if b is nil.
+func (b *Bucket) AsSet() *SetBucket {
+	if b == nil {
+		return nil
+	}
+	return &SetBucket{b: b}
+}
+
+// Bucket returns the bucket under s.
+func (s *SetBucket) Bucket() *Bucket {
+	return s.b
+}
+
+// Add adds member to s and reports whether it was not in s already. Adding
+// a member that is in s writes nothing.
+func (s *SetBucket) Add(member []byte) (bool, error) {
+	if s.Has(member) {
+		return false, nil
+	}
+	if err := s.b.Put(member, nil); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Has reports whether member is in s. Like Get, it reports false if the
+// transaction is closed or the page cannot be read.
+func (s *SetBucket) Has(member []byte) bool {
+	b := s.b
+	if b == nil || b.tx == nil || b.tx.closed {
+		return false
+	}
+	b.trackRead(member)
+	if !b.mayContain(member) {
+		return false
+	}
+	_, ok, err := b.readTree().valueSize(member)
+	return err == nil && ok
+}
+
+// Remove removes member from s and reports whether it was in s.
+func (s *SetBucket) Remove(member []byte) (bool, error) {
+	if !s.Has(member) {
+		return false, nil
+	}
+	if err := s.b.Delete(member); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Members returns an iterator over the members of s in order, for use with
+// range-over-func. It scans the keys alone, like Cursor.Keys.
+func (s *SetBucket) Members() iter.Seq[[]byte] {
+	return s.b.Cursor().Keys(nil, nil)
+}
@@ -0,0 +1,305 @@
+package leafdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"slices"
+)
+
+// Shrink returns the free space at the end of the file to the file system.
+// It runs Tx.Shrink in a write transaction, which moves the pages in use at
+// the end of the file into free pages before them, and then commits a
+// second, empty write transaction, which truncates the file once the moved
+// pages can be reused. Read transactions that are still open at that point
+// hold on to the old copies, so the file only shrinks past them on a later
+// call.
+func (db *DB) Shrink() error {
+	if err := db.Write(func(tx *Tx) error {
+		return tx.Shrink()
+	}); err != nil {
+		return err
+	}
+	return db.Write(func(tx *Tx) error {
+		tx.mgr.shrink = true
+		return nil
+	})
+}
+
+// Shrink moves the pages in use at the end of the file into free pages
+// before them, so that the end of the file becomes free, and makes the
+// commit of tx truncate the file after the last page in use. Pages freed by
+// earlier transactions that readers may still see cannot be reused, so it
+// moves as many pages as fit in the reusable free pages; the pages it moves
+// can only be cut off by a later commit, see DB.Shrink.
+//
+// Buckets opened in tx before Shrink point to the old pages and must be
+// opened again.
+func (tx *Tx) Shrink() error {
+	if tx == nil || tx.closed {
+		return ErrTxClosed
+	}
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	if tx.mgr.staged != nil {
+		return ErrTxPrepared
+	}
+	tx.notReplayable()
+	m := tx.mgr
+	s := &shrinker{
+		mgr:    m,
+		parent: make(map[uint64]uint64),
+		weight: make(map[uint64]int),
+		marked: make(map[uint64]bool),
+	}
+	if err := s.walkTree(m.root, 0, true); err != nil {
+		return err
+	}
+	s.mark()
+	// AllocPage takes the last free page, so the lowest ones are used first.
+	slices.Sort(m.freelist)
+	slices.Reverse(m.freelist)
+	root, err := s.moveTree(m.root, true, 0)
+	if err != nil {
+		return err
+	}
+	m.root = root
+	m.shrink = true
+	tx.changeLog = nil
+	return nil
+}
+
+// shrinker moves the pages of a write transaction for Tx.Shrink.
+type shrinker struct {
+	mgr *txPageManager
+	// parent maps every page in use to the page that points to it: the
+	// branch, bucket header or bucket index leaf above it, or the leaf
+	// holding the value of an overflow page. Tree roots under the meta page
+	// have none.
+	parent map[uint64]uint64
+	// weight is the number of pages that rewriting a page allocates: one,
+	// plus the overflow pages of a leaf, which are copied with it.
+	weight map[uint64]int
+	// marked holds the pages to rewrite: those past the cutoff and the pages
+	// above them.
+	marked map[uint64]bool
+}
+
+// walkTree records the pages of the tree at id and, for bucket index trees,
+// of the buckets its leaves point to.
+func (s *shrinker) walkTree(id, parent uint64, buckets bool) error {
+	if id == 0 {
+		return nil
+	}
+	if _, ok := s.parent[id]; ok {
+		return errors.New("leafdb: page referenced twice")
+	}
+	s.parent[id] = parent
+	s.weight[id] = 1
+	n, err := readNode(s.mgr, id)
+	if err != nil {
+		return err
+	}
+	if !n.isLeaf {
+		for _, child := range n.children {
+			if err := s.walkTree(child, id, buckets); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, first := range n.overflow {
+		for page := first; page != 0; {
+			buf, err := s.mgr.ReadPage(page)
+			if err != nil {
+				return err
+			}
+			s.parent[page] = id
+			s.weight[id]++
+			page = binary.LittleEndian.Uint64(buf[1:])
+		}
+	}
+	if !buckets {
+		return nil
+	}
+	for _, v := range n.values {
+		if err := s.walkBucket(decodePageID(v), id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *shrinker) walkBucket(header, parent uint64) error {
+	s.parent[header] = parent
+	s.weight[header] = 1
+	h, err := readBucketHeader(s.mgr, header)
+	if err != nil {
+		return err
+	}
+	if err := s.walkTree(h.kvRoot, header, false); err != nil {
+		return err
+	}
+	if err := s.walkFilter(h.filter, header); err != nil {
+		return err
+	}
+	return s.walkTree(h.bucketRoot, header, true)
+}
+
+// walkFilter records the pages of the Bloom filter with directory id: the
+// bucket header points to the directory, which points to the blocks.
+func (s *shrinker) walkFilter(id, header uint64) error {
+	if id == 0 {
+		return nil
+	}
+	dir, err := readFilterPage(s.mgr, id, pageFilter)
+	if err != nil {
+		return err
+	}
+	s.parent[id] = header
+	s.weight[id] = 1
+	for _, block := range filterBlocks(dir) {
+		s.parent[block] = id
+		s.weight[block] = 1
+	}
+	return nil
+}
+
+// mark lowers the cutoff from the end of the file one page at a time for as
+// long as the pages to rewrite fit in the free pages before it, marking
+// them. Both only grow as the cutoff is lowered, so the first page that
+// does not fit ends the search.
+func (s *shrinker) mark() {
+	m := s.mgr
+	free := make(map[uint64]bool, len(m.freelist))
+	for _, id := range m.freelist {
+		free[id] = true
+	}
+	available := len(m.freelist)
+	cost := 0
+	for id := m.nextPage - 1; id > metaPage1; id-- {
+		if free[id] {
+			available--
+			if cost > available {
+				return
+			}
+			continue
+		}
+		if _, ok := s.parent[id]; !ok {
+			// Pending pages are moved by no one; they are cut off once
+			// they become free.
+			continue
+		}
+		var added []uint64
+		for page := id; !s.marked[page]; page = s.parent[page] {
+			s.marked[page] = true
+			added = append(added, page)
+			cost += s.weight[page]
+			if s.parent[page] == 0 {
+				break
+			}
+		}
+		if cost > available {
+			for _, page := range added {
+				delete(s.marked, page)
+			}
+			return
+		}
+	}
+}
+
+// moveTree rewrites the marked pages of the tree at id, of blob threshold
+// blob, into new pages and returns the new ID of its root.
+func (s *shrinker) moveTree(id uint64, buckets bool, blob int) (uint64, error) {
+	if !s.marked[id] {
+		return id, nil
+	}
+	n, err := readNode(s.mgr, id)
+	if err != nil {
+		return 0, err
+	}
+	moved := cloneNode(n)
+	if !n.isLeaf {
+		for i, child := range n.children {
+			if moved.children[i], err = s.moveTree(child, buckets, blob); err != nil {
+				return 0, err
+			}
+		}
+	} else if buckets {
+		for i, v := range n.values {
+			header, err := s.moveBucket(decodePageID(v))
+			if err != nil {
+				return 0, err
+			}
+			moved.values[i] = encodePageID(header)
+		}
+	}
+	t := newBPTree(nil, s.mgr)
+	t.blobThreshold = blob
+	moved.pageID = s.mgr.AllocPage()
+	if err := t.writeNode(moved); err != nil {
+		return 0, err
+	}
+	t.freeNode(n)
+	return moved.pageID, nil
+}
+
+// moveFilter rewrites the marked pages of the Bloom filter with directory
+// id into new pages and returns the new ID of its directory.
+func (s *shrinker) moveFilter(id uint64) (uint64, error) {
+	if !s.marked[id] {
+		return id, nil
+	}
+	dir, err := readFilterPage(s.mgr, id, pageFilter)
+	if err != nil {
+		return 0, err
+	}
+	dir = bytes.Clone(dir)
+	for i, block := range filterBlocks(dir) {
+		if !s.marked[block] {
+			continue
+		}
+		buf, err := s.mgr.ReadPage(block)
+		if err != nil {
+			return 0, err
+		}
+		moved := s.mgr.AllocPage()
+		if err := s.mgr.WritePage(moved, buf); err != nil {
+			return 0, err
+		}
+		s.mgr.FreePage(block)
+		binary.LittleEndian.PutUint64(dir[filterHeaderSize+8*i:], moved)
+	}
+	moved := s.mgr.AllocPage()
+	if err := s.mgr.WritePage(moved, dir); err != nil {
+		return 0, err
+	}
+	s.mgr.FreePage(id)
+	return moved, nil
+}
+
+func (s *shrinker) moveBucket(header uint64) (uint64, error) {
+	if !s.marked[header] {
+		return header, nil
+	}
+	h, err := readBucketHeader(s.mgr, header)
+	if err != nil {
+		return 0, err
+	}
+	if h.kvRoot, err = s.moveTree(h.kvRoot, false, h.options.BlobThreshold); err != nil {
+		return 0, err
+	}
+	if h.bucketRoot, err = s.moveTree(h.bucketRoot, true, 0); err != nil {
+		return 0, err
+	}
+	if h.filter, err = s.moveFilter(h.filter); err != nil {
+		return 0, err
+	}
+	id := s.mgr.AllocPage()
+	if err := writeBucketHeader(s.mgr, id, h); err != nil {
+		return 0, err
+	}
+	s.mgr.FreePage(header)
+	return id, nil
+}
@@ -0,0 +1,251 @@
+package leafdb
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// signedMagic starts every signed stream; its last byte is the version of
+// the format. It is as long as exportMagic, so Import can tell a signed
+// export from a plain one.
+const signedMagic = "LDBS\x01"
+
+// signedChunkSize is the most data a chunk of a signed stream holds.
+const signedChunkSize = 64 << 10
+
+// A signed stream is signedMagic followed by chunks, each its length as a
+// uvarint, its data and the SHA-256 of its data, and ends with a zero length
+// and the HMAC-SHA256 of everything before it. The chunk hashes locate
+// damage as soon as it is read; the HMAC proves that the stream is whole and
+// was written by a holder of the key.
+
+var errSigningKeyTooShort = errors.New("leafdb: signing key too short")
+
+// SignedWriter wraps the stream of a backup, written by Tx.WriteTo or
+// Export, so that it can be verified when read back with NewVerifiedReader.
+// Close must be called after the last write to append the signature.
+type SignedWriter struct {
+	w     *bufio.Writer
+	mac   hash.Hash
+	chunk []byte
+	err   error
+}
+
+// NewSignedWriter returns a SignedWriter that writes to w and signs with
+// key, a random secret of at least 16 bytes shared with whoever verifies
+// the stream.
+func NewSignedWriter(w io.Writer, key []byte) (*SignedWriter, error) {
+	if len(key) < minKeySize {
+		return nil, errSigningKeyTooShort
+	}
+	s := &SignedWriter{
+		w:     bufio.NewWriter(w),
+		mac:   hmac.New(sha256.New, key),
+		chunk: make([]byte, 0, signedChunkSize),
+	}
+	s.write([]byte(signedMagic))
+	return s, nil
+}
+
+// Write buffers p and writes every chunk it fills.
+func (s *SignedWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 && s.err == nil {
+		m := copy(s.chunk[len(s.chunk):cap(s.chunk)], p)
+		s.chunk = s.chunk[:len(s.chunk)+m]
+		p = p[m:]
+		n += m
+		if len(s.chunk) == cap(s.chunk) {
+			s.flushChunk()
+		}
+	}
+	if s.err != nil {
+		return n, s.err
+	}
+	return n, nil
+}
+
+// Close writes the last chunk and the signature and flushes them. It does
+// not close the underlying writer.
+func (s *SignedWriter) Close() error {
+	if len(s.chunk) > 0 {
+		s.flushChunk()
+	}
+	s.write([]byte{0})
+	if s.err == nil {
+		_, s.err = s.w.Write(s.mac.Sum(nil))
+	}
+	if s.err == nil {
+		s.err = s.w.Flush()
+	}
+	return s.err
+}
+
+func (s *SignedWriter) flushChunk() {
+	sum := sha256.Sum256(s.chunk)
+	s.write(binary.AppendUvarint(nil, uint64(len(s.chunk))))
+	s.write(s.chunk)
+	s.write(sum[:])
+	s.chunk = s.chunk[:0]
+}
+
+// write writes p to the stream and the signature.
+func (s *SignedWriter) write(p []byte) {
+	if s.err != nil {
+		return
+	}
+	s.mac.Write(p)
+	_, s.err = s.w.Write(p)
+}
+
+// verifiedReader reads the data of a signed stream back.
+type verifiedReader struct {
+	r     *bufio.Reader
+	mac   hash.Hash
+	chunk []byte
+	// n counts the chunks read, for error messages.
+	n   int
+	err error
+}
+
+// NewVerifiedReader returns a reader over the data of a stream written by a
+// SignedWriter with key. A chunk is returned only once its hash matches,
+// and the reader returns io.EOF only once the signature matches too; any
+// damage, truncation or tampering makes it fail with an error wrapping
+// ErrBadSignature instead. Data read before that error is not to be
+// trusted, so apply it in a transaction that can be rolled back, as
+// DB.ImportSigned does.
+func NewVerifiedReader(r io.Reader, key []byte) (io.Reader, error) {
+	if len(key) < minKeySize {
+		return nil, errSigningKeyTooShort
+	}
+	v := &verifiedReader{r: bufio.NewReader(r), mac: hmac.New(sha256.New, key)}
+	magic := v.read(len(signedMagic))
+	if v.err != nil {
+		return nil, v.err
+	}
+	if string(magic) != signedMagic {
+		return nil, fmt.Errorf("%w: not a signed stream", ErrBadSignature)
+	}
+	return v, nil
+}
+
+func (v *verifiedReader) Read(p []byte) (int, error) {
+	for len(v.chunk) == 0 && v.err == nil {
+		v.next()
+	}
+	if len(v.chunk) == 0 {
+		return 0, v.err
+	}
+	n := copy(p, v.chunk)
+	v.chunk = v.chunk[n:]
+	return n, nil
+}
+
+// next reads the next chunk, or the signature, leaving io.EOF in v.err once
+// it matches.
+func (v *verifiedReader) next() {
+	length, err := binary.ReadUvarint(byteCounter{v})
+	if err != nil {
+		v.fail(err)
+		return
+	}
+	if length == 0 {
+		want := v.mac.Sum(nil)
+		got := v.read(len(want))
+		if v.err == nil && !hmac.Equal(got, want) {
+			v.err = fmt.Errorf("%w: signature mismatch", ErrBadSignature)
+		}
+		if v.err == nil {
+			v.err = io.EOF
+		}
+		return
+	}
+	if length > signedChunkSize {
+		v.err = fmt.Errorf("%w: chunk %d too large", ErrBadSignature, v.n)
+		return
+	}
+	data := v.read(int(length))
+	sum := v.read(sha256.Size)
+	if v.err != nil {
+		return
+	}
+	if want := sha256.Sum256(data); !hmac.Equal(sum, want[:]) {
+		v.err = fmt.Errorf("%w: chunk %d hash mismatch", ErrBadSignature, v.n)
+		return
+	}
+	v.n++
+	v.chunk = data
+}
+
+// read reads n bytes of the stream into the signature.
+func (v *verifiedReader) read(n int) []byte {
+	if v.err != nil {
+		return nil
+	}
+	p := make([]byte, n)
+	if _, err := io.ReadFull(v.r, p); err != nil {
+		v.fail(err)
+		return nil
+	}
+	v.mac.Write(p)
+	return p
+}
+
+// fail records err, reporting a stream that ends early as truncated.
+func (v *verifiedReader) fail(err error) {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		err = fmt.Errorf("%w: truncated", ErrBadSignature)
+	}
+	v.err = err
+}
+
+// byteCounter reads single bytes of a verifiedReader's stream into its
+// signature, for binary.ReadUvarint.
+type byteCounter struct{ v *verifiedReader }
+
+func (b byteCounter) ReadByte() (byte, error) {
+	c, err := b.v.r.ReadByte()
+	if err == nil {
+		b.v.mac.Write([]byte{c})
+	}
+	return c, err
+}
+
+// ExportSigned writes the stream of Export to w, signed with key by a
+// SignedWriter.
+func (db *DB) ExportSigned(w io.Writer, key []byte) error {
+	s, err := NewSignedWriter(w, key)
+	if err != nil {
+		return err
+	}
+	if err := db.Export(s); err != nil {
+		return err
+	}
+	return s.Close()
+}
+
+// ImportSigned reads a stream written by ExportSigned with key into the
+// database in a single write transaction, which commits only if the whole
+// stream, signature included, verifies. Otherwise nothing is written and
+// the error wraps ErrBadSignature.
+func (db *DB) ImportSigned(r io.Reader, key []byte) error {
+	v, err := NewVerifiedReader(r, key)
+	if err != nil {
+		return err
+	}
+	return db.Write(func(tx *Tx) error {
+		if err := tx.Import(v); err != nil {
+			return err
+		}
+		// Import stops at the end record; the signature follows it.
+		_, err := io.Copy(io.Discard, v)
+		return err
+	})
+}
@@ -0,0 +1,197 @@
+package leafdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"iter"
+	"math"
+)
+
+// sortedSetScores is the nested bucket of a sorted set that orders its
+// members by score.
+const sortedSetScores = reservedPrefix + "zset:scores"
+
+var errNaNScore = errors.New("leafdb: score is NaN")
+
+// SortedSet is a view of a bucket as a set of members ordered by score,
+// like a Redis sorted set. The bucket maps each member to its score, and a
+// nested bucket holds the member again under its score, as a set of score
+// and member keys, so that members can be ranged in score order; members
+// of equal score are ordered by their bytes. Add and Remove keep both in
+// step in the same transaction, so the bucket must only be written through
+// its SortedSet.
+//
+// Members are at most MaxKeySize-8 bytes. Scores are float64 values other
+// than NaN; -0 is stored as 0.
+type SortedSet struct {
+	b *Bucket
+}
+
+// AsSortedSet returns a view of b as a sorted set, or nil if b is nil.
+func (b *Bucket) AsSortedSet() *SortedSet {
+	if b == nil {
+		return nil
+	}
+	return &SortedSet{b: b}
+}
+
+// Bucket returns the bucket under z.
+func (z *SortedSet) Bucket() *Bucket {
+	return z.b
+}
+
+// Add sets the score of member, adding it to z if needed, and reports
+// whether it was added. Setting the score a member has writes nothing.
+func (z *SortedSet) Add(member []byte, score float64) (bool, error) {
+	if math.IsNaN(score) {
+		return false, errNaNScore
+	}
+	if len(member) > MaxKeySize-8 {
+		return false, ErrKeyTooLarge
+	}
+	scores, err := z.scores(true)
+	if err != nil {
+		return false, err
+	}
+	encoded := encodeScore(score)
+	old := z.b.Get(member)
+	if bytes.Equal(old, encoded) {
+		return false, nil
+	}
+	// The scores are not recorded as changes, so replaying the change of
+	// the member alone would leave them behind.
+	z.b.tx.notReplayable()
+	if old != nil {
+		if _, err := scores.Remove(scoreKey(old, member)); err != nil {
+			return false, err
+		}
+	}
+	if err := z.b.Put(member, encoded); err != nil {
+		return false, err
+	}
+	if _, err := scores.Add(scoreKey(encoded, member)); err != nil {
+		return false, err
+	}
+	return old == nil, nil
+}
+
+// Score returns the score of member and reports whether it is in z.
+func (z *SortedSet) Score(member []byte) (float64, bool) {
+	encoded := z.b.Get(member)
+	if len(encoded) != 8 {
+		return 0, false
+	}
+	return decodeScore(encoded), true
+}
+
+// Remove removes member from z and reports whether it was in z.
+func (z *SortedSet) Remove(member []byte) (bool, error) {
+	old := z.b.Get(member)
+	if old == nil {
+		return false, nil
+	}
+	scores, err := z.scores(true)
+	if err != nil {
+		return false, err
+	}
+	z.b.tx.notReplayable()
+	if _, err := scores.Remove(scoreKey(old, member)); err != nil {
+		return false, err
+	}
+	if err := z.b.Delete(member); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RangeByScore returns an iterator over the members of z with min <= score
+// <= max and their scores, in score order, for use with range-over-func.
+func (z *SortedSet) RangeByScore(min, max float64) iter.Seq2[[]byte, float64] {
+	return func(yield func(member []byte, score float64) bool) {
+		scores, err := z.scores(false)
+		if err != nil || scores == nil || math.IsNaN(min) || math.IsNaN(max) {
+			return
+		}
+		for key := range scores.Bucket().Cursor().Keys(encodeScore(min), nil) {
+			score := decodeScore(key[:8])
+			if score > max || !yield(key[8:], score) {
+				return
+			}
+		}
+	}
+}
+
+// Rank returns the number of members of z ordered before member, by score
+// and then by bytes, and reports whether member is in z. It takes the rank
+// of the score and member key in the nested bucket, see Bucket.Rank.
+func (z *SortedSet) Rank(member []byte) (int, bool) {
+	encoded := z.b.Get(member)
+	if len(encoded) != 8 {
+		return 0, false
+	}
+	scores, err := z.scores(false)
+	if err != nil || scores == nil {
+		return 0, false
+	}
+	rank, err := scores.Bucket().Rank(scoreKey(encoded, member))
+	if err != nil {
+		return 0, false
+	}
+	return rank, true
+}
+
+// scores returns the set of score and member keys of z, creating it if
+// create is set and it is missing, or nil if it is missing.
+func (z *SortedSet) scores(create bool) (*SetBucket, error) {
+	b := z.b
+	if b == nil || b.tx == nil || b.tx.closed {
+		return nil, ErrTxClosed
+	}
+	if scores := b.child([]byte(sortedSetScores)); scores != nil {
+		return scores.AsSet(), nil
+	}
+	if !create {
+		return nil, nil
+	}
+	if !b.tx.writable {
+		return nil, ErrTxReadOnly
+	}
+	b.tx.notReplayable()
+	scores, err := b.createChild([]byte(sortedSetScores))
+	if err != nil {
+		return nil, err
+	}
+	return scores.AsSet(), nil
+}
+
+// scoreKey returns the key of member in the scores of a sorted set.
+func scoreKey(encoded, member []byte) []byte {
+	return append(append(make([]byte, 0, 8+len(member)), encoded...), member...)
+}
+
+// encodeScore encodes score so that encoded scores sort as their values do:
+// big-endian, with the sign bit flipped for positive scores and every bit
+// flipped for negative ones.
+func encodeScore(score float64) []byte {
+	if score == 0 {
+		score = 0 // not -0
+	}
+	bits := math.Float64bits(score)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	return binary.BigEndian.AppendUint64(nil, bits)
+}
+
+func decodeScore(encoded []byte) float64 {
+	bits := binary.BigEndian.Uint64(encoded)
+	if bits&(1<<63) != 0 {
+		bits &^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	return math.Float64frombits(bits)
+}
@@ -0,0 +1,101 @@
+package leafdb_test
+
+import (
+	"math"
+	"slices"
+	"testing"
+
+	"leafdb"
+)
+
+func TestSortedSetOrder(t *testing.T) {
+	db, err := leafdb.OpenMem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	scores := map[string]float64{
+		"ninf":  math.Inf(-1),
+		"big":   -1e300,
+		"neg":   -2.5,
+		"tiny":  -math.SmallestNonzeroFloat64,
+		"mzero": math.Copysign(0, -1),
+		"zero":  0,
+		"pos":   1.5,
+		"inf":   math.Inf(1),
+	}
+	want := []string{"ninf", "big", "neg", "tiny", "mzero", "zero", "pos", "inf"}
+	err = db.Write(func(tx *leafdb.Tx) error {
+		b, err := tx.CreateBucket([]byte("z"))
+		if err != nil {
+			return err
+		}
+		z := b.AsSortedSet()
+		for member, score := range scores {
+			if _, err := z.Add([]byte(member), score); err != nil {
+				return err
+			}
+		}
+		var got []string
+		for member, score := range z.RangeByScore(math.Inf(-1), math.Inf(1)) {
+			got = append(got, string(member))
+			if score != scores[string(member)] {
+				t.Errorf("%s has score %v, want %v", member, score, scores[string(member)])
+			}
+		}
+		if !slices.Equal(got, want) {
+			t.Fatalf("members in order %q, want %q", got, want)
+		}
+		for i, member := range want {
+			if rank, ok := z.Rank([]byte(member)); !ok || rank != i {
+				t.Errorf("%s has rank %d, %v, want %d", member, rank, ok, i)
+			}
+		}
+		// -0 is stored as 0, so it ranges with 0 and has no sign.
+		if score, _ := z.Score([]byte("mzero")); math.Signbit(score) {
+			t.Error("-0 kept its sign")
+		}
+		got = got[:0]
+		for member := range z.RangeByScore(-3, 0) {
+			got = append(got, string(member))
+		}
+		if !slices.Equal(got, want[2:6]) {
+			t.Fatalf("members in [-3, 0] %q, want %q", got, want[2:6])
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSortedSetNaN(t *testing.T) {
+	db, err := leafdb.OpenMem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Write(func(tx *leafdb.Tx) error {
+		b, err := tx.CreateBucket([]byte("z"))
+		if err != nil {
+			return err
+		}
+		z := b.AsSortedSet()
+		if _, err := z.Add([]byte("a"), 1); err != nil {
+			return err
+		}
+		if _, err := z.Add([]byte("a"), math.NaN()); err == nil {
+			t.Fatal("NaN score accepted")
+		}
+		if score, ok := z.Score([]byte("a")); !ok || score != 1 {
+			t.Fatalf("score %v, %v after rejected NaN, want 1", score, ok)
+		}
+		for member := range z.RangeByScore(math.NaN(), math.Inf(1)) {
+			t.Fatalf("range from NaN yields %q", member)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,234 @@
+// Package sqldriver is a minimal database/sql driver for leafdb. Each table
+// is a top-level bucket with two columns, key and value, and statements are
+// limited to simple key-based access:
+//
+//	CREATE TABLE [IF NOT EXISTS] t
+//	DROP TABLE [IF EXISTS] t
+//	INSERT [OR REPLACE] INTO t [(key, value)] VALUES (?, ?) [, (?, ?) ...]
+//	SELECT * | key, value FROM t [WHERE key = ?] [LIMIT n]
+//	DELETE FROM t [WHERE key = ?]
+//
+// Keys and values are strings or byte slices and scan back as []byte.
+// SELECT returns rows in key order. Importing the package registers the
+// driver as "leafdb"; the data source name is the path of the database file:
+//
+//	db, err := sql.Open("leafdb", "example.db")
+//
+// Connections to the same file, by whatever path, share one leafdb.DB, which
+// is closed when the last of them closes. OpenDB wraps a DB the caller
+// already has open. Each INSERT is applied whole or not at all, also inside
+// an explicit transaction.
+package sqldriver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"path/filepath"
+	"sync"
+
+	"leafdb"
+)
+
+func init() {
+	sql.Register("leafdb", Driver{})
+}
+
+// Driver is the leafdb database/sql driver.
+type Driver struct{}
+
+// Open opens a connection to the database file at name.
+func (d Driver) Open(name string) (driver.Conn, error) {
+	c, err := d.OpenConnector(name)
+	if err != nil {
+		return nil, err
+	}
+	return c.Connect(context.Background())
+}
+
+// OpenConnector returns a connector for the database file at name.
+func (Driver) OpenConnector(name string) (driver.Connector, error) {
+	return &fileConnector{path: name}, nil
+}
+
+// OpenDB returns a sql.DB backed by db. Closing the sql.DB does not close
+// db.
+func OpenDB(db *leafdb.DB) *sql.DB {
+	return sql.OpenDB(dbConnector{db})
+}
+
+// files holds the databases opened, by the resolved path of their file,
+// shared by their connections so that a file is never mapped twice by one
+// process, whichever name it is opened by.
+var files = struct {
+	sync.Mutex
+	open map[string]*sharedDB
+}{open: make(map[string]*sharedDB)}
+
+type sharedDB struct {
+	db   *leafdb.DB
+	refs int
+}
+
+type fileConnector struct {
+	path string
+}
+
+func (c *fileConnector) Connect(context.Context) (driver.Conn, error) {
+	files.Lock()
+	defer files.Unlock()
+	path, err := resolvePath(c.path)
+	if err != nil {
+		return nil, err
+	}
+	s := files.open[path]
+	if s == nil {
+		db, err := leafdb.Open(c.path)
+		if err != nil {
+			return nil, err
+		}
+		s = &sharedDB{db: db}
+		files.open[path] = s
+	}
+	s.refs++
+	return &conn{db: s.db, release: func() error { return release(path, s) }}, nil
+}
+
+func release(path string, s *sharedDB) error {
+	files.Lock()
+	defer files.Unlock()
+	s.refs--
+	if s.refs > 0 {
+		return nil
+	}
+	delete(files.open, path)
+	return s.db.Close()
+}
+
+// resolvePath returns the absolute path of name with symbolic links
+// resolved. A file that does not exist yet is resolved through its
+// directory.
+func resolvePath(name string) (string, error) {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return "", err
+	}
+	if path, err := filepath.EvalSymlinks(abs); err == nil {
+		return path, nil
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(abs))
+	if err != nil {
+		return abs, nil
+	}
+	return filepath.Join(dir, filepath.Base(abs)), nil
+}
+
+func (c *fileConnector) Driver() driver.Driver {
+	return Driver{}
+}
+
+type dbConnector struct {
+	db *leafdb.DB
+}
+
+func (c dbConnector) Connect(context.Context) (driver.Conn, error) {
+	return &conn{db: c.db}, nil
+}
+
+func (dbConnector) Driver() driver.Driver {
+	return Driver{}
+}
+
+// conn is a connection. Outside an explicit transaction every statement runs
+// in a transaction of its own.
+type conn struct {
+	db *leafdb.DB
+	// release is called on Close, if set.
+	release func() error
+	// tx is the open explicit transaction, if any.
+	tx     *leafdb.Tx
+	closed bool
+}
+
+var errConnClosed = errors.New("sqldriver: connection closed")
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *conn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if c.closed {
+		return nil, errConnClosed
+	}
+	s, err := parse(query)
+	if err != nil {
+		return nil, err
+	}
+	return &stmt{conn: c, s: s}, nil
+}
+
+func (c *conn) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.tx != nil {
+		c.tx.Rollback()
+		c.tx = nil
+	}
+	if c.release != nil {
+		return c.release()
+	}
+	return nil
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// BeginTx starts a leafdb transaction. Read-only transactions see a
+// snapshot and do not block writers; writable ones hold the writer lock
+// until they end, which makes them serializable.
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if c.closed {
+		return nil, errConnClosed
+	}
+	if c.tx != nil {
+		return nil, errors.New("sqldriver: transaction already open")
+	}
+	switch sql.IsolationLevel(opts.Isolation) {
+	case sql.LevelDefault, sql.LevelSnapshot, sql.LevelSerializable:
+	default:
+		return nil, errors.New("sqldriver: unsupported isolation level")
+	}
+	tx, err := c.db.BeginCtx(ctx, !opts.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	c.tx = tx
+	return &connTx{c}, nil
+}
+
+type connTx struct {
+	c *conn
+}
+
+func (t *connTx) Commit() error {
+	tx := t.c.tx
+	if tx == nil {
+		return leafdb.ErrTxClosed
+	}
+	t.c.tx = nil
+	return tx.Commit()
+}
+
+func (t *connTx) Rollback() error {
+	tx := t.c.tx
+	if tx == nil {
+		return leafdb.ErrTxClosed
+	}
+	t.c.tx = nil
+	tx.Rollback()
+	return nil
+}
@@ -0,0 +1,137 @@
+package sqldriver_test
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"leafdb"
+	_ "leafdb/sqldriver"
+)
+
+func openTest(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("leafdb", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec("CREATE TABLE t"); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// keys returns the keys of table t in order, as tx or db sees them.
+func keys(t *testing.T, q interface {
+	Query(string, ...any) (*sql.Rows, error)
+}) []string {
+	t.Helper()
+	rows, err := q.Query("SELECT key FROM t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, k)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestInsertSelectInTx(t *testing.T) {
+	db := openTest(t)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := tx.Exec("INSERT INTO t VALUES (?, ?), ('b', '2')", "a", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := res.RowsAffected(); n != 2 {
+		t.Fatalf("inserted %d rows, want 2", n)
+	}
+	var v string
+	if err := tx.QueryRow("SELECT value FROM t WHERE key = ?", "b").Scan(&v); err != nil || v != "2" {
+		t.Fatalf("got %q, %v inside the transaction, want 2", v, err)
+	}
+	if got := keys(t, db); len(got) != 0 {
+		t.Fatalf("uncommitted rows %q visible outside the transaction", got)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(keys(t, db), ","); got != "a,b" {
+		t.Fatalf("got keys %s after commit, want a,b", got)
+	}
+}
+
+func TestInsertAtomicInTx(t *testing.T) {
+	db := openTest(t)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("INSERT INTO t VALUES ('a', '1')"); err != nil {
+		t.Fatal(err)
+	}
+	// The duplicate is found before anything is written.
+	if _, err := tx.Exec("INSERT INTO t VALUES ('b', '2'), ('a', '3')"); err == nil {
+		t.Fatal("duplicate key inserted")
+	}
+	// The second row fails as it is written, and the first is undone.
+	long := strings.Repeat("k", leafdb.MaxKeySize+1)
+	if _, err := tx.Exec("INSERT OR REPLACE INTO t VALUES ('a', '4'), ('c', '5'), (?, '6')", long); err == nil {
+		t.Fatal("key longer than MaxKeySize inserted")
+	}
+	if got := strings.Join(keys(t, tx), ","); got != "a" {
+		t.Fatalf("got keys %s after failed inserts, want a", got)
+	}
+	var v string
+	if err := tx.QueryRow("SELECT value FROM t WHERE key = 'a'").Scan(&v); err != nil || v != "1" {
+		t.Fatalf("got %q, %v for a, want 1", v, err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSharedBySymlink(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	link := filepath.Join(dir, "link.db")
+	a, err := sql.Open("leafdb", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if _, err := a.Exec("CREATE TABLE t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(path, link); err != nil {
+		t.Skip(err)
+	}
+	// Both names share one leafdb.DB, so the link sees the table.
+	b, err := sql.Open("leafdb", link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if _, err := b.Exec("INSERT INTO t VALUES ('a', '1')"); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(keys(t, a), ","); got != "a" {
+		t.Fatalf("got keys %s through the other path, want a", got)
+	}
+}
@@ -0,0 +1,331 @@
+package sqldriver
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"leafdb"
+)
+
+type stmt struct {
+	conn *conn
+	s    *statement
+}
+
+func (st *stmt) Close() error {
+	return nil
+}
+
+func (st *stmt) NumInput() int {
+	return st.s.numArgs
+}
+
+func (st *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	return st.ExecContext(context.Background(), namedValues(args))
+}
+
+func (st *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	return st.QueryContext(context.Background(), namedValues(args))
+}
+
+func (st *stmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	var n int64
+	err := st.run(ctx, st.s.kind != stmtSelect, func(tx *leafdb.Tx) error {
+		var err error
+		if st.s.kind == stmtSelect {
+			_, err = query(tx, st.s, args)
+		} else {
+			n, err = exec(tx, st.s, args)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(n), nil
+}
+
+// QueryContext reads the whole result inside the transaction, so the
+// returned rows stay valid after it ends. Statements other than SELECT are
+// executed and return no rows.
+func (st *stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	r := &rows{}
+	err := st.run(ctx, st.s.kind != stmtSelect, func(tx *leafdb.Tx) error {
+		if st.s.kind != stmtSelect {
+			_, err := exec(tx, st.s, args)
+			return err
+		}
+		r.columns = st.s.columns
+		var err error
+		r.pairs, err = query(tx, st.s, args)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// run calls fn in the connection's open transaction, or else in a
+// transaction of its own that commits when fn succeeds.
+func (st *stmt) run(ctx context.Context, write bool, fn func(*leafdb.Tx) error) error {
+	c := st.conn
+	if c.closed {
+		return errConnClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if c.tx != nil {
+		err := fn(c.tx)
+		if errors.As(err, new(partialError)) {
+			c.tx.Rollback()
+			c.tx = nil
+		}
+		return err
+	}
+	if write {
+		return c.db.UpdateCtx(ctx, fn)
+	}
+	return c.db.ViewCtx(ctx, fn)
+}
+
+func exec(tx *leafdb.Tx, s *statement, args []driver.NamedValue) (int64, error) {
+	name := []byte(s.table)
+	switch s.kind {
+	case stmtCreate:
+		if s.ifExists && tx.Bucket(name) != nil {
+			return 0, nil
+		}
+		_, err := tx.CreateBucket(name)
+		if err == leafdb.ErrBucketExists {
+			return 0, fmt.Errorf("sqldriver: table %s already exists", s.table)
+		}
+		return 0, err
+	case stmtDrop:
+		err := tx.DeleteBucket(name)
+		if err == leafdb.ErrBucketNotFound {
+			if s.ifExists {
+				return 0, nil
+			}
+			return 0, noTable(s.table)
+		}
+		return 0, err
+	case stmtInsert:
+		b := tx.Bucket(name)
+		if b == nil {
+			return 0, noTable(s.table)
+		}
+		if err := insert(b, s, args); err != nil {
+			return 0, err
+		}
+		return int64(len(s.rows)), nil
+	case stmtDelete:
+		b := tx.Bucket(name)
+		if b == nil {
+			return 0, noTable(s.table)
+		}
+		var keys [][]byte
+		if s.key != nil {
+			key, err := bind(*s.key, args)
+			if err != nil {
+				return 0, err
+			}
+			if b.Get(key) != nil {
+				keys = append(keys, key)
+			}
+		} else {
+			c := b.Cursor()
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+				keys = append(keys, bytes.Clone(k))
+			}
+		}
+		for _, key := range keys {
+			if err := b.Delete(key); err != nil {
+				return 0, err
+			}
+		}
+		return int64(len(keys)), nil
+	}
+	return 0, fmt.Errorf("sqldriver: cannot execute statement")
+}
+
+// insert writes the rows of an INSERT to b, all or none of them: the rows
+// are bound and checked for duplicate keys before any is written, and a
+// row that fails to be written undoes the rows before it. If the undo
+// fails too, insert returns a partialError, on which run rolls back the
+// explicit transaction the statement ran in.
+func insert(b *leafdb.Bucket, s *statement, args []driver.NamedValue) error {
+	keys := make([][]byte, len(s.rows))
+	values := make([][]byte, len(s.rows))
+	seen := make(map[string]bool, len(s.rows))
+	for i, row := range s.rows {
+		var err error
+		if keys[i], err = bind(row[0], args); err != nil {
+			return err
+		}
+		if values[i], err = bind(row[1], args); err != nil {
+			return err
+		}
+		if !s.replace && (seen[string(keys[i])] || b.Get(keys[i]) != nil) {
+			return fmt.Errorf("sqldriver: duplicate key %q in table %s", keys[i], s.table)
+		}
+		seen[string(keys[i])] = true
+	}
+	// old holds the value each written key had before, nil if none.
+	old := make([][]byte, 0, len(keys))
+	for i, key := range keys {
+		old = append(old, bytes.Clone(b.Get(key)))
+		if err := b.Put(key, values[i]); err != nil {
+			if undoErr := undoInsert(b, keys[:i+1], old); undoErr != nil {
+				return partialError{err}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// undoInsert restores the keys an insert wrote to their old values, last
+// first, so that a key written twice gets the value it had before both.
+func undoInsert(b *leafdb.Bucket, keys, old [][]byte) error {
+	for i := len(keys) - 1; i >= 0; i-- {
+		var err error
+		if old[i] == nil {
+			err = b.Delete(keys[i])
+		} else {
+			err = b.Put(keys[i], old[i])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// partialError is the error of a statement that failed partway and could not
+// undo what it wrote.
+type partialError struct {
+	err error
+}
+
+func (e partialError) Error() string {
+	return "sqldriver: statement failed partway, transaction rolled back: " + e.err.Error()
+}
+
+func (e partialError) Unwrap() error {
+	return e.err
+}
+
+func query(tx *leafdb.Tx, s *statement, args []driver.NamedValue) ([]leafdb.KV, error) {
+	b := tx.Bucket([]byte(s.table))
+	if b == nil {
+		return nil, noTable(s.table)
+	}
+	limit := int64(-1)
+	if s.limit != nil {
+		var err error
+		if limit, err = bindLimit(*s.limit, args); err != nil {
+			return nil, err
+		}
+	}
+	if limit == 0 {
+		return nil, nil
+	}
+	if s.key != nil {
+		key, err := bind(*s.key, args)
+		if err != nil {
+			return nil, err
+		}
+		v := b.Get(key)
+		if v == nil {
+			return nil, nil
+		}
+		return []leafdb.KV{{Key: bytes.Clone(key), Value: bytes.Clone(v)}}, nil
+	}
+	var out []leafdb.KV
+	c := b.Cursor()
+	for k, v := c.First(); k != nil && int64(len(out)) != limit; k, v = c.Next() {
+		out = append(out, leafdb.KV{Key: bytes.Clone(k), Value: bytes.Clone(v)})
+	}
+	return out, nil
+}
+
+func noTable(name string) error {
+	return fmt.Errorf("sqldriver: no such table: %s", name)
+}
+
+// bind returns the value of op, taking placeholders from args.
+func bind(op operand, args []driver.NamedValue) ([]byte, error) {
+	if op.arg < 0 {
+		return op.value, nil
+	}
+	if op.arg >= len(args) {
+		return nil, fmt.Errorf("sqldriver: missing argument %d", op.arg+1)
+	}
+	switch v := args[op.arg].Value.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	}
+	return nil, fmt.Errorf("sqldriver: argument %d: unsupported type %T, want string or []byte", op.arg+1, args[op.arg].Value)
+}
+
+func bindLimit(op operand, args []driver.NamedValue) (int64, error) {
+	if op.arg < 0 {
+		return strconv.ParseInt(string(op.value), 10, 64)
+	}
+	if op.arg >= len(args) {
+		return 0, fmt.Errorf("sqldriver: missing argument %d", op.arg+1)
+	}
+	n, ok := args[op.arg].Value.(int64)
+	if !ok || n < 0 {
+		return 0, fmt.Errorf("sqldriver: argument %d: limit must be a non-negative integer", op.arg+1)
+	}
+	return n, nil
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	return named
+}
+
+// rows is a fully read SELECT result.
+type rows struct {
+	columns []string
+	pairs   []leafdb.KV
+}
+
+func (r *rows) Columns() []string {
+	return r.columns
+}
+
+func (r *rows) Close() error {
+	r.pairs = nil
+	return nil
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	if len(r.pairs) == 0 {
+		return io.EOF
+	}
+	kv := r.pairs[0]
+	r.pairs = r.pairs[1:]
+	for i, col := range r.columns {
+		if col == "key" {
+			dest[i] = kv.Key
+		} else {
+			dest[i] = kv.Value
+		}
+	}
+	return nil
+}
@@ -0,0 +1,464 @@
+package sqldriver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type stmtKind int
+
+const (
+	stmtCreate stmtKind = iota
+	stmtDrop
+	stmtInsert
+	stmtSelect
+	stmtDelete
+)
+
+// operand is a literal or a placeholder in a statement.
+type operand struct {
+	// arg is the index of the placeholder's argument, or -1 for a literal.
+	arg   int
+	value []byte
+}
+
+// statement is a parsed SQL statement. Tables are buckets with two columns,
+// key and value.
+type statement struct {
+	kind  stmtKind
+	table string
+	// ifExists is set for CREATE TABLE IF NOT EXISTS and DROP TABLE IF EXISTS.
+	ifExists bool
+	// replace is set for INSERT OR REPLACE, which overwrites existing keys.
+	replace bool
+	// rows holds the key and value operands of each row of an INSERT.
+	rows [][2]operand
+	// columns lists the selected columns, each "key" or "value".
+	columns []string
+	// key is the operand of WHERE key = ..., if present.
+	key *operand
+	// limit is the operand of LIMIT, if present.
+	limit   *operand
+	numArgs int
+}
+
+// parse parses the subset of SQL the driver understands:
+//
+//	CREATE TABLE [IF NOT EXISTS] t
+//	DROP TABLE [IF EXISTS] t
+//	INSERT [OR REPLACE] INTO t [(key, value)] VALUES (k, v) [, (k, v) ...]
+//	SELECT * | cols FROM t [WHERE key = k] [LIMIT n]
+//	DELETE FROM t [WHERE key = k]
+//
+// Keywords are case-insensitive. Operands are '...' string literals or ?
+// placeholders; LIMIT also takes an integer.
+func parse(query string) (*statement, error) {
+	toks, err := tokenize(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	s, err := p.statement()
+	if err != nil {
+		return nil, fmt.Errorf("sqldriver: %v in %q", err, query)
+	}
+	return s, nil
+}
+
+type tokenKind int
+
+const (
+	tokIdent tokenKind = iota
+	tokString
+	tokNumber
+	tokPlaceholder
+	tokPunct
+	tokEOF
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	// quoted is set for identifiers written in double quotes, which are
+	// never keywords.
+	quoted bool
+}
+
+func tokenize(query string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '?':
+			toks = append(toks, token{kind: tokPlaceholder, text: "?"})
+			i++
+		case strings.IndexByte("(),=*;", c) >= 0:
+			toks = append(toks, token{kind: tokPunct, text: string(c)})
+			i++
+		case c == '\'' || c == '"':
+			s, n, err := unquote(query[i:], c)
+			if err != nil {
+				return nil, err
+			}
+			if c == '\'' {
+				toks = append(toks, token{kind: tokString, text: s})
+			} else {
+				toks = append(toks, token{kind: tokIdent, text: s, quoted: true})
+			}
+			i += n
+		case isDigit(c):
+			j := i
+			for j < len(query) && isDigit(query[j]) {
+				j++
+			}
+			toks = append(toks, token{kind: tokNumber, text: query[i:j]})
+			i = j
+		case isIdentStart(c):
+			j := i
+			for j < len(query) && (isIdentStart(query[j]) || isDigit(query[j])) {
+				j++
+			}
+			toks = append(toks, token{kind: tokIdent, text: query[i:j]})
+			i = j
+		default:
+			return nil, fmt.Errorf("sqldriver: unexpected %q in %q", c, query)
+		}
+	}
+	return append(toks, token{kind: tokEOF}), nil
+}
+
+// unquote reads a literal quoted with q from the start of s, where a doubled
+// quote stands for one, and returns its contents and length in s.
+func unquote(s string, q byte) (string, int, error) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		if s[i] != q {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == q {
+			b.WriteByte(q)
+			i++
+			continue
+		}
+		return b.String(), i + 1, nil
+	}
+	return "", 0, fmt.Errorf("sqldriver: unterminated %c in %q", q, s)
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+type parser struct {
+	toks []token
+	pos  int
+	args int
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// keyword consumes the next token if it is the keyword kw.
+func (p *parser) keyword(kw string) bool {
+	t := p.peek()
+	if t.kind == tokIdent && !t.quoted && strings.EqualFold(t.text, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectKeyword(kws ...string) error {
+	for _, kw := range kws {
+		if !p.keyword(kw) {
+			return fmt.Errorf("expected %s, found %s", kw, describe(p.peek()))
+		}
+	}
+	return nil
+}
+
+func (p *parser) punct(c string) bool {
+	t := p.peek()
+	if t.kind == tokPunct && t.text == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectPunct(c string) error {
+	if !p.punct(c) {
+		return fmt.Errorf("expected %q, found %s", c, describe(p.peek()))
+	}
+	return nil
+}
+
+func (p *parser) ident() (string, error) {
+	t := p.next()
+	if t.kind != tokIdent {
+		return "", fmt.Errorf("expected a name, found %s", describe(t))
+	}
+	return t.text, nil
+}
+
+// column parses a column name, which must be key or value.
+func (p *parser) column() (string, error) {
+	t := p.peek()
+	name, err := p.ident()
+	if err != nil {
+		return "", err
+	}
+	name = strings.ToLower(name)
+	if name != "key" && name != "value" {
+		return "", fmt.Errorf("unknown column %s; tables have columns key and value", describe(t))
+	}
+	return name, nil
+}
+
+func (p *parser) operand() (operand, error) {
+	t := p.next()
+	switch t.kind {
+	case tokString:
+		return operand{arg: -1, value: []byte(t.text)}, nil
+	case tokPlaceholder:
+		p.args++
+		return operand{arg: p.args - 1}, nil
+	}
+	return operand{}, fmt.Errorf("expected a string or ?, found %s", describe(t))
+}
+
+func (p *parser) statement() (*statement, error) {
+	var s *statement
+	var err error
+	switch {
+	case p.keyword("create"):
+		s, err = p.create()
+	case p.keyword("drop"):
+		s, err = p.drop()
+	case p.keyword("insert"):
+		s, err = p.insert()
+	case p.keyword("select"):
+		s, err = p.selectStmt()
+	case p.keyword("delete"):
+		s, err = p.delete()
+	default:
+		return nil, fmt.Errorf("unsupported statement starting with %s", describe(p.peek()))
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.punct(";")
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %s", describe(t))
+	}
+	s.numArgs = p.args
+	return s, nil
+}
+
+func (p *parser) create() (*statement, error) {
+	s := &statement{kind: stmtCreate}
+	if err := p.expectKeyword("table"); err != nil {
+		return nil, err
+	}
+	if p.keyword("if") {
+		if err := p.expectKeyword("not", "exists"); err != nil {
+			return nil, err
+		}
+		s.ifExists = true
+	}
+	var err error
+	s.table, err = p.ident()
+	return s, err
+}
+
+func (p *parser) drop() (*statement, error) {
+	s := &statement{kind: stmtDrop}
+	if err := p.expectKeyword("table"); err != nil {
+		return nil, err
+	}
+	if p.keyword("if") {
+		if err := p.expectKeyword("exists"); err != nil {
+			return nil, err
+		}
+		s.ifExists = true
+	}
+	var err error
+	s.table, err = p.ident()
+	return s, err
+}
+
+func (p *parser) insert() (*statement, error) {
+	s := &statement{kind: stmtInsert}
+	if p.keyword("or") {
+		if err := p.expectKeyword("replace"); err != nil {
+			return nil, err
+		}
+		s.replace = true
+	}
+	if err := p.expectKeyword("into"); err != nil {
+		return nil, err
+	}
+	var err error
+	if s.table, err = p.ident(); err != nil {
+		return nil, err
+	}
+	// keyFirst records the column order of the row tuples.
+	keyFirst := true
+	if p.punct("(") {
+		first, err := p.column()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectPunct(","); err != nil {
+			return nil, err
+		}
+		second, err := p.column()
+		if err != nil {
+			return nil, err
+		}
+		if first == second {
+			return nil, fmt.Errorf("column %s listed twice", first)
+		}
+		if err := p.expectPunct(")"); err != nil {
+			return nil, err
+		}
+		keyFirst = first == "key"
+	}
+	if err := p.expectKeyword("values"); err != nil {
+		return nil, err
+	}
+	for {
+		if err := p.expectPunct("("); err != nil {
+			return nil, err
+		}
+		a, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectPunct(","); err != nil {
+			return nil, err
+		}
+		b, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectPunct(")"); err != nil {
+			return nil, err
+		}
+		if !keyFirst {
+			a, b = b, a
+		}
+		s.rows = append(s.rows, [2]operand{a, b})
+		if !p.punct(",") {
+			return s, nil
+		}
+	}
+}
+
+func (p *parser) selectStmt() (*statement, error) {
+	s := &statement{kind: stmtSelect}
+	if p.punct("*") {
+		s.columns = []string{"key", "value"}
+	} else {
+		for {
+			col, err := p.column()
+			if err != nil {
+				return nil, err
+			}
+			s.columns = append(s.columns, col)
+			if !p.punct(",") {
+				break
+			}
+		}
+	}
+	if err := p.expectKeyword("from"); err != nil {
+		return nil, err
+	}
+	var err error
+	if s.table, err = p.ident(); err != nil {
+		return nil, err
+	}
+	if s.key, err = p.where(); err != nil {
+		return nil, err
+	}
+	if p.keyword("limit") {
+		t := p.peek()
+		if t.kind == tokNumber {
+			p.next()
+			if _, err := strconv.ParseUint(t.text, 10, 63); err != nil {
+				return nil, fmt.Errorf("invalid limit %s", t.text)
+			}
+			s.limit = &operand{arg: -1, value: []byte(t.text)}
+		} else if t.kind == tokPlaceholder {
+			p.next()
+			p.args++
+			s.limit = &operand{arg: p.args - 1}
+		} else {
+			return nil, fmt.Errorf("expected a number or ?, found %s", describe(t))
+		}
+	}
+	return s, nil
+}
+
+func (p *parser) delete() (*statement, error) {
+	s := &statement{kind: stmtDelete}
+	if err := p.expectKeyword("from"); err != nil {
+		return nil, err
+	}
+	var err error
+	if s.table, err = p.ident(); err != nil {
+		return nil, err
+	}
+	s.key, err = p.where()
+	return s, err
+}
+
+// where parses an optional WHERE key = operand clause.
+func (p *parser) where() (*operand, error) {
+	if !p.keyword("where") {
+		return nil, nil
+	}
+	t := p.peek()
+	col, err := p.column()
+	if err != nil {
+		return nil, err
+	}
+	if col != "key" {
+		return nil, fmt.Errorf("WHERE only supports key = ..., found %s", describe(t))
+	}
+	if err := p.expectPunct("="); err != nil {
+		return nil, err
+	}
+	op, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	return &op, nil
+}
+
+func describe(t token) string {
+	switch t.kind {
+	case tokEOF:
+		return "end of statement"
+	case tokString:
+		return fmt.Sprintf("string '%s'", t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
@@ -0,0 +1,501 @@
+package leafdb
+
+import (
+	"expvar"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a point-in-time snapshot of database runtime statistics.
+type Stats struct {
+	Commit CommitStats
+	Tx     TxStats
+	Pages  PageStats
+	Cache  CacheStats
+	Remote RemoteStats
+
+	// PageCount is the number of pages allocated in the file, including
+	// free ones.
+	PageCount uint64
+	// FreePages counts pages ready for reuse, and PendingPages counts freed
+	// pages that are held back until no open reader can see them.
+	FreePages    int
+	PendingPages int
+}
+
+// CacheStats describes the node cache enabled by Options.NodeCacheSize.
+type CacheStats struct {
+	// Hits and Misses count lookups of committed pages in the cache.
+	Hits   uint64
+	Misses uint64
+	// Nodes is the number of cached nodes and Size their estimated size in
+	// bytes.
+	Nodes int
+	Size  int
+}
+
+// RemoteStats describes the page fetches of a database opened with
+// OpenRemote or with Options.NoMmap.
+type RemoteStats struct {
+	// Fetches counts ranges read from the file and FetchedBytes
+	// their total size.
+	Fetches      uint64
+	FetchedBytes uint64
+	// CachedBytes is the size of the ranges held in memory.
+	CachedBytes int
+}
+
+// PageStats counts the pages handled by committed write transactions over
+// the lifetime of the DB.
+type PageStats struct {
+	// Allocated and Freed count pages allocated and freed.
+	Allocated uint64
+	Freed     uint64
+	// Written counts pages written to the file, and WrittenBytes their
+	// size on disk.
+	Written      uint64
+	WrittenBytes uint64
+	// Punched counts free pages punched out of the file, see
+	// Options.PunchHoleSize, and Released free pages whose memory was
+	// released, see Options.ReleaseFreeMemory.
+	Punched  uint64
+	Released uint64
+}
+
+// TxStats counts transactions over the lifetime of the DB.
+type TxStats struct {
+	// ReadTxs counts read transactions begun, and OpenReadTxs those still
+	// open.
+	ReadTxs     uint64
+	OpenReadTxs int
+	// Commits counts committed write transactions. Rollbacks counts write
+	// transactions rolled back, including those whose commit failed.
+	Commits   uint64
+	Rollbacks uint64
+}
+
+// CommitStats describes where time is spent committing write transactions
+// and how often writers and readers wait on each other.
+type CommitStats struct {
+	// PageCopy covers copying dirty pages into the mapping.
+	PageCopy Histogram
+	// Remap covers growing the file and remapping it.
+	Remap Histogram
+	// MetaWrite covers persisting the freelist and writing the meta page.
+	MetaWrite Histogram
+	// Sync covers msync and fsync calls.
+	Sync Histogram
+	// Total covers the whole commit.
+	Total Histogram
+
+	// WriterLockWaits counts writers that had to wait for the writer lock,
+	// and WriterLockWait is the cumulative time they waited.
+	WriterLockWaits uint64
+	WriterLockWait  time.Duration
+	// WriterQueue is the number of writers waiting for the writer lock, and
+	// WriterQueueMax the most that ever waited at once.
+	WriterQueue    int
+	WriterQueueMax int
+	// Remaps counts replacements of the memory map as the file grew.
+	Remaps uint64
+	// RemapStalls counts read transactions that waited to begin because a
+	// remap was in progress, and RemapStallTime is the cumulative wait.
+	RemapStalls    uint64
+	RemapStallTime time.Duration
+}
+
+// Histogram is a snapshot of a latency distribution. Counts[i] is the number
+// of observations no larger than Bounds[i]; the final entry of Counts holds
+// observations above the last bound.
+type Histogram struct {
+	Bounds []time.Duration
+	Counts []uint64
+	Count  uint64
+	Sum    time.Duration
+}
+
+// Mean returns the average observation, or zero if there are none.
+func (h Histogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// histogramBounds are exponential latency buckets from 1µs to roughly 4s.
+var histogramBounds = [...]time.Duration{
+	time.Microsecond,
+	4 * time.Microsecond,
+	16 * time.Microsecond,
+	64 * time.Microsecond,
+	256 * time.Microsecond,
+	time.Millisecond,
+	4 * time.Millisecond,
+	16 * time.Millisecond,
+	64 * time.Millisecond,
+	256 * time.Millisecond,
+	time.Second,
+	4 * time.Second,
+}
+
+// histogram is a lock-free latency histogram over histogramBounds.
+type histogram struct {
+	counts [len(histogramBounds) + 1]atomic.Uint64
+	count  atomic.Uint64
+	sum    atomic.Int64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	idx := len(histogramBounds)
+	for i, bound := range histogramBounds {
+		if d <= bound {
+			idx = i
+			break
+		}
+	}
+	h.counts[idx].Add(1)
+	h.count.Add(1)
+	h.sum.Add(int64(d))
+}
+
+func (h *histogram) since(start time.Time) {
+	h.observe(time.Since(start))
+}
+
+func (h *histogram) snapshot() Histogram {
+	out := Histogram{
+		Bounds: append([]time.Duration(nil), histogramBounds[:]...),
+		Counts: make([]uint64, len(h.counts)),
+		Count:  h.count.Load(),
+		Sum:    time.Duration(h.sum.Load()),
+	}
+	for i := range h.counts {
+		out.Counts[i] = h.counts[i].Load()
+	}
+	return out
+}
+
+// dbStats holds the live counters behind DB.Stats.
+type dbStats struct {
+	pageCopy  histogram
+	remap     histogram
+	metaWrite histogram
+	sync      histogram
+	commit    histogram
+
+	writerLockWaits atomic.Uint64
+	writerLockWait  atomic.Int64
+	remaps          atomic.Uint64
+	remapStalls     atomic.Uint64
+	remapStallTime  atomic.Int64
+
+	pagesAllocated atomic.Uint64
+	pagesFreed     atomic.Uint64
+	pagesWritten   atomic.Uint64
+	pagesPunched   atomic.Uint64
+	pagesReleased  atomic.Uint64
+
+	readTxs   atomic.Uint64
+	commits   atomic.Uint64
+	rollbacks atomic.Uint64
+}
+
+// Stats returns a snapshot of the database's runtime statistics.
+func (db *DB) Stats() Stats {
+	if db == nil {
+		return Stats{}
+	}
+	s := &db.stats
+	db.metaMu.RLock()
+	pageCount := db.meta.nextPage
+	free := len(db.meta.freelist)
+	pending := len(db.pending)
+	db.metaMu.RUnlock()
+	openReads := 0
+	db.readMu.Lock()
+	for _, n := range db.readTxs {
+		openReads += n
+	}
+	db.readMu.Unlock()
+	queue, maxQueue := db.mu.waiting()
+	return Stats{
+		PageCount:    pageCount,
+		FreePages:    free,
+		PendingPages: pending,
+		Tx: TxStats{
+			ReadTxs:     s.readTxs.Load(),
+			OpenReadTxs: openReads,
+			Commits:     s.commits.Load(),
+			Rollbacks:   s.rollbacks.Load(),
+		},
+		Pages: PageStats{
+			Allocated:    s.pagesAllocated.Load(),
+			Freed:        s.pagesFreed.Load(),
+			Written:      s.pagesWritten.Load(),
+			WrittenBytes: s.pagesWritten.Load() * uint64(db.diskPageSize),
+			Punched:      s.pagesPunched.Load(),
+			Released:     s.pagesReleased.Load(),
+		},
+		Cache:  db.nodeCache.stats(),
+		Remote: db.remote.stats(),
+		Commit: CommitStats{
+			PageCopy:        s.pageCopy.snapshot(),
+			Remap:           s.remap.snapshot(),
+			MetaWrite:       s.metaWrite.snapshot(),
+			Sync:            s.sync.snapshot(),
+			Total:           s.commit.snapshot(),
+			WriterLockWaits: s.writerLockWaits.Load(),
+			WriterLockWait:  time.Duration(s.writerLockWait.Load()),
+			WriterQueue:     queue,
+			WriterQueueMax:  maxQueue,
+			Remaps:          s.remaps.Load(),
+			RemapStalls:     s.remapStalls.Load(),
+			RemapStallTime:  time.Duration(s.remapStallTime.Load()),
+		},
+	}
+}
+
+// StatsVar returns an expvar.Var whose value is the JSON encoding of
+// DB.Stats, read afresh every time it is shown. Publish it to include the
+// database in /debug/vars:
+//
+//	expvar.Publish("leafdb", db.StatsVar())
+func (db *DB) StatsVar() expvar.Var {
+	return expvar.Func(func() any { return db.Stats() })
+}
+
+// BucketStats describes the shape of a bucket's trees, including those of
+// its nested buckets.
+type BucketStats struct {
+	// BucketN counts the bucket itself and every nested bucket.
+	BucketN int
+	// KeyN counts key/value pairs across all of the buckets.
+	KeyN int
+	// Depth is the number of levels in the deepest key/value tree.
+	Depth int
+
+	BranchPages   int
+	LeafPages     int
+	OverflowPages int
+	// FilterPages counts the directory and block pages of Bloom filters.
+	FilterPages int
+
+	// BranchInuse and LeafInuse are the bytes used by encoded nodes;
+	// BranchAlloc and LeafAlloc the bytes of the pages holding them.
+	BranchInuse int
+	BranchAlloc int
+	LeafInuse   int
+	LeafAlloc   int
+}
+
+// LeafFill returns the fraction of allocated leaf page space in use, or zero
+// if there are no leaves.
+func (s BucketStats) LeafFill() float64 {
+	if s.LeafAlloc == 0 {
+		return 0
+	}
+	return float64(s.LeafInuse) / float64(s.LeafAlloc)
+}
+
+// Stats walks the bucket and its nested buckets and returns their page
+// usage.
+func (b *Bucket) Stats() (BucketStats, error) {
+	var s BucketStats
+	if b == nil || b.tx == nil || b.tx.closed {
+		return s, ErrTxClosed
+	}
+	err := b.collectStats(&s)
+	return s, err
+}
+
+func (b *Bucket) collectStats(s *BucketStats) error {
+	s.BucketN++
+	if err := treeStats(b.tx.mgr, s, b.kvRoot, 1, true, b.options.BlobThreshold); err != nil {
+		return err
+	}
+	if err := treeStats(b.tx.mgr, s, b.bucketRoot, 1, false, 0); err != nil {
+		return err
+	}
+	if b.filter != 0 {
+		dir, err := readFilterPage(b.tx.mgr, b.filter, pageFilter)
+		if err != nil {
+			return err
+		}
+		s.FilterPages += 1 + len(filterBlocks(dir))
+	}
+	return b.ForEachBucket(func(_ []byte, child *Bucket) error {
+		return child.collectStats(s)
+	})
+}
+
+// treeStats accumulates page usage of the tree rooted at pageID, of blob
+// threshold blob. Keys and depth are only counted for key/value trees, not
+// bucket index trees.
+func treeStats(store pageStore, s *BucketStats, pageID uint64, depth int, kv bool, blob int) error {
+	if pageID == 0 {
+		return nil
+	}
+	n, err := readNode(store, pageID)
+	if err != nil {
+		return err
+	}
+	pageSize := store.PageSize()
+	if !n.isLeaf {
+		size, err := nodeSize(pageSize, 0, n)
+		if err != nil {
+			return err
+		}
+		s.BranchPages++
+		s.BranchInuse += size
+		s.BranchAlloc += pageSize
+		for _, child := range n.children {
+			if err := treeStats(store, s, child, depth+1, kv, blob); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	size, err := leafSize(pageSize, blob, n)
+	if err != nil {
+		return err
+	}
+	for i, first := range n.overflow {
+		if first != 0 {
+			payload := pageSize - overflowHeaderSize
+			s.OverflowPages += (len(n.values[i]) + payload - 1) / payload
+		}
+	}
+	s.LeafPages++
+	s.LeafInuse += size
+	s.LeafAlloc += pageSize
+	if kv {
+		s.KeyN += len(n.keys)
+		s.Depth = max(s.Depth, depth)
+	}
+	return nil
+}
+
+// SizeStats describes the sizes of the pairs of a bucket and its nested
+// buckets and how full their leaf pages are, to guide the choice of page
+// size and whether values are worth compressing.
+type SizeStats struct {
+	// KeySize and ValueSize count pairs by the length of their key and of
+	// their value, in bytes.
+	KeySize   SizeHistogram
+	ValueSize SizeHistogram
+	// LeafFill counts the leaf pages of key/value trees by the percentage
+	// of the page in use.
+	LeafFill SizeHistogram
+}
+
+// SizeHistogram is a distribution of sizes. Counts[i] is the number of
+// observations no larger than Bounds[i]; the final entry of Counts holds
+// observations above the last bound.
+type SizeHistogram struct {
+	Bounds []int
+	Counts []uint64
+	Count  uint64
+	Sum    uint64
+}
+
+// Mean returns the average observation, or zero if there are none.
+func (h SizeHistogram) Mean() float64 {
+	if h.Count == 0 {
+		return 0
+	}
+	return float64(h.Sum) / float64(h.Count)
+}
+
+func newSizeHistogram(bounds []int) SizeHistogram {
+	return SizeHistogram{
+		Bounds: append([]int(nil), bounds...),
+		Counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (h *SizeHistogram) observe(v int) {
+	idx, _ := slices.BinarySearch(h.Bounds, v)
+	h.Counts[idx]++
+	h.Count++
+	h.Sum += uint64(v)
+}
+
+// sizeBounds are the bounds of key and value size histograms: powers of two
+// from 8 bytes to 1MiB. fillBounds are those of leaf fill histograms, in
+// steps of ten percent.
+var (
+	sizeBounds = []int{8, 16, 32, 64, 128, 256, 512, 1 << 10, 2 << 10, 4 << 10, 8 << 10, 16 << 10, 32 << 10, 64 << 10, 128 << 10, 256 << 10, 512 << 10, 1 << 20}
+	fillBounds = []int{10, 20, 30, 40, 50, 60, 70, 80, 90, 100}
+)
+
+func newSizeStats() SizeStats {
+	return SizeStats{
+		KeySize:   newSizeHistogram(sizeBounds),
+		ValueSize: newSizeHistogram(sizeBounds),
+		LeafFill:  newSizeHistogram(fillBounds),
+	}
+}
+
+// SizeStats walks every top-level bucket and its nested buckets and returns
+// the distribution of their key and value sizes and leaf fill.
+func (tx *Tx) SizeStats() (SizeStats, error) {
+	s := newSizeStats()
+	if tx == nil || tx.closed {
+		return s, ErrTxClosed
+	}
+	err := tx.ForEachBucket(func(_ []byte, b *Bucket) error {
+		return b.collectSizes(&s)
+	})
+	return s, err
+}
+
+// SizeStats walks the bucket and its nested buckets and returns the
+// distribution of their key and value sizes and leaf fill.
+func (b *Bucket) SizeStats() (SizeStats, error) {
+	s := newSizeStats()
+	if b == nil || b.tx == nil || b.tx.closed {
+		return s, ErrTxClosed
+	}
+	err := b.collectSizes(&s)
+	return s, err
+}
+
+func (b *Bucket) collectSizes(s *SizeStats) error {
+	if err := treeSizes(b.tx.mgr, s, b.kvRoot, b.options.BlobThreshold); err != nil {
+		return err
+	}
+	return b.ForEachBucket(func(_ []byte, child *Bucket) error {
+		return child.collectSizes(s)
+	})
+}
+
+// treeSizes adds the pairs and leaves of the key/value tree at pageID, of
+// blob threshold blob, to s.
+func treeSizes(store pageStore, s *SizeStats, pageID uint64, blob int) error {
+	if pageID == 0 {
+		return nil
+	}
+	n, err := readNode(store, pageID)
+	if err != nil {
+		return err
+	}
+	if !n.isLeaf {
+		for _, child := range n.children {
+			if err := treeSizes(store, s, child, blob); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	size, err := leafSize(store.PageSize(), blob, n)
+	if err != nil {
+		return err
+	}
+	s.LeafFill.observe(size * 100 / store.PageSize())
+	for i, key := range n.keys {
+		s.KeySize.observe(len(key))
+		s.ValueSize.observe(len(n.values[i]))
+	}
+	return nil
+}
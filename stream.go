@@ -0,0 +1,222 @@
+package leafdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// streamedValue is a value that Bucket.PutReader wrote to the overflow
+// chain at first. The leaf of key carries streamedPlaceholder in its place,
+// which is too large to be stored inline, so the tree sizes the entry as
+// any value in overflow pages.
+type streamedValue struct {
+	key    []byte
+	first  uint64
+	length uint32
+}
+
+var streamedPlaceholder = make([]byte, defaultPageSize)
+
+// GetReader returns a reader over the value of key, or ErrKeyNotFound.
+// A value in overflow pages is read a page at a time as the reader is
+// consumed, so it never has to fit in memory, unless its leaf predates slot
+// directories and is decoded with all its values. The reader must be used
+// while the transaction is open, and in a write transaction before the
+// next write to b.
+func (b *Bucket) GetReader(key []byte) (io.ReadCloser, error) {
+	if b == nil || b.tx == nil || b.tx.closed {
+		return nil, ErrTxClosed
+	}
+	b.trackRead(key)
+	if !b.mayContain(key) {
+		return nil, ErrKeyNotFound
+	}
+	tree := newBPTree(&b.kvRoot, b.tx.mgr)
+	e, ok, err := tree.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	if e.node != nil {
+		return io.NopCloser(bytes.NewReader(e.node.values[e.index])), nil
+	}
+	if e.empty {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	if e.pos+4 > len(e.page) {
+		return nil, atPage(corrupted(e.pos, "corrupted value length"), e.id)
+	}
+	length := binary.LittleEndian.Uint32(e.page[e.pos:])
+	if length&valueOverflowFlag == 0 {
+		value, err := readSlotValue(b.tx.mgr, e.page, e.pos, true)
+		if err != nil {
+			return nil, atPage(err, e.id)
+		}
+		return io.NopCloser(bytes.NewReader(value)), nil
+	}
+	if e.pos+12 > len(e.page) {
+		return nil, atPage(corrupted(e.pos+4, "corrupted overflow pointer"), e.id)
+	}
+	return &overflowReader{
+		tx:        b.tx,
+		next:      binary.LittleEndian.Uint64(e.page[e.pos+4:]),
+		remaining: int(length &^ valueOverflowFlag),
+	}, nil
+}
+
+// overflowReader reads a value from its overflow chain a page at a time.
+type overflowReader struct {
+	tx *Tx
+	// next is the page after buf, which came from page, and remaining the
+	// bytes of the value that are not in buf yet.
+	page      uint64
+	next      uint64
+	remaining int
+	buf       []byte
+	closed    bool
+}
+
+func (r *overflowReader) Read(p []byte) (int, error) {
+	if r.closed || r.tx.closed {
+		return 0, ErrTxClosed
+	}
+	if len(r.buf) == 0 {
+		if r.remaining == 0 {
+			return 0, io.EOF
+		}
+		if r.next == 0 {
+			return 0, atPage(corrupted(1, "overflow chain too short"), r.page)
+		}
+		page, err := r.tx.mgr.ReadPage(r.next)
+		if err != nil {
+			return 0, err
+		}
+		if len(page) < r.tx.mgr.PageSize() || !isChainPage(page[0]) {
+			return 0, atPage(corrupted(0, "invalid overflow page"), r.next)
+		}
+		chunk := min(r.remaining, len(page)-overflowHeaderSize)
+		r.page, r.next = r.next, binary.LittleEndian.Uint64(page[1:])
+		r.buf = page[overflowHeaderSize : overflowHeaderSize+chunk]
+		r.remaining -= chunk
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *overflowReader) Close() error {
+	r.closed = true
+	r.buf = nil
+	return nil
+}
+
+// PutReader sets key to the size bytes read from r. A value too large to
+// be stored in the leaf is written to overflow pages as it is read, a page
+// at a time, rather than read into one slice and copied again into pages;
+// like every page of the transaction, those pages are held until it
+// commits. If r ends early, b is left unchanged and PutReader returns
+// io.ErrUnexpectedEOF. Smaller values, and values of buckets whose writes
+// feed declared indexes, hooks or the changefeed, are checked by a
+// validator or are tracked for Options.OptimisticWrites, are read in full
+// and stored with Put.
+//
+// Other large values in the same leaf are still read and copied whenever
+// the leaf is rewritten, as with Put.
+func (b *Bucket) PutReader(key []byte, r io.Reader, size int64) error {
+	if b == nil || b.tx == nil || b.tx.closed {
+		return ErrTxClosed
+	}
+	if !b.tx.writable {
+		return ErrTxReadOnly
+	}
+	if len(key) > MaxKeySize {
+		return ErrKeyTooLarge
+	}
+	if size < 0 || size > int64(maxValueLength) {
+		return errors.New("leafdb: value too large")
+	}
+	indexes, err := b.declaredIndexes()
+	if err != nil {
+		return err
+	}
+	recorded := (b.tx.db.changefeed || b.tx.db.optimisticWrites) && !isReservedName(b.name)
+	if len(indexes) > 0 || len(b.hooks()) > 0 || recorded || b.options.Validator != "" || fitsInline(key, int(size), b.tx.mgr.PageSize(), b.options.BlobThreshold) {
+		value := make([]byte, size)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return err
+		}
+		return b.Put(key, value)
+	}
+
+	tree := b.writeTree()
+	oldSize, err := b.storedSize(tree, key)
+	if err != nil {
+		return err
+	}
+	newSize := uint64(len(key)) + uint64(size)
+	if err := b.checkQuota(oldSize, newSize); err != nil {
+		return err
+	}
+	kind := byte(pageOverflow)
+	if tree.blobThreshold > 0 {
+		kind = pageBlob
+	}
+	first, err := writeOverflowFrom(b.tx.mgr, r, int(size), kind)
+	if err != nil {
+		return err
+	}
+	tree.streamed = &streamedValue{key: key, first: first, length: uint32(size)}
+	if err := tree.set(key, streamedPlaceholder); err != nil {
+		freeOverflowPages(b.tx.mgr, first)
+		return err
+	}
+	if err := b.addToFilter(key); err != nil {
+		return err
+	}
+	b.account(oldSize, newSize)
+	return b.persistHeader()
+}
+
+// writeOverflowFrom writes the size bytes read from r, which must be more
+// than zero, to a new chain of pages of type kind and returns its first
+// page. Pages are written as they fill; if r fails, those written are freed
+// again.
+func writeOverflowFrom(store pageStore, r io.Reader, size int, kind byte) (uint64, error) {
+	pageSize := store.PageSize()
+	payload := pageSize - overflowHeaderSize
+	buf := getPageBuffer(pageSize)
+	defer putPageBuffer(buf)
+	var ids []uint64
+	id := store.AllocPage()
+	for remaining := size; remaining > 0; {
+		ids = append(ids, id)
+		chunk := min(remaining, payload)
+		clear(buf)
+		buf[0] = kind
+		_, err := io.ReadFull(r, buf[overflowHeaderSize:overflowHeaderSize+chunk])
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		remaining -= chunk
+		next := uint64(0)
+		if err == nil && remaining > 0 {
+			next = store.AllocPage()
+		}
+		binary.LittleEndian.PutUint64(buf[1:], next)
+		if err == nil {
+			err = store.WritePage(id, buf)
+		}
+		if err != nil {
+			for _, id := range ids {
+				store.FreePage(id)
+			}
+			return 0, err
+		}
+		id = next
+	}
+	return ids[0], nil
+}
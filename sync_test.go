@@ -0,0 +1,114 @@
+package leafdb_test
+
+import (
+	"fmt"
+	"maps"
+	"testing"
+	"time"
+
+	"leafdb"
+	"leafdb/testutil"
+)
+
+// syncCommits is the number of commits of syncWorkload.
+const syncCommits = 40
+
+// syncWrites calls fn with each write of commit i of syncWorkload: puts of
+// values that grow from one commit to the next and deletes, so that commits
+// free pages and reuse them. A delete has a negative size.
+func syncWrites(i int, fn func(key []byte, size int) error) error {
+	for j := range 20 {
+		k := fmt.Appendf(nil, "k%03d", (i*7+j)%150)
+		size := 200 + i*10
+		if i%3 == 2 {
+			size = -1
+		}
+		if err := fn(k, size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func syncWorkload(db *leafdb.DB) error {
+	for i := range syncCommits {
+		err := db.Write(func(tx *leafdb.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("b"))
+			if err != nil {
+				return err
+			}
+			return syncWrites(i, func(key []byte, size int) error {
+				if size < 0 {
+					return b.Delete(key)
+				}
+				return b.Put(key, make([]byte, size))
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncVerify checks that the bucket holds what it did after one of the
+// commits of syncWorkload, by the sizes of its values.
+func syncVerify(db *leafdb.DB) error {
+	got := make(map[string]int)
+	err := db.Read(func(tx *leafdb.Tx) error {
+		b := tx.Bucket([]byte("b"))
+		if b == nil {
+			return nil
+		}
+		for k, v := range b.All() {
+			got[string(k)] = len(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	want := make(map[string]int)
+	for i := 0; ; i++ {
+		if maps.Equal(got, want) {
+			return nil
+		}
+		if i == syncCommits {
+			return fmt.Errorf("bucket holds %d keys, matching no commit", len(got))
+		}
+		_ = syncWrites(i, func(key []byte, size int) error {
+			if size < 0 {
+				delete(want, string(key))
+			} else {
+				want[string(key)] = size
+			}
+			return nil
+		})
+	}
+}
+
+func TestSimulateSyncModes(t *testing.T) {
+	tests := []struct {
+		name string
+		opts *leafdb.Options
+	}{
+		{"FullSync", nil},
+		{"SyncEveryN", &leafdb.Options{Sync: leafdb.SyncEveryN, SyncEvery: 4}},
+		{"SyncEveryNPunch", &leafdb.Options{Sync: leafdb.SyncEveryN, SyncEvery: 4, PunchHoleSize: 4096}},
+		{"SyncInterval", &leafdb.Options{Sync: leafdb.SyncEveryN, SyncEvery: 1000, SyncInterval: time.Millisecond}},
+	}
+	seeds := uint64(300)
+	if testing.Short() {
+		seeds = 30
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for seed := range seeds {
+				opts := testutil.SimOptions{Seed: seed, Reorder: true, TornWrites: seed%2 == 0}
+				if err := testutil.Simulate(opts, tt.opts, syncWorkload, syncVerify); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
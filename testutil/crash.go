@@ -0,0 +1,100 @@
+package testutil
+
+import (
+	"errors"
+	"fmt"
+
+	"leafdb"
+)
+
+// TornWriteSize is how much of the write at the crash point CrashTest keeps
+// when it tears it: less than a page, as a disk that writes in sectors
+// could leave.
+const TornWriteSize = 512
+
+// CrashTest checks that a database recovers from a power cut at any point
+// of workload. It creates a database with opts in a MemFile, makes it
+// durable and runs workload on it once to count the writes it makes,
+// closing the database afterwards. Then, for every such write, it runs
+// workload again on a new database, crashing the file at that write, once
+// cleanly and once tearing the write after TornWriteSize bytes. Each time,
+// it reopens what survived, runs DB.Check and then verify, which must
+// accept the state of any prefix of the commits of workload, and closes it.
+//
+// Errors returned by workload after the crash, and by closing the crashed
+// database, are expected and ignored. The first failure to reopen, check or
+// verify is returned, naming the write and how it was cut.
+func CrashTest(opts *leafdb.Options, workload, verify func(*leafdb.DB) error) error {
+	writes, err := countWrites(opts, workload)
+	if err != nil {
+		return err
+	}
+	for n := 1; n <= writes; n++ {
+		for _, keep := range []int{0, TornWriteSize} {
+			if err := crashOnce(opts, workload, verify, n, keep); err != nil {
+				return fmt.Errorf("testutil: crash at write %d of %d, keeping %d bytes: %w", n, writes, keep, err)
+			}
+		}
+	}
+	return nil
+}
+
+// crashOnce runs workload on a new database crashing at its n-th write and
+// checks the database that survives.
+func crashOnce(opts *leafdb.Options, workload, verify func(*leafdb.DB) error, n, keep int) error {
+	f := NewMemFile(nil)
+	db, err := create(f, opts)
+	if err != nil {
+		return err
+	}
+	f.CrashAt(n, keep)
+	_ = workload(db)
+	_ = db.Close()
+	return recovered(f.Crash(), opts, verify)
+}
+
+// countWrites returns the number of writes workload makes on a new database
+// without a crash, including closing it.
+func countWrites(opts *leafdb.Options, workload func(*leafdb.DB) error) (int, error) {
+	f := NewMemFile(nil)
+	db, err := create(f, opts)
+	if err != nil {
+		return 0, err
+	}
+	start := f.Writes()
+	if err := workload(db); err != nil {
+		db.Close()
+		return 0, fmt.Errorf("testutil: workload without crash: %w", err)
+	}
+	if err := db.Close(); err != nil {
+		return 0, err
+	}
+	return f.Writes() - start, nil
+}
+
+// create opens a new database in f and makes it durable.
+func create(f leafdb.File, opts *leafdb.Options) (*leafdb.DB, error) {
+	db, err := leafdb.OpenFile(f, 0, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// recovered opens the database that survived a crash in f, checks it with
+// DB.Check and verify, and closes it.
+func recovered(f *MemFile, opts *leafdb.Options, verify func(*leafdb.DB) error) error {
+	db, err := leafdb.OpenFile(f, f.Size(), opts)
+	if err != nil {
+		return fmt.Errorf("reopen: %w", err)
+	}
+	defer db.Close()
+	if errs := db.Check(); len(errs) > 0 {
+		return fmt.Errorf("check: %w", errors.Join(errs...))
+	}
+	return verify(db)
+}
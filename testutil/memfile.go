@@ -0,0 +1,254 @@
+// Package testutil helps test code that embeds leafdb against failures of
+// the storage under it. MemFile is an in-memory leafdb.File whose writes,
+// syncs and reads can be made to fail, and which keeps apart what was
+// synced from what a power cut would lose; CrashTest runs a workload once
+// for every write it makes, cutting the power at that write, and checks
+// that the database recovers.
+package testutil
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+var (
+	// ErrInjected is returned by the operations of a MemFile that a
+	// failpoint makes fail.
+	ErrInjected = errors.New("testutil: injected failure")
+	// ErrCrashed is returned by every operation of a MemFile after a crash
+	// set with CrashAt.
+	ErrCrashed = errors.New("testutil: file crashed")
+)
+
+// MemFile is a leafdb.File held in memory, for leafdb.OpenFile. Writes and
+// truncations change what it reads at once, but only reach its durable
+// contents, those that survive Crash, when Sync is called. Failpoints make
+// chosen operations fail; they count operations from the call that sets
+// them, starting at one, and fire once.
+//
+// A MemFile is safe for concurrent use.
+type MemFile struct {
+	mu      sync.Mutex
+	data    []byte
+	durable []byte
+	// pending are the writes and truncations made since the last Sync.
+	pending []fileOp
+	writes  int
+	crashed bool
+
+	failWrite  countdown
+	failSync   countdown
+	shortRead  countdown
+	crashWrite countdown
+	crashKeep  int
+}
+
+// fileOp is a write of data at off, or a truncation to off if data is nil.
+type fileOp struct {
+	off  int64
+	data []byte
+}
+
+// countdown is a failpoint: it fires on the n-th operation it counts.
+type countdown int
+
+func (c *countdown) tick() bool {
+	if *c <= 0 {
+		return false
+	}
+	*c--
+	return *c == 0
+}
+
+// NewMemFile returns a MemFile holding a copy of data, which is taken as
+// durable.
+func NewMemFile(data []byte) *MemFile {
+	return &MemFile{
+		data:    clone(data),
+		durable: clone(data),
+	}
+}
+
+// ReadAt implements io.ReaderAt.
+func (f *MemFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.crashed {
+		return 0, ErrCrashed
+	}
+	if off < 0 {
+		return 0, errors.New("testutil: negative offset")
+	}
+	if f.shortRead.tick() {
+		n := copy(p[:len(p)/2], tail(f.data, off))
+		return n, io.ErrUnexpectedEOF
+	}
+	n := copy(p, tail(f.data, off))
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt implements io.WriterAt.
+func (f *MemFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.crashed {
+		return 0, ErrCrashed
+	}
+	if off < 0 {
+		return 0, errors.New("testutil: negative offset")
+	}
+	f.writes++
+	if f.failWrite.tick() {
+		return 0, ErrInjected
+	}
+	if f.crashWrite.tick() {
+		// The writes before this one reached the disk in order, and the
+		// power was cut while this one was written.
+		for _, op := range f.pending {
+			f.durable = op.apply(f.durable)
+		}
+		if keep := min(f.crashKeep, len(p)); keep > 0 {
+			torn := fileOp{off: off, data: clone(p[:keep])}
+			f.durable = torn.apply(f.durable)
+		}
+		f.pending = nil
+		f.crashed = true
+		return 0, ErrCrashed
+	}
+	op := fileOp{off: off, data: clone(p)}
+	f.data = op.apply(f.data)
+	f.pending = append(f.pending, op)
+	return len(p), nil
+}
+
+// Truncate changes the size of the file.
+func (f *MemFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.crashed {
+		return ErrCrashed
+	}
+	if size < 0 {
+		return errors.New("testutil: negative size")
+	}
+	op := fileOp{off: size}
+	f.data = op.apply(f.data)
+	f.pending = append(f.pending, op)
+	return nil
+}
+
+// Sync makes the contents of the file durable.
+func (f *MemFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.crashed {
+		return ErrCrashed
+	}
+	if f.failSync.tick() {
+		return ErrInjected
+	}
+	f.durable = clone(f.data)
+	f.pending = nil
+	return nil
+}
+
+// Close does nothing but report a crash; the contents stay available.
+func (f *MemFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.crashed {
+		return ErrCrashed
+	}
+	return nil
+}
+
+// Size returns the size of the file.
+func (f *MemFile) Size() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return int64(len(f.data))
+}
+
+// Writes returns the number of calls to WriteAt so far, including those that
+// failed.
+func (f *MemFile) Writes() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.writes
+}
+
+// FailWrite makes the n-th call to WriteAt from now fail with ErrInjected
+// without writing anything.
+func (f *MemFile) FailWrite(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failWrite = countdown(n)
+}
+
+// FailSync makes the n-th call to Sync from now fail with ErrInjected
+// without making anything durable.
+func (f *MemFile) FailSync(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failSync = countdown(n)
+}
+
+// ShortRead makes the n-th call to ReadAt from now read only the first half
+// of the buffer and fail with io.ErrUnexpectedEOF.
+func (f *MemFile) ShortRead(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.shortRead = countdown(n)
+}
+
+// CrashAt cuts the power at the n-th call to WriteAt from now: the writes
+// and truncations made before it become durable, as if the disk had
+// written them in order, and only the first keep bytes of the n-th write
+// do, which tears it if keep is shorter than the write. From then on, every
+// operation fails with ErrCrashed; Crash returns what survived.
+func (f *MemFile) CrashAt(n, keep int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.crashWrite = countdown(n)
+	f.crashKeep = max(keep, 0)
+}
+
+// Crash returns a new MemFile holding the durable contents of f: what would
+// be on the disk after a power cut now, or at the crash set with CrashAt if
+// it happened. f is left unchanged.
+func (f *MemFile) Crash() *MemFile {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return NewMemFile(f.durable)
+}
+
+// apply returns data after the operation.
+func (op fileOp) apply(data []byte) []byte {
+	if op.data == nil {
+		if op.off <= int64(len(data)) {
+			return data[:op.off]
+		}
+		return append(data, make([]byte, op.off-int64(len(data)))...)
+	}
+	if end := op.off + int64(len(op.data)); end > int64(len(data)) {
+		data = append(data, make([]byte, end-int64(len(data)))...)
+	}
+	copy(data[op.off:], op.data)
+	return data
+}
+
+// tail returns data from off, or nothing if off is past its end.
+func tail(data []byte, off int64) []byte {
+	if off >= int64(len(data)) {
+		return nil
+	}
+	return data[off:]
+}
+
+func clone(b []byte) []byte {
+	return append([]byte{}, b...)
+}
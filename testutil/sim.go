@@ -0,0 +1,220 @@
+package testutil
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"leafdb"
+)
+
+// SectorSize is the unit in which a SimFile with SimOptions.TornWrites
+// tears writes.
+const SectorSize = 512
+
+// SimOptions configures a SimFile. Every random choice of the simulation is
+// drawn from Seed, so a run that issues the same operations in the same
+// order makes the same choices.
+type SimOptions struct {
+	Seed uint64
+	// MaxLatency bounds the delay added to every operation, drawn uniformly
+	// below it. Operations are served one at a time, as by a disk with a
+	// single queue, so concurrent callers wait for each other's delays.
+	MaxLatency time.Duration
+	// Reorder lets a power cut keep any subset of the writes made since the
+	// last sync, reaching the disk in any order. Otherwise it keeps a
+	// prefix of them, as a disk that writes in order would.
+	Reorder bool
+	// TornWrites lets a power cut keep only the first sectors of a write it
+	// keeps: of any of them with Reorder, and of the last otherwise.
+	TornWrites bool
+}
+
+// SimFile is a leafdb.File for deterministic simulations: a MemFile whose
+// operations are delayed and whose power cuts lose the unsynced writes as
+// chosen by a seeded random source, following SimOptions. After a power
+// cut every operation fails with ErrCrashed.
+//
+// A SimFile is safe for concurrent use.
+type SimFile struct {
+	mu    sync.Mutex
+	file  *MemFile
+	opts  SimOptions
+	rng   *rand.Rand
+	cutAt countdown
+	// survived is what was left on the disk by the power cut, once it
+	// happened.
+	survived *MemFile
+}
+
+// NewSimFile returns a SimFile holding a copy of data, which is taken as
+// durable.
+func NewSimFile(data []byte, opts SimOptions) *SimFile {
+	return &SimFile{
+		file: NewMemFile(data),
+		opts: opts,
+		rng:  rand.New(rand.NewPCG(opts.Seed, opts.Seed)),
+	}
+}
+
+// File returns the MemFile under s, to set failpoints. Operations made
+// directly on it bypass the simulation.
+func (s *SimFile) File() *MemFile {
+	return s.file
+}
+
+// ReadAt implements io.ReaderAt.
+func (s *SimFile) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delay()
+	return s.file.ReadAt(p, off)
+}
+
+// WriteAt implements io.WriterAt. The write at which PowerCutAt cuts the
+// power is in flight when it happens, so the cut may keep it.
+func (s *SimFile) WriteAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delay()
+	if s.survived == nil && s.cutAt.tick() {
+		s.cut(&fileOp{off: off, data: clone(p)})
+		return 0, ErrCrashed
+	}
+	return s.file.WriteAt(p, off)
+}
+
+// Truncate changes the size of the file.
+func (s *SimFile) Truncate(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delay()
+	return s.file.Truncate(size)
+}
+
+// Sync makes the contents of the file durable.
+func (s *SimFile) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delay()
+	return s.file.Sync()
+}
+
+// Close reports a power cut, like MemFile.Close.
+func (s *SimFile) Close() error {
+	return s.file.Close()
+}
+
+// Size returns the size of the file.
+func (s *SimFile) Size() int64 {
+	return s.file.Size()
+}
+
+// Writes returns the number of calls to WriteAt so far.
+func (s *SimFile) Writes() int {
+	return s.file.Writes()
+}
+
+// PowerCutAt cuts the power at the n-th call to WriteAt from now.
+func (s *SimFile) PowerCutAt(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cutAt = countdown(n)
+}
+
+// PowerCut cuts the power now, unless it was cut already, and returns a new
+// MemFile holding what survived on the disk.
+func (s *SimFile) PowerCut() *MemFile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.survived == nil {
+		s.cut(nil)
+	}
+	return s.survived.Crash()
+}
+
+// cut cuts the power while inflight, if not nil, is being written. The
+// durable contents get the writes and truncations since the last sync that
+// the options and the random source choose to keep.
+func (s *SimFile) cut(inflight *fileOp) {
+	f := s.file
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ops := f.pending
+	if inflight != nil {
+		ops = append(ops, *inflight)
+	}
+	var kept []fileOp
+	if s.opts.Reorder {
+		for _, op := range ops {
+			if s.rng.IntN(2) == 0 {
+				kept = append(kept, s.tear(op))
+			}
+		}
+		s.rng.Shuffle(len(kept), func(i, j int) {
+			kept[i], kept[j] = kept[j], kept[i]
+		})
+	} else if n := s.rng.IntN(len(ops) + 1); n > 0 {
+		// Only the write the disk was busy with when the power went can
+		// be torn.
+		kept = append(ops[:n-1:n-1], s.tear(ops[n-1]))
+	}
+	image := clone(f.durable)
+	for _, op := range kept {
+		image = op.apply(image)
+	}
+	s.survived = NewMemFile(image)
+	f.pending = nil
+	f.crashed = true
+}
+
+// tear returns op, or with SimOptions.TornWrites and as the random source
+// chooses, only its first sectors if it is a write.
+func (s *SimFile) tear(op fileOp) fileOp {
+	sectors := (len(op.data) + SectorSize - 1) / SectorSize
+	if !s.opts.TornWrites || sectors < 2 || s.rng.IntN(2) == 0 {
+		return op
+	}
+	op.data = op.data[:s.rng.IntN(sectors-1)*SectorSize+SectorSize]
+	return op
+}
+
+// delay sleeps for a latency drawn below SimOptions.MaxLatency.
+func (s *SimFile) delay() {
+	if s.opts.MaxLatency > 0 {
+		time.Sleep(time.Duration(s.rng.Int64N(int64(s.opts.MaxLatency))))
+	}
+}
+
+// Simulate runs workload on a new database with dbOpts in a SimFile with
+// opts, cuts the power at a write chosen from opts.Seed, or after workload
+// if it makes fewer writes, then reopens what survived and checks it as
+// CrashTest does. Runs of a workload that issues its operations in a fixed
+// order are reproduced by their seed, which the error names; running many
+// seeds explores crashes like CrashTest does, with the unsynced writes
+// lost in different ways.
+func Simulate(opts SimOptions, dbOpts *leafdb.Options, workload, verify func(*leafdb.DB) error) error {
+	f := NewSimFile(nil, opts)
+	db, err := create(f, dbOpts)
+	if err != nil {
+		return err
+	}
+	// The write to cut at is drawn apart from the file's own choices, and
+	// is within the writes a run of workload without a crash makes, plus
+	// one for after it.
+	writes, err := countWrites(dbOpts, workload)
+	if err != nil {
+		db.Close()
+		return err
+	}
+	n := rand.New(rand.NewPCG(opts.Seed, ^opts.Seed)).IntN(writes+1) + 1
+	f.PowerCutAt(n)
+	_ = workload(db)
+	survived := f.PowerCut()
+	_ = db.Close()
+	if err := recovered(survived, dbOpts, verify); err != nil {
+		return fmt.Errorf("testutil: simulation with seed %d, power cut at write %d: %w", opts.Seed, n, err)
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"slices"
 )
 
 type pageStore interface {
@@ -12,11 +13,61 @@ type pageStore interface {
 	WritePage(id uint64, buf []byte) error
 	AllocPage() uint64
 	FreePage(id uint64)
+	VerifyChecksums() bool
+}
+
+// nodeCache is implemented by page stores that keep decoded nodes, so that
+// pages read repeatedly are not decoded each time. Cached nodes are shared
+// and must not be modified.
+type nodeCache interface {
+	cachedNode(id uint64) *node
+	cacheNode(n *node)
 }
 
 type bptree struct {
 	root  *uint64
 	store pageStore
+	// fillPercent is how full a split leaves every node but the last; zero
+	// uses DefaultFillPercent.
+	fillPercent float64
+	// noCopy makes get and cursors return keys and values without copying
+	// them, for Options.NoCopyReads.
+	noCopy bool
+	// streamed is the value written by Bucket.PutReader, if any, which
+	// leaves reference instead of writing overflow pages for it.
+	streamed *streamedValue
+	// blobThreshold is the BucketOptions.BlobThreshold of the bucket whose
+	// pairs the tree holds: values of at least that many bytes are stored
+	// in blob chains instead of the leaf. Zero only moves the values that
+	// do not fit in the leaf out of it.
+	blobThreshold int
+	// chains tracks the chains of the write in progress, if any.
+	chains *chainRefs
+}
+
+// chainRefs tracks the overflow and blob chains of the leaves a write reads
+// and writes, so that a rewritten leaf references the chains of the values
+// it keeps instead of copying them. Each chain in a tree is referenced by
+// one leaf. The write counts the references the leaves it writes add and
+// those the leaves it frees remove, and drops the chains that are left
+// without any once it is done.
+type chainRefs struct {
+	// values maps the first byte of each out-of-line value of the leaves
+	// read to its chain. Stored values are never modified in place, so a
+	// leaf holding the same slice holds the same value.
+	values map[*byte]uint64
+	// delta is the change in references to each chain. fresh holds the
+	// chains the write created, which had none before it.
+	delta map[uint64]int
+	fresh map[uint64]bool
+}
+
+// childRef is a page, the smallest key below it and the number of pairs
+// below it.
+type childRef struct {
+	pageID uint64
+	first  []byte
+	count  uint64
 }
 
 type node struct {
@@ -25,13 +76,66 @@ type node struct {
 	keys     [][]byte
 	values   [][]byte
 	children []uint64
+	// counts holds the number of pairs below each child of a branch, or
+	// unknownCount for those of branches written before counts were stored
+	// that were not rewritten since.
+	counts   []uint64
 	next     uint64
 	overflow []uint64
 }
 
+// unknownCount is the count of a subtree whose pairs were never counted.
+const unknownCount = ^uint64(0)
+
+// count returns the number of pairs below n, or unknownCount.
+func (n *node) count() uint64 {
+	if n.isLeaf {
+		return uint64(len(n.keys))
+	}
+	var count uint64
+	for _, c := range n.counts {
+		if c == unknownCount {
+			return unknownCount
+		}
+		count += c
+	}
+	return count
+}
+
+// countOf returns the number of pairs below page id, or unknownCount. The
+// pages a write just wrote are in the transaction's node cache, or are
+// leaves whose count is read from their header.
+func countOf(store pageStore, id uint64) uint64 {
+	n, keys, err := readCountPage(store, id)
+	switch {
+	case err != nil:
+		return unknownCount
+	case n == nil:
+		return uint64(keys)
+	}
+	return n.count()
+}
+
+// DefaultFillPercent is how full a node split leaves its left part, unless
+// Bucket.SetFillPercent sets another value.
+const DefaultFillPercent = 0.5
+
+// minFillPercent and maxFillPercent bound the accepted fill percents.
+const (
+	minFillPercent = 0.1
+	maxFillPercent = 1.0
+)
+
 const valueOverflowFlag = uint32(1 << 31)
 const maxValueLength = int(^valueOverflowFlag)
 
+// MaxKeySize is the largest key, or bucket name, that can be stored. Keys
+// are never spilled to overflow pages, so the limit is chosen so that a
+// branch page always has room for at least two separator keys. A branch of
+// two keys this large has no room for the counts of its children, which it
+// goes without.
+const MaxKeySize = (defaultPageSize-nodeHeaderSize-3*8)/2 - 2
+
 type cursorFrame struct {
 	node  *node
 	index int
@@ -41,50 +145,148 @@ func newBPTree(root *uint64, store pageStore) *bptree {
 	return &bptree{root: root, store: store}
 }
 
+// result returns b as get and cursors hand it out: copied unless t.noCopy
+// is set.
+func (t *bptree) result(b []byte) []byte {
+	if t.noCopy {
+		return b
+	}
+	return cloneBytes(b)
+}
+
+// get returns a copy of the value of key.
 func (t *bptree) get(key []byte) ([]byte, bool, error) {
-	leaf, err := t.findLeaf(key)
-	if err != nil {
+	e, ok, err := t.lookup(key)
+	if err != nil || !ok {
 		return nil, false, err
 	}
-	idx, ok := findKeyIndex(leaf.keys, key)
-	if !ok {
-		return nil, false, nil
+	if e.node != nil {
+		return t.result(e.node.values[e.index]), true, nil
+	}
+	if e.empty {
+		return []byte{}, true, nil
+	}
+	value, err := readSlotValue(t.store, e.page, e.pos, !t.noCopy)
+	return value, err == nil, atPage(err, e.id)
+}
+
+// valueSize returns the length of the value of key without reading it.
+func (t *bptree) valueSize(key []byte) (int, bool, error) {
+	e, ok, err := t.lookup(key)
+	if err != nil || !ok {
+		return 0, false, err
+	}
+	if e.node != nil {
+		return len(e.node.values[e.index]), true, nil
+	}
+	if e.empty {
+		return 0, true, nil
+	}
+	if e.pos+4 > len(e.page) {
+		return 0, false, atPage(corrupted(e.pos, "corrupted value length"), e.id)
+	}
+	return int(binary.LittleEndian.Uint32(e.page[e.pos:]) &^ valueOverflowFlag), true, nil
+}
+
+// leafEntry is where lookup found a key: at index of a decoded leaf node,
+// or, for a leaf searched in place, in page id, cut off before its slot
+// directory, with the length field of its value at pos, unless empty
+// reports that the value is empty and stored without one.
+type leafEntry struct {
+	node  *node
+	index int
+	id    uint64
+	page  []byte
+	pos   int
+	empty bool
+}
+
+// lookup finds the entry of key. Unless the store caches them decoded
+// already, branches and leaves with a slot directory are searched in their
+// pages, without decoding their other entries.
+func (t *bptree) lookup(key []byte) (leafEntry, bool, error) {
+	cache, _ := t.store.(nodeCache)
+	id := *t.root
+	for {
+		var n *node
+		if cache != nil {
+			n = cache.cachedNode(id)
+		}
+		if n == nil {
+			buf, err := t.store.ReadPage(id)
+			if err != nil {
+				return leafEntry{}, false, err
+			}
+			if child, searched, err := searchBranchPage(t.store, buf, key); searched {
+				if err != nil {
+					return leafEntry{}, false, atPage(err, id)
+				}
+				id = child
+				continue
+			}
+			if e, ok, searched, err := searchLeafPage(t.store, buf, key); searched {
+				e.id = id
+				return e, ok, atPage(err, id)
+			}
+			if n, err = decodeNodePage(t.store, id, buf); err != nil {
+				return leafEntry{}, false, err
+			}
+			if cache != nil {
+				cache.cacheNode(n)
+			}
+		}
+		if !n.isLeaf {
+			id = n.children[findChildIndex(n.keys, key)]
+			continue
+		}
+		idx, ok := findKeyIndex(n.keys, key)
+		return leafEntry{node: n, index: idx}, ok, nil
 	}
-	return cloneBytes(leaf.values[idx]), true, nil
 }
 
 func (t *bptree) set(key, value []byte) error {
-	newID, promoted, rightID, split, err := t.insert(*t.root, key, value)
+	return t.update(key, func([]byte) ([]byte, error) {
+		return value, nil
+	})
+}
+
+// update sets key to the value fn returns for its current value, or for nil
+// if key is absent, in a single descent. fn runs before any page is written,
+// so an error from it leaves the tree unchanged.
+func (t *bptree) update(key []byte, fn func(old []byte) ([]byte, error)) error {
+	t.trackChains()
+	newID, siblings, err := t.insert(*t.root, key, fn)
 	if err != nil {
 		return err
 	}
-	if split {
-		rootID := t.store.AllocPage()
+	// A split root gets a new root above it, which may split in turn.
+	for len(siblings) > 0 {
 		root := &node{
-			pageID:   rootID,
-			isLeaf:   false,
-			keys:     [][]byte{promoted},
-			children: []uint64{newID, rightID},
+			pageID:   t.store.AllocPage(),
+			children: []uint64{newID},
+			counts:   []uint64{countOf(t.store, newID)},
 		}
-		buf, err := encodeNodePage(t.store.PageSize(), root)
-		if err != nil {
-			return err
+		for _, s := range siblings {
+			root.keys = append(root.keys, s.first)
+			root.children = append(root.children, s.pageID)
+			root.counts = append(root.counts, s.count)
 		}
-		if err := t.store.WritePage(rootID, buf); err != nil {
+		if newID, siblings, err = t.writeSplit(root); err != nil {
 			return err
 		}
-		*t.root = rootID
-		return nil
 	}
 	*t.root = newID
+	t.dropChains()
 	return nil
 }
 
 func (t *bptree) delete(key []byte) (bool, error) {
+	t.trackChains()
 	newID, deleted, err := t.deleteRecursive(*t.root, key)
 	if err != nil {
 		return false, err
 	}
+	t.dropChains()
 	if !deleted {
 		return false, nil
 	}
@@ -101,6 +303,49 @@ func (t *bptree) delete(key []byte) (bool, error) {
 	return true, nil
 }
 
+// trackChains starts tracking the chains of a write, see chainRefs.
+func (t *bptree) trackChains() {
+	t.chains = &chainRefs{
+		values: make(map[*byte]uint64),
+		delta:  make(map[uint64]int),
+		fresh:  make(map[uint64]bool),
+	}
+}
+
+// readNode is readNode for a write, which records the chains of the values
+// of leaves so that they can be kept when the leaf is rewritten.
+func (t *bptree) readNode(pageID uint64) (*node, error) {
+	n, err := readNode(t.store, pageID)
+	if err != nil || t.chains == nil || !n.isLeaf {
+		return n, err
+	}
+	for i, first := range n.overflow {
+		if first != 0 && len(n.values[i]) > 0 {
+			t.chains.values[&n.values[i][0]] = first
+		}
+	}
+	return n, nil
+}
+
+// dropChains ends the tracking of the chains of a write that succeeded and
+// drops those that no leaf references anymore.
+func (t *bptree) dropChains() {
+	var dropped []uint64
+	for first, delta := range t.chains.delta {
+		if !t.chains.fresh[first] {
+			delta++
+		}
+		if delta == 0 {
+			dropped = append(dropped, first)
+		}
+	}
+	slices.Sort(dropped)
+	for _, first := range dropped {
+		dropChain(t.store, first)
+	}
+	t.chains = nil
+}
+
 func (t *bptree) findLeaf(key []byte) (*node, error) {
 	currentID := *t.root
 	for {
@@ -130,73 +375,230 @@ func (t *bptree) firstLeaf() (*node, error) {
 	}
 }
 
-func (t *bptree) insert(pageID uint64, key, value []byte) (uint64, []byte, uint64, bool, error) {
+func (t *bptree) lastLeaf() (*node, error) {
+	currentID := *t.root
+	for {
+		n, err := readNode(t.store, currentID)
+		if err != nil {
+			return nil, err
+		}
+		if n.isLeaf {
+			return n, nil
+		}
+		currentID = n.children[len(n.children)-1]
+	}
+}
+
+// edge returns the smallest (or largest when last is set) key/value pair in
+// the tree. Only the edge path is read unless an edge leaf was left empty by
+// a merge that did not fit, in which case the neighbouring subtrees are
+// tried in order.
+func (t *bptree) edge(last bool) ([]byte, []byte, bool, error) {
+	leaf, err := t.firstLeaf()
+	if last {
+		leaf, err = t.lastLeaf()
+	}
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if len(leaf.keys) > 0 {
+		idx := 0
+		if last {
+			idx = len(leaf.keys) - 1
+		}
+		return t.result(leaf.keys[idx]), t.result(leaf.values[idx]), true, nil
+	}
+	return t.edgeFrom(*t.root, last)
+}
+
+func (t *bptree) edgeFrom(pageID uint64, last bool) ([]byte, []byte, bool, error) {
 	n, err := readNode(t.store, pageID)
 	if err != nil {
-		return 0, nil, 0, false, err
+		return nil, nil, false, err
+	}
+	if n.isLeaf {
+		if len(n.keys) == 0 {
+			return nil, nil, false, nil
+		}
+		idx := 0
+		if last {
+			idx = len(n.keys) - 1
+		}
+		return t.result(n.keys[idx]), t.result(n.values[idx]), true, nil
+	}
+	for i := range n.children {
+		child := n.children[i]
+		if last {
+			child = n.children[len(n.children)-1-i]
+		}
+		key, value, ok, err := t.edgeFrom(child, last)
+		if err != nil || ok {
+			return key, value, ok, err
+		}
+	}
+	return nil, nil, false, nil
+}
+
+// insert updates key below page pageID and returns the page that replaces
+// it, followed by the new right siblings if the page had to split.
+func (t *bptree) insert(pageID uint64, key []byte, fn func(old []byte) ([]byte, error)) (uint64, []childRef, error) {
+	n, err := t.readNode(pageID)
+	if err != nil {
+		return 0, nil, err
 	}
 	if n.isLeaf {
-		return t.insertLeaf(n, key, value)
+		return t.insertLeaf(n, key, fn)
 	}
 
 	idx := findChildIndex(n.keys, key)
 	childID := n.children[idx]
-	newChildID, promoted, rightID, split, err := t.insert(childID, key, value)
+	newChildID, siblings, err := t.insert(childID, key, fn)
 	if err != nil {
-		return 0, nil, 0, false, err
+		return 0, nil, err
 	}
-	return t.insertBranch(n, idx, newChildID, promoted, rightID, split)
+	return t.insertBranch(n, idx, newChildID, siblings)
 }
 
-func (t *bptree) splitLeaf(n *node) (uint64, []byte, uint64, bool, error) {
-	mid := len(n.keys) / 2
-	right := &node{
-		pageID: t.store.AllocPage(),
-		isLeaf: true,
-		keys:   append([][]byte{}, n.keys[mid:]...),
-		values: append([][]byte{}, n.values[mid:]...),
-		next:   n.next,
+// fillLimit returns the number of bytes a split fills nodes to.
+func (t *bptree) fillLimit() int {
+	fill := t.fillPercent
+	if fill == 0 {
+		fill = DefaultFillPercent
 	}
+	fill = min(max(fill, minFillPercent), maxFillPercent)
+	return int(float64(t.store.PageSize()) * fill)
+}
 
-	n.keys = n.keys[:mid]
-	n.values = n.values[:mid]
-	n.next = right.pageID
-
-	if err := t.writeNode(n); err != nil {
-		return 0, nil, 0, false, err
+// writeSplit writes n, first splitting it if it does not fit in a page. It
+// returns the page of n and the new right siblings.
+func (t *bptree) writeSplit(n *node) (uint64, []childRef, error) {
+	if nodeFits(t.store.PageSize(), t.blobThreshold, n) {
+		return n.pageID, nil, t.writeNode(n)
 	}
-	if err := t.writeNode(right); err != nil {
-		return 0, nil, 0, false, err
+	if n.isLeaf {
+		return t.splitLeaf(n)
 	}
-	return n.pageID, cloneBytes(right.keys[0]), right.pageID, true, nil
+	return t.splitBranch(n)
 }
 
-func (t *bptree) splitBranch(n *node) (uint64, []byte, uint64, bool, error) {
-	mid := len(n.keys) / 2
-	promoted := n.keys[mid]
-
-	right := &node{
-		pageID:   t.store.AllocPage(),
-		isLeaf:   false,
-		keys:     append([][]byte{}, n.keys[mid+1:]...),
-		children: append([]uint64{}, n.children[mid+1:]...),
+// splitLeaf splits a leaf that does not fit in a page by bytes rather than
+// by key count: every part but the last is filled up to the fill limit, and
+// parts are cut off until the rest fits. An insert into a full leaf usually
+// makes two parts, but one large entry between large neighbours can take a
+// page of its own.
+func (t *bptree) splitLeaf(n *node) (uint64, []childRef, error) {
+	pageSize := t.store.PageSize()
+	limit := t.fillLimit()
+	var parts []*node
+	rest := n
+	for !nodeFits(pageSize, t.blobThreshold, rest) {
+		end, err := leafSplitIndex(rest, pageSize, t.blobThreshold, limit)
+		if err != nil {
+			return 0, nil, err
+		}
+		parts = append(parts, &node{
+			isLeaf: true,
+			keys:   rest.keys[:end:end],
+			values: rest.values[:end:end],
+		})
+		rest = &node{isLeaf: true, keys: rest.keys[end:], values: rest.values[end:]}
+	}
+	parts = append(parts, rest)
+
+	parts[0].pageID = n.pageID
+	for i := 1; i < len(parts); i++ {
+		parts[i].pageID = t.store.AllocPage()
+		parts[i-1].next = parts[i].pageID
+	}
+	parts[len(parts)-1].next = n.next
+	siblings := make([]childRef, 0, len(parts)-1)
+	for i, part := range parts {
+		if err := t.writeNode(part); err != nil {
+			return 0, nil, err
+		}
+		if i > 0 {
+			siblings = append(siblings, childRef{pageID: part.pageID, first: cloneBytes(part.keys[0]), count: part.count()})
+		}
 	}
+	return n.pageID, siblings, nil
+}
 
-	n.keys = n.keys[:mid]
-	n.children = n.children[:mid+1]
+// leafSplitIndex returns how many of the entries of n, which has at least
+// two, to put in the next part of a split: as many as fit in limit bytes, at
+// least one, and never all of them.
+func leafSplitIndex(n *node, pageSize, blob, limit int) (int, error) {
+	first := n.keys[0]
+	prefix := len(first)
+	entries := 0
+	for i, key := range n.keys {
+		entry, _, err := leafEntrySize(key, n.values[i], pageSize, blob)
+		if err != nil {
+			return 0, err
+		}
+		entries += entry
+		prefix = commonPrefixLen(first[:prefix], key)
+		// The size of the first i+1 entries, as leafSize computes it.
+		size := nodeHeaderSize + entries
+		if i*prefix > 2 {
+			size += 2 + prefix - (i+1)*prefix
+		}
+		if i > 0 && size > limit {
+			return i, nil
+		}
+	}
+	return len(n.keys) - 1, nil
+}
 
-	if err := t.writeNode(n); err != nil {
-		return 0, nil, 0, false, err
+func commonPrefixLen(a, b []byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
 	}
-	if err := t.writeNode(right); err != nil {
-		return 0, nil, 0, false, err
+	return n
+}
+
+// splitBranch splits a branch that does not fit in a page into parts filled
+// up to the fill limit, promoting the key between each pair of parts.
+func (t *bptree) splitBranch(n *node) (uint64, []childRef, error) {
+	pageSize := t.store.PageSize()
+	limit := t.fillLimit()
+	var (
+		parts    []*node
+		promoted [][]byte
+	)
+	keys, children, counts := n.keys, n.children, n.counts
+	for !nodeFits(pageSize, 0, &node{keys: keys, children: children}) {
+		// Each part keeps at least one key, and so does the rest. Each
+		// child takes its page ID and its count.
+		end := 1
+		size := nodeHeaderSize + 2*16 + 2 + len(keys[0])
+		for end < len(keys)-2 && size+16+2+len(keys[end]) <= limit {
+			size += 16 + 2 + len(keys[end])
+			end++
+		}
+		parts = append(parts, &node{keys: keys[:end:end], children: children[: end+1 : end+1], counts: counts[: end+1 : end+1]})
+		promoted = append(promoted, cloneBytes(keys[end]))
+		keys, children, counts = keys[end+1:], children[end+1:], counts[end+1:]
 	}
+	parts = append(parts, &node{keys: keys, children: children, counts: counts})
 
-	return n.pageID, cloneBytes(promoted), right.pageID, true, nil
+	siblings := make([]childRef, 0, len(parts)-1)
+	for i, part := range parts {
+		if i == 0 {
+			part.pageID = n.pageID
+		} else {
+			part.pageID = t.store.AllocPage()
+			siblings = append(siblings, childRef{pageID: part.pageID, first: promoted[i-1], count: part.count()})
+		}
+		if err := t.writeNode(part); err != nil {
+			return 0, nil, err
+		}
+	}
+	return n.pageID, siblings, nil
 }
 
 func (t *bptree) deleteRecursive(pageID uint64, key []byte) (uint64, bool, error) {
-	n, err := readNode(t.store, pageID)
+	n, err := t.readNode(pageID)
 	if err != nil {
 		return 0, false, err
 	}
@@ -216,73 +618,219 @@ func (t *bptree) deleteRecursive(pageID uint64, key []byte) (uint64, bool, error
 	return t.deleteBranch(n, idx, newChildID)
 }
 
+// readNode returns the node stored in page pageID, from the store's node
+// cache if it has one. The node must not be modified.
 func readNode(store pageStore, pageID uint64) (*node, error) {
+	cache, _ := store.(nodeCache)
+	if cache != nil {
+		if n := cache.cachedNode(pageID); n != nil {
+			return n, nil
+		}
+	}
+	n, err := decodeNode(store, pageID)
+	if err != nil {
+		return nil, err
+	}
+	if cache != nil {
+		cache.cacheNode(n)
+	}
+	return n, nil
+}
+
+func decodeNode(store pageStore, pageID uint64) (*node, error) {
+	buf, err := store.ReadPage(pageID)
+	if err != nil {
+		return nil, err
+	}
+	return decodeNodePage(store, pageID, buf)
+}
+
+// decodeNodePage decodes buf, the contents of page pageID.
+func decodeNodePage(store pageStore, pageID uint64, buf []byte) (*node, error) {
+	n, err := decodePage(store, pageID, buf, false)
+	return n, atPage(err, pageID)
+}
+
+// readNodeKeys is readNode for scans that only need keys. A leaf that is
+// not cached is decoded without its values, which are neither copied nor
+// read from their overflow or blob chains, and is not cached since it is
+// incomplete; its values are nil.
+func readNodeKeys(store pageStore, pageID uint64) (*node, error) {
+	cache, _ := store.(nodeCache)
+	if cache != nil {
+		if n := cache.cachedNode(pageID); n != nil {
+			return n, nil
+		}
+	}
 	buf, err := store.ReadPage(pageID)
 	if err != nil {
 		return nil, err
 	}
-	if len(buf) < store.PageSize() {
-		return nil, errors.New("leafdb: short page")
+	n, err := decodePage(store, pageID, buf, true)
+	if err != nil {
+		return nil, atPage(err, pageID)
+	}
+	if cache != nil && !n.isLeaf {
+		cache.cacheNode(n)
+	}
+	return n, nil
+}
+
+// decodePage decodes node page pageID from buf, skipping the values of a
+// leaf if keysOnly is set.
+func decodePage(store pageStore, pageID uint64, buf []byte, keysOnly bool) (*node, error) {
+	if len(buf) < store.PageSize() || len(buf) < nodeHeaderSize {
+		return nil, corrupted(len(buf), "short page")
 	}
 	kind := buf[0]
 	keyCount := int(binary.LittleEndian.Uint16(buf[1:]))
 	next := binary.LittleEndian.Uint64(buf[3:])
-	pos := nodeHeaderSize
+	flags := binary.LittleEndian.Uint16(buf[11:])
+	if flags&^(nodeFlagsLeaf|nodeFlagsBranch) != 0 {
+		return nil, corrupted(11, "unsupported node page flags")
+	}
+	pos := nodeHeaderSizeV3
+	if flags&nodeFlagChecksum != 0 {
+		pos = nodeHeaderSize
+		if store.VerifyChecksums() && binary.LittleEndian.Uint32(buf[13:]) != nodeChecksum(buf) {
+			return nil, checksumMismatch()
+		}
+	}
 
 	switch kind {
 	case pageLeaf:
-		return decodeLeafNode(store, pageID, next, keyCount, buf, pos)
+		if flags&^nodeFlagsLeaf != 0 {
+			return nil, corrupted(11, "invalid leaf page flags")
+		}
+		return decodeLeafNode(store, pageID, next, keyCount, buf, pos, flags, keysOnly)
 	case pageBranch:
-		return decodeBranchNode(pageID, keyCount, buf, pos)
+		if flags&^nodeFlagsBranch != 0 {
+			return nil, corrupted(11, "invalid branch page flags")
+		}
+		return decodeBranchNode(pageID, keyCount, buf, pos, flags)
 	default:
-		return nil, errors.New("leafdb: invalid node page")
+		return nil, corrupted(0, "invalid node page type")
 	}
 }
 
 func encodeNodePage(pageSize int, n *node) ([]byte, error) {
-	buf := make([]byte, pageSize)
+	buf := getPageBuffer(pageSize)
+	var err error
 	if n.isLeaf {
 		buf[0] = pageLeaf
-		return encodeLeafPage(buf, n)
+		buf, err = encodeLeafPage(buf, n)
+	} else {
+		buf[0] = pageBranch
+		buf, err = encodeBranchPage(buf, n)
 	}
-	buf[0] = pageBranch
-	return encodeBranchPage(buf, n)
+	if err != nil {
+		return nil, err
+	}
+	sealNodePage(buf)
+	return buf, nil
 }
 
-func nodeFits(pageSize int, n *node) bool {
-	size := nodeHeaderSize
+// nodeFits reports whether n fits in a page. blob is the blob threshold of
+// the tree, see bptree.blobThreshold.
+func nodeFits(pageSize, blob int, n *node) bool {
+	size, err := nodeSize(pageSize, blob, n)
+	if !n.isLeaf && len(n.keys) < 3 {
+		// A branch too small to split goes without counts if needed; see
+		// MaxKeySize.
+		size -= 8 * len(n.children)
+	}
+	return err == nil && size <= pageSize
+}
+
+// nodeSize returns the size of n encoded in a page.
+func nodeSize(pageSize, blob int, n *node) (int, error) {
 	if n.isLeaf {
-		for i, key := range n.keys {
-			entrySize, _, err := leafEntrySize(key, n.values[i], pageSize)
-			if err != nil {
-				return false
-			}
-			size += entrySize
-		}
-		return size <= pageSize
+		return leafSize(pageSize, blob, n)
 	}
-	size += len(n.children) * 8
+	size := nodeHeaderSize
+	size += len(n.children) * 16
 	for _, key := range n.keys {
 		size += 2 + len(key)
 	}
-	return size <= pageSize
+	return size, nil
+}
+
+// leafSize returns the encoded size of leaf n, including its shared key
+// prefix.
+func leafSize(pageSize, blob int, n *node) (int, error) {
+	prefix := leafPrefixLen(n.keys)
+	size := nodeHeaderSize
+	if prefix > 0 {
+		size += 2 + prefix
+	}
+	for i, key := range n.keys {
+		entrySize, _, err := leafEntrySize(key, n.values[i], pageSize, blob)
+		if err != nil {
+			return 0, err
+		}
+		size += entrySize - prefix
+	}
+	return size, nil
 }
 
-func leafEntrySize(key, value []byte, pageSize int) (int, bool, error) {
+// leafPrefixLen returns the length of the prefix shared by the sorted keys
+// of a leaf, or zero if storing it separately would not save space. The
+// inline/overflow choice of each entry is made on its full key, so a leaf
+// with a shared prefix is never larger than one without.
+func leafPrefixLen(keys [][]byte) int {
+	if len(keys) < 2 {
+		return 0
+	}
+	n := commonPrefixLen(keys[0], keys[len(keys)-1])
+	if (len(keys)-1)*n <= 2 {
+		return 0
+	}
+	return n
+}
+
+// writeLeafPrefix stores the shared key prefix of leaf n, if any, after the
+// header and returns the position of the first entry and the prefix length.
+func writeLeafPrefix(buf []byte, n *node) (int, int, error) {
+	prefix := leafPrefixLen(n.keys)
+	if prefix == 0 {
+		return nodeHeaderSize, 0, nil
+	}
+	binary.LittleEndian.PutUint16(buf[11:], nodeFlagPrefix)
+	pos, err := writeKey(buf, nodeHeaderSize, n.keys[0][:prefix])
+	return pos, prefix, err
+}
+
+// leafEntrySize returns the size an entry takes in a leaf page, including
+// its slot, and whether its value is moved to an overflow or blob chain.
+func leafEntrySize(key, value []byte, pageSize, blob int) (int, bool, error) {
+	if len(key) > MaxKeySize {
+		return 0, false, ErrKeyTooLarge
+	}
 	if len(value) > maxValueLength {
 		return 0, false, errors.New("leafdb: value too large")
 	}
-	inlineSize := 2 + len(key) + 4 + len(value)
-	if nodeHeaderSize+inlineSize <= pageSize {
-		return inlineSize, false, nil
+	if len(value) == 0 {
+		return 2 + len(key) + leafSlotSize, false, nil
+	}
+	if fitsInline(key, len(value), pageSize, blob) {
+		return 2 + len(key) + 4 + len(value) + leafSlotSize, false, nil
 	}
-	overflowSize := 2 + len(key) + 4 + 8
+	overflowSize := 2 + len(key) + 4 + 8 + leafSlotSize
 	if nodeHeaderSize+overflowSize > pageSize {
-		return 0, false, errors.New("leafdb: key too large")
+		return 0, false, ErrKeyTooLarge
 	}
 	return overflowSize, true, nil
 }
 
+// fitsInline reports whether a value of length bytes is stored in the leaf
+// with key rather than in a chain, in a tree of blob threshold blob.
+func fitsInline(key []byte, length, pageSize, blob int) bool {
+	if blob > 0 && length >= blob {
+		return false
+	}
+	return nodeHeaderSize+2+len(key)+4+length+leafSlotSize <= pageSize
+}
+
 func findChildIndex(keys [][]byte, key []byte) int {
 	low, high := 0, len(keys)
 	for low < high {
@@ -313,7 +861,19 @@ func findKeyIndex(keys [][]byte, key []byte) (int, bool) {
 	return low, false
 }
 
+// writeKeyValue writes an entry of a leaf, flagging the page if the value
+// is empty and stored compactly.
 func writeKeyValue(buf []byte, pos int, key, value []byte) (int, error) {
+	if len(value) == 0 {
+		if pos+2+len(key) > len(buf) {
+			return pos, errors.New("leafdb: node too large for page")
+		}
+		flags := binary.LittleEndian.Uint16(buf[11:])
+		binary.LittleEndian.PutUint16(buf[11:], flags|nodeFlagEmptyValues)
+		binary.LittleEndian.PutUint16(buf[pos:], uint16(len(key))|keyEmptyValue)
+		copy(buf[pos+2:], key)
+		return pos + 2 + len(key), nil
+	}
 	if pos+2+len(key)+4+len(value) > len(buf) {
 		return pos, errors.New("leafdb: node too large for page")
 	}
@@ -356,12 +916,12 @@ func writeKey(buf []byte, pos int, key []byte) (int, error) {
 
 func readKey(buf []byte, pos int) ([]byte, int, error) {
 	if pos+2 > len(buf) {
-		return nil, pos, errors.New("leafdb: corrupted key length")
+		return nil, pos, corrupted(pos, "corrupted key length")
 	}
 	length := int(binary.LittleEndian.Uint16(buf[pos:]))
 	pos += 2
 	if pos+length > len(buf) {
-		return nil, pos, errors.New("leafdb: corrupted key data")
+		return nil, pos, corrupted(pos, "corrupted key data")
 	}
 	key := make([]byte, length)
 	copy(key, buf[pos:pos+length])
@@ -369,44 +929,77 @@ func readKey(buf []byte, pos int) ([]byte, int, error) {
 	return key, pos, nil
 }
 
+// readLeafKey reads the key of a leaf entry, stored without prefix, and
+// returns it in full. In a page with nodeFlagEmptyValues, given as flags,
+// it also reports whether the entry has an empty value stored compactly.
+func readLeafKey(buf []byte, pos int, prefix []byte, flags uint16) ([]byte, bool, int, error) {
+	if pos+2 > len(buf) {
+		return nil, false, pos, corrupted(pos, "corrupted key length")
+	}
+	length := int(binary.LittleEndian.Uint16(buf[pos:]))
+	empty := flags&nodeFlagEmptyValues != 0 && length&keyEmptyValue != 0
+	if empty {
+		length &^= keyEmptyValue
+	}
+	pos += 2
+	if pos+length > len(buf) {
+		return nil, false, pos, corrupted(pos, "corrupted key data")
+	}
+	key := make([]byte, len(prefix)+length)
+	copy(key, prefix)
+	copy(key[len(prefix):], buf[pos:pos+length])
+	pos += length
+	return key, empty, pos, nil
+}
+
 func readOverflowPages(store pageStore, first uint64, length uint32) ([]byte, error) {
 	if first == 0 || length == 0 {
 		return []byte{}, nil
 	}
 	pageSize := store.PageSize()
 	payload := pageSize - overflowHeaderSize
-	out := make([]byte, length)
+	// The value grows as its pages are read rather than being allocated
+	// up front, so that a corrupted length costs no more memory than the
+	// chain really holds.
+	out := make([]byte, 0, min(int(length), 1<<20))
 	remaining := int(length)
-	offset := 0
 	pageID := first
+	// A chain that loops back on itself would be read over and over until
+	// length runs out. As in Brent's algorithm, the page reached after each
+	// power of two steps is marked, and reaching it again is a loop.
+	mark, sinceMark, nextMark := first, 0, 1
 	for remaining > 0 {
 		buf, err := store.ReadPage(pageID)
 		if err != nil {
 			return nil, err
 		}
-		if len(buf) < pageSize {
-			return nil, errors.New("leafdb: invalid overflow page")
-		}
-		if buf[0] != pageOverflow {
-			return nil, errors.New("leafdb: invalid overflow page")
+		if len(buf) < pageSize || !isChainPage(buf[0]) {
+			return nil, atPage(corrupted(0, "invalid overflow page"), pageID)
 		}
 		next := binary.LittleEndian.Uint64(buf[1:])
 		chunk := remaining
 		if chunk > payload {
 			chunk = payload
 		}
-		copy(out[offset:], buf[overflowHeaderSize:overflowHeaderSize+chunk])
-		offset += chunk
+		out = append(out, buf[overflowHeaderSize:overflowHeaderSize+chunk]...)
 		remaining -= chunk
-		pageID = next
-		if remaining > 0 && pageID == 0 {
-			return nil, errors.New("leafdb: overflow chain too short")
+		if remaining > 0 && next == 0 {
+			return nil, atPage(corrupted(1, "overflow chain too short"), pageID)
+		}
+		if remaining > 0 && next == mark {
+			return nil, atPage(corrupted(1, "overflow chain loops"), pageID)
 		}
+		if sinceMark++; sinceMark == nextMark {
+			mark, sinceMark, nextMark = next, 0, nextMark*2
+		}
+		pageID = next
 	}
 	return out, nil
 }
 
-func writeOverflowPages(store pageStore, value []byte) (uint64, error) {
+// writeOverflowPages writes value to a new chain of pages of type kind,
+// pageOverflow or pageBlob, and returns its first page.
+func writeOverflowPages(store pageStore, value []byte, kind byte) (uint64, error) {
 	pageSize := store.PageSize()
 	payload := pageSize - overflowHeaderSize
 	pagesNeeded := (len(value) + payload - 1) / payload
@@ -420,8 +1013,8 @@ func writeOverflowPages(store pageStore, value []byte) (uint64, error) {
 		if i+1 < len(ids) {
 			next = ids[i+1]
 		}
-		buf := make([]byte, pageSize)
-		buf[0] = pageOverflow
+		buf := getPageBuffer(pageSize)
+		buf[0] = kind
 		binary.LittleEndian.PutUint64(buf[1:], next)
 		end := offset + payload
 		if end > len(value) {
@@ -429,7 +1022,9 @@ func writeOverflowPages(store pageStore, value []byte) (uint64, error) {
 		}
 		copy(buf[overflowHeaderSize:], value[offset:end])
 		offset = end
-		if err := store.WritePage(id, buf); err != nil {
+		err := store.WritePage(id, buf)
+		putPageBuffer(buf)
+		if err != nil {
 			for _, freeID := range ids {
 				store.FreePage(freeID)
 			}
@@ -442,11 +1037,18 @@ func writeOverflowPages(store pageStore, value []byte) (uint64, error) {
 	return ids[0], nil
 }
 
+// isChainPage reports whether a page of type kind belongs to the chain of
+// a value stored out of line.
+func isChainPage(kind byte) bool {
+	return kind == pageOverflow || kind == pageBlob
+}
+
+// freeOverflowPages frees the overflow or blob chain at first.
 func freeOverflowPages(store pageStore, first uint64) {
 	pageID := first
 	for pageID != 0 {
 		buf, err := store.ReadPage(pageID)
-		if err != nil || len(buf) < store.PageSize() || buf[0] != pageOverflow {
+		if err != nil || len(buf) < store.PageSize() || !isChainPage(buf[0]) {
 			return
 		}
 		next := binary.LittleEndian.Uint64(buf[1:])
@@ -455,6 +1057,29 @@ func freeOverflowPages(store pageStore, first uint64) {
 	}
 }
 
+// blobDropper is implemented by page stores that leave dropped blob chains
+// to the blob collector instead of freeing them.
+type blobDropper interface {
+	dropBlob(first uint64)
+}
+
+// dropChain releases the chain at first, which no leaf references anymore.
+// Overflow chains are freed at once; blob chains are left to the blob
+// collector, see DB.CollectBlobs, so that dropping a large value does not
+// read all its pages.
+func dropChain(store pageStore, first uint64) {
+	buf, err := store.ReadPage(first)
+	if err != nil || len(buf) < store.PageSize() {
+		return
+	}
+	if d, ok := store.(blobDropper); ok && buf[0] == pageBlob {
+		d.dropBlob(first)
+		return
+	}
+	freeOverflowPages(store, first)
+}
+
+// freeNodeOverflow frees the chains of the values of leaf n.
 func freeNodeOverflow(store pageStore, n *node) {
 	if n == nil || !n.isLeaf || len(n.overflow) == 0 {
 		return
@@ -504,67 +1129,57 @@ func cloneNode(n *node) *node {
 		return out
 	}
 	out.children = append(out.children, n.children...)
+	out.counts = append(out.counts, n.counts...)
 	return out
 }
 
-func (t *bptree) insertLeaf(n *node, key, value []byte) (uint64, []byte, uint64, bool, error) {
-	if _, _, err := leafEntrySize(key, value, t.store.PageSize()); err != nil {
-		return 0, nil, 0, false, err
+func (t *bptree) insertLeaf(n *node, key []byte, fn func(old []byte) ([]byte, error)) (uint64, []childRef, error) {
+	idx, exists := findKeyIndex(n.keys, key)
+	var old []byte
+	if exists {
+		old = n.values[idx]
+	}
+	value, err := fn(old)
+	if err != nil {
+		return 0, nil, err
+	}
+	if _, _, err := leafEntrySize(key, value, t.store.PageSize(), t.blobThreshold); err != nil {
+		return 0, nil, err
 	}
-	oldID := n.pageID
 	newNode := cloneNode(n)
 	newNode.pageID = t.store.AllocPage()
-	idx, exists := findKeyIndex(newNode.keys, key)
 	if exists {
 		newNode.values[idx] = cloneBytes(value)
-		if err := t.writeNode(newNode); err != nil {
-			return 0, nil, 0, false, err
-		}
-		freeNodeOverflow(t.store, n)
-		t.store.FreePage(oldID)
-		return newNode.pageID, nil, 0, false, nil
-	}
-	insertAt(&newNode.keys, idx, cloneBytes(key))
-	insertAt(&newNode.values, idx, cloneBytes(value))
-	if nodeFits(t.store.PageSize(), newNode) {
-		if err := t.writeNode(newNode); err != nil {
-			return 0, nil, 0, false, err
-		}
-		freeNodeOverflow(t.store, n)
-		t.store.FreePage(oldID)
-		return newNode.pageID, nil, 0, false, nil
+	} else {
+		insertAt(&newNode.keys, idx, cloneBytes(key))
+		insertAt(&newNode.values, idx, cloneBytes(value))
 	}
-	newID, promoted, rightID, split, err := t.splitLeaf(newNode)
+	newID, siblings, err := t.writeSplit(newNode)
 	if err != nil {
-		return 0, nil, 0, false, err
+		return 0, nil, err
 	}
-	freeNodeOverflow(t.store, n)
-	t.store.FreePage(oldID)
-	return newID, promoted, rightID, split, nil
+	t.freeNode(n)
+	return newID, siblings, nil
 }
 
-func (t *bptree) insertBranch(n *node, idx int, newChildID uint64, promoted []byte, rightID uint64, split bool) (uint64, []byte, uint64, bool, error) {
-	oldID := n.pageID
+// insertBranch replaces the child at idx of n with newChildID followed by
+// its new siblings.
+func (t *bptree) insertBranch(n *node, idx int, newChildID uint64, siblings []childRef) (uint64, []childRef, error) {
 	newNode := cloneNode(n)
 	newNode.pageID = t.store.AllocPage()
 	newNode.children[idx] = newChildID
-	if split {
-		insertAt(&newNode.keys, idx, promoted)
-		insertAtUint64(&newNode.children, idx+1, rightID)
+	newNode.counts[idx] = countOf(t.store, newChildID)
+	for i, s := range siblings {
+		insertAt(&newNode.keys, idx+i, s.first)
+		insertAtUint64(&newNode.children, idx+1+i, s.pageID)
+		insertAtUint64(&newNode.counts, idx+1+i, s.count)
 	}
-	if nodeFits(t.store.PageSize(), newNode) {
-		if err := t.writeNode(newNode); err != nil {
-			return 0, nil, 0, false, err
-		}
-		t.store.FreePage(oldID)
-		return newNode.pageID, nil, 0, false, nil
-	}
-	newID, newPromoted, newRightID, newSplit, err := t.splitBranch(newNode)
+	newID, newSiblings, err := t.writeSplit(newNode)
 	if err != nil {
-		return 0, nil, 0, false, err
+		return 0, nil, err
 	}
-	t.store.FreePage(oldID)
-	return newID, newPromoted, newRightID, newSplit, nil
+	t.store.FreePage(n.pageID)
+	return newID, newSiblings, nil
 }
 
 func (t *bptree) deleteLeaf(n *node, key []byte) (uint64, bool, error) {
@@ -572,7 +1187,6 @@ func (t *bptree) deleteLeaf(n *node, key []byte) (uint64, bool, error) {
 	if !ok {
 		return n.pageID, false, nil
 	}
-	oldID := n.pageID
 	newNode := cloneNode(n)
 	newNode.pageID = t.store.AllocPage()
 	removeAt(&newNode.keys, idx)
@@ -580,8 +1194,7 @@ func (t *bptree) deleteLeaf(n *node, key []byte) (uint64, bool, error) {
 	if err := t.writeNode(newNode); err != nil {
 		return 0, false, err
 	}
-	freeNodeOverflow(t.store, n)
-	t.store.FreePage(oldID)
+	t.freeNode(n)
 	return newNode.pageID, true, nil
 }
 
@@ -591,11 +1204,12 @@ func (t *bptree) deleteBranch(n *node, idx int, newChildID uint64) (uint64, bool
 	newNode.pageID = t.store.AllocPage()
 	newNode.children[idx] = newChildID
 
-	child, err := readNode(t.store, newChildID)
+	child, err := t.readNode(newChildID)
 	if err != nil {
 		return 0, false, err
 	}
-	if child != nil && nodeUnderflow(child) {
+	newNode.counts[idx] = child.count()
+	if nodeUnderflow(t.store.PageSize(), t.blobThreshold, child) {
 		if err := t.rebalanceChild(newNode, idx, child); err != nil {
 			return 0, false, err
 		}
@@ -607,155 +1221,215 @@ func (t *bptree) deleteBranch(n *node, idx int, newChildID uint64) (uint64, bool
 	return newNode.pageID, true, nil
 }
 
-func nodeUnderflow(n *node) bool {
-	if n == nil {
-		return false
-	}
-	if n.isLeaf {
-		return len(n.keys) == 0
-	}
-	return len(n.children) < 2
-}
+// minFillDivisor sets the fill below which a node is rebalanced after a
+// delete: a quarter of a page.
+const minFillDivisor = 4
 
-func nodeCanSpare(n *node) bool {
+// nodeUnderflow reports whether n, which is not a root, should be merged
+// with or refilled from a sibling: it is a leaf without keys, a branch with
+// a single child, or is filled below a quarter of the page.
+func nodeUnderflow(pageSize, blob int, n *node) bool {
 	if n == nil {
 		return false
 	}
-	if n.isLeaf {
-		return len(n.keys) > 1
+	if n.isLeaf && len(n.keys) == 0 || !n.isLeaf && len(n.children) < 2 {
+		return true
 	}
-	return len(n.children) > 2
+	size, err := nodeSize(pageSize, blob, n)
+	return err == nil && size < pageSize/minFillDivisor
 }
 
+// rebalanceChild fixes the underflowing child at idx of parent, which the
+// caller writes afterwards. The child is merged into a sibling if they fit
+// in one page, and otherwise refilled with entries from a sibling. If
+// neither is possible, as when a sibling's entries are too large to move,
+// the child is left as is.
 func (t *bptree) rebalanceChild(parent *node, idx int, child *node) error {
+	var left, right *node
+	var err error
 	if idx > 0 {
-		left, err := readNode(t.store, parent.children[idx-1])
-		if err != nil {
+		if left, err = t.sibling(parent.children[idx-1], child); err != nil {
 			return err
 		}
-		if left.isLeaf != child.isLeaf {
-			return errors.New("leafdb: invalid tree state")
-		}
-		if nodeCanSpare(left) {
-			return t.borrowFromLeft(parent, idx, left, child)
-		}
 	}
 	if idx+1 < len(parent.children) {
-		right, err := readNode(t.store, parent.children[idx+1])
-		if err != nil {
+		if right, err = t.sibling(parent.children[idx+1], child); err != nil {
 			return err
 		}
-		if right.isLeaf != child.isLeaf {
-			return errors.New("leafdb: invalid tree state")
-		}
-		if nodeCanSpare(right) {
-			return t.borrowFromRight(parent, idx, child, right)
-		}
 	}
-	if idx > 0 {
-		left, err := readNode(t.store, parent.children[idx-1])
-		if err != nil {
+	if left != nil {
+		if merged, err := t.mergeChildren(parent, idx-1, left, child); err != nil || merged {
 			return err
 		}
-		if left.isLeaf != child.isLeaf {
-			return errors.New("leafdb: invalid tree state")
-		}
-		return t.mergeChildren(parent, idx-1, left, child)
 	}
-	if idx+1 < len(parent.children) {
-		right, err := readNode(t.store, parent.children[idx+1])
-		if err != nil {
+	if right != nil {
+		if merged, err := t.mergeChildren(parent, idx, child, right); err != nil || merged {
 			return err
 		}
-		if right.isLeaf != child.isLeaf {
-			return errors.New("leafdb: invalid tree state")
+	}
+	if left != nil {
+		if moved, err := t.borrowFromLeft(parent, idx, left, child); err != nil || moved {
+			return err
 		}
-		return t.mergeChildren(parent, idx, child, right)
+	}
+	if right != nil {
+		_, err := t.borrowFromRight(parent, idx, child, right)
+		return err
 	}
 	return nil
 }
 
-func (t *bptree) borrowFromLeft(parent *node, idx int, left, child *node) error {
+// sibling reads the sibling of child in page pageID.
+func (t *bptree) sibling(pageID uint64, child *node) (*node, error) {
+	n, err := t.readNode(pageID)
+	if err != nil {
+		return nil, err
+	}
+	if n.isLeaf != child.isLeaf {
+		return nil, errors.New("leafdb: invalid tree state")
+	}
+	return n, nil
+}
+
+// borrowFromLeft moves entries from the end of left to the start of child
+// until child no longer underflows, as long as left does not underflow and
+// parent still fits. It reports whether any entry moved.
+func (t *bptree) borrowFromLeft(parent *node, idx int, left, child *node) (bool, error) {
+	pageSize := t.store.PageSize()
 	leftNew := cloneNode(left)
-	leftNew.pageID = t.store.AllocPage()
 	childNew := cloneNode(child)
-	childNew.pageID = t.store.AllocPage()
-
-	if childNew.isLeaf {
-		moveKey := leftNew.keys[len(leftNew.keys)-1]
-		moveVal := leftNew.values[len(leftNew.values)-1]
-		leftNew.keys = leftNew.keys[:len(leftNew.keys)-1]
-		leftNew.values = leftNew.values[:len(leftNew.values)-1]
-		insertAt(&childNew.keys, 0, moveKey)
-		insertAt(&childNew.values, 0, moveVal)
-		parent.keys[idx-1] = cloneBytes(childNew.keys[0])
-	} else {
+	moved := 0
+	for nodeUnderflow(pageSize, t.blobThreshold, childNew) && len(leftNew.keys) > 1 {
 		sep := parent.keys[idx-1]
-		moveKey := leftNew.keys[len(leftNew.keys)-1]
-		moveChild := leftNew.children[len(leftNew.children)-1]
-		leftNew.keys = leftNew.keys[:len(leftNew.keys)-1]
-		leftNew.children = leftNew.children[:len(leftNew.children)-1]
-		insertAt(&childNew.keys, 0, cloneBytes(sep))
-		insertAtUint64(&childNew.children, 0, moveChild)
-		parent.keys[idx-1] = cloneBytes(moveKey)
+		lastKey := len(leftNew.keys) - 1
+		moveKey := leftNew.keys[lastKey]
+		leftNew.keys = leftNew.keys[:lastKey]
+		if childNew.isLeaf {
+			moveVal := leftNew.values[lastKey]
+			leftNew.values = leftNew.values[:lastKey]
+			insertAt(&childNew.keys, 0, moveKey)
+			insertAt(&childNew.values, 0, moveVal)
+			parent.keys[idx-1] = cloneBytes(moveKey)
+		} else {
+			lastChild := len(leftNew.children) - 1
+			moveChild, moveCount := leftNew.children[lastChild], leftNew.counts[lastChild]
+			leftNew.children = leftNew.children[:lastChild]
+			leftNew.counts = leftNew.counts[:lastChild]
+			insertAt(&childNew.keys, 0, cloneBytes(sep))
+			insertAtUint64(&childNew.children, 0, moveChild)
+			insertAtUint64(&childNew.counts, 0, moveCount)
+			parent.keys[idx-1] = cloneBytes(moveKey)
+		}
+		if nodeUnderflow(pageSize, t.blobThreshold, leftNew) || !nodeFits(pageSize, t.blobThreshold, childNew) || !nodeFits(pageSize, 0, parent) {
+			parent.keys[idx-1] = sep
+			leftNew.keys = append(leftNew.keys, moveKey)
+			if childNew.isLeaf {
+				leftNew.values = append(leftNew.values, childNew.values[0])
+				removeAt(&childNew.values, 0)
+			} else {
+				leftNew.children = append(leftNew.children, childNew.children[0])
+				leftNew.counts = append(leftNew.counts, childNew.counts[0])
+				removeAt(&childNew.children, 0)
+				removeAt(&childNew.counts, 0)
+			}
+			removeAt(&childNew.keys, 0)
+			break
+		}
+		moved++
+	}
+	if moved == 0 {
+		return false, nil
 	}
 
+	leftNew.pageID = t.store.AllocPage()
+	childNew.pageID = t.store.AllocPage()
 	if err := t.writeNode(leftNew); err != nil {
-		return err
+		return false, err
 	}
 	if err := t.writeNode(childNew); err != nil {
-		return err
+		return false, err
 	}
 	parent.children[idx-1] = leftNew.pageID
 	parent.children[idx] = childNew.pageID
-	t.store.FreePage(left.pageID)
-	t.store.FreePage(child.pageID)
-	return nil
+	parent.counts[idx-1] = leftNew.count()
+	parent.counts[idx] = childNew.count()
+	t.freeNode(left)
+	t.freeNode(child)
+	return true, nil
 }
 
-func (t *bptree) borrowFromRight(parent *node, idx int, child, right *node) error {
+// borrowFromRight moves entries from the start of right to the end of child
+// until child no longer underflows, as long as right does not underflow and
+// parent still fits. It reports whether any entry moved.
+func (t *bptree) borrowFromRight(parent *node, idx int, child, right *node) (bool, error) {
+	pageSize := t.store.PageSize()
 	childNew := cloneNode(child)
-	childNew.pageID = t.store.AllocPage()
 	rightNew := cloneNode(right)
-	rightNew.pageID = t.store.AllocPage()
-
-	if childNew.isLeaf {
-		moveKey := rightNew.keys[0]
-		moveVal := rightNew.values[0]
-		removeAt(&rightNew.keys, 0)
-		removeAt(&rightNew.values, 0)
-		childNew.keys = append(childNew.keys, moveKey)
-		childNew.values = append(childNew.values, moveVal)
-		parent.keys[idx] = cloneBytes(rightNew.keys[0])
-	} else {
+	moved := 0
+	for nodeUnderflow(pageSize, t.blobThreshold, childNew) && len(rightNew.keys) > 1 {
 		sep := parent.keys[idx]
 		moveKey := rightNew.keys[0]
-		moveChild := rightNew.children[0]
 		removeAt(&rightNew.keys, 0)
-		removeAt(&rightNew.children, 0)
-		childNew.keys = append(childNew.keys, cloneBytes(sep))
-		childNew.children = append(childNew.children, moveChild)
-		parent.keys[idx] = cloneBytes(moveKey)
+		if childNew.isLeaf {
+			moveVal := rightNew.values[0]
+			removeAt(&rightNew.values, 0)
+			childNew.keys = append(childNew.keys, moveKey)
+			childNew.values = append(childNew.values, moveVal)
+			parent.keys[idx] = cloneBytes(rightNew.keys[0])
+		} else {
+			moveChild, moveCount := rightNew.children[0], rightNew.counts[0]
+			removeAt(&rightNew.children, 0)
+			removeAt(&rightNew.counts, 0)
+			childNew.keys = append(childNew.keys, cloneBytes(sep))
+			childNew.children = append(childNew.children, moveChild)
+			childNew.counts = append(childNew.counts, moveCount)
+			parent.keys[idx] = cloneBytes(moveKey)
+		}
+		if nodeUnderflow(pageSize, t.blobThreshold, rightNew) || !nodeFits(pageSize, t.blobThreshold, childNew) || !nodeFits(pageSize, 0, parent) {
+			parent.keys[idx] = sep
+			insertAt(&rightNew.keys, 0, moveKey)
+			last := len(childNew.keys) - 1
+			childNew.keys = childNew.keys[:last]
+			if childNew.isLeaf {
+				insertAt(&rightNew.values, 0, childNew.values[last])
+				childNew.values = childNew.values[:last]
+			} else {
+				lastChild := len(childNew.children) - 1
+				insertAtUint64(&rightNew.children, 0, childNew.children[lastChild])
+				insertAtUint64(&rightNew.counts, 0, childNew.counts[lastChild])
+				childNew.children = childNew.children[:lastChild]
+				childNew.counts = childNew.counts[:lastChild]
+			}
+			break
+		}
+		moved++
+	}
+	if moved == 0 {
+		return false, nil
 	}
 
+	childNew.pageID = t.store.AllocPage()
+	rightNew.pageID = t.store.AllocPage()
 	if err := t.writeNode(childNew); err != nil {
-		return err
+		return false, err
 	}
 	if err := t.writeNode(rightNew); err != nil {
-		return err
+		return false, err
 	}
 	parent.children[idx] = childNew.pageID
 	parent.children[idx+1] = rightNew.pageID
-	t.store.FreePage(child.pageID)
-	t.store.FreePage(right.pageID)
-	return nil
+	parent.counts[idx] = childNew.count()
+	parent.counts[idx+1] = rightNew.count()
+	t.freeNode(child)
+	t.freeNode(right)
+	return true, nil
 }
 
-func (t *bptree) mergeChildren(parent *node, sepIdx int, left, right *node) error {
-	merged := &node{
-		pageID: t.store.AllocPage(),
-		isLeaf: left.isLeaf,
-	}
+// mergeChildren replaces the adjacent children left and right of parent,
+// separated by parent.keys[sepIdx], with a single node if their entries fit
+// in one page. It reports whether they were merged.
+func (t *bptree) mergeChildren(parent *node, sepIdx int, left, right *node) (bool, error) {
+	merged := &node{isLeaf: left.isLeaf}
 	if left.isLeaf {
 		merged.keys = append(merged.keys, left.keys...)
 		merged.keys = append(merged.keys, right.keys...)
@@ -768,19 +1442,40 @@ func (t *bptree) mergeChildren(parent *node, sepIdx int, left, right *node) erro
 		merged.keys = append(merged.keys, right.keys...)
 		merged.children = append(merged.children, left.children...)
 		merged.children = append(merged.children, right.children...)
+		merged.counts = append(merged.counts, left.counts...)
+		merged.counts = append(merged.counts, right.counts...)
 	}
-	if !nodeFits(t.store.PageSize(), merged) {
-		return nil
+	if !nodeFits(t.store.PageSize(), t.blobThreshold, merged) {
+		return false, nil
 	}
+	merged.pageID = t.store.AllocPage()
 	if err := t.writeNode(merged); err != nil {
-		return err
+		return false, err
 	}
 	parent.children[sepIdx] = merged.pageID
+	parent.counts[sepIdx] = merged.count()
 	removeAt(&parent.children, sepIdx+1)
+	removeAt(&parent.counts, sepIdx+1)
 	removeAt(&parent.keys, sepIdx)
-	t.store.FreePage(left.pageID)
-	t.store.FreePage(right.pageID)
-	return nil
+	t.freeNode(left)
+	t.freeNode(right)
+	return true, nil
+}
+
+// freeNode frees the page of a node that has been rewritten elsewhere. Its
+// chains are released with the write if it tracks them, and freed with the
+// page otherwise, as the rewrite copied them.
+func (t *bptree) freeNode(n *node) {
+	if t.chains == nil {
+		freeNodeOverflow(t.store, n)
+	} else if n.isLeaf {
+		for _, first := range n.overflow {
+			if first != 0 {
+				t.chains.delta[first]--
+			}
+		}
+	}
+	t.store.FreePage(n.pageID)
 }
 
 func (t *bptree) writeNode(n *node) error {
@@ -789,29 +1484,56 @@ func (t *bptree) writeNode(n *node) error {
 		err error
 	)
 	if n.isLeaf {
-		buf, err = encodeLeafPageWithOverflow(t.store, n)
+		buf, err = t.encodeLeaf(n)
 	} else {
 		buf, err = encodeNodePage(t.store.PageSize(), n)
 	}
 	if err != nil {
 		return err
 	}
-	return t.store.WritePage(n.pageID, buf)
+	err = t.store.WritePage(n.pageID, buf)
+	putPageBuffer(buf)
+	if err != nil {
+		return err
+	}
+	// The node is what the next descent would decode from the page, unless
+	// it holds the placeholder of a streamed value.
+	if cache, ok := t.store.(nodeCache); ok && t.streamed == nil {
+		cache.cacheNode(n)
+	}
+	return nil
 }
 
-func decodeLeafNode(store pageStore, pageID uint64, next uint64, keyCount int, buf []byte, pos int) (*node, error) {
+func decodeLeafNode(store pageStore, pageID uint64, next uint64, keyCount int, buf []byte, pos int, flags uint16, keysOnly bool) (*node, error) {
 	n := &node{pageID: pageID, isLeaf: true, next: next}
+	var prefix []byte
+	if flags&nodeFlagPrefix != 0 {
+		var err error
+		prefix, pos, err = readKey(buf, pos)
+		if err != nil {
+			return nil, err
+		}
+	}
 	n.keys = make([][]byte, keyCount)
-	n.values = make([][]byte, keyCount)
-	n.overflow = make([]uint64, keyCount)
+	if !keysOnly {
+		n.values = make([][]byte, keyCount)
+		n.overflow = make([]uint64, keyCount)
+	}
 	for i := 0; i < keyCount; i++ {
+		var empty bool
 		var err error
-		n.keys[i], pos, err = readKey(buf, pos)
+		n.keys[i], empty, pos, err = readLeafKey(buf, pos, prefix, flags)
 		if err != nil {
 			return nil, err
 		}
+		if empty {
+			if !keysOnly {
+				n.values[i] = []byte{}
+			}
+			continue
+		}
 		if pos+4 > len(buf) {
-			return nil, errors.New("leafdb: corrupted value length")
+			return nil, corrupted(pos, "corrupted value length")
 		}
 		length := binary.LittleEndian.Uint32(buf[pos:])
 		pos += 4
@@ -819,10 +1541,13 @@ func decodeLeafNode(store pageStore, pageID uint64, next uint64, keyCount int, b
 		length &= ^valueOverflowFlag
 		if overflow {
 			if pos+8 > len(buf) {
-				return nil, errors.New("leafdb: corrupted overflow pointer")
+				return nil, corrupted(pos, "corrupted overflow pointer")
 			}
 			overflowID := binary.LittleEndian.Uint64(buf[pos:])
 			pos += 8
+			if keysOnly {
+				continue
+			}
 			value, err := readOverflowPages(store, overflowID, length)
 			if err != nil {
 				return nil, err
@@ -832,7 +1557,11 @@ func decodeLeafNode(store pageStore, pageID uint64, next uint64, keyCount int, b
 			continue
 		}
 		if pos+int(length) > len(buf) {
-			return nil, errors.New("leafdb: corrupted value data")
+			return nil, corrupted(pos, "corrupted value data")
+		}
+		if keysOnly {
+			pos += int(length)
+			continue
 		}
 		value := make([]byte, length)
 		copy(value, buf[pos:pos+int(length)])
@@ -842,13 +1571,13 @@ func decodeLeafNode(store pageStore, pageID uint64, next uint64, keyCount int, b
 	return n, nil
 }
 
-func decodeBranchNode(pageID uint64, keyCount int, buf []byte, pos int) (*node, error) {
+func decodeBranchNode(pageID uint64, keyCount int, buf []byte, pos int, flags uint16) (*node, error) {
 	n := &node{pageID: pageID, isLeaf: false}
 	childCount := keyCount + 1
 	n.children = make([]uint64, childCount)
 	for i := 0; i < childCount; i++ {
 		if pos+8 > len(buf) {
-			return nil, errors.New("leafdb: invalid branch page")
+			return nil, corrupted(pos, "corrupted child pointer")
 		}
 		n.children[i] = binary.LittleEndian.Uint64(buf[pos:])
 		pos += 8
@@ -861,58 +1590,273 @@ func decodeBranchNode(pageID uint64, keyCount int, buf []byte, pos int) (*node,
 			return nil, err
 		}
 	}
+	n.counts = make([]uint64, childCount)
+	if flags&nodeFlagCounts == 0 {
+		for i := range n.counts {
+			n.counts[i] = unknownCount
+		}
+		return n, nil
+	}
+	for i := range n.counts {
+		if pos+8 > len(buf) {
+			return nil, corrupted(pos, "corrupted child count")
+		}
+		n.counts[i] = binary.LittleEndian.Uint64(buf[pos:])
+		pos += 8
+	}
 	return n, nil
 }
 
 func encodeLeafPage(buf []byte, n *node) ([]byte, error) {
 	binary.LittleEndian.PutUint16(buf[1:], uint16(len(n.keys)))
 	binary.LittleEndian.PutUint64(buf[3:], n.next)
-	pos := nodeHeaderSize
+	pos, prefix, err := writeLeafPrefix(buf, n)
+	if err != nil {
+		return nil, err
+	}
 	for i, key := range n.keys {
-		var err error
-		pos, err = writeKeyValue(buf, pos, key, n.values[i])
+		putLeafSlot(buf, len(n.keys), i, pos)
+		pos, err = writeKeyValue(buf, pos, key[prefix:], n.values[i])
 		if err != nil {
 			return nil, err
 		}
 	}
+	if err := finishLeafSlots(buf, len(n.keys), pos); err != nil {
+		return nil, err
+	}
 	return buf, nil
 }
 
-func encodeLeafPageWithOverflow(store pageStore, n *node) ([]byte, error) {
-	pageSize := store.PageSize()
-	buf := make([]byte, pageSize)
+// encodeLeaf encodes leaf n. Values that are not stored in the page keep
+// the chain they had when the write tracks it, or are written to a new one;
+// that of streamed is referenced as it is.
+func (t *bptree) encodeLeaf(n *node) ([]byte, error) {
+	pageSize := t.store.PageSize()
+	buf := getPageBuffer(pageSize)
 	buf[0] = pageLeaf
 	binary.LittleEndian.PutUint16(buf[1:], uint16(len(n.keys)))
 	binary.LittleEndian.PutUint64(buf[3:], n.next)
-	pos := nodeHeaderSize
+	pos, prefix, err := writeLeafPrefix(buf, n)
+	if err != nil {
+		return nil, err
+	}
+	n.overflow = make([]uint64, len(n.keys))
 	for i, key := range n.keys {
 		value := n.values[i]
-		entrySize, overflow, err := leafEntrySize(key, value, pageSize)
+		entrySize, overflow, err := leafEntrySize(key, value, pageSize, t.blobThreshold)
 		if err != nil {
 			return nil, err
 		}
-		if pos+entrySize > len(buf) {
+		if pos+entrySize-prefix > len(buf) {
 			return nil, errors.New("leafdb: node too large for page")
 		}
+		putLeafSlot(buf, len(n.keys), i, pos)
 		if overflow {
-			overflowID, err := writeOverflowPages(store, value)
+			first, length, err := t.writeChain(key, value)
 			if err != nil {
 				return nil, err
 			}
-			pos, err = writeOverflowEntry(buf, pos, key, uint32(len(value)), overflowID)
+			n.overflow[i] = first
+			pos, err = writeOverflowEntry(buf, pos, key[prefix:], length, first)
 			if err != nil {
 				return nil, err
 			}
 			continue
 		}
-		pos, err = writeKeyValue(buf, pos, key, value)
+		pos, err = writeKeyValue(buf, pos, key[prefix:], value)
 		if err != nil {
 			return nil, err
 		}
 	}
+	if err := finishLeafSlots(buf, len(n.keys), pos); err != nil {
+		return nil, err
+	}
+	sealNodePage(buf)
 	return buf, nil
 }
 
+// writeChain returns the chain of the out-of-line value of key and its
+// length, writing the value to a new blob chain if the tree has a blob
+// threshold and to a new overflow chain otherwise, unless it already has
+// one.
+func (t *bptree) writeChain(key, value []byte) (uint64, uint32, error) {
+	if t.streamed != nil && bytes.Equal(key, t.streamed.key) {
+		if t.chains != nil {
+			t.chains.fresh[t.streamed.first] = true
+			t.chains.delta[t.streamed.first]++
+		}
+		return t.streamed.first, t.streamed.length, nil
+	}
+	if t.chains != nil && len(value) > 0 {
+		if first, ok := t.chains.values[&value[0]]; ok {
+			t.chains.delta[first]++
+			return first, uint32(len(value)), nil
+		}
+	}
+	kind := byte(pageOverflow)
+	if t.blobThreshold > 0 {
+		kind = pageBlob
+	}
+	first, err := writeOverflowPages(t.store, value, kind)
+	if err != nil {
+		return 0, 0, err
+	}
+	if t.chains != nil {
+		t.chains.fresh[first] = true
+		t.chains.delta[first]++
+	}
+	return first, uint32(len(value)), nil
+}
+
+// putLeafSlot stores pos as the offset of entry i of a leaf of count
+// entries.
+func putLeafSlot(buf []byte, count, i, pos int) {
+	binary.LittleEndian.PutUint16(buf[len(buf)-leafSlotSize*(count-i):], uint16(pos))
+}
+
+// finishLeafSlots checks that the entries of a leaf of count entries, which
+// end at pos, left room for its slot directory and flags the page as
+// having one.
+func finishLeafSlots(buf []byte, count, pos int) error {
+	if pos > len(buf)-leafSlotSize*count {
+		return errors.New("leafdb: node too large for page")
+	}
+	flags := binary.LittleEndian.Uint16(buf[11:])
+	binary.LittleEndian.PutUint16(buf[11:], flags|nodeFlagSlots)
+	return nil
+}
+
+// searchLeafPage looks key up in buf, the contents of a leaf page with a
+// slot directory, by binary search over its slots, without copying any of
+// its entries. It reports false in searched if buf is another kind of page,
+// which the caller must decode instead.
+func searchLeafPage(store pageStore, buf, key []byte) (e leafEntry, ok, searched bool, err error) {
+	if len(buf) < store.PageSize() || buf[0] != pageLeaf {
+		return e, false, false, nil
+	}
+	flags := binary.LittleEndian.Uint16(buf[11:])
+	if flags&nodeFlagSlots == 0 || flags&nodeFlagChecksum == 0 || flags&^nodeFlagsLeaf != 0 {
+		return e, false, false, nil
+	}
+	if store.VerifyChecksums() && binary.LittleEndian.Uint32(buf[13:]) != nodeChecksum(buf) {
+		return e, false, true, checksumMismatch()
+	}
+	count := int(binary.LittleEndian.Uint16(buf[1:]))
+	slots := len(buf) - leafSlotSize*count
+	pos := nodeHeaderSize
+	var prefix []byte
+	if flags&nodeFlagPrefix != 0 {
+		length := int(binary.LittleEndian.Uint16(buf[pos:]))
+		pos += 2
+		if pos+length > slots {
+			return e, false, true, corrupted(pos, "corrupted key prefix")
+		}
+		prefix = buf[pos : pos+length]
+		pos += length
+	}
+	if pos > slots {
+		return e, false, true, corrupted(1, "corrupted leaf slot count")
+	}
+	low, high := 0, count
+	for low < high {
+		mid := (low + high) / 2
+		slot := slots + leafSlotSize*mid
+		entry := int(binary.LittleEndian.Uint16(buf[slot:]))
+		if entry < pos || entry+2 > slots {
+			return e, false, true, corrupted(slot, "corrupted leaf slot")
+		}
+		length := int(binary.LittleEndian.Uint16(buf[entry:]))
+		empty := flags&nodeFlagEmptyValues != 0 && length&keyEmptyValue != 0
+		if empty {
+			length &^= keyEmptyValue
+		}
+		if entry+2+length > slots {
+			return e, false, true, corrupted(entry, "corrupted key length")
+		}
+		suffix := buf[entry+2 : entry+2+length]
+		switch cmp := compareStoredKey(prefix, suffix, key); {
+		case cmp < 0:
+			low = mid + 1
+		case cmp > 0:
+			high = mid
+		default:
+			return leafEntry{page: buf[:slots], pos: entry + 2 + length, empty: empty}, true, true, nil
+		}
+	}
+	return e, false, true, nil
+}
+
+// searchBranchPage returns the child of buf, the contents of a branch page,
+// whose subtree holds key, scanning its keys in place. It reports false in
+// searched if buf is another kind of page, which the caller must decode
+// instead.
+func searchBranchPage(store pageStore, buf, key []byte) (child uint64, searched bool, err error) {
+	if len(buf) < store.PageSize() || buf[0] != pageBranch {
+		return 0, false, nil
+	}
+	flags := binary.LittleEndian.Uint16(buf[11:])
+	if flags&nodeFlagChecksum == 0 || flags&^nodeFlagsBranch != 0 {
+		return 0, false, nil
+	}
+	if store.VerifyChecksums() && binary.LittleEndian.Uint32(buf[13:]) != nodeChecksum(buf) {
+		return 0, true, checksumMismatch()
+	}
+	count := int(binary.LittleEndian.Uint16(buf[1:]))
+	pos := nodeHeaderSize + 8*(count+1)
+	if pos > len(buf) {
+		return 0, true, corrupted(1, "corrupted key count")
+	}
+	idx := 0
+	for ; idx < count; idx++ {
+		if pos+2 > len(buf) {
+			return 0, true, corrupted(pos, "corrupted key length")
+		}
+		length := int(binary.LittleEndian.Uint16(buf[pos:]))
+		pos += 2
+		if pos+length > len(buf) {
+			return 0, true, corrupted(pos, "corrupted key data")
+		}
+		if bytes.Compare(key, buf[pos:pos+length]) < 0 {
+			break
+		}
+		pos += length
+	}
+	return binary.LittleEndian.Uint64(buf[nodeHeaderSize+8*idx:]), true, nil
+}
+
+// compareStoredKey compares the key stored as prefix and suffix with key.
+func compareStoredKey(prefix, suffix, key []byte) int {
+	n := min(len(prefix), len(key))
+	if cmp := bytes.Compare(prefix, key[:n]); cmp != 0 {
+		return cmp
+	}
+	return bytes.Compare(suffix, key[n:])
+}
+
+// readSlotValue returns the value of the leaf entry whose length field is at
+// pos in buf, copied if clone is set, or read from its overflow pages.
+func readSlotValue(store pageStore, buf []byte, pos int, clone bool) ([]byte, error) {
+	if pos+4 > len(buf) {
+		return nil, corrupted(pos, "corrupted value length")
+	}
+	length := binary.LittleEndian.Uint32(buf[pos:])
+	pos += 4
+	if length&valueOverflowFlag != 0 {
+		if pos+8 > len(buf) {
+			return nil, corrupted(pos, "corrupted overflow pointer")
+		}
+		return readOverflowPages(store, binary.LittleEndian.Uint64(buf[pos:]), length&^valueOverflowFlag)
+	}
+	if pos+int(length) > len(buf) {
+		return nil, corrupted(pos, "corrupted value data")
+	}
+	value := buf[pos : pos+int(length)]
+	if clone {
+		value = cloneBytes(value)
+	}
+	return value, nil
+}
+
 func encodeBranchPage(buf []byte, n *node) ([]byte, error) {
 	binary.LittleEndian.PutUint16(buf[1:], uint16(len(n.keys)))
 	binary.LittleEndian.PutUint64(buf[3:], 0)
@@ -931,5 +1875,13 @@ func encodeBranchPage(buf []byte, n *node) ([]byte, error) {
 			return nil, err
 		}
 	}
+	if len(n.counts) != len(n.children) || pos+8*len(n.counts) > len(buf) {
+		return buf, nil
+	}
+	for _, count := range n.counts {
+		binary.LittleEndian.PutUint64(buf[pos:], count)
+		pos += 8
+	}
+	binary.LittleEndian.PutUint16(buf[11:], nodeFlagCounts)
 	return buf, nil
 }
@@ -1,10 +1,14 @@
 package leafdb
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
-
-	"golang.org/x/sys/unix"
+	"fmt"
+	"os"
+	"slices"
+	"time"
 )
 
 type Tx struct {
@@ -12,39 +16,147 @@ type Tx struct {
 	writable bool
 	closed   bool
 	mgr      *txPageManager
-	mapLock  bool
 	readTxID uint64
+	start    time.Time
+	// ctx is the context the transaction was begun with.
+	ctx context.Context
+	// changeLog is the changefeed bucket once this transaction has opened it,
+	// and changeSeq numbers the changes it has recorded.
+	changeLog *Bucket
+	changeSeq uint32
+	// commitHandlers and rollbackHandlers are run once the transaction has
+	// ended, in registration order.
+	commitHandlers   []func()
+	rollbackHandlers []func()
+	// optimistic is set for an optimistic write transaction until its
+	// commit takes the writer lock. writes holds what the transaction
+	// wrote, while Options.OptimisticWrites is set, and hookDepth counts
+	// the hooks running, whose writes are not replayed.
+	optimistic *optimisticTx
+	writes     *accessSet
+	hookDepth  int
+}
+
+// OnCommit registers fn to be called after the transaction commits
+// successfully, once its changes are durable as configured by Options.Sync.
+// Handlers run after the writer lock is released, so they may start new
+// transactions. A transaction used by DB.Batch may be rolled back and its
+// functions rerun, so handlers registered there can run for a rollback first.
+func (tx *Tx) OnCommit(fn func()) {
+	tx.commitHandlers = append(tx.commitHandlers, fn)
+}
+
+// OnRollback registers fn to be called after the transaction is rolled back,
+// including when Commit fails.
+func (tx *Tx) OnRollback(fn func()) {
+	tx.rollbackHandlers = append(tx.rollbackHandlers, fn)
 }
 
 func (tx *Tx) Bucket(name []byte) *Bucket {
+	if isReservedName(name) {
+		return nil
+	}
+	return tx.bucket(name)
+}
+
+// bucket opens the top-level bucket name, including reserved ones.
+func (tx *Tx) bucket(name []byte) *Bucket {
 	if tx == nil || tx.closed {
 		return nil
 	}
 	if len(name) == 0 {
 		return nil
 	}
+	tx.trackBucket(nil, name)
 	root := tx.mgr.root
 	tree := newBPTree(&root, tx.mgr)
 	val, ok, err := tree.get(name)
 	if err != nil || !ok {
 		return nil
 	}
-	pageID := decodePageID(val)
-	kvRoot, bucketRoot, sequence, err := readBucketHeader(tx.mgr, pageID)
+	bucket, err := tx.openBucket(name, decodePageID(val))
 	if err != nil {
 		return nil
 	}
-	return &Bucket{
-		tx:         tx,
-		name:       cloneBytes(name),
-		header:     pageID,
-		kvRoot:     kvRoot,
-		bucketRoot: bucketRoot,
-		sequence:   sequence,
+	return bucket
+}
+
+// ID returns the ID of the committed transaction whose snapshot tx reads.
+// A writable transaction commits as ID()+1.
+func (tx *Tx) ID() uint64 {
+	if tx == nil || tx.mgr == nil {
+		return 0
 	}
+	return tx.mgr.txid
+}
+
+// ForEachBucket calls fn for every top-level bucket in key order. Iteration
+// stops at the first error returned by fn.
+func (tx *Tx) ForEachBucket(fn func(name []byte, b *Bucket) error) error {
+	if tx == nil || tx.closed {
+		return ErrTxClosed
+	}
+	tx.trackTopLevel()
+	root := tx.mgr.root
+	c := &Cursor{tree: newBPTree(&root, tx.mgr)}
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if isReservedName(k) {
+			continue
+		}
+		bucket, err := tx.openBucket(k, decodePageID(v))
+		if err != nil {
+			return err
+		}
+		if err := fn(k, bucket); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Buckets returns the names of all top-level buckets in key order.
+func (tx *Tx) Buckets() [][]byte {
+	if tx == nil || tx.closed {
+		return nil
+	}
+	tx.trackTopLevel()
+	var names [][]byte
+	root := tx.mgr.root
+	c := &Cursor{tree: newBPTree(&root, tx.mgr)}
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		if !isReservedName(k) {
+			names = append(names, k)
+		}
+	}
+	return names
+}
+
+func (tx *Tx) openBucket(name []byte, pageID uint64) (*Bucket, error) {
+	h, err := readBucketHeader(tx.mgr, pageID)
+	if err != nil {
+		return nil, err
+	}
+	b := &Bucket{tx: tx, name: cloneBytes(name)}
+	b.setHeaderFields(pageID, h)
+	return b, nil
 }
 
 func (tx *Tx) CreateBucket(name []byte) (*Bucket, error) {
+	if err := tx.validateWritable(name); err != nil {
+		return nil, err
+	}
+	if isReservedName(name) {
+		return nil, ErrReservedName
+	}
+	bucket, err := tx.createTopLevel(name)
+	if err != nil {
+		return nil, err
+	}
+	return bucket, tx.recordChange(Change{Op: ChangeCreateBucket, Key: name})
+}
+
+// createTopLevel creates the top-level bucket name, including reserved ones.
+func (tx *Tx) createTopLevel(name []byte) (*Bucket, error) {
 	if err := tx.validateWritable(name); err != nil {
 		return nil, err
 	}
@@ -74,6 +186,17 @@ func (tx *Tx) CreateBucketIfNotExists(name []byte) (*Bucket, error) {
 }
 
 func (tx *Tx) DeleteBucket(name []byte) error {
+	if isReservedName(name) {
+		return ErrBucketNotFound
+	}
+	if err := tx.deleteTopLevel(name); err != nil {
+		return err
+	}
+	return tx.recordChange(Change{Op: ChangeDeleteBucket, Key: name})
+}
+
+// deleteTopLevel deletes the top-level bucket name, including reserved ones.
+func (tx *Tx) deleteTopLevel(name []byte) error {
 	if tx == nil || tx.closed {
 		return ErrTxClosed
 	}
@@ -101,20 +224,142 @@ func (tx *Tx) DeleteBucket(name []byte) error {
 	return nil
 }
 
+// Upgrade converts a read-only transaction into a writable one. It takes the
+// writer lock and succeeds only if no write transaction has committed since
+// the transaction's snapshot was taken; otherwise it returns ErrTxConflict
+// and the transaction stays read-only. Buckets opened before the upgrade
+// remain usable for writes.
+func (tx *Tx) Upgrade() error {
+	if tx == nil || tx.closed {
+		return ErrTxClosed
+	}
+	if tx.writable {
+		return nil
+	}
+	db := tx.db
+	if db.readOnly {
+		return ErrDatabaseReadOnly
+	}
+	if err := db.lockWriterCtx(tx.ctx); err != nil {
+		return err
+	}
+	meta := db.snapshotMeta()
+	if meta.txid != tx.mgr.txid {
+		db.mu.Unlock()
+		return ErrTxConflict
+	}
+	db.removeReadTx(tx.readTxID)
+	db.releaseMapping(tx.mgr.mapping)
+	// ActiveTx reads mgr and writable under txMu.
+	db.txMu.Lock()
+	tx.mgr = newTxPageManager(db, true, meta)
+	tx.writable = true
+	db.txMu.Unlock()
+	tx.readTxID = 0
+	return nil
+}
+
+// Context returns the context the transaction was begun with, or
+// context.Background for transactions begun without one.
+func (tx *Tx) Context() context.Context {
+	return tx.ctx
+}
+
+// Prepare is the first phase of a two-phase commit of a write transaction,
+// for coordinating it with systems outside the database. It writes and
+// syncs every page the commit needs except the meta page, so that Commit
+// only has to switch the meta page and cannot run out of space, and
+// Rollback only has to drop the pages, which no meta page references. The
+// transaction keeps the writer lock until it ends, and writes after
+// Prepare fail with ErrTxPrepared. If Prepare fails the transaction is
+// rolled back.
+//
+// A crash between Prepare and Commit leaves the database as it was before
+// the transaction, so the transaction is lost as if it had been rolled
+// back.
+func (tx *Tx) Prepare() error {
+	if tx == nil || tx.closed {
+		return ErrTxClosed
+	}
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	if tx.mgr.staged != nil {
+		return ErrTxPrepared
+	}
+	if err := tx.ctx.Err(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if tx.optimistic != nil {
+		if err := tx.lockOptimistic(); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if tx.db.audit {
+		if err := tx.writeAudit(); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.mgr.prepare(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return nil
+}
+
+// Commit writes the changes of a write transaction and closes it. With
+// Options.StrictMode, a commit that leaves the database inconsistent is
+// still durable but returns an error wrapping ErrInconsistent.
 func (tx *Tx) Commit() error {
 	if tx == nil || tx.closed {
 		return ErrTxClosed
 	}
+	if err := tx.ctx.Err(); err != nil {
+		tx.Rollback()
+		return err
+	}
 	if !tx.writable {
 		tx.close()
+		runHandlers(tx.commitHandlers)
 		return nil
 	}
+	if tx.optimistic != nil {
+		if err := tx.lockOptimistic(); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if tx.db.audit && tx.mgr.staged == nil {
+		if err := tx.writeAudit(); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
 	if err := tx.mgr.commit(); err != nil {
+		tx.db.stats.rollbacks.Add(1)
 		tx.close()
+		runHandlers(tx.rollbackHandlers)
 		return err
 	}
+	if tx.db.optimisticWrites {
+		tx.db.recordCommit(tx.mgr.txid+1, tx.writes)
+	}
+	tx.db.stats.commits.Add(1)
+	tx.db.stats.pagesAllocated.Add(tx.mgr.allocs)
+	tx.db.stats.pagesFreed.Add(tx.mgr.frees)
+	tx.db.blobsDropped.Add(tx.mgr.blobsDropped)
+	var err error
+	if tx.db.strict {
+		if errs := tx.db.check(); len(errs) > 0 {
+			err = fmt.Errorf("%w after commit: %w", ErrInconsistent, errors.Join(errs...))
+		}
+	}
 	tx.close()
-	return nil
+	runHandlers(tx.commitHandlers)
+	return err
 }
 
 func (tx *Tx) Rollback() {
@@ -123,8 +368,16 @@ func (tx *Tx) Rollback() {
 	}
 	if tx.writable {
 		tx.mgr.rollback()
+		tx.db.stats.rollbacks.Add(1)
 	}
 	tx.close()
+	runHandlers(tx.rollbackHandlers)
+}
+
+func runHandlers(fns []func()) {
+	for _, fn := range fns {
+		fn()
+	}
 }
 
 func (tx *Tx) close() {
@@ -132,14 +385,17 @@ func (tx *Tx) close() {
 		return
 	}
 	tx.closed = true
-	if tx.writable {
+	if tx.optimistic != nil {
+		tx.db.endOptimistic(tx)
+	} else if tx.writable {
 		tx.db.mu.Unlock()
-	} else if tx.mapLock {
+	} else if tx.mgr != nil && tx.mgr.mapping != nil {
 		if tx.readTxID != 0 {
 			tx.db.removeReadTx(tx.readTxID)
 		}
-		tx.db.mapMu.RUnlock()
+		tx.db.releaseMapping(tx.mgr.mapping)
 	}
+	tx.db.removeTx(tx)
 }
 
 func (tx *Tx) createBucket() (*Bucket, error) {
@@ -147,40 +403,58 @@ func (tx *Tx) createBucket() (*Bucket, error) {
 	kvRootID := tx.mgr.AllocPage()
 	bucketRootID := tx.mgr.AllocPage()
 
-	leaf := &node{pageID: kvRootID, isLeaf: true}
-	buf, err := encodeNodePage(tx.mgr.pageSize, leaf)
-	if err != nil {
-		return nil, err
-	}
-	if err := tx.mgr.WritePage(kvRootID, buf); err != nil {
-		return nil, err
-	}
-
-	leaf = &node{pageID: bucketRootID, isLeaf: true}
-	buf, err = encodeNodePage(tx.mgr.pageSize, leaf)
-	if err != nil {
-		return nil, err
-	}
-	if err := tx.mgr.WritePage(bucketRootID, buf); err != nil {
-		return nil, err
+	for _, id := range []uint64{kvRootID, bucketRootID} {
+		buf, err := encodeNodePage(tx.mgr.pageSize, &node{pageID: id, isLeaf: true})
+		if err != nil {
+			return nil, err
+		}
+		err = tx.mgr.WritePage(id, buf)
+		putPageBuffer(buf)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	if err := writeBucketHeader(tx.mgr, headerID, kvRootID, bucketRootID, 0); err != nil {
+	h := bucketHeader{kvRoot: kvRootID, bucketRoot: bucketRootID}
+	if err := writeBucketHeader(tx.mgr, headerID, h); err != nil {
 		return nil, err
 	}
 	return &Bucket{tx: tx, header: headerID, kvRoot: kvRootID, bucketRoot: bucketRootID, sequence: 0}, nil
 }
 
+// releaseBucket frees a bucket's header page and trees along with every
+// nested bucket reachable from its bucket index tree.
 func (tx *Tx) releaseBucket(headerID uint64) {
-	kvRoot, bucketRoot, _, err := readBucketHeader(tx.mgr, headerID)
+	h, err := readBucketHeader(tx.mgr, headerID)
 	if err != nil {
 		return
 	}
-	freeTree(tx.mgr, kvRoot)
-	freeTree(tx.mgr, bucketRoot)
+	tx.releaseNestedBuckets(h.bucketRoot)
+	freeTree(tx.mgr, h.kvRoot)
+	freeTree(tx.mgr, h.bucketRoot)
+	freeFilter(tx.mgr, h.filter)
 	tx.mgr.FreePage(headerID)
 }
 
+func (tx *Tx) releaseNestedBuckets(pageID uint64) {
+	if pageID == 0 {
+		return
+	}
+	node, err := readNode(tx.mgr, pageID)
+	if err != nil || node == nil {
+		return
+	}
+	if !node.isLeaf {
+		for _, child := range node.children {
+			tx.releaseNestedBuckets(child)
+		}
+		return
+	}
+	for _, val := range node.values {
+		tx.releaseBucket(decodePageID(val))
+	}
+}
+
 func freeTree(store pageStore, rootID uint64) {
 	if rootID == 0 {
 		return
@@ -221,6 +495,9 @@ func (tx *Tx) validateWritable(name []byte) error {
 	if len(name) == 0 {
 		return errors.New("leafdb: bucket name required")
 	}
+	if len(name) > MaxKeySize {
+		return ErrKeyTooLarge
+	}
 	return nil
 }
 
@@ -245,6 +522,44 @@ type txPageManager struct {
 	pending  []uint64
 	dirty    map[uint64][]byte
 	maxPage  uint64
+	mapping  *mapping
+	// base is the meta the transaction began from, without its freelist.
+	base meta
+	// allocated holds pages first allocated by this transaction. No reader
+	// can see them, so freeing one returns it straight to the freelist.
+	allocated map[uint64]bool
+	// nodes caches the decoded nodes of allocated pages, which every write
+	// to a tree reads again on its next descent.
+	nodes map[uint64]*node
+	// allocs and frees count the pages allocated and freed, for DB.Stats.
+	allocs uint64
+	frees  uint64
+	// shrink is set by Tx.Shrink: the commit cuts the free pages at the end
+	// off the file.
+	shrink bool
+	// rebuiltFreelist is set by DB.RebuildFreelist: freelist holds every
+	// page the tree does not reach, including those pending and those of
+	// the old freelist chain.
+	rebuiltFreelist bool
+	// freed are the pages the commit makes free, whose space is punched
+	// out of the file once it is synced, and released the runs of free
+	// pages whose memory it releases.
+	freed    []uint64
+	released []pageRun
+	// blobsDropped counts the blob chains left to the blob collector.
+	blobsDropped uint64
+	// staged is set once the pages of the commit are written, by Tx.Prepare
+	// or by commit.
+	staged *stagedCommit
+}
+
+// stagedCommit is the meta page of a commit whose other pages are written,
+// with what finalizeMeta needs to switch to it.
+type stagedCommit struct {
+	meta      meta
+	inline    []uint64
+	remaining []pendingFree
+	metaTime  time.Duration
 }
 
 func newTxPageManager(db *DB, writable bool, m meta) *txPageManager {
@@ -257,6 +572,11 @@ func newTxPageManager(db *DB, writable bool, m meta) *txPageManager {
 		nextPage: m.nextPage,
 		freelist: append([]uint64(nil), m.freelist...),
 		dirty:    make(map[uint64][]byte),
+		base:     meta{txid: m.txid, root: m.root, nextPage: m.nextPage},
+	}
+	if writable {
+		mgr.allocated = make(map[uint64]bool)
+		mgr.nodes = make(map[uint64]*node)
 	}
 	if m.nextPage > 0 {
 		mgr.maxPage = m.nextPage - 1
@@ -268,12 +588,40 @@ func (m *txPageManager) PageSize() int {
 	return m.pageSize
 }
 
+func (m *txPageManager) VerifyChecksums() bool {
+	return m.db.verifyChecksums
+}
+
 func (m *txPageManager) ReadPage(id uint64) ([]byte, error) {
-	if !m.writable {
-		return m.db.page(id), nil
+	if m.writable {
+		if buf, ok := m.dirty[id]; ok {
+			return buf, nil
+		}
 	}
-	if buf, ok := m.dirty[id]; ok {
-		return buf, nil
+	if id > m.maxPage {
+		// Only a corrupted page points past the pages in use, which the
+		// mapping may not cover.
+		return nil, errPageBeyondEnd
+	}
+	if m.db.remote != nil {
+		page, err := m.db.readPage(id)
+		if err != nil || !m.writable || m.db.cipher != nil {
+			return page, err
+		}
+		// The cached range is updated in place when the page is rewritten.
+		return bytes.Clone(page), nil
+	}
+	if m.mapping != nil {
+		// A read transaction or an optimistic write transaction, which
+		// reads the mapping it pinned.
+		page, err := m.db.decodePage(id, mappedPage(m.mapping.data, id, m.db.diskPageSize))
+		if err != nil || !m.writable || m.db.cipher != nil {
+			return page, err
+		}
+		return bytes.Clone(page), nil
+	}
+	if m.db.cipher != nil {
+		return m.db.readPage(id)
 	}
 	page := m.db.page(id)
 	copyBuf := make([]byte, len(page))
@@ -285,61 +633,195 @@ func (m *txPageManager) WritePage(id uint64, buf []byte) error {
 	if !m.writable {
 		return ErrTxReadOnly
 	}
-	page := make([]byte, len(buf))
+	if m.staged != nil {
+		return ErrTxPrepared
+	}
+	page, ok := m.dirty[id]
+	if !ok || len(page) != len(buf) {
+		page = getPageBuffer(len(buf))
+	}
 	copy(page, buf)
 	m.dirty[id] = page
+	delete(m.nodes, id)
 	if id > m.maxPage {
 		m.maxPage = id
 	}
 	return nil
 }
 
+func (m *txPageManager) cachedNode(id uint64) *node {
+	if m.private(id) {
+		return m.nodes[id]
+	}
+	return m.db.nodeCache.get(id)
+}
+
+// cacheNode keeps n in the transaction if its page is private to it, and
+// otherwise in the DB's shared cache, if any. Committed pages are not cached
+// in the transaction: a write copies them, and caching every page a
+// transaction reads would hold them all in memory.
+func (m *txPageManager) cacheNode(n *node) {
+	if m.private(n.pageID) {
+		m.nodes[n.pageID] = n
+		return
+	}
+	m.db.nodeCache.add(n)
+}
+
+// private reports whether page id has contents only this transaction sees.
+func (m *txPageManager) private(id uint64) bool {
+	if m.allocated[id] {
+		return true
+	}
+	_, ok := m.dirty[id]
+	return ok
+}
+
 func (m *txPageManager) AllocPage() uint64 {
+	var id uint64
 	if len(m.freelist) > 0 {
-		id := m.freelist[len(m.freelist)-1]
+		id = m.freelist[len(m.freelist)-1]
 		m.freelist = m.freelist[:len(m.freelist)-1]
 		if id > m.maxPage {
 			m.maxPage = id
 		}
-		return id
+	} else {
+		id = m.allocPageFromEnd()
+	}
+	if m.allocated != nil {
+		m.allocated[id] = true
 	}
-	return m.allocPageFromEnd()
+	m.allocs++
+	return id
 }
 
 func (m *txPageManager) FreePage(id uint64) {
 	if id == metaPage0 || id == metaPage1 {
 		return
 	}
+	m.frees++
+	delete(m.nodes, id)
+	if m.allocated[id] {
+		delete(m.allocated, id)
+		delete(m.dirty, id)
+		m.freelist = append(m.freelist, id)
+		return
+	}
 	m.pending = append(m.pending, id)
 }
 
 func (m *txPageManager) commit() error {
-	if err := m.ensureMapSize(); err != nil {
+	defer m.releaseDirty()
+	stats := &m.db.stats
+	defer stats.commit.since(time.Now())
+
+	if m.staged == nil {
+		if err := m.stage(); err != nil {
+			return err
+		}
+	}
+	s := m.staged
+
+	// A rebuilt freelist may list the pages of the last synced meta page,
+	// so the commit holding it is synced at once.
+	if !m.db.syncDue() && !m.shrink && !m.rebuiltFreelist {
+		start := time.Now()
+		if err := m.finalizeMeta(s.meta, s.inline, s.remaining, m.db.syncMode != SyncEveryN); err != nil {
+			return err
+		}
+		stats.metaWrite.observe(s.metaTime + time.Since(start))
+		m.db.addUnpunched(m.freed)
+		if m.db.syncMode == NoSync {
+			m.db.punchFreed()
+		}
+		m.db.releaseMemory(m.released)
+		return nil
+	}
+
+	start := time.Now()
+	if err := m.db.flushPages(); err != nil {
 		return err
 	}
-	if err := m.flushDirty(); err != nil {
+	syncTime := time.Since(start)
+
+	start = time.Now()
+	if err := m.finalizeMeta(s.meta, s.inline, s.remaining, true); err != nil {
 		return err
 	}
-	if err := m.db.msync(); err != nil {
+	stats.metaWrite.observe(s.metaTime + time.Since(start))
+
+	start = time.Now()
+	err := m.db.sync()
+	stats.sync.observe(syncTime + time.Since(start))
+	if err != nil {
 		return err
 	}
-	if err := m.finalizeMeta(); err != nil {
+	m.db.addUnpunched(m.freed)
+	m.db.punchFreed()
+	m.db.releaseMemory(m.released)
+	if !m.shrink {
+		return nil
+	}
+	// Both meta pages now list the pages past the end as free, so they
+	// can go.
+	return m.db.truncate()
+}
+
+// stage writes the pages of the commit other than the meta page and sets
+// staged.
+func (m *txPageManager) stage() error {
+	stats := &m.db.stats
+	// The freelist is staged as dirty pages first so that its pages, which
+	// may extend the file, are covered by the remap and flush below.
+	start := time.Now()
+	newMeta, inline, remaining, err := m.prepareMeta()
+	if err != nil {
 		return err
 	}
-	if err := m.db.msync(); err != nil {
+	metaTime := time.Since(start)
+
+	start = time.Now()
+	if err := m.ensureMapSize(); err != nil {
 		return err
 	}
-	if m.db.file == nil {
-		return nil
+	stats.remap.since(start)
+
+	// Cached nodes of the pages being rewritten are dropped before readers
+	// can reach the new contents.
+	m.db.nodeCache.invalidate(m.dirty)
+
+	start = time.Now()
+	if err := m.flushDirty(); err != nil {
+		return err
+	}
+	stats.pageCopy.since(start)
+	stats.pagesWritten.Add(uint64(len(m.dirty)))
+	m.staged = &stagedCommit{meta: newMeta, inline: inline, remaining: remaining, metaTime: metaTime}
+	return nil
+}
+
+// prepare stages the commit for Tx.Prepare and syncs the staged pages.
+func (m *txPageManager) prepare() error {
+	if err := m.stage(); err != nil {
+		return err
 	}
-	return unix.Fsync(int(m.db.file.Fd()))
+	return m.db.sync()
 }
 
 func (m *txPageManager) rollback() {
-	m.dirty = nil
+	m.releaseDirty()
 	m.pending = nil
 }
 
+// releaseDirty returns staged page buffers to the pool once the transaction
+// no longer needs them.
+func (m *txPageManager) releaseDirty() {
+	for _, buf := range m.dirty {
+		putPageBuffer(buf)
+	}
+	m.dirty = nil
+}
+
 func (m *txPageManager) allocPageFromEnd() uint64 {
 	id := m.nextPage
 	m.nextPage++
@@ -349,163 +831,297 @@ func (m *txPageManager) allocPageFromEnd() uint64 {
 	return id
 }
 
+// ensureMapSize grows the file and the mapping to cover every page the
+// transaction allocated. The file grows in chunks, so most commits that
+// allocate pages at the end fit in space that is already there; meta.nextPage
+// marks how much of the file is in use.
 func (m *txPageManager) ensureMapSize() error {
-	requiredSize := int((m.maxPage + 1) * uint64(m.pageSize))
-	if requiredSize <= len(m.db.data) {
-		return nil
+	requiredSize := int64(m.maxPage+1) * int64(m.db.diskPageSize)
+	if requiredSize > m.db.fileSize {
+		size := growSize(m.db.fileSize, requiredSize, int64(m.db.diskPageSize))
+		if m.db.remote == nil && size > maxMmapSize {
+			return errMmapTooLarge
+		}
+		switch {
+		case m.db.remote != nil:
+			// Without a mapping there is nothing to extend the file on
+			// Windows, so it is always extended here.
+			if err := m.db.file.Truncate(size); err != nil {
+				return err
+			}
+			m.db.remote.resize(size)
+		case m.db.file != nil:
+			if err := growFile(m.db.file.(*os.File), size); err != nil {
+				return err
+			}
+		}
+		m.db.fileSize = size
 	}
-	if err := m.db.file.Truncate(int64(requiredSize)); err != nil {
-		return err
+	if m.db.remote != nil || requiredSize <= int64(len(m.db.mapping.data)) {
+		return nil
 	}
-	return m.db.remap(requiredSize)
+	return m.db.remap(int(m.db.fileSize))
+}
+
+const (
+	// minGrowSize is the smallest size a growing file is extended to.
+	minGrowSize = 32 << 10
+	// maxGrowStep is the largest amount the file is extended by at once.
+	maxGrowStep = 1 << 30
+)
+
+// growSize returns the file size to grow to from size so that it holds at
+// least required bytes: the size doubles until it reaches maxGrowStep, then
+// grows by maxGrowStep at a time, and is rounded up to whole pages.
+func growSize(size, required, pageSize int64) int64 {
+	size = max(size, minGrowSize)
+	for size < required {
+		size += min(size, maxGrowStep)
+	}
+	return (size + pageSize - 1) / pageSize * pageSize
 }
 
 func (m *txPageManager) flushDirty() error {
 	for id, buf := range m.dirty {
-		copy(m.db.page(id), buf)
+		if err := m.db.writePage(id, buf); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func (m *txPageManager) finalizeMeta() error {
-	newMeta := meta{txid: m.txid + 1, root: m.root, nextPage: m.nextPage, freelist: nil}
-	nextMetaPage := m.nextMetaPage()
-	minRead, threshold := m.reuseThreshold(newMeta.txid)
-	reusable, remaining := m.collectReusable(newMeta.txid, minRead, threshold)
+// prepareMeta builds the next meta page and stages any freelist pages that
+// do not fit inline. The returned meta holds the freelist usable in this
+// process; the persisted freelist, whose inline part is returned separately,
+// also lists pending pages, since no reader survives a restart.
+func (m *txPageManager) prepareMeta() (meta, []uint64, []pendingFree, error) {
+	txid := m.txid + 1
+	minRead, threshold := m.reuseThreshold(txid)
+	reusable, remaining := m.collectReusable(txid, minRead, threshold)
 	// Avoid overwriting existing freelist pages before the meta page flips.
 	oldFreelistPages, err := m.db.freelistPageIDs()
 	if err != nil {
-		return err
+		return meta{}, nil, nil, err
 	}
+
 	free := append([]uint64(nil), m.freelist...)
-	free = append(free, reusable...)
-	free = append(free, oldFreelistPages...)
-	inlineFree, freelistPage, err := m.persistFreelist(free, oldFreelistPages)
+	switch {
+	case m.rebuiltFreelist:
+		reusable, remaining = nil, nil
+	case m.db.syncMode == SyncEveryN:
+		// The freelist chain may still be that of the last synced meta
+		// page, so it waits for a sync like the pages freed since.
+		free = append(free, reusable...)
+		for _, id := range oldFreelistPages {
+			remaining = append(remaining, pendingFree{txid: txid, id: id})
+		}
+	default:
+		free = append(free, reusable...)
+		free = append(free, oldFreelistPages...)
+	}
+	if m.shrink {
+		free = m.trimFree(free)
+	}
+	pending := make([]uint64, len(remaining))
+	for i, entry := range remaining {
+		pending[i] = entry.id
+	}
+	free, inline, freelistPage, err := m.persistFreelist(free, pending, oldFreelistPages)
 	if err != nil {
-		return err
+		return meta{}, nil, nil, err
+	}
+	if m.db.punchPages > 0 {
+		m.freed = reusable
 	}
-	newMeta.freelist = inlineFree
-	newMeta.freelistPage = freelistPage
+	if m.db.releaseFree && len(reusable) > 0 {
+		m.released = freeRuns(free, reusable, oldFreelistPages, 1)
+	}
+	newMeta := meta{
+		txid:         txid,
+		root:         m.root,
+		nextPage:     m.nextPage,
+		freelistPage: freelistPage,
+		freelist:     free,
+	}
+	return newMeta, inline, remaining, nil
+}
+
+// finalizeMeta makes newMeta current, writing it to the next meta page slot
+// if write is set and leaving it to the next sync otherwise.
+func (m *txPageManager) finalizeMeta(newMeta meta, inline []uint64, remaining []pendingFree, write bool) error {
+	onDisk := newMeta
+	onDisk.freelist = inline
+	nextMetaPage := m.db.nextMetaPage()
 
 	m.db.metaMu.Lock()
 	defer m.db.metaMu.Unlock()
-	if err := writeMetaPage(m.db.page(nextMetaPage), newMeta, m.pageSize); err != nil {
-		return err
+	if !write {
+		m.db.unwritten = &onDisk
+	} else {
+		if err := m.db.writeMeta(nextMetaPage, onDisk); err != nil {
+			return err
+		}
+		m.db.metaPage = nextMetaPage
+		m.db.unwritten = nil
 	}
 	m.db.pending = remaining
 	m.db.meta = newMeta
-	m.db.metaPage = nextMetaPage
 	return nil
 }
 
-func (m *txPageManager) nextMetaPage() uint64 {
-	if m.db.metaPage == metaPage0 {
-		return metaPage1
+// pageRun is a run of consecutive pages.
+type pageRun struct {
+	first, count uint64
+}
+
+// freeRuns returns the runs of at least minPages consecutive pages in free,
+// leaving out the pages in skip, that hold one of the pages in fresh.
+func freeRuns(free, fresh, skip []uint64, minPages int) []pageRun {
+	skipped := make(map[uint64]bool, len(skip))
+	for _, id := range skip {
+		skipped[id] = true
+	}
+	isFresh := make(map[uint64]bool, len(fresh))
+	for _, id := range fresh {
+		isFresh[id] = true
+	}
+	ids := slices.DeleteFunc(slices.Clone(free), func(id uint64) bool { return skipped[id] })
+	slices.Sort(ids)
+	var runs []pageRun
+	for start := 0; start < len(ids); {
+		end, hasFresh := start, false
+		for ; end < len(ids) && ids[end] == ids[start]+uint64(end-start); end++ {
+			hasFresh = hasFresh || isFresh[ids[end]]
+		}
+		if hasFresh && end-start >= minPages {
+			runs = append(runs, pageRun{first: ids[start], count: uint64(end - start)})
+		}
+		start = end
 	}
-	return metaPage0
+	return runs
+}
+
+// trimFree lowers nextPage past the free pages at its end and returns free
+// without them, in descending order, so that the pages nearest the start of
+// the file are allocated first.
+func (m *txPageManager) trimFree(free []uint64) []uint64 {
+	slices.Sort(free)
+	for len(free) > 0 && free[len(free)-1] == m.nextPage-1 {
+		free = free[:len(free)-1]
+		m.nextPage--
+	}
+	slices.Reverse(free)
+	return free
 }
 
 func (m *txPageManager) reuseThreshold(txid uint64) (uint64, uint64) {
 	minRead, ok := m.db.minReadTxID()
+	threshold := txid + 1
 	if ok {
-		return minRead, minRead
+		threshold = minRead
 	}
-	return 0, txid + 1
+	if m.db.syncMode == SyncEveryN {
+		// Pages freed after the last synced commit may still be used by
+		// its meta page, which a crash falls back to.
+		threshold = min(threshold, m.db.syncedTxID+1)
+	}
+	return minRead, threshold
 }
 
+// collectReusable splits pending frees into pages no reader can see any more
+// and pages that must stay pending. Pages freed by this transaction are still
+// visible to readers of the current meta, including readers that begin after
+// the reader set was sampled, so they always wait for a later commit.
 func (m *txPageManager) collectReusable(txid uint64, minRead uint64, threshold uint64) ([]uint64, []pendingFree) {
-	pending := make([]pendingFree, 0, len(m.db.pending)+len(m.pending))
-	pending = append(pending, m.db.pending...)
-	for _, id := range m.pending {
-		pending = append(pending, pendingFree{txid: txid, id: id})
-	}
-	reusable := make([]uint64, 0, len(pending))
-	remaining := make([]pendingFree, 0, len(pending))
-	for _, entry := range pending {
+	reusable := make([]uint64, 0, len(m.db.pending))
+	remaining := make([]pendingFree, 0, len(m.db.pending)+len(m.pending))
+	for _, entry := range m.db.pending {
 		if entry.txid < threshold && (minRead == 0 || entry.txid < minRead) {
 			reusable = append(reusable, entry.id)
 		} else {
 			remaining = append(remaining, entry)
 		}
 	}
+	for _, id := range m.pending {
+		remaining = append(remaining, pendingFree{txid: txid, id: id})
+	}
 	return reusable, remaining
 }
 
-func (m *txPageManager) persistFreelist(free []uint64, protected []uint64) ([]uint64, uint64, error) {
-	inlineCap := metaInlineFreeCapacity(m.pageSize)
-	if len(free) <= inlineCap {
-		return free, 0, nil
+// persistFreelist lays out the persisted freelist, the runs of free and
+// pending pages, and writes the runs that do not fit inline in the meta
+// page to a chain of freelist pages. Chain pages are taken from free where
+// possible, skipping protected ids and pages inside a run, whose removal
+// would split it, and allocated at the end of the file otherwise. It
+// returns free without the chain pages, the page IDs of the runs inline in
+// the meta page and the first page of the chain.
+func (m *txPageManager) persistFreelist(free, pending, protected []uint64) ([]uint64, []uint64, uint64, error) {
+	runs := toRuns(append(slices.Clone(free), pending...))
+	inline, chunks := packFreeRuns(runs, m.pageSize)
+	if len(chunks) == 0 {
+		return free, runIDs(runs), 0, nil
 	}
-	perPage := freelistPageCapacity(m.pageSize)
-	overflowCount := len(free) - inlineCap
-	pagesNeeded := (overflowCount + perPage) / (perPage + 1)
 
 	protectedSet := make(map[uint64]bool, len(protected))
 	for _, id := range protected {
 		protectedSet[id] = true
 	}
-
-	pageIDs := make([]uint64, 0, pagesNeeded)
-	selected := make(map[uint64]bool, pagesNeeded)
-	for i := len(free) - 1; i >= 0 && len(pageIDs) < pagesNeeded; i-- {
-		id := free[i]
-		if protectedSet[id] || selected[id] {
-			continue
-		}
-		pageIDs = append(pageIDs, id)
-		selected[id] = true
+	listed := make(map[uint64]bool, len(free)+len(pending))
+	for _, id := range free {
+		listed[id] = true
 	}
-	for len(pageIDs) < pagesNeeded {
-		id := m.allocPageFromEnd()
-		pageIDs = append(pageIDs, id)
+	for _, id := range pending {
+		listed[id] = true
 	}
 
-	if len(selected) > 0 {
-		kept := free[:0]
-		for _, id := range free {
-			if !selected[id] {
-				kept = append(kept, id)
+	// Taking the last page of a run never adds a run, but the encoded runs
+	// can still need fewer pages than were taken; the chain then ends with
+	// empty pages.
+	var pageIDs []uint64
+	candidate := len(free) - 1
+	for len(pageIDs) < len(chunks) {
+		for len(pageIDs) < len(chunks) {
+			for candidate >= 0 && (protectedSet[free[candidate]] || listed[free[candidate]+1]) {
+				candidate--
 			}
+			if candidate < 0 {
+				pageIDs = append(pageIDs, m.allocPageFromEnd())
+				continue
+			}
+			pageIDs = append(pageIDs, free[candidate])
+			delete(listed, free[candidate])
+			free = append(free[:candidate], free[candidate+1:]...)
+			candidate--
 		}
-		free = kept
+		runs = toRuns(append(slices.Clone(free), pending...))
+		inline, chunks = packFreeRuns(runs, m.pageSize)
 	}
 
-	if len(free) <= inlineCap {
-		inlineCap = len(free)
-	}
-	inline := free[:inlineCap]
-	overflow := free[inlineCap:]
-	if len(overflow) > len(pageIDs)*perPage {
-		return nil, 0, errors.New("leafdb: freelist overflow")
+	if err := m.writeFreelistPages(pageIDs, chunks); err != nil {
+		return nil, nil, 0, err
 	}
-	if err := m.writeFreelistPages(pageIDs, overflow); err != nil {
-		return nil, 0, err
-	}
-	return inline, pageIDs[0], nil
+	return free, runIDs(runs[:inline]), pageIDs[0], nil
 }
 
-func (m *txPageManager) writeFreelistPages(pageIDs []uint64, ids []uint64) error {
-	if len(pageIDs) == 0 {
-		return nil
-	}
-	perPage := freelistPageCapacity(m.pageSize)
-	index := 0
+// writeFreelistPages writes the chain of freelist pages pageIDs, the i-th
+// holding chunks[i], or nothing past the last chunk.
+func (m *txPageManager) writeFreelistPages(pageIDs []uint64, chunks [][]pageRun) error {
 	for i, pageID := range pageIDs {
 		next := uint64(0)
 		if i+1 < len(pageIDs) {
 			next = pageIDs[i+1]
 		}
-		end := index + perPage
-		if end > len(ids) {
-			end = len(ids)
+		var chunk []pageRun
+		if i < len(chunks) {
+			chunk = chunks[i]
 		}
-		chunk := ids[index:end]
-		index = end
-		buf := make([]byte, m.pageSize)
+		buf := getPageBuffer(m.pageSize)
 		if err := writeFreelistPage(buf, chunk, next, m.pageSize); err != nil {
 			return err
 		}
-		if err := m.WritePage(pageID, buf); err != nil {
+		err := m.WritePage(pageID, buf)
+		putPageBuffer(buf)
+		if err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,56 @@
+package leafdb
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ValidatorFunc checks a pair written to a bucket, returning an error to
+// reject it.
+type ValidatorFunc func(key, value []byte) error
+
+// maxValidatorName bounds the length of validator names, which are stored
+// in bucket headers.
+const maxValidatorName = 255
+
+var errValidatorName = errors.New("leafdb: validator name too long")
+
+// RegisterValidator registers fn as the validator named name, for the
+// buckets of db whose BucketOptions.Validator is name. Registering a name
+// again replaces its function, and a nil fn removes it.
+func (db *DB) RegisterValidator(name string, fn ValidatorFunc) {
+	db.validatorMu.Lock()
+	defer db.validatorMu.Unlock()
+	if fn == nil {
+		delete(db.validators, name)
+		return
+	}
+	if db.validators == nil {
+		db.validators = make(map[string]ValidatorFunc)
+	}
+	db.validators[name] = fn
+}
+
+// validate runs the validator of b, if it has one, on a pair about to be
+// written. An error from the validator is returned wrapped, naming it and
+// the key.
+func (b *Bucket) validate(key, value []byte) error {
+	name := b.options.Validator
+	if name == "" {
+		return nil
+	}
+	db := b.tx.db
+	db.validatorMu.RLock()
+	fn := db.validators[name]
+	db.validatorMu.RUnlock()
+	if fn == nil {
+		return fmt.Errorf("%w: %q", ErrNoValidator, name)
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	if err := fn(key, value); err != nil {
+		return fmt.Errorf("leafdb: validator %q rejected key %q: %w", name, key, err)
+	}
+	return nil
+}
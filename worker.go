@@ -0,0 +1,64 @@
+package leafdb
+
+import "time"
+
+// worker is a background goroutine that calls a function at an interval
+// until it is stopped.
+type worker struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+func startWorker(interval time.Duration, fn func()) *worker {
+	w := &worker{stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(w.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-ticker.C:
+				fn()
+			}
+		}
+	}()
+	return w
+}
+
+// halt stops w and waits for a call in progress to return. A nil w is not
+// running.
+func (w *worker) halt() {
+	if w != nil {
+		close(w.stop)
+		<-w.done
+	}
+}
+
+// startWorkers starts the background goroutines of db that are enabled and
+// not running: the blob collector and the syncer.
+func (db *DB) startWorkers() {
+	db.workerMu.Lock()
+	defer db.workerMu.Unlock()
+	if db.readOnly {
+		return
+	}
+	if db.collector == nil && db.collectInterval > 0 {
+		db.collector = startWorker(db.collectInterval, db.collectDroppedBlobs)
+	}
+	if db.syncer == nil && db.syncInterval > 0 && db.file != nil {
+		db.syncer = startWorker(db.syncInterval, db.syncUnsynced)
+	}
+}
+
+// stopWorkers stops the background goroutines of db and waits for them to
+// return.
+func (db *DB) stopWorkers() {
+	db.workerMu.Lock()
+	collector, syncer := db.collector, db.syncer
+	db.collector, db.syncer = nil, nil
+	db.workerMu.Unlock()
+	collector.halt()
+	syncer.halt()
+}
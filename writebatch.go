@@ -0,0 +1,312 @@
+package leafdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"iter"
+)
+
+// ErrBatchTooLarge is returned by WriteBatch.Put and Delete when the
+// operation would grow the batch past its MaxSize.
+var ErrBatchTooLarge = errors.New("leafdb: write batch too large")
+
+var (
+	errBatchNoBucket = errors.New("leafdb: write batch operation without a bucket")
+	errInvalidBatch  = errors.New("leafdb: invalid write batch encoding")
+)
+
+// writeBatchVersion is the first byte of an encoded WriteBatch.
+const writeBatchVersion = 1
+
+// batchesBucket is the reserved top-level bucket where ApplyOnce records the
+// IDs of the batches it applied, each mapped to the ID of the transaction
+// that applied it, big-endian.
+const batchesBucket = reservedPrefix + "batches"
+
+// WriteBatch collects Puts and Deletes of keys in existing buckets to apply
+// in one transaction with Tx.Apply or DB.Apply. Operations on a key replace
+// earlier ones on the same key of the same bucket, so the batch holds at
+// most one per key and the last write wins. Keys, values and bucket paths
+// are copied. The zero value is an empty batch without a size limit.
+//
+// A WriteBatch is not safe for concurrent use.
+type WriteBatch struct {
+	// MaxSize limits Size in bytes. Zero means no limit.
+	MaxSize int
+
+	ops []Change
+	// index maps the encoded bucket path and key of each operation to its
+	// position in ops.
+	index map[string]int
+	size  int
+}
+
+// Put sets key to value in the bucket at path bucket, the names from the
+// top level down.
+func (wb *WriteBatch) Put(bucket [][]byte, key, value []byte) error {
+	return wb.add(Change{Op: ChangePut, Bucket: bucket, Key: key, Value: value})
+}
+
+// Delete deletes key from the bucket at path bucket, the names from the top
+// level down.
+func (wb *WriteBatch) Delete(bucket [][]byte, key []byte) error {
+	return wb.add(Change{Op: ChangeDelete, Bucket: bucket, Key: key})
+}
+
+func (wb *WriteBatch) add(c Change) error {
+	if len(c.Bucket) == 0 {
+		return errBatchNoBucket
+	}
+	if len(c.Key) > MaxKeySize {
+		return ErrKeyTooLarge
+	}
+	id := string(append(appendChangePath(nil, c.Bucket), c.Key...))
+	i, replace := wb.index[id]
+	size := wb.size + opSize(c)
+	if replace {
+		size -= opSize(wb.ops[i])
+	}
+	if wb.MaxSize > 0 && size > wb.MaxSize {
+		return ErrBatchTooLarge
+	}
+	c.Bucket = clonePath(c.Bucket)
+	c.Key = cloneBytes(c.Key)
+	c.Value = cloneBytes(c.Value)
+	wb.size = size
+	if replace {
+		wb.ops[i] = c
+		return nil
+	}
+	if wb.index == nil {
+		wb.index = make(map[string]int)
+	}
+	wb.index[id] = len(wb.ops)
+	wb.ops = append(wb.ops, c)
+	return nil
+}
+
+// opSize is the size of an operation counted in WriteBatch.Size.
+func opSize(c Change) int {
+	n := len(c.Key) + len(c.Value)
+	for _, name := range c.Bucket {
+		n += len(name)
+	}
+	return n
+}
+
+// clonePath copies a bucket path and its names.
+func clonePath(path [][]byte) [][]byte {
+	out := make([][]byte, len(path))
+	for i, name := range path {
+		out[i] = cloneBytes(name)
+	}
+	return out
+}
+
+// Len returns the number of operations in wb.
+func (wb *WriteBatch) Len() int {
+	return len(wb.ops)
+}
+
+// Size returns the approximate size of wb in bytes: the lengths of the
+// keys, values and bucket names of its operations.
+func (wb *WriteBatch) Size() int {
+	return wb.size
+}
+
+// All yields the operations of wb in the order their keys were first
+// written, as Changes of op ChangePut or ChangeDelete without a TxID. They
+// share memory with wb and must not be modified.
+func (wb *WriteBatch) All() iter.Seq[Change] {
+	return func(yield func(Change) bool) {
+		for _, c := range wb.ops {
+			if !yield(c) {
+				return
+			}
+		}
+	}
+}
+
+// Reset empties wb, keeping its MaxSize.
+func (wb *WriteBatch) Reset() {
+	wb.ops = nil
+	wb.index = nil
+	wb.size = 0
+}
+
+// Apply applies the operations of wb in tx as if they were made through
+// Bucket.Put and Delete, in the order of WriteBatch.All. It stops at the
+// first that fails, for example with ErrBucketNotFound, and returns its
+// error; tx then holds the operations before it.
+func (tx *Tx) Apply(wb *WriteBatch) error {
+	if tx == nil || tx.closed {
+		return ErrTxClosed
+	}
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	for _, c := range wb.ops {
+		if err := tx.ApplyChange(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply applies wb in a write transaction shared with concurrent Batch
+// calls, see DB.Batch. Either all of its operations are committed or none
+// is.
+func (db *DB) Apply(wb *WriteBatch) error {
+	return db.Batch(func(tx *Tx) error {
+		return tx.Apply(wb)
+	})
+}
+
+// ApplyOnce applies wb in tx, as Apply does, and records id, a unique ID
+// of the batch, in the same transaction, unless a batch with the same ID
+// was recorded before, in which case it changes nothing. applied reports
+// whether wb was applied. Replaying a batch from a log, or retrying one
+// whose commit may or may not have happened, is thus a no-op. IDs are kept
+// until ForgetBatches removes them; they are not recorded in the
+// changefeed.
+func (tx *Tx) ApplyOnce(id []byte, wb *WriteBatch) (applied bool, err error) {
+	if tx == nil || tx.closed {
+		return false, ErrTxClosed
+	}
+	if !tx.writable {
+		return false, ErrTxReadOnly
+	}
+	if len(id) == 0 {
+		return false, errors.New("leafdb: batch ID required")
+	}
+	b := tx.bucket([]byte(batchesBucket))
+	if b == nil {
+		if b, err = tx.createTopLevel([]byte(batchesBucket)); err != nil {
+			return false, err
+		}
+	}
+	if b.Get(id) != nil {
+		return false, nil
+	}
+	tx.untrackedWrite()
+	if err := tx.Apply(wb); err != nil {
+		return false, err
+	}
+	var v [8]byte
+	binary.BigEndian.PutUint64(v[:], tx.mgr.txid+1)
+	if err := b.Put(id, v[:]); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ApplyOnce is Tx.ApplyOnce in a write transaction shared with concurrent
+// Batch calls, see DB.Batch.
+func (db *DB) ApplyOnce(id []byte, wb *WriteBatch) (applied bool, err error) {
+	err = db.Batch(func(tx *Tx) error {
+		var err error
+		applied, err = tx.ApplyOnce(id, wb)
+		return err
+	})
+	return applied, err
+}
+
+// ForgetBatches removes the IDs recorded by ApplyOnce in transactions with
+// IDs below before, so that batches with those IDs would be applied again.
+// Call it once no batch older than that can be replayed.
+func (db *DB) ForgetBatches(before uint64) error {
+	return db.Write(func(tx *Tx) error {
+		b := tx.bucket([]byte(batchesBucket))
+		if b == nil {
+			return nil
+		}
+		tx.untrackedWrite()
+		var ids [][]byte
+		for id, v := range b.All() {
+			if len(v) != 8 || binary.BigEndian.Uint64(v) < before {
+				ids = append(ids, cloneBytes(id))
+			}
+		}
+		for _, id := range ids {
+			if err := b.Delete(id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// MarshalBinary encodes the operations of wb in a stable format, so that a
+// batch built by one process can be logged, or sent to and applied by
+// another. MaxSize is not encoded.
+//
+// The encoding is a version byte of 1 and the number of operations as a
+// uvarint, then for each, in the order of WriteBatch.All, its op byte, as
+// for Change.Op, the bucket path as a uvarint count of uvarint-length-
+// prefixed names, the uvarint-length-prefixed key and, for ChangePut, the
+// uvarint-length-prefixed value.
+func (wb *WriteBatch) MarshalBinary() ([]byte, error) {
+	buf := []byte{writeBatchVersion}
+	buf = binary.AppendUvarint(buf, uint64(len(wb.ops)))
+	for _, c := range wb.ops {
+		buf = append(buf, byte(c.Op))
+		buf = appendChangePath(buf, c.Bucket)
+		buf = appendChangeBytes(buf, c.Key)
+		if c.Op == ChangePut {
+			buf = appendChangeBytes(buf, c.Value)
+		}
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary replaces the operations of wb with those encoded in data
+// by MarshalBinary. It fails with ErrBatchTooLarge if they do not fit in
+// the MaxSize of wb, and leaves wb empty if it fails.
+func (wb *WriteBatch) UnmarshalBinary(data []byte) error {
+	wb.Reset()
+	if err := wb.decode(data); err != nil {
+		wb.Reset()
+		return err
+	}
+	return nil
+}
+
+func (wb *WriteBatch) decode(buf []byte) error {
+	if len(buf) == 0 || buf[0] != writeBatchVersion {
+		return errInvalidBatch
+	}
+	buf = buf[1:]
+	n, err := readChangeUvarint(&buf)
+	if err != nil || n > uint64(len(buf)) {
+		return errInvalidBatch
+	}
+	for range n {
+		if len(buf) == 0 {
+			return errInvalidBatch
+		}
+		c := Change{Op: ChangeOp(buf[0])}
+		buf = buf[1:]
+		if c.Op != ChangePut && c.Op != ChangeDelete {
+			return fmt.Errorf("%w: unknown op %d", errInvalidBatch, c.Op)
+		}
+		if c.Bucket, err = readChangePath(&buf); err != nil {
+			return errInvalidBatch
+		}
+		if c.Key, err = readChangeBytes(&buf); err != nil {
+			return errInvalidBatch
+		}
+		if c.Op == ChangePut {
+			if c.Value, err = readChangeBytes(&buf); err != nil {
+				return errInvalidBatch
+			}
+		}
+		if err := wb.add(c); err != nil {
+			return err
+		}
+	}
+	if len(buf) > 0 {
+		return errInvalidBatch
+	}
+	return nil
+}
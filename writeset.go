@@ -0,0 +1,199 @@
+package leafdb
+
+import (
+	"bytes"
+	"iter"
+	"maps"
+	"slices"
+)
+
+// DirtyPages returns an iterator over the IDs of the pages a write
+// transaction has written so far, in order, which its commit writes along
+// with its freelist and meta page. It yields nothing for a read
+// transaction.
+func (tx *Tx) DirtyPages() iter.Seq[uint64] {
+	return func(yield func(uint64) bool) {
+		if tx == nil || tx.closed || !tx.writable {
+			return
+		}
+		for _, id := range slices.Sorted(maps.Keys(tx.mgr.dirty)) {
+			if !yield(id) {
+				return
+			}
+		}
+	}
+}
+
+// Pending returns an iterator over the changes a write transaction has made
+// so far, for audit middleware or to debug a large transaction before it
+// commits. They are not a log of its writes but the difference between the
+// state it began from and its current state, so a key written twice shows
+// once and a key put and deleted again not at all: ChangeCreateBucket and
+// ChangeDeleteBucket for the buckets created and deleted, followed for a
+// new bucket by its pairs as ChangePut; ChangePut and ChangeDelete for the
+// pairs changed in the other buckets; and ChangeSequence where a sequence
+// changed. A moved bucket shows as deleted and created again. Changes come
+// bucket by bucket, parents first, and in key order within one; reserved
+// buckets and changes to options and quotas are left out, as from the
+// changefeed.
+//
+// Unchanged subtrees, which the transaction shares with its snapshot, are
+// skipped, so Pending reads little more than the pages the transaction
+// wrote. It stops early if a page cannot be read, and must not be used
+// across writes.
+func (tx *Tx) Pending() iter.Seq[Change] {
+	return func(yield func(Change) bool) {
+		if tx == nil || tx.closed || !tx.writable {
+			return
+		}
+		tx.diff(yield)
+	}
+}
+
+// diff yields the changes Pending does and returns the error of a page that
+// could not be read, if any.
+func (tx *Tx) diff(yield func(Change) bool) error {
+	m := tx.mgr
+	base := newTxPageManager(tx.db, false, m.base)
+	base.mapping = m.mapping
+	if base.mapping == nil {
+		// The writer lock keeps the mapping in place.
+		base.mapping = tx.db.mapping
+	}
+	d := &differ{base: base, cur: m, yield: yield}
+	d.buckets(nil, m.base.root, m.root)
+	return d.err
+}
+
+// differ compares the trees of a snapshot, read from base, with those of a
+// write transaction, read from cur, and yields the differences as changes.
+type differ struct {
+	base  pageStore
+	cur   *txPageManager
+	yield func(Change) bool
+	// err is the error of the page that stopped the comparison, if any.
+	err error
+}
+
+// buckets yields the changes of the buckets in the bucket index trees a and
+// b of the bucket at path, and reports whether to go on.
+func (d *differ) buckets(path [][]byte, a, b uint64) bool {
+	return d.trees(a, b, func(name, before, after []byte) bool {
+		if isReservedName(name) {
+			return true
+		}
+		switch {
+		case after == nil:
+			return d.yield(Change{Op: ChangeDeleteBucket, Bucket: path, Key: name})
+		case before == nil:
+			if !d.yield(Change{Op: ChangeCreateBucket, Bucket: path, Key: name}) {
+				return false
+			}
+		}
+		return d.bucket(append(clonePath(path), name), decodePageID(before), decodePageID(after))
+	})
+}
+
+// bucket yields the changes of the bucket at path, whose header is page a
+// in the snapshot, or 0 if it is new, and page b in the transaction.
+func (d *differ) bucket(path [][]byte, a, b uint64) bool {
+	var old bucketHeader
+	if a != 0 {
+		var err error
+		if old, err = readBucketHeader(d.base, a); err != nil {
+			d.err = err
+			return false
+		}
+	}
+	cur, err := readBucketHeader(d.cur, b)
+	if err != nil {
+		d.err = err
+		return false
+	}
+	if cur.sequence != old.sequence && !d.yield(Change{Op: ChangeSequence, Bucket: path, Sequence: cur.sequence}) {
+		return false
+	}
+	ok := d.trees(old.kvRoot, cur.kvRoot, func(key, before, after []byte) bool {
+		if after == nil {
+			return d.yield(Change{Op: ChangeDelete, Bucket: path, Key: key})
+		}
+		return d.yield(Change{Op: ChangePut, Bucket: path, Key: key, Value: after})
+	})
+	return ok && d.buckets(path, old.bucketRoot, cur.bucketRoot)
+}
+
+// trees calls fn, in key order, for every key whose value differs between
+// the tree rooted at page a of the snapshot and that at page b of the
+// transaction, either of which may be 0 for none, with before or after nil
+// where the key is missing, and reports whether to go on. A page both
+// trees reference is the same in both, so it is skipped; branches with the
+// same keys are compared child by child, and other subtrees pair by pair.
+func (d *differ) trees(a, b uint64, fn func(key, before, after []byte) bool) bool {
+	if a == b && !d.cur.private(b) {
+		return true
+	}
+	if a != 0 && b != 0 {
+		na, err := readNodeKeys(d.base, a)
+		if err != nil {
+			d.err = err
+			return false
+		}
+		nb, err := readNodeKeys(d.cur, b)
+		if err != nil {
+			d.err = err
+			return false
+		}
+		if !na.isLeaf && !nb.isLeaf && len(na.children) == len(nb.children) &&
+			slices.EqualFunc(na.keys, nb.keys, bytes.Equal) {
+			for i := range na.children {
+				if !d.trees(na.children[i], nb.children[i], fn) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	ca, cb := d.cursor(d.base, a), d.cursor(d.cur, b)
+	ka, va := ca.First()
+	kb, vb := cb.First()
+	for ka != nil || kb != nil {
+		c := bytes.Compare(ka, kb)
+		switch {
+		case kb == nil || ka != nil && c < 0:
+			if !fn(ka, nonNil(va), nil) {
+				return false
+			}
+			ka, va = ca.Next()
+		case ka == nil || c > 0:
+			if !fn(kb, nil, nonNil(vb)) {
+				return false
+			}
+			kb, vb = cb.Next()
+		default:
+			if !bytes.Equal(va, vb) && !fn(ka, nonNil(va), nonNil(vb)) {
+				return false
+			}
+			ka, va = ca.Next()
+			kb, vb = cb.Next()
+		}
+	}
+	return true
+}
+
+// cursor returns a cursor over the tree rooted at page id of store, which
+// finds nothing if id is 0.
+func (d *differ) cursor(store pageStore, id uint64) *Cursor {
+	if id == 0 {
+		return nil
+	}
+	return &Cursor{tree: newBPTree(&id, store)}
+}
+
+// nonNil returns v, or an empty slice if v is nil, so that an empty value
+// is told apart from a missing one.
+func nonNil(v []byte) []byte {
+	if v == nil {
+		return []byte{}
+	}
+	return v
+}